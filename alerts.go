@@ -0,0 +1,519 @@
+package topdown
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Alert webhook defaults, see WithAlertWebhook.
+const (
+	DefaultAlertTimeout = 2 * time.Second
+	DefaultAlertRetries = 3
+	// alertQueueSize is the number of notifications waiting to be sent before new ones are dropped.
+	alertQueueSize = 64
+)
+
+// AlertMetric is the metric of a method an alert rule watches.
+type AlertMetric string
+
+// Metrics alert rules can watch, computed over a single interval.
+const (
+	// AlertSloViolationRatio is the share of the requests completed with a good status code that
+	// exceeded their SLO.
+	AlertSloViolationRatio AlertMetric = "slo_violation_ratio"
+	// AlertRejectionRate is the share of the requests that were rejected, out of the rejected and
+	// the completed ones.
+	AlertRejectionRate AlertMetric = "rejection_rate"
+	// AlertMemoryPressure is the memory pressure of the process, see WithMemoryPressure; it's the
+	// same for every method.
+	AlertMemoryPressure AlertMetric = "memory_pressure"
+)
+
+// AlertRule fires an alert for a method once its metric stayed above the threshold for Sustain
+// consecutive intervals, and resolves it once the metric is back at or below the threshold.
+type AlertRule struct {
+	// Name identifies the rule in the notifications and GET /alerts; names must be unique.
+	Name string
+	// Method is the name of the methods the rule applies to, or a pattern like
+	// "/inventory.Service/*"; "*" applies to every method.
+	Method    string
+	Metric    AlertMetric
+	Threshold float64
+	// Sustain is the number of consecutive intervals above the threshold that fire the alert;
+	// zero fires after the first one.
+	Sustain int
+	// Cooldown is the time after a notification that the alert fires again for the same method
+	// without notifying, so a flapping metric doesn't notify every interval.
+	Cooldown time.Duration
+}
+
+// validate checks that the rule can be evaluated.
+func (r AlertRule) validate() error {
+	if r.Name == "" {
+		return errors.New("alert rule name must not be empty")
+	}
+	if r.Method == "" {
+		return fmt.Errorf("alert rule '%s': method must not be empty", r.Name)
+	}
+	if r.Metric != AlertSloViolationRatio && r.Metric != AlertRejectionRate && r.Metric != AlertMemoryPressure {
+		return fmt.Errorf("alert rule '%s': unknown metric '%s'", r.Name, r.Metric)
+	}
+	if r.Threshold < 0 || r.Threshold >= 1 {
+		return fmt.Errorf("alert rule '%s': threshold must be in [0, 1), got %g", r.Name, r.Threshold)
+	}
+	if r.Sustain < 0 {
+		return fmt.Errorf("alert rule '%s': sustain must not be negative, got %d", r.Name, r.Sustain)
+	}
+	if r.Cooldown < 0 {
+		return fmt.Errorf("alert rule '%s': cooldown must not be negative, got %v", r.Name, r.Cooldown)
+	}
+	return nil
+}
+
+// value returns the metric of the rule for the last interval of a method.
+func (r AlertRule) value(snapshot MetricsSnapshot) float64 {
+	switch r.Metric {
+	case AlertRejectionRate:
+		completed := snapshot.Goodput + snapshot.SloViolations + snapshot.Errors + snapshot.Cancelled
+		return ratio(snapshot.Rejected, completed+snapshot.Rejected)
+	case AlertMemoryPressure:
+		if snapshot.Memory == nil {
+			return 0
+		}
+		return snapshot.Memory.Pressure
+	}
+	return snapshot.SloViolationRatio
+}
+
+// validateAlertRules checks the rules and that their names are unique.
+func validateAlertRules(rules []AlertRule) error {
+	names := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("duplicate alert rule '%s'", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	return nil
+}
+
+// Alert states reported in the notifications.
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// alertKey identifies the alert of a rule for a method.
+type alertKey struct {
+	rule   string
+	method string
+}
+
+// alertState is the state of the alert of a rule for a method.
+type alertState struct {
+	rule AlertRule
+	// above counts the consecutive intervals above the threshold, up to the sustain.
+	above  int
+	firing bool
+	since  time.Time
+	value  float64
+	// notified is set if the notification of the current firing was sent, and notifiedAt is the
+	// time of the last one.
+	notified   bool
+	notifiedAt time.Time
+}
+
+// alertNotification is the JSON body POSTed to the webhook. Text makes it readable as a Slack
+// message.
+type alertNotification struct {
+	Text      string      `json:"text"`
+	Limiter   string      `json:"limiter,omitempty"`
+	Rule      string      `json:"rule"`
+	Method    string      `json:"method"`
+	Metric    AlertMetric `json:"metric"`
+	Threshold float64     `json:"threshold"`
+	Value     float64     `json:"value"`
+	State     string      `json:"state"`
+	Timestamp float64     `json:"timestamp"`
+}
+
+// alertManager evaluates the alert rules and queues their notifications for the webhook. mu
+// guards the rules and states and is never held with any other lock.
+type alertManager struct {
+	url      string
+	client   *http.Client
+	retries  int
+	failures atomic.Int64
+	queue    chan alertNotification
+
+	mu sync.Mutex
+	// rules are the rules set from Go, fileRules those of the configuration file.
+	rules     []AlertRule
+	fileRules []AlertRule
+	states    map[alertKey]*alertState
+}
+
+// WithAlertWebhook POSTs a JSON notification to url whenever an alert fires or resolves, e.g. to
+// a Slack incoming webhook. Notifications are sent from their own goroutine, retried with
+// exponential backoff, and counted by AlertFailures if they fail after all retries.
+func WithAlertWebhook(url string) Option {
+	return func(rl *TopDownRL) {
+		rl.alerts.url = url
+	}
+}
+
+// WithAlertTimeout sets the timeout of a single attempt to send a notification.
+func WithAlertTimeout(d time.Duration) Option {
+	return func(rl *TopDownRL) {
+		rl.alerts.client = &http.Client{Timeout: d}
+	}
+}
+
+// WithAlertRetries sets how many times a failed notification is retried.
+func WithAlertRetries(retries int) Option {
+	return func(rl *TopDownRL) {
+		rl.alerts.retries = retries
+	}
+}
+
+// WithAlertRules adds alert rules, evaluated for every method at the end of each metrics interval.
+func WithAlertRules(rules ...AlertRule) Option {
+	return func(rl *TopDownRL) {
+		rl.alerts.rules = append(rl.alerts.rules, rules...)
+	}
+}
+
+// SetAlertRules replaces the alert rules set from Go; the rules of the configuration file stay.
+// The alerts of the rules that changed or were removed are reset without notifying.
+func (rl *TopDownRL) SetAlertRules(rules []AlertRule) error {
+	rl.alerts.mu.Lock()
+	defer rl.alerts.mu.Unlock()
+
+	rules = append([]AlertRule(nil), rules...)
+	if err := validateAlertRules(append(append([]AlertRule(nil), rules...), rl.alerts.fileRules...)); err != nil {
+		return err
+	}
+	rl.alerts.rules = rules
+	rl.alerts.pruneLocked()
+	return nil
+}
+
+// AlertRules returns a copy of the alert rules, those set from Go first.
+func (rl *TopDownRL) AlertRules() []AlertRule {
+	rl.alerts.mu.Lock()
+	defer rl.alerts.mu.Unlock()
+	return rl.alerts.rulesLocked()
+}
+
+// AlertFailures returns the number of notifications that couldn't be sent.
+func (rl *TopDownRL) AlertFailures() int64 {
+	return rl.alerts.failures.Load()
+}
+
+// checkFileRules checks that the rules of a configuration file can replace the current ones.
+func (a *alertManager) checkFileRules(rules []AlertRule) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return validateAlertRules(append(append([]AlertRule(nil), a.rules...), rules...))
+}
+
+// setFileRules replaces the rules of the configuration file.
+func (a *alertManager) setFileRules(rules []AlertRule) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := validateAlertRules(append(append([]AlertRule(nil), a.rules...), rules...)); err != nil {
+		return err
+	}
+	a.fileRules = rules
+	a.pruneLocked()
+	return nil
+}
+
+// rulesLocked returns a copy of all rules. The caller must hold a.mu.
+func (a *alertManager) rulesLocked() []AlertRule {
+	return append(append([]AlertRule(nil), a.rules...), a.fileRules...)
+}
+
+// configured reports whether there are any rules.
+func (a *alertManager) configured() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.rules) > 0 || len(a.fileRules) > 0
+}
+
+// pruneLocked drops the states of the rules that changed or were removed. The caller must hold a.mu.
+func (a *alertManager) pruneLocked() {
+	rules := make(map[string]AlertRule)
+	for _, rule := range a.rulesLocked() {
+		rules[rule.Name] = rule
+	}
+	for key, state := range a.states {
+		if rule, exists := rules[key.rule]; !exists || rule != state.rule {
+			delete(a.states, key)
+		}
+	}
+}
+
+// evaluateAlerts evaluates the alert rules for every method after the rollover and queues the
+// notifications of the alerts that fired or resolved. It runs on the metrics goroutine only.
+func (rl *TopDownRL) evaluateAlerts() {
+	if !rl.alerts.configured() {
+		return
+	}
+	snapshots := rl.GetAllMetrics()
+	now := rl.clock.Now()
+
+	a := &rl.alerts
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.states == nil {
+		a.states = make(map[alertKey]*alertState)
+	}
+	// The alerts of unregistered methods are dropped without notifying
+	for key := range a.states {
+		if _, exists := snapshots[key.method]; !exists {
+			delete(a.states, key)
+		}
+	}
+
+	methods := make([]string, 0, len(snapshots))
+	for methodName := range snapshots {
+		methods = append(methods, methodName)
+	}
+	sort.Strings(methods)
+	for _, rule := range a.rulesLocked() {
+		for _, methodName := range methods {
+			if !matchPattern(rule.Method, methodName) {
+				continue
+			}
+			key := alertKey{rule: rule.Name, method: methodName}
+			state := a.states[key]
+			if state == nil {
+				state = &alertState{rule: rule}
+				a.states[key] = state
+			}
+			rl.evaluateAlertLocked(state, methodName, rule.value(snapshots[methodName]), now)
+		}
+	}
+}
+
+// evaluateAlertLocked updates the alert of a rule for a method with the metric of the last
+// interval. The caller must hold rl.alerts.mu.
+func (rl *TopDownRL) evaluateAlertLocked(state *alertState, methodName string, value float64, now time.Time) {
+	rule := state.rule
+	state.value = value
+	if value <= rule.Threshold {
+		state.above = 0
+		if !state.firing {
+			return
+		}
+		state.firing = false
+		if rl.Debug {
+			rl.logger.Debugf("Alert '%s' resolved for method '%s': %s %g", rule.Name, methodName, rule.Metric, value)
+		}
+		if state.notified {
+			state.notified = false
+			rl.queueAlert(rule, methodName, value, AlertResolved, now)
+		}
+		return
+	}
+
+	if state.above < max(rule.Sustain, 1) {
+		state.above++
+	}
+	if state.firing || state.above < max(rule.Sustain, 1) {
+		return
+	}
+	state.firing, state.since = true, now
+	if rl.Debug {
+		rl.logger.Debugf("Alert '%s' firing for method '%s': %s %g above %g", rule.Name, methodName, rule.Metric, value, rule.Threshold)
+	}
+	if !state.notifiedAt.IsZero() && now.Sub(state.notifiedAt) < rule.Cooldown {
+		return
+	}
+	state.notified, state.notifiedAt = true, now
+	rl.queueAlert(rule, methodName, value, AlertFiring, now)
+}
+
+// queueAlert queues a notification for the webhook, if any, dropping it if the queue is full.
+// The caller must hold rl.alerts.mu.
+func (rl *TopDownRL) queueAlert(rule AlertRule, methodName string, value float64, state string, now time.Time) {
+	if rl.alerts.url == "" {
+		return
+	}
+	notification := alertNotification{
+		Text:      fmt.Sprintf("[%s] %s: %s of %s is %.4g (threshold %g)", state, rule.Name, rule.Metric, methodName, value, rule.Threshold),
+		Limiter:   rl.name,
+		Rule:      rule.Name,
+		Method:    methodName,
+		Metric:    rule.Metric,
+		Threshold: rule.Threshold,
+		Value:     value,
+		State:     state,
+		Timestamp: float64(now.UnixNano()) / float64(time.Second),
+	}
+	if rl.name != "" {
+		notification.Text = rl.name + " " + notification.Text
+	}
+	select {
+	case rl.alerts.queue <- notification:
+	default:
+		rl.alerts.failures.Add(1)
+		rl.logger.Errorf("Dropped alert notification for rule '%s' and method '%s': queue full", rule.Name, methodName)
+	}
+}
+
+// alertLoop sends the queued notifications until ctx is done.
+func (rl *TopDownRL) alertLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case notification := <-rl.alerts.queue:
+			if err := rl.sendAlert(ctx, notification); err != nil && ctx.Err() == nil {
+				rl.alerts.failures.Add(1)
+				rl.logger.Errorf("Failed to send alert notification to %s: %v", rl.alerts.url, err)
+			}
+		}
+	}
+}
+
+// sendAlert POSTs a notification to the webhook, retrying with exponential backoff.
+func (rl *TopDownRL) sendAlert(ctx context.Context, notification alertNotification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	backoff := pushBackoff
+	for attempt := 0; ; attempt++ {
+		err = rl.sendAlertOnce(ctx, body)
+		if err == nil || attempt >= rl.alerts.retries {
+			return err
+		}
+		if rl.Debug {
+			rl.logger.Debugf("Alert notification attempt %d failed, retrying in %v: %v", attempt+1, backoff, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-rl.clock.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// sendAlertOnce POSTs body to the webhook.
+func (rl *TopDownRL) sendAlertOnce(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rl.alerts.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := rl.alerts.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// firingAlerts returns the number of alerts currently firing.
+func (rl *TopDownRL) firingAlerts() int {
+	rl.alerts.mu.Lock()
+	defer rl.alerts.mu.Unlock()
+
+	firing := 0
+	for _, state := range rl.alerts.states {
+		if state.firing {
+			firing++
+		}
+	}
+	return firing
+}
+
+// alertRuleResponse is the JSON shape of an alert rule and its alerts, served by HandleAlerts.
+type alertRuleResponse struct {
+	Name      string          `json:"name"`
+	Method    string          `json:"method"`
+	Metric    AlertMetric     `json:"metric"`
+	Threshold float64         `json:"threshold"`
+	Sustain   int             `json:"sustain"`
+	Cooldown  string          `json:"cooldown"`
+	Source    string          `json:"source"`
+	Alerts    []alertResponse `json:"alerts"`
+}
+
+// alertResponse is the JSON shape of the alert of a rule for a method.
+type alertResponse struct {
+	Method string     `json:"method"`
+	Value  float64    `json:"value"`
+	Firing bool       `json:"firing"`
+	Since  *time.Time `json:"since,omitempty"`
+}
+
+// HandleAlerts handles the GET requests listing the alert rules along with the last metric and
+// firing state of every method they apply to.
+func (rl *TopDownRL) HandleAlerts(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleAlerts called")
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rl.alerts.mu.Lock()
+	rules := make([]alertRuleResponse, 0, len(rl.alerts.rules)+len(rl.alerts.fileRules))
+	for i, rule := range rl.alerts.rulesLocked() {
+		response := alertRuleResponse{
+			Name:      rule.Name,
+			Method:    rule.Method,
+			Metric:    rule.Metric,
+			Threshold: rule.Threshold,
+			Sustain:   rule.Sustain,
+			Cooldown:  rule.Cooldown.String(),
+			Source:    "api",
+			Alerts:    []alertResponse{},
+		}
+		if i >= len(rl.alerts.rules) {
+			response.Source = "file"
+		}
+		for key, state := range rl.alerts.states {
+			if key.rule != rule.Name {
+				continue
+			}
+			alert := alertResponse{Method: key.method, Value: state.value, Firing: state.firing}
+			if state.firing {
+				since := state.since
+				alert.Since = &since
+			}
+			response.Alerts = append(response.Alerts, alert)
+		}
+		sort.Slice(response.Alerts, func(i, j int) bool { return response.Alerts[i].Method < response.Alerts[j].Method })
+		rules = append(rules, response)
+	}
+	rl.alerts.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
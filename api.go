@@ -0,0 +1,123 @@
+package topdown
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// APIVersion is the version of the HTTP control API. RegisterHandlers serves every endpoint under
+// /v1 and, for older agents, at its unversioned path.
+const APIVersion = "v1"
+
+// DefaultMaxRequestBytes is the default cap on the request bodies of the control API, see
+// WithMaxRequestBytes.
+const DefaultMaxRequestBytes = 1 << 20
+
+// WithMaxRequestBytes caps the request bodies of the control API at n bytes; larger bodies are
+// rejected with 413 before they reach the handler. Zero or less removes the cap.
+func WithMaxRequestBytes(n int64) Option {
+	return func(rl *TopDownRL) {
+		rl.maxRequestBytes = n
+	}
+}
+
+// Error codes of the control API, see APIError. Each matches an HTTP status code.
+const (
+	ErrorCodeInvalidRequest   = "invalid_request"    // 400
+	ErrorCodeUnauthenticated  = "unauthenticated"    // 401
+	ErrorCodeForbidden        = "forbidden"          // 403
+	ErrorCodeNotFound         = "not_found"          // 404, e.g. for unknown methods
+	ErrorCodeMethodNotAllowed = "method_not_allowed" // 405
+	ErrorCodeConflict         = "conflict"           // 409, e.g. for fixed rates
+	ErrorCodeRequestTooLarge  = "request_too_large"  // 413
+	ErrorCodeInvalidValue     = "invalid_value"      // 422, e.g. for negative rates
+	ErrorCodeTooManyRequests  = "too_many_requests"  // 429
+	ErrorCodeUnavailable      = "unavailable"        // 503
+	ErrorCodeInternal         = "internal"           // 500 and any other status
+)
+
+// errorCodes maps the HTTP status codes of the control API to their error codes.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            ErrorCodeInvalidRequest,
+	http.StatusUnauthorized:          ErrorCodeUnauthenticated,
+	http.StatusForbidden:             ErrorCodeForbidden,
+	http.StatusNotFound:              ErrorCodeNotFound,
+	http.StatusMethodNotAllowed:      ErrorCodeMethodNotAllowed,
+	http.StatusConflict:              ErrorCodeConflict,
+	http.StatusRequestEntityTooLarge: ErrorCodeRequestTooLarge,
+	http.StatusUnprocessableEntity:   ErrorCodeInvalidValue,
+	http.StatusTooManyRequests:       ErrorCodeTooManyRequests,
+	http.StatusServiceUnavailable:    ErrorCodeUnavailable,
+}
+
+// ErrorResponse is the JSON body of the errors of the control API.
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// APIError is an error of the control API: Code is one of the ErrorCode constants and Message
+// the reason for humans.
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError replies to a control API request with an ErrorResponse, like http.Error does with
+// plain text.
+func writeError(w http.ResponseWriter, message string, statusCode int) {
+	code, ok := errorCodes[statusCode]
+	if !ok {
+		code = ErrorCodeInternal
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: APIError{Code: code, Message: message}})
+}
+
+// limitBody wraps a control endpoint to reject request bodies above the cap, if any. The body is
+// read up front, so the handler never sees a truncated one.
+func (rl *TopDownRL) limitBody(handler http.Handler) http.Handler {
+	if rl.maxRequestBytes <= 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		tooLarge := fmt.Sprintf("Request body exceeds %d bytes", rl.maxRequestBytes)
+		if r.ContentLength > rl.maxRequestBytes {
+			writeError(w, tooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, rl.maxRequestBytes+1))
+		if err != nil {
+			writeError(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) > rl.maxRequestBytes {
+			writeError(w, tooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// SetRateRequest is the JSON body of POST /v1/set_rate. With the 'method' parameter, RateLimit
+// sets its rate and MaxTokens its burst; either may be omitted. Without it, Rates sets the rates
+// of several methods atomically and the response is a RateUpdateResponse.
+type SetRateRequest struct {
+	RateLimit *float64           `json:"rate_limit,omitempty"`
+	MaxTokens *int64             `json:"max_tokens,omitempty"`
+	Rates     map[string]float64 `json:"rates,omitempty"`
+	// Immediate bypasses the ramp set through WithRateRamp, and TTLSeconds makes the rates
+	// temporary overrides, see SetTemporaryRateLimit.
+	Immediate  bool    `json:"immediate,omitempty"`
+	TTLSeconds float64 `json:"ttl_seconds,omitempty"`
+}
@@ -0,0 +1,77 @@
+package topdown
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrUnauthenticated is returned by an AuthFunc when a request carries no credentials.
+// Requests failing with it are answered with 401; any other error is answered with 403.
+var ErrUnauthenticated = errors.New("missing credentials")
+
+// errForbidden is returned for requests with invalid credentials.
+var errForbidden = errors.New("invalid credentials")
+
+// AuthFunc authenticates a request to the control endpoints.
+type AuthFunc func(*http.Request) error
+
+// WithAuthToken requires requests to the control endpoints to carry token either as a bearer
+// token in the Authorization header or in the X-API-Key header. The Go API is not affected.
+func WithAuthToken(token string) Option {
+	return WithAuthFunc(tokenAuth(token))
+}
+
+// WithAuthFunc authenticates requests to the control endpoints with auth, e.g. to check the
+// client certificate of an mTLS connection or validate a JWT. The Go API is not affected.
+func WithAuthFunc(auth AuthFunc) Option {
+	return func(rl *TopDownRL) {
+		rl.auth = auth
+	}
+}
+
+// AuthFailures returns the number of requests to the control endpoints that failed authentication.
+func (rl *TopDownRL) AuthFailures() int64 {
+	return rl.authFailures.Load()
+}
+
+// tokenAuth returns an AuthFunc accepting requests that carry token.
+func tokenAuth(token string) AuthFunc {
+	return func(r *http.Request) error {
+		credentials := r.Header.Get("X-API-Key")
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			credentials = bearer
+		}
+		if credentials == "" {
+			return ErrUnauthenticated
+		}
+		if subtle.ConstantTimeCompare([]byte(credentials), []byte(token)) != 1 {
+			return errForbidden
+		}
+		return nil
+	}
+}
+
+// authenticate wraps a control endpoint to reject requests that fail authentication, if configured.
+func (rl *TopDownRL) authenticate(handler http.HandlerFunc) http.Handler {
+	if rl.auth == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := rl.auth(r); err != nil {
+			rl.authFailures.Add(1)
+			if rl.Debug {
+				rl.logger.Debugf("Rejected unauthenticated request to %s: %v", r.URL.Path, err)
+			}
+			if errors.Is(err, ErrUnauthenticated) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			writeError(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	})
+}
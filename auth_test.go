@@ -0,0 +1,103 @@
+package topdown
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthToken(t *testing.T) {
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 10, RefillRate: 10}},
+		map[string]time.Duration{"/a": time.Second}, WithAuthToken("secret"))
+	server := httptest.NewServer(rl.Handler())
+	defer server.Close()
+
+	credentials := []struct {
+		name   string
+		header string
+		value  string
+		want   int
+	}{
+		{"missing", "", "", http.StatusUnauthorized},
+		{"wrong bearer token", "Authorization", "Bearer wrong", http.StatusForbidden},
+		{"wrong API key", "X-API-Key", "wrong", http.StatusForbidden},
+		{"valid bearer token", "Authorization", "Bearer secret", http.StatusOK},
+		{"valid API key", "X-API-Key", "secret", http.StatusOK},
+	}
+	failures := int64(0)
+	for _, c := range credentials {
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			url, body := server.URL+"/metrics?method=/a", ""
+			if method == http.MethodPost {
+				url, body = server.URL+"/set_rate?method=/a", `{"rate_limit": 20}`
+			}
+			req, err := http.NewRequest(method, url, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.header != "" {
+				req.Header.Set(c.header, c.value)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != c.want {
+				t.Errorf("%s with %s credentials = %d, want %d", method, c.name, resp.StatusCode, c.want)
+			}
+			if c.want == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("%s with %s credentials didn't ask for a bearer token", method, c.name)
+			}
+			if c.want != http.StatusOK {
+				failures++
+			}
+			if got := rl.AuthFailures(); got != failures {
+				t.Errorf("%s with %s credentials: AuthFailures() = %d, want %d", method, c.name, got, failures)
+			}
+		}
+	}
+
+	snapshot, err := rl.GetMetricsSnapshot("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.RefillRate != 20 {
+		t.Errorf("refill rate = %v, want the 20 set with valid credentials", snapshot.RefillRate)
+	}
+}
+
+func TestAuthFuncErrors(t *testing.T) {
+	results := map[string]error{"/none": ErrUnauthenticated, "/bad": errors.New("bad certificate")}
+	rl, err := NewTopDownRLWithBuckets(nil, map[string]time.Duration{"/a": time.Second}, false,
+		WithAuthFunc(func(r *http.Request) error { return results[r.Header.Get("X-Client")] }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Stop(context.Background())
+	handler := rl.Handler()
+
+	for client, want := range map[string]int{"/none": http.StatusUnauthorized, "/bad": http.StatusForbidden, "/ok": http.StatusOK} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics?method=/a", nil)
+		req.Header.Set("X-Client", client)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("GET from %s = %d, want %d", client, w.Code, want)
+		}
+	}
+	if got := rl.AuthFailures(); got != 2 {
+		t.Errorf("AuthFailures() = %d, want 2", got)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/prometheus", nil))
+	if !strings.Contains(w.Body.String(), "topdown_auth_failures_total 2\n") {
+		t.Errorf("Prometheus output doesn't count the 2 failures:\n%s", w.Body.String())
+	}
+}
@@ -0,0 +1,234 @@
+package topdown
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// ErrUnknownBorrowingGroup is returned when a borrowing group that wasn't declared is changed.
+var ErrUnknownBorrowingGroup = errors.New("unknown borrowing group")
+
+// WithBorrowingGroup declares a group of methods sharing a budget of refillRate tokens per second,
+// with bursts of up to maxTokens. Each method keeps its own bucket as its guaranteed allocation;
+// once that's empty, it borrows from the group's pool, which holds the part of the group's
+// budget the other methods don't use. A method belongs to at most one group.
+func WithBorrowingGroup(name string, maxTokens int64, refillRate float64, methods ...string) Option {
+	return func(rl *TopDownRL) {
+		rl.borrowingGroups = append(rl.borrowingGroups, borrowingGroupConfig{
+			name:    name,
+			bucket:  BucketConfig{MaxTokens: maxTokens, RefillRate: refillRate},
+			methods: methods,
+		})
+	}
+}
+
+// borrowingGroupConfig is a group declared with WithBorrowingGroup.
+type borrowingGroupConfig struct {
+	name    string
+	bucket  BucketConfig
+	methods []string
+}
+
+// BorrowingGroupState is the state of a borrowing group reported by the control API.
+type BorrowingGroupState struct {
+	Name       string   `json:"name"`
+	Methods    []string `json:"methods"`
+	MaxTokens  int64    `json:"max_tokens"`
+	RefillRate float64  `json:"refill_rate"`
+	Tokens     float64  `json:"tokens"`
+	// Borrowed is the number of tokens the methods borrowed from the pool since start.
+	Borrowed int64 `json:"borrowed"`
+}
+
+// borrowingGroup is the pool of a borrowing group. Every admission of its methods takes tokens
+// from the pool, so the pool refills at the group's rate and drains at the rate the methods
+// use, leaving the unused part of the budget to be borrowed.
+type borrowingGroup struct {
+	name     string
+	methods  []string
+	pool     *tokenBucket
+	borrowed atomic.Int64
+}
+
+// validateBorrowingGroups checks that the groups have unique names and valid budgets, and that
+// no method belongs to several groups.
+func (rl *TopDownRL) validateBorrowingGroups() error {
+	names := make(map[string]bool, len(rl.borrowingGroups))
+	members := make(map[string]string)
+	for _, group := range rl.borrowingGroups {
+		if group.name == "" || names[group.name] {
+			return fmt.Errorf("borrowing group names must be unique and not empty, got '%s'", group.name)
+		}
+		names[group.name] = true
+		if group.bucket.MaxTokens <= 0 || !(group.bucket.RefillRate > 0) {
+			return fmt.Errorf("borrowing group '%s' needs a positive max tokens and refill rate, got %d and %g",
+				group.name, group.bucket.MaxTokens, group.bucket.RefillRate)
+		}
+		for _, methodName := range group.methods {
+			if other, exists := members[methodName]; exists {
+				return fmt.Errorf("method '%s' belongs to borrowing groups '%s' and '%s'", methodName, other, group.name)
+			}
+			members[methodName] = group.name
+		}
+	}
+	return nil
+}
+
+// newBorrowingGroups creates the pools of the declared groups and indexes them by member method.
+func (rl *TopDownRL) newBorrowingGroups() {
+	rl.groupOf = make(map[string]*borrowingGroup)
+	for _, config := range rl.borrowingGroups {
+		group := &borrowingGroup{
+			name:    config.name,
+			methods: config.methods,
+			pool:    newTokenBucket(config.bucket.MaxTokens, config.bucket.RefillRate, rl.clock.Now()),
+		}
+		rl.groups = append(rl.groups, group)
+		for _, methodName := range config.methods {
+			rl.groupOf[methodName] = group
+		}
+	}
+}
+
+// tokenGrant is where the tokens of a request came from, so they can be refunded.
+type tokenGrant int
+
+const (
+	// noTokens were taken, e.g. for rejected requests or those bypassing the bucket.
+	noTokens tokenGrant = iota
+	limiterTokens
+	borrowedTokens
+)
+
+// takeTokens takes n tokens for a request from the method's limiter, or borrows them from the
+// pool of its group once the limiter is out of capacity, and returns where they came from. ctx is
+// the limiter context.
+func (rl *TopDownRL) takeTokens(ctx context.Context, metrics *InterfaceMetrics, n int64) tokenGrant {
+	group := metrics.group
+	if metrics.limiter.Allow(ctx, n) {
+		if group != nil {
+			group.pool.drain(rl.clock.Now(), n)
+		}
+		return limiterTokens
+	}
+	if group == nil || !group.pool.takeShare(rl.clock.Now(), n, PriorityShare(ctx)) {
+		return noTokens
+	}
+	metrics.borrowed.Add(n)
+	group.borrowed.Add(n)
+	return borrowedTokens
+}
+
+// refundTokens gives the n tokens of a request a wider limit rejected back to the narrower limits
+// it passed: the bucket of its tenant and, as grant says, the method's limiter or its group's pool.
+func (rl *TopDownRL) refundTokens(ctx context.Context, metrics *InterfaceMetrics, n int64, grant tokenGrant) {
+	rl.refundTenant(ctx, metrics, n)
+	group := metrics.group
+	switch grant {
+	case limiterTokens:
+		if limiter, ok := metrics.limiter.(RefundLimiter); ok {
+			limiter.Refund(n)
+		}
+		if group != nil {
+			group.pool.refund(n)
+		}
+	case borrowedTokens:
+		group.pool.refund(n)
+		metrics.borrowed.Add(-n)
+		group.borrowed.Add(-n)
+	}
+}
+
+// findBorrowingGroup returns the group with the given name, or nil if it wasn't declared.
+func (rl *TopDownRL) findBorrowingGroup(name string) *borrowingGroup {
+	for _, group := range rl.groups {
+		if group.name == name {
+			return group
+		}
+	}
+	return nil
+}
+
+// BorrowingGroups returns the state of all borrowing groups sorted by name.
+func (rl *TopDownRL) BorrowingGroups() []BorrowingGroupState {
+	now := rl.clock.Now()
+	states := make([]BorrowingGroupState, 0, len(rl.groups))
+	for _, group := range rl.groups {
+		p := group.pool.params.Load()
+		states = append(states, BorrowingGroupState{
+			Name:       group.name,
+			Methods:    group.methods,
+			MaxTokens:  p.maxTokens / tokenScale,
+			RefillRate: p.rate,
+			Tokens:     group.pool.available(now),
+			Borrowed:   group.borrowed.Load(),
+		})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
+
+// SetBorrowingGroupLimit changes the budget of a borrowing group, keeping the tokens in its pool
+// up to the new capacity. The guarantees of its methods are their own rates, see SetRateLimit.
+func (rl *TopDownRL) SetBorrowingGroupLimit(name string, maxTokens int64, refillRate float64) error {
+	if maxTokens <= 0 || !(refillRate > 0) {
+		return fmt.Errorf("max tokens and refill rate must be positive, got %d and %g", maxTokens, refillRate)
+	}
+	group := rl.findBorrowingGroup(name)
+	if group == nil {
+		return fmt.Errorf("%w: '%s'", ErrUnknownBorrowingGroup, name)
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	group.pool.setLimits(maxTokens, refillRate, rl.clock.Now())
+	if rl.Debug {
+		rl.logger.Debugf("Set limit for borrowing group '%s': max tokens %d, refill rate %g", name, maxTokens, refillRate)
+	}
+	return nil
+}
+
+// HandleBorrowingGroups handles the GET requests listing the borrowing groups and the POST
+// requests to change the budget of the group given by the 'group' parameter with a body of
+// {"max_tokens": <int>, "refill_rate": <float>}; omitted fields keep their current value.
+func (rl *TopDownRL) HandleBorrowingGroups(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleBorrowingGroups called")
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		name := r.URL.Query().Get("group")
+		group := rl.findBorrowingGroup(name)
+		if group == nil {
+			writeError(w, fmt.Sprintf("%v: '%s'", ErrUnknownBorrowingGroup, name), http.StatusNotFound)
+			return
+		}
+		p := group.pool.params.Load()
+		data := struct {
+			MaxTokens  int64   `json:"max_tokens"`
+			RefillRate float64 `json:"refill_rate"`
+		}{MaxTokens: p.maxTokens / tokenScale, RefillRate: p.rate}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeError(w, "Failed to decode request body", http.StatusBadRequest)
+			return
+		}
+		if err := rl.SetBorrowingGroupLimit(name, data.MaxTokens, data.RefillRate); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rl.BorrowingGroups())
+}
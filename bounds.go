@@ -0,0 +1,174 @@
+package topdown
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+)
+
+// ErrInvalidRate is returned when setting a rate that is negative, infinite or not a number.
+var ErrInvalidRate = errors.New("invalid rate")
+
+// ErrRateOutOfBounds is returned in RejectOutOfBounds mode when setting a rate outside the
+// bounds of a method.
+var ErrRateOutOfBounds = errors.New("rate out of bounds")
+
+// RateBoundsMode selects what SetRateLimit does with rates outside the bounds of a method.
+type RateBoundsMode int
+
+const (
+	// ClampToBounds sets the closest rate within the bounds instead and records the requested
+	// rate in the change log. This is the default.
+	ClampToBounds RateBoundsMode = iota
+	// RejectOutOfBounds fails with ErrRateOutOfBounds and keeps the current rate.
+	RejectOutOfBounds
+)
+
+// String returns the name of the mode as used by the control API.
+func (m RateBoundsMode) String() string {
+	if m == RejectOutOfBounds {
+		return "reject"
+	}
+	return "clamp"
+}
+
+// WithRateBounds sets the bounds of the refill rates set through SetRateLimit for the methods
+// whose bucket configuration sets none, see BucketConfig.MinRefillRate and MaxRefillRate. A
+// maxRate of zero means no cap.
+func WithRateBounds(minRate, maxRate float64) Option {
+	return func(rl *TopDownRL) {
+		rl.defaultMinRate = minRate
+		rl.defaultMaxRate = maxRate
+	}
+}
+
+// WithRateBoundsMode sets whether rates outside the bounds of a method are clamped, the default,
+// or rejected.
+func WithRateBoundsMode(mode RateBoundsMode) Option {
+	return func(rl *TopDownRL) {
+		rl.rateBoundsMode = mode
+	}
+}
+
+// validateRate checks that a rate is a finite, non-negative number.
+func validateRate(rate float64) error {
+	if !(rate >= 0) || math.IsInf(rate, 1) {
+		return fmt.Errorf("%w: %g", ErrInvalidRate, rate)
+	}
+	return nil
+}
+
+// validateRateBounds checks a pair of rate bounds; a maxRate of zero means no cap.
+func validateRateBounds(minRate, maxRate float64) error {
+	if err := validateRate(minRate); err != nil {
+		return fmt.Errorf("min rate: %w", err)
+	}
+	if err := validateRate(maxRate); err != nil {
+		return fmt.Errorf("max rate: %w", err)
+	}
+	if maxRate > 0 && minRate > maxRate {
+		return fmt.Errorf("min rate %g must not exceed the max rate %g", minRate, maxRate)
+	}
+	return nil
+}
+
+// boundRateLocked applies the bounds of a method to a rate set through SetRateLimit, clamping it
+// or failing with ErrRateOutOfBounds depending on the RateBoundsMode. The caller must hold metrics.mu.
+func (rl *TopDownRL) boundRateLocked(method string, metrics *InterfaceMetrics, rate float64) (float64, error) {
+	bounded := rate
+	if metrics.MaxRefillRate > 0 && bounded > metrics.MaxRefillRate {
+		bounded = metrics.MaxRefillRate
+	}
+	if bounded < metrics.MinRefillRate {
+		bounded = metrics.MinRefillRate
+	}
+	if bounded == rate {
+		return rate, nil
+	}
+
+	if rl.rateBoundsMode == RejectOutOfBounds {
+		return 0, fmt.Errorf("%w: %g for method '%s' with min rate %g and max rate %g",
+			ErrRateOutOfBounds, rate, method, metrics.MinRefillRate, metrics.MaxRefillRate)
+	}
+	if rl.Debug {
+		rl.logger.Debugf("Clamping rate limit for method '%s' from %f to %f", method, rate, bounded)
+	}
+	return bounded, nil
+}
+
+// SetRateBounds changes the bounds of the refill rates SetRateLimit may set for a method; a
+// maxRate of zero means no cap. The current rate is kept even if it's outside the new bounds.
+func (rl *TopDownRL) SetRateBounds(method string, minRate, maxRate float64) error {
+	return rl.setRateBounds(method, minRate, maxRate, apiSource)
+}
+
+// setRateBounds changes the rate bounds of a method on behalf of source.
+func (rl *TopDownRL) setRateBounds(method string, minRate, maxRate float64, source changeSource) error {
+	if err := validateRateBounds(minRate, maxRate); err != nil {
+		return err
+	}
+
+	defer rl.changes.flush()
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	// The members of method groups share the limits of their group
+	method = rl.methodGroupOf(method)
+	metrics, exists := rl.interfaces[method]
+	if !exists {
+		return fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	rl.recordChange(method, ChangeFieldMinRate, metrics.MinRefillRate, minRate, source)
+	rl.recordChange(method, ChangeFieldMaxRate, metrics.MaxRefillRate, maxRate, source)
+	metrics.MinRefillRate, metrics.MaxRefillRate = minRate, maxRate
+	if rl.Debug {
+		rl.logger.Debugf("Set rate bounds for method '%s': min %g, max %g", method, minRate, maxRate)
+	}
+	return nil
+}
+
+// HandleSetBounds handles the POST requests to change the rate bounds of the method given by the
+// 'method' parameter with a body of {"min_rate": <float>, "max_rate": <float>}; omitted fields
+// keep their current value.
+func (rl *TopDownRL) HandleSetBounds(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleSetBounds called")
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	method := r.URL.Query().Get("method")
+	metrics := rl.registeredMetrics(method)
+	if metrics == nil {
+		writeError(w, fmt.Sprintf("%v: '%s'", ErrUnknownMethod, method), http.StatusNotFound)
+		return
+	}
+	metrics.mu.Lock()
+	data := struct {
+		MinRate float64 `json:"min_rate"`
+		MaxRate float64 `json:"max_rate"`
+	}{MinRate: metrics.MinRefillRate, MaxRate: metrics.MaxRefillRate}
+	metrics.mu.Unlock()
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeError(w, "Failed to decode request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := rl.setRateBounds(method, data.MinRate, data.MaxRate, httpSource(r)); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrUnknownMethod) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
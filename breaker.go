@@ -0,0 +1,469 @@
+package topdown
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// ErrNoBreaker is returned when forcing the circuit breaker of a method that has none.
+var ErrNoBreaker = errors.New("method has no circuit breaker")
+
+// DefaultBreakerCodes are the status codes counted as failures by the circuit breaker unless
+// BreakerConfig.FailureCodes says otherwise: those of a failing server or dependency, while
+// client errors like InvalidArgument count as successes.
+var DefaultBreakerCodes = []codes.Code{codes.Unknown, codes.DeadlineExceeded, codes.Internal, codes.Unavailable, codes.DataLoss}
+
+// breakerSlots is the number of slots the sliding window of a circuit breaker is divided into.
+const breakerSlots = 10
+
+// BreakerConfig holds the parameters of the circuit breaker of a method, which fails its requests
+// fast with Unavailable, before they take any tokens, while its handler keeps failing.
+type BreakerConfig struct {
+	// Window is the sliding window the error rate is measured over.
+	Window time.Duration
+	// Threshold is the error rate at or above which the circuit opens, once the window holds at
+	// least MinRequests completed requests.
+	Threshold   float64
+	MinRequests int64
+	// CoolDown is how long the circuit stays open before it admits Probes requests half-open.
+	// The circuit closes once a probe succeeds and opens again once one fails; probes that don't
+	// complete within another CoolDown, e.g. because the limiter rejected them, are replaced.
+	CoolDown time.Duration
+	Probes   int
+	// FailureCodes are the status codes counted as failures; nil means DefaultBreakerCodes.
+	// Cancelled requests are never counted.
+	FailureCodes []codes.Code
+}
+
+// DefaultBreakerConfig returns the default parameters of the circuit breaker.
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		Window:      10 * time.Second,
+		Threshold:   0.5,
+		MinRequests: 20,
+		CoolDown:    5 * time.Second,
+		Probes:      1,
+	}
+}
+
+// WithCircuitBreaker enables the circuit breaker for methods without a bucket configuration, see
+// BucketConfig.Breaker.
+func WithCircuitBreaker(config BreakerConfig) Option {
+	return func(rl *TopDownRL) {
+		rl.defaultBucket.Breaker = &config
+	}
+}
+
+// WithOnStateChange calls hook whenever the circuit breaker of a method changes state, including
+// when it's forced. It runs on the goroutine of the request or control call causing the change,
+// after the breaker's lock was released.
+func WithOnStateChange(hook func(method string, from, to BreakerState)) Option {
+	return func(rl *TopDownRL) {
+		rl.onStateChange = hook
+	}
+}
+
+// validate checks that the circuit can open and close again.
+func (c BreakerConfig) validate() error {
+	if c.Window <= 0 || c.CoolDown <= 0 {
+		return fmt.Errorf("window %v and cool-down %v must be positive", c.Window, c.CoolDown)
+	}
+	if !(c.Threshold > 0 && c.Threshold <= 1) {
+		return fmt.Errorf("threshold must be in (0, 1], got %g", c.Threshold)
+	}
+	if c.MinRequests < 1 || c.Probes < 1 {
+		return fmt.Errorf("min requests %d and probes %d must be positive", c.MinRequests, c.Probes)
+	}
+	return nil
+}
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed admits requests to the limiter.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects all requests.
+	BreakerOpen
+	// BreakerHalfOpen admits a limited number of probe requests.
+	BreakerHalfOpen
+)
+
+// String returns the name of the state.
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half_open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// BreakerMetrics is the state of the circuit breaker of a method.
+type BreakerMetrics struct {
+	State string `json:"state"`
+	// Forced reports whether the state was forced through ForceBreaker and doesn't change by itself.
+	Forced bool      `json:"forced"`
+	Since  time.Time `json:"since"`
+	// Requests and Failures are the completed requests in the window, and ErrorRate their ratio.
+	Requests  int64   `json:"requests"`
+	Failures  int64   `json:"failures"`
+	ErrorRate float64 `json:"error_rate"`
+	// Transitions counts the state changes and Rejected the requests rejected while not closed.
+	Transitions int64 `json:"transitions"`
+	Rejected    int64 `json:"rejected"`
+}
+
+// breakerSlot counts the requests completed during one slot of the window.
+type breakerSlot struct {
+	epoch    int64
+	requests int64
+	failures int64
+}
+
+// breaker is the circuit breaker of a method, with its own lock so its checks never wait for the
+// metrics of the method.
+type breaker struct {
+	config   BreakerConfig
+	failures map[codes.Code]bool
+
+	mu          sync.Mutex
+	state       BreakerState
+	forced      bool
+	since       time.Time
+	slots       [breakerSlots]breakerSlot
+	probes      int
+	probeStart  time.Time
+	transitions int64
+	rejected    int64
+}
+
+// newBreaker creates the circuit breaker of a method, or returns nil if it's disabled.
+func newBreaker(config *BreakerConfig, now time.Time) *breaker {
+	if config == nil {
+		return nil
+	}
+	failureCodes := config.FailureCodes
+	if failureCodes == nil {
+		failureCodes = DefaultBreakerCodes
+	}
+	failures := make(map[codes.Code]bool, len(failureCodes))
+	for _, code := range failureCodes {
+		failures[code] = true
+	}
+	return &breaker{config: *config, failures: failures, since: now}
+}
+
+// slotWidth returns the span of a slot of the window.
+func (b *breaker) slotWidth() int64 {
+	if width := int64(b.config.Window) / breakerSlots; width > 0 {
+		return width
+	}
+	return 1
+}
+
+// countsLocked returns the requests and failures completed in the window ending at now. The
+// caller must hold b.mu.
+func (b *breaker) countsLocked(now time.Time) (requests, failures int64) {
+	epoch := now.UnixNano() / b.slotWidth()
+	for _, slot := range b.slots {
+		if slot.epoch > epoch-breakerSlots {
+			requests += slot.requests
+			failures += slot.failures
+		}
+	}
+	return requests, failures
+}
+
+// transitionLocked moves the breaker to state at now. The caller must hold b.mu.
+func (b *breaker) transitionLocked(state BreakerState, now time.Time) {
+	if state == BreakerClosed {
+		b.slots = [breakerSlots]breakerSlot{}
+	}
+	if state == BreakerHalfOpen {
+		b.probes, b.probeStart = 0, now
+	}
+	b.state, b.since = state, now
+	b.transitions++
+}
+
+// allow reports whether a request may proceed at now, opening the circuit half-way once the
+// cool-down is over, and returns the state it was in if it changed.
+func (b *breaker) allow(now time.Time) (ok bool, from BreakerState, changed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	from = b.state
+	if b.state == BreakerOpen && !b.forced && now.Sub(b.since) >= b.config.CoolDown {
+		b.transitionLocked(BreakerHalfOpen, now)
+		changed = true
+	}
+	if b.state == BreakerHalfOpen && b.probes >= b.config.Probes && now.Sub(b.probeStart) >= b.config.CoolDown {
+		// The probes never completed, so let new ones through
+		b.probes, b.probeStart = 0, now
+	}
+
+	switch {
+	case b.state == BreakerClosed:
+		return true, from, changed
+	case b.state == BreakerHalfOpen && b.probes < b.config.Probes:
+		b.probes++
+		return true, from, changed
+	}
+	b.rejected++
+	return false, from, changed
+}
+
+// record counts a completed request with the given status code at now and returns the states the
+// breaker changed from and to, if it did.
+func (b *breaker) record(code codes.Code, now time.Time) (from, to BreakerState, changed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failed := b.failures[code]
+	epoch := now.UnixNano() / b.slotWidth()
+	slot := &b.slots[epoch%breakerSlots]
+	if slot.epoch != epoch {
+		*slot = breakerSlot{epoch: epoch}
+	}
+	slot.requests++
+	if failed {
+		slot.failures++
+	}
+
+	from = b.state
+	if b.forced {
+		return from, from, false
+	}
+	switch b.state {
+	case BreakerClosed:
+		requests, failures := b.countsLocked(now)
+		if requests >= b.config.MinRequests && float64(failures) >= b.config.Threshold*float64(requests) {
+			b.transitionLocked(BreakerOpen, now)
+		}
+	case BreakerHalfOpen:
+		if failed {
+			b.transitionLocked(BreakerOpen, now)
+		} else {
+			b.transitionLocked(BreakerClosed, now)
+		}
+	}
+	return from, b.state, b.state != from
+}
+
+// force sets the breaker to state at now until released, or releases it if forced is false,
+// closing it. It returns the state it was in if it changed.
+func (b *breaker) force(state BreakerState, forced bool, now time.Time) (from BreakerState, changed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	from = b.state
+	b.forced = forced
+	if b.state == state {
+		return from, false
+	}
+	b.transitionLocked(state, now)
+	return from, true
+}
+
+// snapshot returns the state of the breaker at now.
+func (b *breaker) snapshot(now time.Time) *BreakerMetrics {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	requests, failures := b.countsLocked(now)
+	return &BreakerMetrics{
+		State:       b.state.String(),
+		Forced:      b.forced,
+		Since:       b.since,
+		Requests:    requests,
+		Failures:    failures,
+		ErrorRate:   ratio(failures, requests),
+		Transitions: b.transitions,
+		Rejected:    b.rejected,
+	}
+}
+
+// breakerValue converts the name of a breaker state into its Prometheus gauge value.
+func breakerValue(state string) float64 {
+	switch state {
+	case BreakerOpen.String():
+		return 1
+	case BreakerHalfOpen.String():
+		return 0.5
+	}
+	return 0
+}
+
+// breakerStateLocked returns the state of the circuit breaker of a method, or nil if it has none.
+// The caller must hold metrics.mu.
+func (rl *TopDownRL) breakerStateLocked(metrics *InterfaceMetrics) *BreakerMetrics {
+	if metrics.breaker == nil {
+		return nil
+	}
+	return metrics.breaker.snapshot(rl.clock.Now())
+}
+
+// breakerAllows reports whether the circuit breaker of a method, if any, lets a request through.
+func (rl *TopDownRL) breakerAllows(methodName string) bool {
+	metrics := rl.registeredMetrics(methodName)
+	if metrics == nil || metrics.breaker == nil {
+		return true
+	}
+	ok, from, changed := metrics.breaker.allow(rl.clock.Now())
+	if changed {
+		rl.breakerChanged(methodName, from, BreakerHalfOpen)
+	}
+	return ok
+}
+
+// breakerClosed reports whether the circuit breaker of a registered method, if any, is closed.
+func breakerClosed(metrics *InterfaceMetrics) bool {
+	if metrics.breaker == nil {
+		return true
+	}
+	metrics.breaker.mu.Lock()
+	defer metrics.breaker.mu.Unlock()
+	return metrics.breaker.state == BreakerClosed
+}
+
+// recordBreakerOutcome counts a completed request of a method towards its circuit breaker, if any.
+func (rl *TopDownRL) recordBreakerOutcome(methodName string, code codes.Code) {
+	metrics := rl.registeredMetrics(methodName)
+	if metrics == nil || metrics.breaker == nil {
+		return
+	}
+	if from, to, changed := metrics.breaker.record(code, rl.clock.Now()); changed {
+		rl.breakerChanged(methodName, from, to)
+	}
+}
+
+// breakerChanged logs a state change of the circuit breaker of a method and calls the
+// OnStateChange hook, if any.
+func (rl *TopDownRL) breakerChanged(methodName string, from, to BreakerState) {
+	rl.logger.Infof("Circuit breaker for method '%s' changed from %s to %s", methodName, from, to)
+	if rl.onStateChange != nil {
+		rl.runHook("OnStateChange", func() { rl.onStateChange(methodName, from, to) })
+	}
+}
+
+// ForceBreaker forces the circuit breaker of a method open or closed until ReleaseBreaker is
+// called; a forced breaker ignores the error rate and the cool-down.
+func (rl *TopDownRL) ForceBreaker(method string, state BreakerState) error {
+	if state != BreakerOpen && state != BreakerClosed {
+		return fmt.Errorf("a circuit breaker can only be forced open or closed, got %s", state)
+	}
+	return rl.forceBreaker(method, state, true)
+}
+
+// ReleaseBreaker lets the circuit breaker of a method change state by itself again, starting
+// closed with an empty window.
+func (rl *TopDownRL) ReleaseBreaker(method string) error {
+	return rl.forceBreaker(method, BreakerClosed, false)
+}
+
+// forceBreaker sets the circuit breaker of a method to state, forced or released.
+func (rl *TopDownRL) forceBreaker(method string, state BreakerState, forced bool) error {
+	metrics := rl.registeredMetrics(method)
+	if metrics == nil {
+		return fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+	}
+	if metrics.breaker == nil {
+		return fmt.Errorf("%w: '%s'", ErrNoBreaker, method)
+	}
+	if from, changed := metrics.breaker.force(state, forced, rl.clock.Now()); changed {
+		rl.breakerChanged(method, from, state)
+	}
+	if rl.Debug {
+		rl.logger.Debugf("Set circuit breaker for method '%s' to %s, forced: %t", method, state, forced)
+	}
+	return nil
+}
+
+// Breakers returns the state of the circuit breakers of all methods that have one.
+func (rl *TopDownRL) Breakers() map[string]BreakerMetrics {
+	now := rl.clock.Now()
+	breakers := make(map[string]BreakerMetrics)
+	for methodName, metrics := range *rl.published.Load() {
+		if metrics.breaker != nil {
+			breakers[methodName] = *metrics.breaker.snapshot(now)
+		}
+	}
+	return breakers
+}
+
+// HandleBreaker handles the GET requests listing the circuit breakers and the POST requests
+// forcing the one of the method given by the 'method' parameter with a body of
+// {"force": "open" | "closed" | "auto"}, where "auto" releases it.
+func (rl *TopDownRL) HandleBreaker(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleBreaker called")
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		method := r.URL.Query().Get("method")
+		if method == "" {
+			writeError(w, "Missing 'method' parameter", http.StatusBadRequest)
+			return
+		}
+		var data struct {
+			Force string `json:"force"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeError(w, "Failed to decode request body", http.StatusBadRequest)
+			return
+		}
+		var err error
+		switch data.Force {
+		case "open":
+			err = rl.ForceBreaker(method, BreakerOpen)
+		case "closed":
+			err = rl.ForceBreaker(method, BreakerClosed)
+		case "auto":
+			err = rl.ReleaseBreaker(method)
+		default:
+			writeError(w, "Invalid 'force' value '"+data.Force+"'", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrUnknownMethod) || errors.Is(err, ErrNoBreaker) {
+				status = http.StatusNotFound
+			}
+			writeError(w, err.Error(), status)
+			return
+		}
+	default:
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	breakers := rl.Breakers()
+	methods := make([]string, 0, len(breakers))
+	for methodName := range breakers {
+		methods = append(methods, methodName)
+	}
+	sort.Strings(methods)
+	type breakerResponse struct {
+		Method string `json:"method"`
+		BreakerMetrics
+	}
+	response := make([]breakerResponse, 0, len(methods))
+	for _, methodName := range methods {
+		response = append(response, breakerResponse{Method: methodName, BreakerMetrics: breakers[methodName]})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
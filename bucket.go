@@ -0,0 +1,184 @@
+package topdown
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// tokenScale is the fixed-point scale of token counts: buckets count tokens in millionths so
+// that fractional tokens carry over between calls and refill rates below 1 rps still accrue.
+const tokenScale = 1_000_000
+
+// bucketParams holds the parameters of a token bucket. They are replaced as a whole through an
+// atomic pointer, so the admission fast path always sees a consistent pair.
+type bucketParams struct {
+	rate      float64 // tokens per second
+	maxTokens int64   // scaled by tokenScale
+}
+
+// tokenBucket is a lock-free token bucket. Admission decisions only use atomic loads and CAS;
+// parameter updates swap the params pointer and are expected to be serialized by the caller.
+type tokenBucket struct {
+	params atomic.Pointer[bucketParams]
+	// tokens is the number of available tokens, scaled by tokenScale.
+	tokens atomic.Int64
+	// credited is the time, in nanoseconds since base, up to which tokens have been credited.
+	credited atomic.Int64
+	base     time.Time
+}
+
+// newTokenBucket creates a full bucket.
+func newTokenBucket(maxTokens int64, rate float64, now time.Time) *tokenBucket {
+	b := &tokenBucket{base: now}
+	b.params.Store(&bucketParams{rate: rate, maxTokens: maxTokens * tokenScale})
+	b.tokens.Store(maxTokens * tokenScale)
+	return b
+}
+
+// pendingCredit returns the scaled tokens accrued between credited and now given the parameters,
+// and how far credited may advance for them. Only whole scaled tokens are credited, and the
+// time for the remainder is kept, unless the bucket fills up and the excess is discarded.
+func pendingCredit(p *bucketParams, tokens, credited, now int64) (int64, int64) {
+	elapsed := now - credited
+	if elapsed <= 0 || p.rate <= 0 {
+		return 0, 0
+	}
+
+	credit := float64(elapsed) * p.rate * tokenScale / float64(time.Second)
+	if float64(tokens)+credit >= float64(p.maxTokens) {
+		return p.maxTokens - tokens, elapsed
+	}
+	whole := int64(credit)
+	return whole, int64(float64(whole) * float64(time.Second) / (p.rate * tokenScale))
+}
+
+// refill credits the tokens accrued up to now.
+func (b *tokenBucket) refill(now time.Time) {
+	t := int64(now.Sub(b.base))
+	for {
+		credited := b.credited.Load()
+		p := b.params.Load()
+		credit, advance := pendingCredit(p, b.tokens.Load(), credited, t)
+		if advance <= 0 {
+			return
+		}
+		// Whoever advances the credited time owns the credit for that span
+		if !b.credited.CompareAndSwap(credited, credited+advance) {
+			continue
+		}
+		if credit > 0 {
+			b.add(credit, p.maxTokens)
+		}
+		return
+	}
+}
+
+// add adds scaled tokens, clamped to maxTokens.
+func (b *tokenBucket) add(credit, maxTokens int64) {
+	for {
+		tokens := b.tokens.Load()
+		updated := tokens + credit
+		if updated > maxTokens {
+			updated = maxTokens
+		}
+		if b.tokens.CompareAndSwap(tokens, updated) {
+			return
+		}
+	}
+}
+
+// takeShare consumes n tokens if that many are available at now within the given share of the
+// capacity, i.e. without leaving less than (1 - share) of the capacity in the bucket.
+func (b *tokenBucket) takeShare(now time.Time, n int64, share float64) bool {
+	b.refill(now)
+
+	need := required(b.params.Load(), n, share)
+	for {
+		tokens := b.tokens.Load()
+		if tokens < need {
+			return false
+		}
+		if b.tokens.CompareAndSwap(tokens, tokens-n*tokenScale) {
+			return true
+		}
+	}
+}
+
+// required returns the scaled tokens the bucket must hold to take n tokens within share, which
+// leaves (1 - share) of the capacity in the bucket. Takes that don't fit into the share only
+// require a full bucket and leave it in debt, so their full cost is still charged.
+func required(p *bucketParams, n int64, share float64) int64 {
+	need := n * tokenScale
+	if share < 1 {
+		need += int64(float64(p.maxTokens) * (1 - share))
+	}
+	if need > p.maxTokens {
+		return p.maxTokens
+	}
+	return need
+}
+
+// available returns the number of tokens the bucket holds at now without modifying it.
+func (b *tokenBucket) available(now time.Time) float64 {
+	tokens := b.tokens.Load()
+	credit, _ := pendingCredit(b.params.Load(), tokens, b.credited.Load(), int64(now.Sub(b.base)))
+	return float64(tokens+credit) / tokenScale
+}
+
+// setRate changes the refill rate. Tokens accrued at the old rate up to now are kept.
+func (b *tokenBucket) setRate(rate float64, now time.Time) {
+	b.refill(now)
+	p := *b.params.Load()
+	p.rate = rate
+	b.params.Store(&p)
+	b.credited.Store(int64(now.Sub(b.base)))
+}
+
+// setLimits changes the capacity and the refill rate. Tokens accrued at the old rate up to now
+// are kept, up to the new capacity.
+func (b *tokenBucket) setLimits(maxTokens int64, rate float64, now time.Time) {
+	b.refill(now)
+	b.params.Store(&bucketParams{rate: rate, maxTokens: maxTokens * tokenScale})
+	b.credited.Store(int64(now.Sub(b.base)))
+	b.add(0, maxTokens*tokenScale)
+}
+
+// drain removes n tokens at now for consumption that must not be refused. The bucket may go into
+// debt, so later takes wait until it has been repaid, but never by more than its capacity.
+func (b *tokenBucket) drain(now time.Time, n int64) {
+	b.refill(now)
+	floor := -b.params.Load().maxTokens
+	for {
+		tokens := b.tokens.Load()
+		if tokens <= floor {
+			return
+		}
+		updated := tokens - n*tokenScale
+		if updated < floor {
+			updated = floor
+		}
+		if b.tokens.CompareAndSwap(tokens, updated) {
+			return
+		}
+	}
+}
+
+// refund puts back n tokens taken from the bucket, up to its capacity.
+func (b *tokenBucket) refund(n int64) {
+	b.add(n*tokenScale, b.params.Load().maxTokens)
+}
+
+// retryAfterShare returns how long it takes at the current refill rate until n tokens can be
+// taken within share. It returns false if the bucket doesn't refill.
+func (b *tokenBucket) retryAfterShare(now time.Time, n int64, share float64) (time.Duration, bool) {
+	p := b.params.Load()
+	if p.rate <= 0 {
+		return 0, false
+	}
+	need := required(p, n, share)
+	deficit := float64(need)/tokenScale - b.available(now)
+	if deficit <= 0 {
+		return 0, true
+	}
+	return time.Duration(deficit / p.rate * float64(time.Second)), true
+}
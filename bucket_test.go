@@ -0,0 +1,176 @@
+package topdown
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketRefill(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	limiter := NewTokenBucketLimiter(BucketConfig{MaxTokens: 10, RefillRate: 4}, clock)
+	ctx := context.Background()
+
+	if !limiter.Allow(ctx, 10) {
+		t.Fatal("Allow(10) = false on a full bucket")
+	}
+	steps := []struct {
+		advance time.Duration
+		want    float64
+	}{
+		{0, 0},
+		{250 * time.Millisecond, 1},
+		{100 * time.Millisecond, 1.4},
+		{1150 * time.Millisecond, 6},
+		{10 * time.Second, 10},
+	}
+	for _, step := range steps {
+		clock.Advance(step.advance)
+		if got := limiter.Snapshot().Available; got != step.want {
+			t.Errorf("tokens at %v = %v, want %v", clock.Now().Sub(time.Unix(1000, 0)), got, step.want)
+		}
+	}
+	if !limiter.Allow(ctx, 3) {
+		t.Fatal("Allow(3) = false on a full bucket")
+	}
+	if got := limiter.Snapshot().Available; got != 7 {
+		t.Errorf("tokens = %v after taking 3 of 10, want 7", got)
+	}
+}
+
+func TestTokenBucketFractionalRate(t *testing.T) {
+	const (
+		rate     = 0.3
+		duration = 10 * time.Second
+		step     = 10 * time.Millisecond
+	)
+	clock := NewFakeClock(time.Unix(1000, 0))
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 1, RefillRate: rate}},
+		map[string]time.Duration{"/a": time.Second}, WithClock(clock))
+	ctx := context.Background()
+	rl.Allow(ctx, "/a")
+
+	admitted := 0
+	for elapsed := time.Duration(0); elapsed < duration; elapsed += step {
+		clock.Advance(step)
+		if rl.Allow(ctx, "/a") {
+			admitted++
+		}
+	}
+
+	want := rate * duration.Seconds()
+	if got := float64(admitted); got < want-1 || got > want+1 {
+		t.Errorf("admitted %d requests in %v at %v rps, want %v ± 1", admitted, duration, rate, want)
+	}
+}
+
+func TestTokenBucketSetRateKeepsAccruedTokens(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	b := newTokenBucket(10, 2, clock.Now())
+	b.takeShare(clock.Now(), 10, 1)
+
+	clock.Advance(time.Second)
+	b.setRate(8, clock.Now())
+	if got := b.available(clock.Now()); got != 2 {
+		t.Errorf("tokens = %v after 1s at 2 rps, want 2", got)
+	}
+	clock.Advance(500 * time.Millisecond)
+	if got := b.available(clock.Now()); got != 6 {
+		t.Errorf("tokens = %v after another 0.5s at 8 rps, want 6", got)
+	}
+}
+
+func TestTokenBucketConcurrentAdmissions(t *testing.T) {
+	const (
+		goroutines = 128
+		rate       = 1000
+		burst      = 100
+		window     = time.Second
+	)
+	clock := NewFakeClock(time.Unix(1000, 0))
+	limiter := NewTokenBucketLimiter(BucketConfig{MaxTokens: burst, RefillRate: rate}, clock)
+	ctx := context.Background()
+
+	var admitted atomic.Int64
+	var stop atomic.Bool
+	defer stop.Store(true)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				if limiter.Allow(ctx, 1) {
+					admitted.Add(1)
+				} else {
+					runtime.Gosched()
+				}
+			}
+		}()
+	}
+	// Every step refills 10 tokens once the goroutines took the ones before, so none overflow
+	const step = 10 * time.Millisecond
+	drained := func() bool { return limiter.Snapshot().Available < 1 }
+	for elapsed := time.Duration(0); elapsed < window; elapsed += step {
+		waitUntil(t, drained)
+		clock.Advance(step)
+	}
+	waitUntil(t, drained)
+	stop.Store(true)
+	wg.Wait()
+
+	want := int64(rate * window.Seconds())
+	if got := admitted.Load(); got < want-burst || got > want+burst {
+		t.Errorf("admitted %d requests in %v at %d rps, want %d ± %d", got, window, rate, want, burst)
+	}
+	if got := float64(admitted.Load()) + limiter.Snapshot().Available; got > float64(want+burst) {
+		t.Errorf("admitted and available tokens = %v, more than the %d the bucket held", got, want+burst)
+	}
+}
+
+func TestAllowNRejectsNonPositiveCosts(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 10, RefillRate: 1}},
+		map[string]time.Duration{"/a": time.Second}, WithClock(clock))
+	ctx := context.Background()
+	limiter := rl.loadMetrics("/a").limiter
+
+	if !rl.AllowN(ctx, "/a", 4) {
+		t.Fatal("AllowN(4) = false on a full bucket")
+	}
+	for _, n := range []int64{0, -1, -100} {
+		if rl.AllowN(ctx, "/a", n) {
+			t.Errorf("AllowN(%d) = true, want it rejected", n)
+		}
+		if got := limiter.Snapshot().Available; got != 6 {
+			t.Errorf("tokens = %v after AllowN(%d), want 6", got, n)
+		}
+	}
+}
+
+func BenchmarkTokenBucketAllow(b *testing.B) {
+	limiter := NewTokenBucketLimiter(BucketConfig{MaxTokens: 1 << 40, RefillRate: 1e9}, realClock{})
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			limiter.Allow(ctx, 1)
+		}
+	})
+}
+
+func BenchmarkAllowN(b *testing.B) {
+	rl := newTestRL(b, map[string]BucketConfig{"/a": {MaxTokens: 1 << 40, RefillRate: 1e9}}, map[string]time.Duration{"/a": time.Second})
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			rl.AllowN(ctx, "/a", 1)
+		}
+	})
+}
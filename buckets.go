@@ -0,0 +1,66 @@
+package topdown
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// BucketState is the state of the limiter of a method reported by the control API.
+type BucketState struct {
+	Method string `json:"method"`
+	// Tokens is the capacity available at the time it's read, including the refill accrued since
+	// the last request. Reading it doesn't consume tokens or advance the refill.
+	Tokens     float64 `json:"tokens"`
+	MaxTokens  int64   `json:"max_tokens"`
+	RefillRate float64 `json:"refill_rate"`
+	// EmptyIntervals is the number of consecutive intervals that ended with less than one token,
+	// e.g. to alert on a bucket pinned at zero.
+	EmptyIntervals int64 `json:"empty_intervals"`
+}
+
+// countEmptyIntervalLocked updates the number of consecutive intervals ending with an empty
+// bucket at the end of an interval. The caller must hold metrics.mu.
+func countEmptyIntervalLocked(metrics *InterfaceMetrics) {
+	if metrics.limiter.Snapshot().Available < 1 {
+		metrics.EmptyIntervals++
+	} else {
+		metrics.EmptyIntervals = 0
+	}
+}
+
+// Buckets returns the state of the limiters of all registered methods sorted by method name.
+func (rl *TopDownRL) Buckets() []BucketState {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	states := make([]BucketState, 0, len(rl.interfaces))
+	for methodName, metrics := range rl.interfaces {
+		limiter := metrics.limiter.Snapshot()
+		metrics.mu.Lock()
+		states = append(states, BucketState{
+			Method:         methodName,
+			Tokens:         limiter.Available,
+			MaxTokens:      limiter.Burst,
+			RefillRate:     limiter.Rate,
+			EmptyIntervals: metrics.EmptyIntervals,
+		})
+		metrics.mu.Unlock()
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Method < states[j].Method })
+	return states
+}
+
+// HandleBuckets handles the GET requests listing the bucket state of all methods.
+func (rl *TopDownRL) HandleBuckets(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleBuckets called")
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rl.Buckets())
+}
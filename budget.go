@@ -0,0 +1,205 @@
+package topdown
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Burn rate windows reported with the error budget, see WithErrorBudget.
+const (
+	ShortBurnWindow = 5 * time.Minute
+	LongBurnWindow  = time.Hour
+)
+
+// errorBudgetConfig is the SLO objective of WithErrorBudget.
+type errorBudgetConfig struct {
+	target float64
+	window time.Duration
+}
+
+// budgetInterval is the number of completed requests and SLO violations of a method in the
+// interval ending at time.
+type budgetInterval struct {
+	time       time.Time
+	completed  int64
+	violations int64
+}
+
+// errorBudget keeps the intervals of a method within the longest window of the error budget.
+// It's guarded by the metrics.mu of its method.
+type errorBudget struct {
+	intervals []budgetInterval
+}
+
+// ErrorBudget is the state of the error budget of a method, see WithErrorBudget.
+type ErrorBudget struct {
+	// Target is the share of the completed requests that must meet the SLO over Window.
+	Target float64
+	Window time.Duration
+	// Completed and Violations count the requests completed with a good status code and those
+	// of them that exceeded the SLO over the window.
+	Completed  int64
+	Violations int64
+	// Consumed is the share of the budget, the violations the target allows over the window,
+	// used so far, and Remaining the share left; Consumed exceeds 1 once the budget is exhausted.
+	Consumed  float64
+	Remaining float64
+	// BurnRateShort and BurnRateLong are the rates the budget is used up at over the last
+	// ShortBurnWindow and LongBurnWindow: the violation ratio over the allowed one, so a burn
+	// rate of 1 uses up the budget exactly at the end of the window.
+	BurnRateShort float64
+	BurnRateLong  float64
+}
+
+// WithErrorBudget tracks the error budget of every method for an objective of target, e.g. 0.99
+// for 99% of the completed requests within their SLO, over a sliding window, e.g. an hour, along
+// with the burn rates over the last 5 minutes and hour. It's reported by /metrics, /prometheus and
+// GET /budget.
+func WithErrorBudget(target float64, window time.Duration) Option {
+	return func(rl *TopDownRL) {
+		rl.budget = &errorBudgetConfig{target: target, window: window}
+	}
+}
+
+// validate checks that the objective can be met.
+func (c *errorBudgetConfig) validate() error {
+	if !(c.target > 0 && c.target < 1) {
+		return fmt.Errorf("error budget target must be in (0, 1), got %g", c.target)
+	}
+	if c.window <= 0 {
+		return fmt.Errorf("error budget window must be positive, got %v", c.window)
+	}
+	return nil
+}
+
+// recordBudgetLocked adds the last interval of a method to its error budget and drops the
+// intervals older than the longest window. The caller must hold metrics.mu.
+func (rl *TopDownRL) recordBudgetLocked(metrics *InterfaceMetrics, now time.Time) {
+	if rl.budget == nil {
+		return
+	}
+	if metrics.budget == nil {
+		metrics.budget = &errorBudget{}
+	}
+	b := metrics.budget
+	b.intervals = append(b.intervals, budgetInterval{
+		time:       now,
+		completed:  metrics.CurrentGoodput + metrics.CurrentSloViolations,
+		violations: metrics.CurrentSloViolations,
+	})
+
+	cutoff := now.Add(-max(rl.budget.window, LongBurnWindow))
+	expired := 0
+	for expired < len(b.intervals) && !b.intervals[expired].time.After(cutoff) {
+		expired++
+	}
+	b.intervals = append(b.intervals[:0], b.intervals[expired:]...)
+}
+
+// budgetStateLocked returns the state of the error budget of a method, or nil if it isn't
+// tracked. The caller must hold metrics.mu.
+func (rl *TopDownRL) budgetStateLocked(metrics *InterfaceMetrics) *ErrorBudget {
+	if rl.budget == nil {
+		return nil
+	}
+	allowed := 1 - rl.budget.target
+	state := &ErrorBudget{Target: rl.budget.target, Window: rl.budget.window, Remaining: 1}
+	if metrics.budget == nil {
+		return state
+	}
+
+	now := rl.clock.Now()
+	state.Completed, state.Violations = metrics.budget.sum(now.Add(-rl.budget.window))
+	if state.Completed > 0 {
+		state.Consumed = float64(state.Violations) / (allowed * float64(state.Completed))
+		state.Remaining = 1 - state.Consumed
+	}
+	completed, violations := metrics.budget.sum(now.Add(-ShortBurnWindow))
+	state.BurnRateShort = ratio(violations, completed) / allowed
+	completed, violations = metrics.budget.sum(now.Add(-LongBurnWindow))
+	state.BurnRateLong = ratio(violations, completed) / allowed
+	return state
+}
+
+// sum adds up the completed requests and SLO violations of the intervals ending after since.
+func (b *errorBudget) sum(since time.Time) (completed, violations int64) {
+	for i := len(b.intervals) - 1; i >= 0 && b.intervals[i].time.After(since); i-- {
+		completed += b.intervals[i].completed
+		violations += b.intervals[i].violations
+	}
+	return completed, violations
+}
+
+// GetErrorBudget returns the state of the error budget of a method, or ErrUnknownMethod if it
+// isn't registered. The state is nil unless enabled with WithErrorBudget.
+func (rl *TopDownRL) GetErrorBudget(method string) (*ErrorBudget, error) {
+	metrics := rl.registeredMetrics(method)
+	if metrics == nil {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	return rl.budgetStateLocked(metrics), nil
+}
+
+// BudgetResponse is the JSON shape of an ErrorBudget served by HandleBudget and /metrics.
+type BudgetResponse struct {
+	Method        string  `json:"method,omitempty"`
+	Target        float64 `json:"target"`
+	Window        string  `json:"window"`
+	Completed     int64   `json:"completed"`
+	Violations    int64   `json:"violations"`
+	Consumed      float64 `json:"consumed"`
+	Remaining     float64 `json:"remaining"`
+	BurnRateShort float64 `json:"burn_rate_5m"`
+	BurnRateLong  float64 `json:"burn_rate_1h"`
+}
+
+// newBudgetResponse converts the state of an error budget into its JSON shape, nil if it isn't tracked.
+func newBudgetResponse(method string, budget *ErrorBudget) *BudgetResponse {
+	if budget == nil {
+		return nil
+	}
+	return &BudgetResponse{
+		Method:        method,
+		Target:        budget.Target,
+		Window:        budget.Window.String(),
+		Completed:     budget.Completed,
+		Violations:    budget.Violations,
+		Consumed:      budget.Consumed,
+		Remaining:     budget.Remaining,
+		BurnRateShort: budget.BurnRateShort,
+		BurnRateLong:  budget.BurnRateLong,
+	}
+}
+
+// HandleBudget handles the GET requests for the error budget of a method.
+func (rl *TopDownRL) HandleBudget(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleBudget called")
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	method := r.URL.Query().Get("method")
+	if method == "" {
+		writeError(w, "Missing 'method' parameter", http.StatusBadRequest)
+		return
+	}
+	if rl.budget == nil {
+		writeError(w, "Error budget tracking is not enabled", http.StatusNotFound)
+		return
+	}
+
+	budget, err := rl.GetErrorBudget(method)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newBudgetResponse(method, budget))
+}
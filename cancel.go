@@ -0,0 +1,53 @@
+package topdown
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WithIncludeCancelled counts requests cancelled by the client like completed ones, towards
+// goodput, SLO violations and the tail latency, instead of counting them apart.
+func WithIncludeCancelled(include bool) Option {
+	return func(rl *TopDownRL) {
+		rl.includeCancelled = include
+	}
+}
+
+// WithDeadlineExceededAsCancelled counts requests that failed because their deadline passed as
+// cancelled, so a storm of client timeouts doesn't show up in the latencies used for control.
+func WithDeadlineExceededAsCancelled(enabled bool) Option {
+	return func(rl *TopDownRL) {
+		rl.deadlineExceededCancelled = enabled
+	}
+}
+
+// cancelled reports whether a request failed because the client cancelled it.
+func (rl *TopDownRL) cancelled(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Canceled:
+		return true
+	case codes.DeadlineExceeded:
+		return rl.deadlineExceededCancelled
+	}
+	return errors.Is(err, context.Canceled) || rl.deadlineExceededCancelled && errors.Is(err, context.DeadlineExceeded)
+}
+
+// recordCancelled counts a request cancelled by the client; its latency isn't recorded.
+func (rl *TopDownRL) recordCancelled(methodName string) {
+	metrics := rl.loadMetrics(methodName)
+	if metrics == nil {
+		return
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	metrics.CancelledCounter++
+	metrics.CancelledTotal++
+}
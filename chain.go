@@ -0,0 +1,69 @@
+package topdown
+
+import (
+	"context"
+	"math"
+
+	"google.golang.org/grpc"
+)
+
+// ServerOptions returns the server options installing the unary and stream interceptors of the
+// limiter. They're chained, so they compose with further grpc.ChainUnaryInterceptor and
+// grpc.ChainStreamInterceptor options, which run in the order they're passed to grpc.NewServer:
+// pass these first, so the limiter sees the incoming metadata before another interceptor can
+// replace the context.
+func ServerOptions(rl *TopDownRL) []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(rl.UnaryInterceptor),
+		grpc.ChainStreamInterceptor(rl.StreamInterceptor),
+	}
+}
+
+// Admission is the admission decision of the limiter for a request, as later interceptors and
+// the handler see it, see AdmissionFromContext.
+type Admission struct {
+	// Method is the method name the limiter resolved for the request.
+	Method string
+	// Tokens is the number of tokens left in the bucket of the method once the request took its
+	// own, +Inf if the method isn't limited.
+	Tokens float64
+	// Tier is the name of the priority tier of the request, empty if priorities are disabled.
+	Tier string
+}
+
+// admissionKey is the context key of the admission, see AdmissionFromContext.
+type admissionKey struct{}
+
+// AdmissionFromContext returns the admission decision of the limiter for the request of ctx. It
+// reports false for requests that didn't pass the limiter's admission, such as exempt methods.
+func AdmissionFromContext(ctx context.Context) (Admission, bool) {
+	admission, ok := ctx.Value(admissionKey{}).(Admission)
+	return admission, ok
+}
+
+// MethodFromContext returns the method name the limiter resolved for the request of ctx, see
+// AdmissionFromContext.
+func MethodFromContext(ctx context.Context) (string, bool) {
+	admission, ok := AdmissionFromContext(ctx)
+	return admission.Method, ok
+}
+
+// withAdmission returns ctx with the admission of a request admitted for a method and the report
+// its handler fills in, for a request that took cost tokens.
+func (rl *TopDownRL) withAdmission(ctx context.Context, methodName string, tier int, cost int64) context.Context {
+	admission := Admission{Method: methodName, Tokens: rl.tokensAvailable(methodName)}
+	if tier >= 0 {
+		admission.Tier = rl.priorities[tier].Name
+	}
+	ctx = context.WithValue(ctx, reportKey{}, &requestReport{rl: rl, method: methodName, charged: cost})
+	return context.WithValue(ctx, admissionKey{}, admission)
+}
+
+// tokensAvailable returns the tokens available in the bucket of a method, +Inf if it isn't
+// registered.
+func (rl *TopDownRL) tokensAvailable(methodName string) float64 {
+	if metrics := rl.registeredMetrics(methodName); metrics != nil {
+		return metrics.limiter.Snapshot().Available
+	}
+	return math.Inf(1)
+}
@@ -0,0 +1,65 @@
+package topdown
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// laterKey is the context key of the value set by an interceptor chained after the limiter.
+type laterKey struct{}
+
+func TestServerOptionsChain(t *testing.T) {
+	rl := newTestRL(t, map[string]BucketConfig{echoMethod: {MaxTokens: 2, RefillRate: 0.1}},
+		map[string]time.Duration{echoMethod: time.Second}, WithClock(NewFakeClock(time.Unix(1000, 0))), WithMetricsInterval(time.Hour))
+	events := &eventLog{}
+	// later logs the admission and replaces the context, like logging or auth middleware
+	later := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		admission, ok := AdmissionFromContext(ctx)
+		if !ok {
+			t.Error("later interceptor saw no admission")
+		}
+		events.add(fmt.Sprintf("later %s admitted with %v tokens left", admission.Method, admission.Tokens))
+		return handler(context.WithValue(ctx, laterKey{}, true), req)
+	}
+	handler := func(ctx context.Context) error {
+		method, ok := MethodFromContext(ctx)
+		if !ok || ctx.Value(laterKey{}) == nil {
+			t.Error("handler lost the context of the chain")
+		}
+		events.add("handler " + method)
+		return nil
+	}
+	opts := append(ServerOptions(rl), grpc.ChainUnaryInterceptor(later))
+	conn := newTestServer(t, handler, opts)
+
+	for i := 0; i < 2; i++ {
+		if err := echo(context.Background(), conn, &structpb.Struct{}); err != nil {
+			t.Fatalf("call %d failed: %v", i, err)
+		}
+	}
+	if err := echo(context.Background(), conn, &structpb.Struct{}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("third call error = %v, want %v", err, codes.ResourceExhausted)
+	}
+
+	// The rejected call never reached the later interceptor
+	want := []string{
+		"later " + echoMethod + " admitted with 1 tokens left", "handler " + echoMethod,
+		"later " + echoMethod + " admitted with 0 tokens left", "handler " + echoMethod,
+	}
+	got := events.get()
+	if len(got) != len(want) {
+		t.Fatalf("events = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("events = %q, want %q", got, want)
+		}
+	}
+}
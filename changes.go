@@ -0,0 +1,224 @@
+package topdown
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+// DefaultChangeLogSize is the default number of changes kept by the change log, see WithChangeLogSize.
+const DefaultChangeLogSize = 1000
+
+// Sources of the changes in the change log.
+const (
+	ChangeSourceAPI        = "api"
+	ChangeSourceHTTP       = "http"
+	ChangeSourceGRPC       = "grpc"
+	ChangeSourcePush       = "push"
+	ChangeSourceController = "controller"
+	ChangeSourceExpiry     = "expiry"
+	ChangeSourceStore      = "store"
+	ChangeSourceFile       = "file"
+	ChangeSourceSchedule   = "schedule"
+)
+
+// Fields of the changes in the change log.
+const (
+	ChangeFieldRefillRate = "refill_rate"
+	ChangeFieldMinRate    = "min_rate"
+	ChangeFieldMaxRate    = "max_rate"
+	ChangeFieldMaxTokens  = "max_tokens"
+	ChangeFieldSLO        = "slo_ms"
+)
+
+// WithChangeLogSize sets how many of the latest changes to the rates, bucket capacities and SLOs
+// are kept in memory, see Changes. A size of zero keeps none.
+func WithChangeLogSize(size int) Option {
+	return func(rl *TopDownRL) {
+		rl.changeLogSize = size
+	}
+}
+
+// WithChangeLogWriter writes every change to w as a line of JSON, e.g. a file for durable audit
+// logs. Changes are written after the limiter's locks are released, in the order they were made.
+func WithChangeLogWriter(w io.Writer) Option {
+	return func(rl *TopDownRL) {
+		rl.changeWriter = w
+	}
+}
+
+// Change is a change to the configuration of a method recorded in the change log.
+type Change struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	// Field is the parameter that changed, one of the ChangeField constants. Old is zero if the
+	// change registered the method.
+	Field string  `json:"field"`
+	Old   float64 `json:"old"`
+	New   float64 `json:"new"`
+	// Source tells who made the change, one of the ChangeSource constants. Remote is the address
+	// of the client for changes made over HTTP or gRPC, or the push URL for pushed rates.
+	Source string `json:"source"`
+	Remote string `json:"remote,omitempty"`
+
+	// Requested is the rate asked for if it was clamped to the bounds of the method, see WithRateBoundsMode.
+	Requested *float64 `json:"requested,omitempty"`
+}
+
+// changeSource identifies who made a change.
+type changeSource struct {
+	source string
+	remote string
+}
+
+// apiSource is the source of changes made through the Go API.
+var apiSource = changeSource{source: ChangeSourceAPI}
+
+// httpSource returns the source of changes made by an HTTP request.
+func httpSource(r *http.Request) changeSource {
+	return changeSource{source: ChangeSourceHTTP, remote: r.RemoteAddr}
+}
+
+// grpcSource returns the source of changes made by a gRPC call.
+func grpcSource(ctx context.Context) changeSource {
+	source := changeSource{source: ChangeSourceGRPC}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		source.remote = p.Addr.String()
+	}
+	return source
+}
+
+// changeLog keeps the latest changes in a ring and queues them for the writer, if any. Changes
+// are recorded while the limiter's locks are held, so records only touch memory and the writes
+// happen in flush, which the callers run after releasing them.
+type changeLog struct {
+	mu      sync.Mutex
+	entries []Change
+	next    int
+	full    bool
+	pending []Change
+
+	writeMu sync.Mutex
+	writer  io.Writer
+	logger  Logger
+}
+
+// newChangeLog creates a change log keeping up to size changes and logging write errors to logger.
+func newChangeLog(size int, writer io.Writer, logger Logger) *changeLog {
+	return &changeLog{entries: make([]Change, max(size, 0)), writer: writer, logger: logger}
+}
+
+// record adds a change to the log.
+func (l *changeLog) record(change Change) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.entries) > 0 {
+		l.entries[l.next] = change
+		l.next = (l.next + 1) % len(l.entries)
+		l.full = l.full || l.next == 0
+	}
+	if l.writer != nil {
+		l.pending = append(l.pending, change)
+	}
+}
+
+// list returns the changes in the log, oldest first.
+func (l *changeLog) list() []Change {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.full {
+		return append([]Change{}, l.entries[:l.next]...)
+	}
+	return append(append([]Change{}, l.entries[l.next:]...), l.entries[:l.next]...)
+}
+
+// flush writes the queued changes. It must not be called while holding rl.mutex or metrics.mu.
+func (l *changeLog) flush() {
+	if l.writer == nil {
+		return
+	}
+
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+
+	l.mu.Lock()
+	pending := l.pending
+	l.pending = nil
+	l.mu.Unlock()
+
+	encoder := json.NewEncoder(l.writer)
+	for _, change := range pending {
+		if err := encoder.Encode(change); err != nil {
+			l.logger.Errorf("Failed to write change log: %v", err)
+			return
+		}
+	}
+}
+
+// recordChange records a change of a method's parameter if the value changed.
+func (rl *TopDownRL) recordChange(method, field string, before, after float64, source changeSource) {
+	if before == after {
+		return
+	}
+	rl.changes.record(Change{
+		Time:   rl.clock.Now(),
+		Method: method,
+		Field:  field,
+		Old:    before,
+		New:    after,
+		Source: source.source,
+		Remote: source.remote,
+	})
+}
+
+// recordClampedChange records a change to a value clamped from requested, even if the value stayed the same.
+func (rl *TopDownRL) recordClampedChange(method, field string, before, after, requested float64, source changeSource) {
+	rl.changes.record(Change{
+		Time:      rl.clock.Now(),
+		Method:    method,
+		Field:     field,
+		Old:       before,
+		New:       after,
+		Source:    source.source,
+		Remote:    source.remote,
+		Requested: &requested,
+	})
+}
+
+// Changes returns the latest changes to the rates, bucket capacities and SLOs, oldest first.
+func (rl *TopDownRL) Changes() []Change {
+	return rl.changes.list()
+}
+
+// HandleChanges handles the GET requests listing the latest changes, oldest first, optionally
+// only those of the method given by the 'method' parameter.
+func (rl *TopDownRL) HandleChanges(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleChanges called")
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	changes := rl.Changes()
+	if method := r.URL.Query().Get("method"); method != "" {
+		filtered := changes[:0]
+		for _, change := range changes {
+			if change.Method == method {
+				filtered = append(filtered, change)
+			}
+		}
+		changes = filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
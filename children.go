@@ -0,0 +1,306 @@
+package topdown
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+)
+
+// Child is a downstream service whose rate limits a ChildManager derives from the rates of the
+// parent methods calling it.
+type Child struct {
+	// Name identifies the child in the logs and metrics.
+	Name string
+	// URL is the base URL of the child's control endpoints, e.g. "http://inventory:9090/topdown";
+	// the rates are POSTed as a batch to URL + "/set_rate".
+	URL string
+	// AuthToken, if set, is sent as bearer token, see WithAuthToken.
+	AuthToken string
+	// Calls maps each parent method to the methods of the child it calls.
+	Calls map[string][]string
+}
+
+// ChildStatus is the state of a child reported by ChildManager.Status.
+type ChildStatus struct {
+	Name string
+	// Rates are the rates sent last, keyed by child method; nil before the first interval.
+	Rates map[string]float64
+	// FanOut is the observed number of calls per admitted parent request, keyed by parent method
+	// and child method, for the pairs seen so far.
+	FanOut   map[string]map[string]float64
+	Failures int64
+	// LastError is the error of the last push if it failed.
+	LastError string
+}
+
+// childCall identifies the calls from a parent method to a child method.
+type childCall struct {
+	parent string
+	method string
+}
+
+// childState is the state of a child. mu guards the rates and the last error.
+type childState struct {
+	config   Child
+	pushes   chan struct{}
+	failures atomic.Int64
+
+	mu        sync.Mutex
+	rates     map[string]float64
+	lastError string
+}
+
+// ChildManager propagates the rate limits of a limiter to the downstream services it calls, the
+// core of top-down control across tiers: at the end of every interval, each child method gets the
+// sum over the parent methods calling it of their refill rate times the observed fan-out, the
+// calls to the child method per admitted parent request. Calls are observed by the manager's
+// UnaryClientInterceptor; pairs not observed yet count as one call per request. The rates are
+// POSTed to the children from their own goroutines, retried with exponential backoff, and the
+// failures are reported by Status and /prometheus.
+type ChildManager struct {
+	rl       *TopDownRL
+	children []*childState
+	// calls are the configured pairs, counting the calls of the current interval.
+	calls map[childCall]*atomic.Int64
+	// fanOut is the fan-out observed last per pair, guarded by mu.
+	mu     sync.Mutex
+	fanOut map[childCall]float64
+}
+
+// NewChildManager creates a manager for children, to be installed with WithChildManager.
+func NewChildManager(children ...Child) *ChildManager {
+	m := &ChildManager{calls: make(map[childCall]*atomic.Int64), fanOut: make(map[childCall]float64)}
+	for _, child := range children {
+		m.children = append(m.children, &childState{config: child, pushes: make(chan struct{}, 1)})
+		for parent, methods := range child.Calls {
+			for _, method := range methods {
+				m.calls[childCall{parent: parent, method: method}] = &atomic.Int64{}
+			}
+		}
+	}
+	return m
+}
+
+// WithChildManager propagates the rate limits of the limiter to the children of m. The pushes
+// run along with the metrics collection.
+func WithChildManager(m *ChildManager) Option {
+	return func(rl *TopDownRL) {
+		rl.children = m
+		m.rl = rl
+	}
+}
+
+// validate checks that the children can be reached.
+func (m *ChildManager) validate() error {
+	names := make(map[string]bool, len(m.children))
+	for _, child := range m.children {
+		if child.config.Name == "" {
+			return errors.New("child name must not be empty")
+		}
+		if names[child.config.Name] {
+			return fmt.Errorf("duplicate child '%s'", child.config.Name)
+		}
+		names[child.config.Name] = true
+		if !strings.HasPrefix(child.config.URL, "http://") && !strings.HasPrefix(child.config.URL, "https://") {
+			return fmt.Errorf("child '%s': URL must be http or https, got '%s'", child.config.Name, child.config.URL)
+		}
+	}
+	return nil
+}
+
+// UnaryClientInterceptor counts the calls of the parent's handlers to the child methods, to observe
+// the fan-out. It must be installed on the client connections to the children and called with
+// contexts derived from the incoming requests, so the parent method can be told.
+func (m *ChildManager) UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if parent, ok := grpc.Method(ctx); ok {
+		if calls, configured := m.calls[childCall{parent: m.rl.methodName(ctx, parent), method: method}]; configured {
+			calls.Add(1)
+		}
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// Status returns the state of the children, in the order they were configured.
+func (m *ChildManager) Status() []ChildStatus {
+	m.mu.Lock()
+	fanOut := make(map[childCall]float64, len(m.fanOut))
+	for call, value := range m.fanOut {
+		fanOut[call] = value
+	}
+	m.mu.Unlock()
+
+	statuses := make([]ChildStatus, 0, len(m.children))
+	for _, child := range m.children {
+		status := ChildStatus{Name: child.config.Name, FanOut: make(map[string]map[string]float64), Failures: child.failures.Load()}
+		for parent, methods := range child.config.Calls {
+			for _, method := range methods {
+				value, observed := fanOut[childCall{parent: parent, method: method}]
+				if !observed {
+					continue
+				}
+				if status.FanOut[parent] == nil {
+					status.FanOut[parent] = make(map[string]float64)
+				}
+				status.FanOut[parent][method] = value
+			}
+		}
+		child.mu.Lock()
+		if child.rates != nil {
+			status.Rates = make(map[string]float64, len(child.rates))
+			for method, rate := range child.rates {
+				status.Rates[method] = rate
+			}
+		}
+		status.LastError = child.lastError
+		child.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// propagate computes the rates of the children for the interval that just ended and signals
+// their push goroutines. It runs on the metrics goroutine after the rollover.
+func (m *ChildManager) propagate() {
+	snapshots := m.rl.GetAllMetrics()
+
+	m.mu.Lock()
+	for call, calls := range m.calls {
+		count := calls.Swap(0)
+		parent, exists := snapshots[call.parent]
+		// The fan-out of intervals without admitted requests is unknown, so the last one is kept
+		if !exists || parent.Admitted == 0 {
+			continue
+		}
+		m.fanOut[call] = float64(count) / float64(parent.Admitted)
+	}
+	fanOut := m.fanOut
+	for _, child := range m.children {
+		rates := make(map[string]float64)
+		for parent, methods := range child.config.Calls {
+			snapshot, exists := snapshots[parent]
+			if !exists {
+				continue
+			}
+			for _, method := range methods {
+				factor, observed := fanOut[childCall{parent: parent, method: method}]
+				if !observed {
+					factor = 1
+				}
+				rates[method] += snapshot.RefillRate * factor
+			}
+		}
+
+		child.mu.Lock()
+		child.rates = rates
+		child.mu.Unlock()
+		select {
+		case child.pushes <- struct{}{}:
+		default:
+		}
+	}
+	m.mu.Unlock()
+}
+
+// pushLoop sends the rates of a child whenever propagate signals them, coalescing the signals
+// like the metrics pushes.
+func (m *ChildManager) pushLoop(ctx context.Context, child *childState) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-child.pushes:
+			err := m.push(ctx, child)
+			if ctx.Err() != nil {
+				return
+			}
+			child.mu.Lock()
+			child.lastError = ""
+			if err != nil {
+				child.lastError = err.Error()
+			}
+			child.mu.Unlock()
+			if err != nil {
+				child.failures.Add(1)
+				m.rl.logger.Errorf("Failed to push rate limits to child '%s' at %s: %v", child.config.Name, child.config.URL, err)
+			}
+		}
+	}
+}
+
+// push sends the current rates of a child, retrying with exponential backoff like the metrics pushes.
+func (m *ChildManager) push(ctx context.Context, child *childState) error {
+	child.mu.Lock()
+	body, err := json.Marshal(map[string]map[string]float64{"rates": child.rates})
+	child.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	backoff := pushBackoff
+	for attempt := 0; ; attempt++ {
+		err = m.pushOnce(ctx, child, body)
+		if err == nil || attempt >= m.rl.pushRetries {
+			return err
+		}
+		if m.rl.Debug {
+			m.rl.logger.Debugf("Push of rate limits to child '%s' failed, retrying in %v: %v", child.config.Name, backoff, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-m.rl.clock.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// pushOnce POSTs body to the /set_rate endpoint of a child and logs the methods it rejected.
+func (m *ChildManager) pushOnce(ctx context.Context, child *childState, body []byte) error {
+	url := strings.TrimSuffix(child.config.URL, "/") + "/set_rate"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if child.config.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+child.config.AuthToken)
+	}
+
+	resp, err := m.rl.pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var response RateUpdateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil && err != io.EOF {
+		m.rl.logger.Errorf("Failed to decode response of child '%s': %v", child.config.Name, err)
+		return nil
+	}
+	methods := make([]string, 0, len(response.Results))
+	for method := range response.Results {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		if result := response.Results[method]; !result.OK {
+			m.rl.logger.Errorf("Child '%s' rejected the rate limit for method '%s': %s", child.config.Name, method, result.Error)
+		}
+	}
+	return nil
+}
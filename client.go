@@ -0,0 +1,233 @@
+package topdown
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultMethodKey is the default metadata key carrying the method name used for rate limiting.
+const DefaultMethodKey = "method"
+
+// RetryAfterTrailer is the trailer key carrying the suggested backoff in milliseconds.
+const RetryAfterTrailer = "retry-after-ms"
+
+// ClientOption configures the client interceptors.
+type ClientOption func(*clientConfig)
+
+// clientConfig holds the metadata stamped by the client interceptors.
+type clientConfig struct {
+	methodKey       string
+	timestampKey    string
+	timestampFormat TimestampFormat
+	clock           Clock
+
+	// pacingShare enables pacing to the rate hints under rateKey and tokensKey, see WithClientPacing.
+	pacingShare float64
+	rateKey     string
+	tokensKey   string
+	pacer       *clientPacer
+}
+
+// WithClientMethodKey sets the metadata key carrying the method name. The default is "method".
+func WithClientMethodKey(key string) ClientOption {
+	return func(c *clientConfig) {
+		c.methodKey = key
+	}
+}
+
+// WithClientTimestampKey sets the metadata key carrying the request start time, which must
+// match the key configured on the server with WithTimestampKey.
+func WithClientTimestampKey(key string) ClientOption {
+	return func(c *clientConfig) {
+		c.timestampKey = key
+	}
+}
+
+// WithClientTimestampFormat sets the encoding of the request start time, which must be
+// understood by the format configured on the server with WithTimestampFormat.
+func WithClientTimestampFormat(format TimestampFormat) ClientOption {
+	return func(c *clientConfig) {
+		c.timestampFormat = format
+	}
+}
+
+// WithClientClock sets the clock used to stamp the request start time.
+func WithClientClock(clock Clock) ClientOption {
+	return func(c *clientConfig) {
+		c.clock = clock
+	}
+}
+
+// newClientConfig applies opts over the defaults, which match the server defaults.
+func newClientConfig(opts []ClientOption) *clientConfig {
+	c := &clientConfig{
+		methodKey:    DefaultMethodKey,
+		timestampKey: DefaultTimestampKey,
+		clock:        realClock{},
+		rateKey:      DefaultRateHeader,
+		tokensKey:    DefaultTokensHeader,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.pacer = newClientPacer(c)
+	return c
+}
+
+// RetryAfterError wraps an error returned by a rate limited server together with the backoff
+// the server suggested. Use errors.As to inspect it; status.Code still reports the original code.
+type RetryAfterError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+// Error returns the wrapped error message along with the suggested backoff.
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%v (retry after %v)", e.Err, e.RetryAfter)
+}
+
+// Unwrap returns the wrapped error.
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// GRPCStatus returns the status of the wrapped error, so the error keeps its gRPC code and message.
+func (e *RetryAfterError) GRPCStatus() *status.Status {
+	return status.Convert(e.Err)
+}
+
+// ClientUnaryInterceptor returns a unary client interceptor that stamps the outgoing metadata
+// with the method name and the request start time expected by UnaryInterceptor. Errors carrying
+// a retry hint from the server are returned as a *RetryAfterError. Calls made by the handler of a
+// request admitted by a limiter are timed as its external calls, see StartExternalCall.
+func ClientUnaryInterceptor(opts ...ClientOption) grpc.UnaryClientInterceptor {
+	c := newClientConfig(opts)
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+		if c.pacer != nil {
+			if err := c.pacer.wait(ctx, method); err != nil {
+				return err
+			}
+		}
+		var trailer metadata.MD
+		callOpts = append(callOpts, grpc.Trailer(&trailer))
+		done := StartExternalCall(ctx)
+		err := invoker(c.stamp(ctx, method), method, req, reply, cc, callOpts...)
+		done()
+		if c.pacer != nil {
+			c.pacer.update(method, trailer)
+		}
+		return withRetryAfter(err, trailer)
+	}
+}
+
+// ClientStreamInterceptor returns a stream client interceptor that stamps the outgoing metadata
+// with the method name and the stream start time expected by StreamInterceptor. Errors carrying
+// a retry hint from the server are returned as a *RetryAfterError.
+func ClientStreamInterceptor(opts ...ClientOption) grpc.StreamClientInterceptor {
+	c := newClientConfig(opts)
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if c.pacer != nil {
+			if err := c.pacer.wait(ctx, method); err != nil {
+				return nil, err
+			}
+		}
+		stream, err := streamer(c.stamp(ctx, method), desc, cc, method, callOpts...)
+		if err != nil {
+			return nil, err
+		}
+		return &retryAfterStream{ClientStream: stream, pacer: c.pacer, method: method}, nil
+	}
+}
+
+// stamp adds the method name and the current time to the outgoing metadata of ctx.
+// Values already set by the caller are preserved.
+func (c *clientConfig) stamp(ctx context.Context, method string) context.Context {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+
+	if len(md.Get(c.methodKey)) == 0 {
+		md.Set(c.methodKey, method)
+	}
+	if len(md.Get(c.timestampKey)) == 0 {
+		md.Set(c.timestampKey, formatTimestamp(c.clock.Now(), c.timestampFormat))
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// formatTimestamp encodes t in the given format. RFC3339 timestamps keep their fractional
+// seconds since the server accepts them either way and whole seconds would skew the latency.
+func formatTimestamp(t time.Time, format TimestampFormat) string {
+	switch format {
+	case TimestampUnixSeconds:
+		return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+	case TimestampUnixMillis:
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	case TimestampUnixNanos:
+		return strconv.FormatInt(t.UnixNano(), 10)
+	default:
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+}
+
+// retryAfterStream wraps a grpc.ClientStream to attach the server's retry hint to stream errors
+// and pass the rate hints of the trailer to the pacer, if any.
+type retryAfterStream struct {
+	grpc.ClientStream
+	pacer  *clientPacer
+	method string
+}
+
+// RecvMsg receives the next message. Once the stream ends or fails the trailer is available, so
+// the hints can be read from it.
+func (s *retryAfterStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == nil {
+		return nil
+	}
+	if s.pacer != nil {
+		s.pacer.update(s.method, s.Trailer())
+	}
+	if err == io.EOF {
+		return err
+	}
+	return withRetryAfter(err, s.Trailer())
+}
+
+// withRetryAfter wraps err in a RetryAfterError if its RetryInfo detail or the trailer carries
+// a retry hint. RetryInfo takes precedence since it isn't rounded to milliseconds.
+func withRetryAfter(err error, trailer metadata.MD) error {
+	if err == nil {
+		return nil
+	}
+	if retryAfter, ok := retryInfoDelay(status.Convert(err)); ok {
+		return &RetryAfterError{Err: err, RetryAfter: retryAfter}
+	}
+	if retryAfter, ok := retryAfterFromTrailer(trailer); ok {
+		return &RetryAfterError{Err: err, RetryAfter: retryAfter}
+	}
+	return err
+}
+
+// retryAfterFromTrailer parses the retry hint in milliseconds from the trailer.
+func retryAfterFromTrailer(trailer metadata.MD) (time.Duration, bool) {
+	values := trailer.Get(RetryAfterTrailer)
+	if len(values) == 0 {
+		return 0, false
+	}
+	ms, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil || ms < 0 {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
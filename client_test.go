@@ -0,0 +1,84 @@
+package topdown
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestClientUnaryInterceptorEndToEnd(t *testing.T) {
+	rl := newTestRL(t, map[string]BucketConfig{echoMethod: {MaxTokens: 1, RefillRate: 1}},
+		map[string]time.Duration{echoMethod: time.Second}, WithTimestampFormat(TimestampUnixMillis))
+	incoming := make(chan metadata.MD, 2)
+	handler := func(ctx context.Context) error {
+		md, _ := metadata.FromIncomingContext(ctx)
+		incoming <- md
+		return nil
+	}
+	conn := newTestServer(t, handler, []grpc.ServerOption{grpc.UnaryInterceptor(rl.UnaryInterceptor)},
+		grpc.WithUnaryInterceptor(ClientUnaryInterceptor(WithClientTimestampFormat(TimestampUnixMillis))))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "caller", "kept")
+	before := time.Now()
+	if err := echo(ctx, conn, &structpb.Struct{}); err != nil {
+		t.Fatalf("first call failed: %v", err)
+	}
+	md := <-incoming
+	if got := md.Get(DefaultMethodKey); len(got) != 1 || got[0] != echoMethod {
+		t.Errorf("method metadata = %v, want [%s]", got, echoMethod)
+	}
+	if got := md.Get("caller"); len(got) != 1 || got[0] != "kept" {
+		t.Errorf("caller metadata = %v, want [kept]", got)
+	}
+	values := md.Get(DefaultTimestampKey)
+	if len(values) != 1 {
+		t.Fatalf("timestamp metadata = %v, want one value", values)
+	}
+	if stamped, ok := parseTimestamp(values[0], TimestampUnixMillis); !ok || stamped.Before(before.Truncate(time.Millisecond)) || stamped.After(time.Now()) {
+		t.Errorf("timestamp = %q, want the time of the call in milliseconds", values[0])
+	}
+
+	err := echo(ctx, conn, &structpb.Struct{})
+	if code := status.Code(err); code != codes.ResourceExhausted {
+		t.Fatalf("second call code = %v, want %v", code, codes.ResourceExhausted)
+	}
+	var retryErr *RetryAfterError
+	if !errors.As(err, &retryErr) {
+		t.Fatalf("second call error = %v, want a *RetryAfterError", err)
+	}
+	if retryErr.RetryAfter <= 0 || retryErr.RetryAfter > time.Second {
+		t.Errorf("retry after = %v, want at most the 1s refill of a token", retryErr.RetryAfter)
+	}
+	snapshot, err := rl.GetMetricsSnapshot(echoMethod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.RejectedTotal != 1 {
+		t.Errorf("rejected = %d, want 1", snapshot.RejectedTotal)
+	}
+}
+
+func TestClientUnaryInterceptorPreservesMethodOverride(t *testing.T) {
+	incoming := make(chan metadata.MD, 1)
+	handler := func(ctx context.Context) error {
+		md, _ := metadata.FromIncomingContext(ctx)
+		incoming <- md
+		return nil
+	}
+	conn := newTestServer(t, handler, nil, grpc.WithUnaryInterceptor(ClientUnaryInterceptor(WithClientMethodKey("x-method"))))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-method", "/override")
+	if err := echo(ctx, conn, &structpb.Struct{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := (<-incoming).Get("x-method"); len(got) != 1 || got[0] != "/override" {
+		t.Errorf("method metadata = %v, want the caller's [/override]", got)
+	}
+}
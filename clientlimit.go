@@ -0,0 +1,56 @@
+package topdown
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryClientInterceptor is a unary client interceptor enforcing the limits of rl on outgoing
+// calls, to protect downstream services from the fan-out of this one. Calls are limited and
+// measured per full method name exactly like the requests of UnaryInterceptor: goodput, tail
+// latency and violations count against the SLO of the downstream method, and the rates are
+// adjusted through the same controllers, HTTP endpoints and Go API. Calls are rejected with a
+// ResourceExhausted *RetryAfterError without being sent, or wait for a token up to their deadline
+// if the method has an admission queue, see WithAdmissionQueue. Use a separate TopDownRL for the
+// client side, chained before ClientUnaryInterceptor if the downstream server is limited too.
+// Like ClientUnaryInterceptor, it times the calls as external calls of the incoming request.
+func (rl *TopDownRL) UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if rl.exempt(method) {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	rl.recordArrival(ctx, method)
+	startTime := rl.clock.Now()
+	tier := rl.priorityTier(ctx)
+
+	release, ok := rl.acquireSlot(ctx, method)
+	if !ok {
+		rl.recordConcurrencyRejection(method)
+		rl.rejectHook(ctx, method, RejectConcurrency)
+		return status.Error(codes.ResourceExhausted, "Client concurrency limit exceeded, call not sent")
+	}
+	defer release()
+	switch rl.admit(ctx, method, rl.requestCost(ctx, method, req)) {
+	case abandoned:
+		return status.FromContextError(ctx.Err()).Err()
+	case rejected:
+		rl.recordRejection(method, tier)
+		rl.rejectHook(ctx, method, RejectRateLimit)
+		err, trailer := rl.rejectionError(method, "Client rate limit exceeded, call not sent")
+		return withRetryAfter(err, trailer)
+	}
+	rl.recordAdmission(method)
+	rl.admitHook(ctx, method)
+
+	done := StartExternalCall(ctx)
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	done()
+
+	latency := rl.clock.Now().Sub(startTime)
+	outcome := rl.recordOutcome(ctx, latency, method, tier, err)
+	rl.completionHook(ctx, method, latency, outcome)
+	return err
+}
@@ -0,0 +1,78 @@
+package topdown
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestClientAndServerLimitersEndToEnd(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	client := newTestRL(t, map[string]BucketConfig{echoMethod: {MaxTokens: 2, RefillRate: 0.1}},
+		map[string]time.Duration{echoMethod: time.Second}, WithClock(clock), WithMetricsInterval(time.Hour))
+	server := newTestRL(t, map[string]BucketConfig{echoMethod: {MaxTokens: 10, RefillRate: 0.1}},
+		map[string]time.Duration{echoMethod: time.Second}, WithClock(clock), WithMetricsInterval(time.Hour))
+	conn := newTestServer(t, nil, []grpc.ServerOption{grpc.UnaryInterceptor(server.UnaryInterceptor)},
+		grpc.WithChainUnaryInterceptor(client.UnaryClientInterceptor, ClientUnaryInterceptor()))
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := echo(ctx, conn, &structpb.Struct{}); err != nil {
+			t.Fatalf("call %d failed: %v", i, err)
+		}
+	}
+	err := echo(ctx, conn, &structpb.Struct{})
+	var retryErr *RetryAfterError
+	if status.Code(err) != codes.ResourceExhausted || !errors.As(err, &retryErr) {
+		t.Fatalf("third call error = %v, want a ResourceExhausted *RetryAfterError", err)
+	}
+
+	// The rejected call was never sent, and both sides measured the calls they saw
+	client.rollover(client.loadMetrics(echoMethod), clock.Now())
+	server.rollover(server.loadMetrics(echoMethod), clock.Now())
+	tests := []struct {
+		name                      string
+		rl                        *TopDownRL
+		arrivals, goodput, reject int64
+	}{
+		{"client", client, 3, 2, 1},
+		{"server", server, 2, 2, 0},
+	}
+	for _, tt := range tests {
+		snapshot, err := tt.rl.GetMetricsSnapshot(echoMethod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if snapshot.ArrivalsTotal != tt.arrivals || snapshot.Goodput != tt.goodput || snapshot.RejectedTotal != tt.reject {
+			t.Errorf("%s arrivals = %d, goodput = %d, rejected = %d, want %d, %d and %d", tt.name,
+				snapshot.ArrivalsTotal, snapshot.Goodput, snapshot.RejectedTotal, tt.arrivals, tt.goodput, tt.reject)
+		}
+	}
+}
+
+func TestClientLimiterWaitsForToken(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	client := newTestRL(t, map[string]BucketConfig{echoMethod: {MaxTokens: 1, RefillRate: 1, MaxQueueWait: 5 * time.Second}},
+		map[string]time.Duration{echoMethod: time.Second}, WithClock(clock), WithMetricsInterval(time.Hour))
+	conn := newTestServer(t, nil, nil, grpc.WithUnaryInterceptor(client.UnaryClientInterceptor))
+	ctx := context.Background()
+
+	if err := echo(ctx, conn, &structpb.Struct{}); err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan error)
+	go func() { result <- echo(ctx, conn, &structpb.Struct{}) }()
+
+	// The queued call waits on its expiry and on the refill of the next token
+	waitUntil(t, func() bool { return clock.Timers() == 2 })
+	clock.Advance(time.Second)
+	if err := <-result; err != nil {
+		t.Errorf("queued call failed: %v, want it sent once the token refilled", err)
+	}
+}
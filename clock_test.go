@@ -0,0 +1,71 @@
+package topdown
+
+import (
+	"testing"
+	"time"
+)
+
+// waitUntil polls cond until it holds, failing the test after a few seconds. It synchronizes with
+// goroutines blocking on a FakeClock, e.g. until they created their timers.
+func waitUntil(t testing.TB, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFakeClockTimer(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewFakeClock(start)
+	timer := clock.NewTimer(time.Second)
+
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired early")
+	default:
+	}
+	if got := clock.Timers(); got != 1 {
+		t.Errorf("Timers() = %d, want 1", got)
+	}
+
+	clock.Advance(time.Millisecond)
+	select {
+	case fired := <-timer.C():
+		if want := start.Add(time.Second); !fired.Equal(want) {
+			t.Errorf("timer fired at %v, want %v", fired, want)
+		}
+	default:
+		t.Fatal("timer didn't fire")
+	}
+	if timer.Stop() {
+		t.Error("Stop() = true after the timer fired")
+	}
+	if got := clock.Timers(); got != 0 {
+		t.Errorf("Timers() = %d after firing, want 0", got)
+	}
+}
+
+func TestFakeClockTimerStop(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	timer := clock.NewTimer(time.Second)
+	if !timer.Stop() {
+		t.Error("Stop() = false before the timer fired")
+	}
+	clock.Advance(time.Hour)
+	select {
+	case <-timer.C():
+		t.Error("stopped timer fired")
+	default:
+	}
+
+	select {
+	case <-clock.After(0):
+	default:
+		t.Error("After(0) didn't fire at once")
+	}
+}
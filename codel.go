@@ -0,0 +1,130 @@
+package topdown
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// CoDelConfig holds the parameters of latency-based shedding, which governs admission by the tail
+// latency instead of the limiter. Once the tail latency has been above the target for a full
+// interval, the method sheds a fraction of its requests that grows with the square root of the
+// number of intervals spent above the target, like the CoDel control law; every interval below
+// the target steps the fraction back down.
+type CoDelConfig struct {
+	// Target is the tail latency to keep; zero means the method's SLO.
+	Target time.Duration
+	// Step scales the drop probability, which is Step * sqrt(count) after count intervals above target.
+	Step float64
+	// MaxDrop bounds the drop probability so some requests always measure the latency.
+	MaxDrop float64
+}
+
+// DefaultCoDelConfig returns the default parameters of latency-based shedding.
+func DefaultCoDelConfig() CoDelConfig {
+	return CoDelConfig{Step: 0.1, MaxDrop: 0.95}
+}
+
+// WithCoDel enables latency-based shedding for methods without a bucket configuration, see BucketConfig.CoDel.
+func WithCoDel(config CoDelConfig) Option {
+	return func(rl *TopDownRL) {
+		rl.defaultBucket.CoDel = &config
+	}
+}
+
+// validate checks that the shedding parameters are usable.
+func (c CoDelConfig) validate() error {
+	if c.Target < 0 {
+		return fmt.Errorf("target must not be negative, got %v", c.Target)
+	}
+	if !(c.Step > 0 && c.Step <= 1) {
+		return fmt.Errorf("step must be in (0, 1], got %g", c.Step)
+	}
+	if !(c.MaxDrop > 0 && c.MaxDrop < 1) {
+		return fmt.Errorf("max drop must be in (0, 1), got %g", c.MaxDrop)
+	}
+	return nil
+}
+
+// CoDelState is the state of latency-based shedding for a single method.
+type CoDelState struct {
+	// Dropping reports whether the tail latency has been above the target for longer than an interval.
+	Dropping bool `json:"dropping"`
+	// Count is the number of steps of the drop schedule.
+	Count           int     `json:"count"`
+	DropProbability float64 `json:"drop_probability"`
+}
+
+// codel sheds the requests of a method based on its tail latency. The schedule is advanced by the
+// metrics goroutine under InterfaceMetrics.mu; admission only reads the atomic drop probability.
+type codel struct {
+	config CoDelConfig
+
+	aboveSince time.Time
+	state      CoDelState
+
+	dropProbability atomic.Uint64 // math.Float64bits
+	seen            atomic.Uint64
+}
+
+// newCoDel creates the shedder of a method, or returns nil if it's disabled.
+func newCoDel(config *CoDelConfig) *codel {
+	if config == nil {
+		return nil
+	}
+	return &codel{config: *config}
+}
+
+// admit reports whether a request may proceed. Drops are spread evenly over the requests rather
+// than drawn at random, so the shed fraction matches the drop probability in every interval.
+func (c *codel) admit() bool {
+	p := math.Float64frombits(c.dropProbability.Load())
+	if p <= 0 {
+		return true
+	}
+	n := float64(c.seen.Add(1))
+	return math.Floor(n*p) == math.Floor((n-1)*p)
+}
+
+// update advances the schedule after an interval with the given tail latency at now. Empty
+// intervals count as below the target. The caller must hold the method's metrics.mu.
+func (c *codel) update(tailLatency, slo time.Duration, empty bool, now time.Time) {
+	target := c.config.Target
+	if target == 0 {
+		target = slo
+	}
+
+	if empty || tailLatency <= target {
+		c.aboveSince = time.Time{}
+		c.state.Dropping = false
+		if c.state.Count > 0 {
+			c.state.Count--
+		}
+	} else if c.aboveSince.IsZero() {
+		// Dropping only starts once the latency stayed above the target for a full interval
+		c.aboveSince = now
+	} else {
+		c.state.Dropping = true
+		c.state.Count++
+	}
+
+	p := c.config.Step * math.Sqrt(float64(c.state.Count))
+	if p > c.config.MaxDrop {
+		p = c.config.MaxDrop
+		// The schedule doesn't climb past the bound, so it steps down right away once the latency recovers
+		c.state.Count = int(math.Ceil(math.Pow(c.config.MaxDrop/c.config.Step, 2)))
+	}
+	c.state.DropProbability = p
+	c.dropProbability.Store(math.Float64bits(p))
+}
+
+// codelStateLocked returns a copy of the shedding state of a method, or nil if it's disabled.
+// The caller must hold metrics.mu.
+func codelStateLocked(metrics *InterfaceMetrics) *CoDelState {
+	if metrics.codel == nil {
+		return nil
+	}
+	state := metrics.codel.state
+	return &state
+}
@@ -0,0 +1,83 @@
+package topdown
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCoDelDropsAfterIntervalAboveTarget(t *testing.T) {
+	const target = 50 * time.Millisecond
+	clock := NewFakeClock(time.Unix(1000, 0))
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 100, RefillRate: 100,
+		CoDel: &CoDelConfig{Target: target, Step: 0.5, MaxDrop: 0.9}}},
+		map[string]time.Duration{"/a": time.Second}, WithClock(clock), WithMetricsInterval(time.Hour))
+	metrics := rl.loadMetrics("/a")
+	ctx := context.Background()
+
+	// interval offers 10 requests completing with latency, rolls the interval over and returns
+	// how many were admitted
+	interval := func(latency time.Duration) int {
+		admitted := 0
+		for i := 0; i < 10; i++ {
+			if rl.AllowN(ctx, "/a", 1) {
+				admitted++
+				rl.postProcess(latency, "/a", -1, 0, settlement{})
+			}
+		}
+		clock.Advance(time.Second)
+		rl.rollover(metrics, clock.Now())
+		return admitted
+	}
+	state := func() CoDelState {
+		t.Helper()
+		snapshot, err := rl.GetMetricsSnapshot("/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if snapshot.CoDel == nil {
+			t.Fatal("no CoDel state in the snapshot")
+		}
+		return *snapshot.CoDel
+	}
+
+	if got := interval(10 * time.Millisecond); got != 10 {
+		t.Fatalf("admitted %d of 10 requests below the target, want all", got)
+	}
+	// The first interval above the target only starts the clock
+	if got := interval(2 * target); got != 10 {
+		t.Fatalf("admitted %d of 10 requests in the first interval above the target, want all", got)
+	}
+	if s := state(); s.Dropping || s.DropProbability != 0 {
+		t.Errorf("state after one interval above the target = %+v, want no drops yet", s)
+	}
+
+	// After a full interval above the target it drops Step * sqrt(count) of the requests
+	if got := interval(2 * target); got != 10 {
+		t.Fatalf("admitted %d of 10 requests before dropping started, want all", got)
+	}
+	if s := state(); !s.Dropping || s.Count != 1 || s.DropProbability != 0.5 {
+		t.Errorf("state after two intervals above the target = %+v, want dropping half of the requests", s)
+	}
+	if got := interval(2 * target); got != 5 {
+		t.Errorf("admitted %d of 10 requests while dropping half, want 5", got)
+	}
+	if s := state(); s.Count != 2 {
+		t.Errorf("count = %d after three intervals above the target, want 2", s.Count)
+	}
+
+	// Once the queue delay drops the schedule steps back down until it stops dropping
+	if admitted := interval(10 * time.Millisecond); admitted >= 10 {
+		t.Errorf("admitted %d of 10 requests right after the latency recovered, want drops at sqrt(2) * 0.5", admitted)
+	}
+	if s := state(); s.Dropping || s.Count != 1 {
+		t.Errorf("state after recovering = %+v, want count 1 and not dropping", s)
+	}
+	interval(10 * time.Millisecond)
+	if s := state(); s.Count != 0 || s.DropProbability != 0 {
+		t.Errorf("state after two intervals below the target = %+v, want no drops", s)
+	}
+	if got := interval(10 * time.Millisecond); got != 10 {
+		t.Errorf("admitted %d of 10 requests once dropping stopped, want all", got)
+	}
+}
@@ -0,0 +1,216 @@
+package topdown
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WithConcurrencyWait lets requests arriving while their method is at its concurrency limit wait
+// up to d, bounded by their deadline, for another request to complete instead of being rejected
+// immediately. Waiting requests are served in arrival order.
+func WithConcurrencyWait(d time.Duration) Option {
+	return func(rl *TopDownRL) {
+		rl.concurrencyWait = d
+	}
+}
+
+// concurrencyLimiter counts the in-flight requests of a method and bounds them by limit;
+// a limit of zero or less means no bound.
+type concurrencyLimiter struct {
+	mu       sync.Mutex
+	limit    int64
+	inFlight int64
+	// waiters are the requests waiting for a slot in arrival order. A slot is handed to a waiter
+	// by closing its channel, with inFlight already accounting for it.
+	waiters []chan struct{}
+	clock   Clock
+}
+
+// newConcurrencyLimiter creates a limiter without requests in flight, whose waits follow clock.
+func newConcurrencyLimiter(limit int64, clock Clock) *concurrencyLimiter {
+	return &concurrencyLimiter{limit: limit, clock: clock}
+}
+
+// tryAcquireLocked takes a slot if one is free. The caller must hold c.mu.
+func (c *concurrencyLimiter) tryAcquireLocked() bool {
+	if c.limit > 0 && (c.inFlight >= c.limit || len(c.waiters) > 0) {
+		return false
+	}
+	c.inFlight++
+	return true
+}
+
+// acquire takes a slot, waiting up to wait for one to be released. It returns false if no slot
+// became free in time or ctx was done first.
+func (c *concurrencyLimiter) acquire(ctx context.Context, wait time.Duration) bool {
+	c.mu.Lock()
+	if c.tryAcquireLocked() {
+		c.mu.Unlock()
+		return true
+	}
+	if wait <= 0 {
+		c.mu.Unlock()
+		return false
+	}
+	granted := make(chan struct{})
+	c.waiters = append(c.waiters, granted)
+	c.mu.Unlock()
+
+	timer := c.clock.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-granted:
+		return true
+	case <-timer.C():
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, waiter := range c.waiters {
+		if waiter == granted {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return false
+		}
+	}
+	// The slot was handed over while giving up, so it's ours
+	return true
+}
+
+// release returns a slot, handing it to the longest waiting request if the limit allows.
+func (c *concurrencyLimiter) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.waiters) > 0 && (c.limit <= 0 || c.inFlight <= c.limit) {
+		close(c.waiters[0])
+		c.waiters = c.waiters[1:]
+		return
+	}
+	c.inFlight--
+}
+
+// setLimit changes the limit. Requests in flight above a lowered limit complete normally;
+// waiting requests are admitted right away if the limit was raised.
+func (c *concurrencyLimiter) setLimit(limit int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.limit = limit
+	for len(c.waiters) > 0 && (c.limit <= 0 || c.inFlight < c.limit) {
+		close(c.waiters[0])
+		c.waiters = c.waiters[1:]
+		c.inFlight++
+	}
+}
+
+// current returns the number of requests in flight.
+func (c *concurrencyLimiter) current() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inFlight
+}
+
+// acquireSlot takes a concurrency slot for a request to methodName. It returns the function
+// releasing the slot, or false if the method is at its concurrency limit. Concurrency limits
+// are enforced in shadow mode as well, since shadow mode only concerns the token bucket.
+func (rl *TopDownRL) acquireSlot(ctx context.Context, methodName string) (func(), bool) {
+	metrics := rl.loadMetrics(methodName)
+	if metrics == nil {
+		// Unregistered methods bypass rate limiting
+		return func() {}, true
+	}
+
+	wait := rl.concurrencyWait
+	if deadline, ok := ctx.Deadline(); ok && wait > 0 {
+		if remaining := deadline.Sub(rl.clock.Now()); remaining < wait {
+			wait = remaining
+		}
+	}
+	if !metrics.concurrency.acquire(ctx, wait) {
+		return nil, false
+	}
+	return metrics.concurrency.release, true
+}
+
+// recordConcurrencyRejection counts a request rejected because its method was at the concurrency limit.
+func (rl *TopDownRL) recordConcurrencyRejection(methodName string) {
+	metrics := rl.loadMetrics(methodName)
+	if metrics == nil {
+		return
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	metrics.ConcurrencyRejectedCounter++
+	metrics.ConcurrencyRejectedTotal++
+}
+
+// SetMaxConcurrent sets the maximum number of in-flight requests of a method; zero removes the limit.
+func (rl *TopDownRL) SetMaxConcurrent(method string, maxConcurrent int64) error {
+	if maxConcurrent < 0 {
+		return fmt.Errorf("max concurrent must not be negative, got %d", maxConcurrent)
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	// The members of method groups share the limits of their group
+	method = rl.methodGroupOf(method)
+	metrics, exists := rl.interfaces[method]
+	if !exists {
+		return fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	metrics.concurrency.setLimit(maxConcurrent)
+	metrics.MaxConcurrent = maxConcurrent
+	if rl.Debug {
+		rl.logger.Debugf("Set new concurrency limit for method '%s': %d", method, maxConcurrent)
+	}
+	return nil
+}
+
+// HandleSetConcurrency handles the POST requests to update the concurrency limit of the method
+// given by the 'method' parameter with a body of {"max_concurrent": <int>}.
+func (rl *TopDownRL) HandleSetConcurrency(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleSetConcurrency called")
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	method := r.URL.Query().Get("method")
+	if method == "" {
+		writeError(w, "Missing 'method' parameter", http.StatusBadRequest)
+		return
+	}
+
+	var data struct {
+		MaxConcurrent *int64 `json:"max_concurrent"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.MaxConcurrent == nil {
+		writeError(w, "Failed to decode request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := rl.SetMaxConcurrent(method, *data.MaxConcurrent); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrUnknownMethod) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
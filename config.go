@@ -0,0 +1,278 @@
+package topdown
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// DefaultMetricsInterval is the default length of the interval over which metrics are aggregated.
+const DefaultMetricsInterval = time.Second
+
+// WithMetricsInterval sets the length of the interval over which goodput, rejections and tail
+// latencies are aggregated. It should match the polling period of the learning agent, and must
+// be positive.
+func WithMetricsInterval(d time.Duration) Option {
+	return func(rl *TopDownRL) {
+		rl.metricsInterval = d
+	}
+}
+
+// validateMetricsInterval checks that a metrics interval is positive.
+func validateMetricsInterval(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("metrics interval must be positive, got %v", d)
+	}
+	return nil
+}
+
+// WithAlignedTicks aligns the interval boundaries to multiples of the interval on the wall clock,
+// e.g. every 5s interval starts at :00, :05, ..., so that replicas report comparable windows.
+// The first interval is cut short to reach the first boundary.
+func WithAlignedTicks(enabled bool) Option {
+	return func(rl *TopDownRL) {
+		rl.alignedTicks = enabled
+	}
+}
+
+// MetricsInterval returns the length of the metrics aggregation interval.
+func (rl *TopDownRL) MetricsInterval() time.Duration {
+	rl.lifecycleMutex.Lock()
+	defer rl.lifecycleMutex.Unlock()
+
+	return rl.metricsInterval
+}
+
+// SetMetricsInterval changes the length of the metrics aggregation interval. If metrics
+// collection is running it's restarted with the new interval; the counts of the interval in
+// progress carry over to the first new interval.
+func (rl *TopDownRL) SetMetricsInterval(d time.Duration) error {
+	if err := validateMetricsInterval(d); err != nil {
+		return err
+	}
+
+	rl.lifecycleMutex.Lock()
+	defer rl.lifecycleMutex.Unlock()
+
+	rl.metricsInterval = d
+	if rl.stopMetrics != nil {
+		// The goroutine only ever blocks on its ticker, so it stops promptly
+		if err := rl.stopMetricsLocked(context.Background()); err != nil {
+			return err
+		}
+		rl.startMetricsLocked()
+	}
+	if rl.Debug {
+		rl.logger.Debugf("Set new metrics interval: %v", d)
+	}
+	return nil
+}
+
+// Config is the effective configuration of the limiter, see TopDownRL.Config.
+type Config struct {
+	Interval     time.Duration
+	AlignedTicks bool
+	// ShadowMode is the global shadow mode switch; methods may be in shadow mode on their own.
+	ShadowMode     bool
+	ControllerMode ControllerMode
+	// MinRate, MaxRate and RateBounds are the default rate bounds and what happens to rates
+	// outside the bounds, see WithRateBounds.
+	MinRate      float64
+	MaxRate      float64
+	RateBounds   RateBoundsMode
+	RampDuration time.Duration
+	RampMode     RampMode
+	// ScheduleLocation is the time zone of the rate schedules, see WithScheduleLocation.
+	ScheduleLocation *time.Location
+	// Percentiles are the default tail latency percentiles.
+	Percentiles []float64
+	Exemptions  []string
+	// Warmup is the warm-up set with WithWarmup and WarmupRemaining the time left of it, zero
+	// once enforcement began.
+	Warmup          time.Duration
+	WarmupRamp      bool
+	WarmupRemaining time.Duration
+	// Methods holds the registered methods keyed by name, and SLOPatterns the SLOs configured
+	// for patterns.
+	Methods     map[string]MethodConfig
+	SLOPatterns map[string]time.Duration
+}
+
+// Config returns a copy of the effective configuration of the limiter, taken in one critical
+// section so it reflects a single point in time.
+func (rl *TopDownRL) Config() Config {
+	rl.lifecycleMutex.Lock()
+	defer rl.lifecycleMutex.Unlock()
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	config := Config{
+		Interval:       rl.metricsInterval,
+		AlignedTicks:   rl.alignedTicks,
+		ShadowMode:     rl.shadowMode.Load(),
+		ControllerMode: rl.ControllerMode(),
+		MinRate:        rl.defaultMinRate,
+		MaxRate:        rl.defaultMaxRate,
+		RateBounds:     rl.rateBoundsMode,
+		RampDuration:   rl.rampDuration,
+		RampMode:       rl.rampMode,
+		Percentiles:    append([]float64(nil), rl.percentiles...),
+		Exemptions:     rl.Exemptions(),
+		Methods:        rl.methodsLocked(),
+		SLOPatterns:    make(map[string]time.Duration),
+
+		ScheduleLocation: rl.scheduleLocation,
+
+		Warmup:          rl.warmup,
+		WarmupRamp:      rl.warmupRamp,
+		WarmupRemaining: rl.warmupRemaining(rl.clock.Now()),
+	}
+	if rules := rl.sloRules.Load(); rules != nil {
+		for _, rule := range *rules {
+			config.SLOPatterns[rule.pattern] = rule.slo
+		}
+	}
+	return config
+}
+
+// configMethodResponse is the JSON shape of a method in the configuration served by HandleConfig.
+type configMethodResponse struct {
+	Method        string    `json:"method"`
+	SLO           string    `json:"slo"`
+	MaxTokens     int64     `json:"max_tokens"`
+	RefillRate    float64   `json:"refill_rate"`
+	MinRefillRate float64   `json:"min_refill_rate"`
+	MaxRefillRate float64   `json:"max_refill_rate"`
+	MaxConcurrent int64     `json:"max_concurrent"`
+	Cost          int64     `json:"cost"`
+	Percentiles   []float64 `json:"percentiles"`
+	ShadowMode    bool      `json:"shadow_mode"`
+	Pattern       string    `json:"pattern,omitempty"`
+	BucketPattern string    `json:"bucket_pattern,omitempty"`
+	// Schedule is the rate schedule of the method, with its active entry, if any.
+	Schedule *scheduleResponse `json:"schedule,omitempty"`
+}
+
+// configResponse is the JSON shape of the configuration served by HandleConfig.
+type configResponse struct {
+	IntervalMs   float64 `json:"interval_ms"`
+	AlignedTicks bool    `json:"aligned_ticks"`
+	// MinRate and MaxRate are the default rate bounds, see WithRateBounds.
+	MinRate    float64 `json:"min_rate"`
+	MaxRate    float64 `json:"max_rate"`
+	RateBounds string  `json:"rate_bounds"`
+	// RampMs and RampMode configure the rate ramps, see WithRateRamp.
+	RampMs   float64 `json:"ramp_ms"`
+	RampMode string  `json:"ramp_mode"`
+	// ScheduleLocation is the time zone of the rate schedules, see WithScheduleLocation.
+	ScheduleLocation string `json:"schedule_location"`
+	// ConfigFile is the status of the configuration file, see LoadConfig.
+	ConfigFile *configFileStatus `json:"config_file,omitempty"`
+	// WarmupMs and WarmupRemainingMs are the warm-up and the time left of it, see WithWarmup.
+	WarmupMs          float64 `json:"warmup_ms"`
+	WarmupRamp        bool    `json:"warmup_ramp"`
+	WarmupRemainingMs float64 `json:"warmup_remaining_ms"`
+
+	Interval    string                 `json:"interval"`
+	Ramp        string                 `json:"ramp"`
+	ShadowMode  bool                   `json:"shadow_mode"`
+	Controller  string                 `json:"controller"`
+	Percentiles []float64              `json:"percentiles"`
+	Exemptions  []string               `json:"exemptions"`
+	Methods     []configMethodResponse `json:"methods"`
+	SLOPatterns map[string]string      `json:"slo_patterns"`
+}
+
+// newConfigResponse converts a configuration into its JSON shape, with durations as strings
+// like "150ms" and the methods sorted by name.
+func newConfigResponse(config Config) configResponse {
+	response := configResponse{
+		IntervalMs:   durationMs(config.Interval),
+		AlignedTicks: config.AlignedTicks,
+		MinRate:      config.MinRate,
+		MaxRate:      config.MaxRate,
+		RateBounds:   config.RateBounds.String(),
+		RampMs:       durationMs(config.RampDuration),
+		RampMode:     config.RampMode.String(),
+
+		ScheduleLocation: config.ScheduleLocation.String(),
+
+		WarmupMs:          durationMs(config.Warmup),
+		WarmupRamp:        config.WarmupRamp,
+		WarmupRemainingMs: durationMs(config.WarmupRemaining),
+
+		Interval:    config.Interval.String(),
+		Ramp:        config.RampDuration.String(),
+		ShadowMode:  config.ShadowMode,
+		Controller:  config.ControllerMode.String(),
+		Percentiles: config.Percentiles,
+		Exemptions:  config.Exemptions,
+		Methods:     make([]configMethodResponse, 0, len(config.Methods)),
+		SLOPatterns: make(map[string]string, len(config.SLOPatterns)),
+	}
+	for methodName, method := range config.Methods {
+		response.Methods = append(response.Methods, configMethodResponse{
+			Method:        methodName,
+			SLO:           method.SLO.String(),
+			MaxTokens:     method.MaxTokens,
+			RefillRate:    method.RefillRate,
+			MinRefillRate: method.MinRefillRate,
+			MaxRefillRate: method.MaxRefillRate,
+			MaxConcurrent: method.MaxConcurrent,
+			Cost:          method.Cost,
+			Percentiles:   method.Percentiles,
+			ShadowMode:    method.ShadowMode,
+			Pattern:       method.Pattern,
+			BucketPattern: method.BucketPattern,
+			Schedule:      newScheduleResponse(method.Schedule),
+		})
+	}
+	sort.Slice(response.Methods, func(i, j int) bool { return response.Methods[i].Method < response.Methods[j].Method })
+	for pattern, slo := range config.SLOPatterns {
+		response.SLOPatterns[pattern] = slo.String()
+	}
+	return response
+}
+
+// HandleConfig handles the GET requests to return the effective configuration and the POST requests
+// to update it with a body of {"interval": "5s"} or {"interval": <milliseconds>}.
+func (rl *TopDownRL) HandleConfig(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleConfig called")
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var data struct {
+			Interval json.RawMessage `json:"interval"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Interval == nil {
+			writeError(w, "Failed to decode request body", http.StatusBadRequest)
+			return
+		}
+		interval, err := parseDuration(data.Interval)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := rl.SetMetricsInterval(interval); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := newConfigResponse(rl.Config())
+	rl.configFile.mu.Lock()
+	response.ConfigFile = rl.configFileStatusLocked()
+	rl.configFile.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
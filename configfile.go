@@ -0,0 +1,460 @@
+package topdown
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A configuration file maps methods and patterns to their parameters as JSON, e.g.
+//
+//	{"methods": {
+//		"/inventory.Service/GetItem": {"slo": "150ms", "max_tokens": 20, "refill_rate": 200},
+//		"/inventory.Service/*": {"slo": 300, "refill_rate": 100},
+//		"/grpc.health.v1.Health/*": {"exempt": true}
+//	},
+//	"alerts": [
+//		{"name": "violations", "method": "*", "metric": "slo_violation_ratio", "threshold": 0.05, "sustain": 3, "cooldown": "5m"}
+//	]}
+//
+// where "slo" and "cooldown" are duration strings or milliseconds. Omitted parameters keep their
+// current value, or take the default bucket when the entry registers the method. The alert rules
+// replace those of the previous load, see AlertRule.
+
+// fileMethodEntry is the entry of a method or pattern in a configuration file.
+type fileMethodEntry struct {
+	SLO        json.RawMessage `json:"slo"`
+	MaxTokens  *int64          `json:"max_tokens"`
+	RefillRate *float64        `json:"refill_rate"`
+	Exempt     bool            `json:"exempt"`
+}
+
+// fileAlertEntry is an alert rule in a configuration file.
+type fileAlertEntry struct {
+	Name      string          `json:"name"`
+	Method    string          `json:"method"`
+	Metric    AlertMetric     `json:"metric"`
+	Threshold float64         `json:"threshold"`
+	Sustain   int             `json:"sustain"`
+	Cooldown  json.RawMessage `json:"cooldown"`
+}
+
+// fileMethodConfig is a validated entry of a configuration file; zero values are omitted ones.
+type fileMethodConfig struct {
+	slo        time.Duration
+	maxTokens  int64
+	refillRate *float64
+	exempt     bool
+	// registered is set if applying the entry registered the method, so that removing the entry
+	// unregisters it again.
+	registered bool
+}
+
+// configFile is the state of the configuration file loaded through LoadConfig. mu serializes
+// the loads and guards the fields.
+type configFile struct {
+	mu        sync.Mutex
+	path      string
+	methods   map[string]fileMethodConfig
+	loadedAt  time.Time
+	loads     int64
+	lastError string
+}
+
+// configFileStatus is the JSON shape of the configuration file status served by HandleConfig.
+type configFileStatus struct {
+	Path     string    `json:"path"`
+	LoadedAt time.Time `json:"loaded_at"`
+	Loads    int64     `json:"loads"`
+	Errors   int64     `json:"errors"`
+	// Error is the error of the last load, if it failed and the previous configuration still applies.
+	Error string `json:"error,omitempty"`
+}
+
+// parseConfigFile reads and validates a configuration file.
+func parseConfigFile(path string) (map[string]fileMethodConfig, []AlertRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var file struct {
+		Methods map[string]fileMethodEntry `json:"methods"`
+		Alerts  []fileAlertEntry           `json:"alerts"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse '%s': %w", path, err)
+	}
+
+	var alerts []AlertRule
+	for _, entry := range file.Alerts {
+		rule := AlertRule{Name: entry.Name, Method: entry.Method, Metric: entry.Metric, Threshold: entry.Threshold, Sustain: entry.Sustain}
+		if entry.Cooldown != nil {
+			cooldown, err := parseDuration(entry.Cooldown)
+			if err != nil {
+				return nil, nil, fmt.Errorf("alert rule '%s': %w", entry.Name, err)
+			}
+			rule.Cooldown = cooldown
+		}
+		alerts = append(alerts, rule)
+	}
+	if err := validateAlertRules(alerts); err != nil {
+		return nil, nil, err
+	}
+
+	methods := make(map[string]fileMethodConfig, len(file.Methods))
+	for name, entry := range file.Methods {
+		if name == "" {
+			return nil, nil, errors.New("method name must not be empty")
+		}
+		config := fileMethodConfig{exempt: entry.Exempt, refillRate: entry.RefillRate}
+		if entry.SLO != nil {
+			slo, err := parseDuration(entry.SLO)
+			if err != nil {
+				return nil, nil, fmt.Errorf("method '%s': %w", name, err)
+			}
+			if slo <= 0 {
+				return nil, nil, fmt.Errorf("method '%s': SLO must be positive, got %v", name, slo)
+			}
+			config.slo = slo
+		}
+		if entry.MaxTokens != nil {
+			if *entry.MaxTokens <= 0 {
+				return nil, nil, fmt.Errorf("method '%s': max tokens must be positive, got %d", name, *entry.MaxTokens)
+			}
+			config.maxTokens = *entry.MaxTokens
+		}
+		if entry.RefillRate != nil {
+			if err := validateRate(*entry.RefillRate); err != nil {
+				return nil, nil, fmt.Errorf("method '%s': %w", name, err)
+			}
+		}
+		methods[name] = config
+	}
+	return methods, alerts, nil
+}
+
+// LoadConfig applies the configuration file at path: the methods and patterns it lists are
+// registered or updated through the same validated paths as the control API, and those a previous
+// load registered but the file no longer lists are unregistered. Only the parameters that changed
+// since the previous load are applied, so reloading an unchanged file keeps the rates set since.
+// Its alert rules replace those of the previous load, next to the rules set from Go.
+// The file is validated as a whole before any change, including the rates against the bounds and
+// the controller mode, and applied while holding the limiter's lock, so requests never observe
+// half of it. If the file can't be read or is invalid, the running configuration is kept and the
+// error is reported by /config and ConfigErrors. Updates that still fail once applying are
+// reported the same way, and retried on the next load while the rest of the file applies.
+func (rl *TopDownRL) LoadConfig(path string) error {
+	rl.configFile.mu.Lock()
+	defer rl.configFile.mu.Unlock()
+
+	rl.configLoaded.Store(true)
+	methods, alerts, err := parseConfigFile(path)
+	if err == nil {
+		err = rl.alerts.checkFileRules(alerts)
+	}
+	applied := false
+	if err == nil {
+		applied, err = rl.applyConfigFile(path, methods)
+	}
+	if applied {
+		if rulesErr := rl.alerts.setFileRules(alerts); rulesErr != nil {
+			err = errors.Join(err, rulesErr)
+		}
+		rl.configFile.path = path
+		rl.configFile.loadedAt = rl.clock.Now()
+		rl.configFile.loads++
+	}
+	if err != nil {
+		rl.configErrors.Add(1)
+		rl.configFile.lastError = err.Error()
+		if applied {
+			rl.logger.Errorf("Loaded config file '%s' with errors, retrying the failed updates on the next load: %v", path, err)
+		} else {
+			rl.logger.Errorf("Failed to load config file '%s', keeping the current configuration: %v", path, err)
+		}
+		return err
+	}
+	rl.configFile.lastError = ""
+	if rl.Debug {
+		rl.logger.Debugf("Loaded config file '%s' with %d methods", path, len(methods))
+	}
+	return nil
+}
+
+// ConfigErrors returns the number of configuration file loads that failed.
+func (rl *TopDownRL) ConfigErrors() int64 {
+	return rl.configErrors.Load()
+}
+
+// applyConfigFile applies a validated configuration read from path against the one loaded
+// before. It reports whether it applied, or failed before changing anything, and returns the
+// errors of the updates that failed. The caller must hold rl.configFile.mu.
+func (rl *TopDownRL) applyConfigFile(path string, methods map[string]fileMethodConfig) (bool, error) {
+	defer rl.changes.flush()
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	// Entries registering a method need an SLO and a valid bucket, and the updates of registered
+	// ones must be accepted, which are checked before changing anything
+	for name, config := range methods {
+		if rl.configuredLocked(name) {
+			if err := rl.checkConfigEntryLocked(name, config, rl.configFile.methods[name]); err != nil {
+				return false, err
+			}
+			continue
+		}
+		if config.slo == 0 {
+			if config.exempt {
+				continue
+			}
+			return false, fmt.Errorf("method '%s': an SLO is required to register it", name)
+		}
+		if err := rl.fileBucket(config).validate(); err != nil {
+			return false, fmt.Errorf("method '%s': %w", name, err)
+		}
+	}
+
+	source := changeSource{source: ChangeSourceFile, remote: path}
+	for name, previous := range rl.configFile.methods {
+		if _, listed := methods[name]; listed {
+			continue
+		}
+		if previous.exempt {
+			rl.removeExemptionLocked(name)
+		}
+		if previous.registered {
+			if err := rl.unregisterMethodLocked(name); err != nil {
+				rl.logger.Errorf("Failed to unregister method '%s' removed from the config file: %v", name, err)
+			}
+		}
+	}
+	var failed []error
+	for name, config := range methods {
+		previous := rl.configFile.methods[name]
+		applied, err := rl.applyConfigEntryLocked(name, config, previous, source)
+		if err != nil {
+			failed = append(failed, err)
+		}
+		methods[name] = applied
+	}
+	rl.configFile.methods = methods
+	return true, errors.Join(failed...)
+}
+
+// configuredLocked reports whether a method or pattern is registered. The caller must hold rl.mutex.
+func (rl *TopDownRL) configuredLocked(name string) bool {
+	if isPattern(name) {
+		_, exists := rl.buckets[name]
+		_, hasSLO := rl.patternSLO(name)
+		return exists || hasSLO
+	}
+	_, exists := rl.interfaces[name]
+	return exists
+}
+
+// fileBucket returns the bucket of a method registered by a configuration file entry.
+func (rl *TopDownRL) fileBucket(config fileMethodConfig) BucketConfig {
+	bucket := rl.defaultBucket
+	if config.maxTokens != 0 {
+		bucket.MaxTokens = config.maxTokens
+	}
+	if config.refillRate != nil {
+		bucket.RefillRate = *config.refillRate
+	}
+	return bucket
+}
+
+// configEntryChanges reports whether the rate and the max tokens of an entry changed since the
+// previous load.
+func configEntryChanges(config, previous fileMethodConfig) (bool, bool) {
+	rateChanged := config.refillRate != nil && (previous.refillRate == nil || *config.refillRate != *previous.refillRate)
+	maxTokensChanged := config.maxTokens != 0 && config.maxTokens != previous.maxTokens
+	return rateChanged, maxTokensChanged
+}
+
+// configEntryMethodsLocked returns the registered methods whose bucket the entry of a method or
+// pattern sets: a pattern's bucket applies to the methods registered from it from now on, and is
+// updated on those already registered. The caller must hold rl.mutex.
+func (rl *TopDownRL) configEntryMethodsLocked(name string) []string {
+	if !isPattern(name) {
+		return []string{name}
+	}
+	var methods []string
+	for methodName, metrics := range rl.interfaces {
+		if metrics.bucketPattern == name {
+			methods = append(methods, methodName)
+		}
+	}
+	return methods
+}
+
+// checkConfigEntryLocked checks that the rate and max tokens of the entry of a registered method
+// or pattern can be applied to its methods, with the same checks as SetRateLimit and SetMaxTokens.
+// The caller must hold rl.mutex.
+func (rl *TopDownRL) checkConfigEntryLocked(name string, config, previous fileMethodConfig) error {
+	rateChanged, maxTokensChanged := configEntryChanges(config, previous)
+	if !rateChanged && !maxTokensChanged {
+		return nil
+	}
+	var rateLimit *float64
+	var maxTokens *int64
+	if rateChanged {
+		rateLimit = config.refillRate
+	}
+	if maxTokensChanged {
+		maxTokens = &config.maxTokens
+	}
+	for _, methodName := range rl.configEntryMethodsLocked(name) {
+		if err := rl.checkRateAndMaxTokensLocked(methodName, rateLimit, maxTokens); err != nil {
+			return fmt.Errorf("method '%s': %w", name, err)
+		}
+	}
+	return nil
+}
+
+// applyConfigEntryLocked applies the changes of the entry of a method or pattern since the
+// previous load and returns the entry as applied, with the previous values of the updates that
+// failed, so the next load retries them, and their errors. The caller must hold rl.mutex.
+func (rl *TopDownRL) applyConfigEntryLocked(name string, config, previous fileMethodConfig, source changeSource) (fileMethodConfig, error) {
+	config.registered = previous.registered
+	if config.exempt && !previous.exempt {
+		rl.addExemptionLocked(name)
+	} else if !config.exempt && previous.exempt {
+		rl.removeExemptionLocked(name)
+	}
+
+	if !rl.configuredLocked(name) {
+		if config.slo == 0 {
+			return config, nil
+		}
+		if err := rl.registerMethodLocked(name, config.slo, rl.fileBucket(config)); err != nil {
+			return config, fmt.Errorf("failed to register method '%s': %w", name, err)
+		}
+		rl.recordChange(name, ChangeFieldSLO, 0, durationMs(config.slo), source)
+		config.registered = true
+		return config, nil
+	}
+
+	var failed []error
+	if config.slo != 0 && config.slo != previous.slo {
+		if err := rl.setSLOLocked(name, config.slo, source); err != nil {
+			failed = append(failed, fmt.Errorf("failed to set SLO for method '%s': %w", name, err))
+			config.slo = previous.slo
+		}
+	}
+	rateChanged, maxTokensChanged := configEntryChanges(config, previous)
+	if !rateChanged && !maxTokensChanged {
+		return config, errors.Join(failed...)
+	}
+
+	methods := rl.configEntryMethodsLocked(name)
+	if bucket, exists := rl.buckets[name]; exists {
+		if rateChanged {
+			bucket.RefillRate = *config.refillRate
+		}
+		if maxTokensChanged {
+			bucket.MaxTokens = config.maxTokens
+		}
+		rl.buckets[name] = bucket
+	}
+	rateFailed, maxTokensFailed := false, false
+	for _, methodName := range methods {
+		if rateChanged {
+			if err := rl.setRateLimitLocked(methodName, *config.refillRate, rateOptions{}, source); err != nil {
+				failed = append(failed, fmt.Errorf("failed to set rate limit for method '%s': %w", methodName, err))
+				rateFailed = true
+			}
+		}
+		if maxTokensChanged {
+			if err := rl.setMaxTokensLocked(methodName, config.maxTokens, source); err != nil {
+				failed = append(failed, fmt.Errorf("failed to set max tokens for method '%s': %w", methodName, err))
+				maxTokensFailed = true
+			}
+		}
+	}
+	if rateFailed {
+		config.refillRate = previous.refillRate
+	}
+	if maxTokensFailed {
+		config.maxTokens = previous.maxTokens
+	}
+	return config, errors.Join(failed...)
+}
+
+// WatchConfig loads the configuration file at path and keeps reloading it until ctx is done:
+// whenever the process receives SIGHUP, and whenever the modification time or size of the file
+// changed, checked every interval. An interval of zero only reloads on SIGHUP. It fails if the
+// first load fails; failed reloads keep the running configuration, see LoadConfig.
+func (rl *TopDownRL) WatchConfig(ctx context.Context, path string, interval time.Duration) error {
+	if interval < 0 {
+		return fmt.Errorf("config watch interval must not be negative, got %v", interval)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := rl.LoadConfig(path); err != nil {
+		return err
+	}
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	var ticks <-chan time.Time
+	var ticker Ticker
+	if interval > 0 {
+		ticker = rl.clock.NewTicker(interval)
+		ticks = ticker.C()
+	}
+
+	go func() {
+		defer signal.Stop(hangups)
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangups:
+				if rl.Debug {
+					rl.logger.Debugf("Reloading config file '%s' on SIGHUP", path)
+				}
+				rl.LoadConfig(path)
+			case <-ticks:
+				current, err := os.Stat(path)
+				if err != nil {
+					rl.logger.Errorf("Failed to check config file '%s': %v", path, err)
+					continue
+				}
+				if current.ModTime().Equal(info.ModTime()) && current.Size() == info.Size() {
+					continue
+				}
+				info = current
+				rl.LoadConfig(path)
+			}
+		}
+	}()
+	return nil
+}
+
+// configFileStatusLocked returns the status of the configuration file, or nil if none was
+// loaded. The caller must hold rl.configFile.mu.
+func (rl *TopDownRL) configFileStatusLocked() *configFileStatus {
+	if rl.configFile.path == "" && rl.configFile.lastError == "" {
+		return nil
+	}
+	return &configFileStatus{
+		Path:     rl.configFile.path,
+		LoadedAt: rl.configFile.loadedAt,
+		Loads:    rl.configFile.loads,
+		Errors:   rl.configErrors.Load(),
+		Error:    rl.configFile.lastError,
+	}
+}
@@ -0,0 +1,73 @@
+package topdown
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes a configuration file into a temporary directory and returns its path.
+func writeConfigFile(t *testing.T, path, contents string) string {
+	t.Helper()
+	if path == "" {
+		path = filepath.Join(t.TempDir(), "config.json")
+	}
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigRejectsOutOfBoundsRateBeforeChanging(t *testing.T) {
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 10, RefillRate: 100, MaxRefillRate: 200}},
+		map[string]time.Duration{"/a": time.Second}, WithRateBoundsMode(RejectOutOfBounds))
+
+	path := writeConfigFile(t, "", `{"methods": {"/a": {"refill_rate": 500, "max_tokens": 30}, "/b": {"slo": "1s"}}}`)
+	if err := rl.LoadConfig(path); !errors.Is(err, ErrRateOutOfBounds) {
+		t.Fatalf("LoadConfig() = %v, want %v", err, ErrRateOutOfBounds)
+	}
+	if got := rl.ConfigErrors(); got != 1 {
+		t.Errorf("ConfigErrors() = %d, want 1", got)
+	}
+	if rl.registeredMetrics("/b") != nil {
+		t.Error("method '/b' registered by a rejected file")
+	}
+	if got := rl.registeredMetrics("/a").MaxTokens; got != 10 {
+		t.Errorf("max tokens = %d after a rejected file, want 10", got)
+	}
+
+	// The same entries within the bounds apply in full
+	writeConfigFile(t, path, `{"methods": {"/a": {"refill_rate": 150, "max_tokens": 30}}}`)
+	if err := rl.LoadConfig(path); err != nil {
+		t.Fatalf("LoadConfig() = %v", err)
+	}
+	metrics := rl.registeredMetrics("/a")
+	if metrics.RefillRate != 150 || metrics.MaxTokens != 30 {
+		t.Errorf("rate and max tokens = %g and %d, want 150 and 30", metrics.RefillRate, metrics.MaxTokens)
+	}
+}
+
+func TestLoadConfigRejectsRatesWhenFixed(t *testing.T) {
+	rl := newTestRL(t, nil, map[string]time.Duration{"/a": time.Second})
+	if err := rl.SetControllerMode(ControllerNone); err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeConfigFile(t, "", `{"methods": {"/a": {"refill_rate": 120}}}`)
+	if err := rl.LoadConfig(path); !errors.Is(err, ErrRatesFixed) {
+		t.Fatalf("LoadConfig() = %v, want %v", err, ErrRatesFixed)
+	}
+
+	// The rate wasn't recorded as applied, so the next load retries it
+	if err := rl.SetControllerMode(ControllerExternal); err != nil {
+		t.Fatal(err)
+	}
+	if err := rl.LoadConfig(path); err != nil {
+		t.Fatalf("LoadConfig() = %v", err)
+	}
+	if got := rl.registeredMetrics("/a").RefillRate; got != 120 {
+		t.Errorf("rate = %g after reloading, want 120", got)
+	}
+}
@@ -0,0 +1,316 @@
+package topdown
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// ControlServiceName is the full name of the gRPC control service defined in proto/control.proto.
+const ControlServiceName = "topdown.control.v1.TopDownControl"
+
+// ControlServer is the server API of the gRPC control service.
+type ControlServer interface {
+	GetMetrics(context.Context, *structpb.Struct) (*structpb.Struct, error)
+	SetRate(context.Context, *structpb.Struct) (*structpb.Struct, error)
+	SetSLO(context.Context, *structpb.Struct) (*structpb.Struct, error)
+	SetConcurrency(context.Context, *structpb.Struct) (*structpb.Struct, error)
+	SetShed(context.Context, *structpb.Struct) (*structpb.Struct, error)
+	ListMethods(context.Context, *structpb.Struct) (*structpb.Struct, error)
+	Watch(*structpb.Struct, grpc.ServerStream) error
+	Control(grpc.ServerStream) error
+}
+
+// TopDownControlServer implements the gRPC control service on top of a TopDownRL. Its messages are
+// structpb.Struct values with the same fields as the JSON bodies of the HTTP control API.
+type TopDownControlServer struct {
+	rl *TopDownRL
+}
+
+// NewControlServer creates a control service backed by rl.
+func NewControlServer(rl *TopDownRL) *TopDownControlServer {
+	return &TopDownControlServer{rl: rl}
+}
+
+// RegisterControlService registers the gRPC control service of rl on s, e.g. the grpc.Server
+// the application already runs. The HTTP control API keeps working alongside it.
+func (rl *TopDownRL) RegisterControlService(s grpc.ServiceRegistrar) {
+	s.RegisterService(&ControlServiceDesc, NewControlServer(rl))
+}
+
+// GetMetrics returns the metrics of a method, or of all methods if no method is given.
+func (s *TopDownControlServer) GetMetrics(ctx context.Context, req *structpb.Struct) (*structpb.Struct, error) {
+	method := req.GetFields()["method"].GetStringValue()
+	if method == "" {
+		return toStruct(s.allMetrics())
+	}
+
+	snapshot, err := s.rl.GetMetricsSnapshot(method)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return toStruct(newMetricsResponse(method, snapshot))
+}
+
+// allMetrics returns the metrics of all methods keyed by method name.
+func (s *TopDownControlServer) allMetrics() map[string]MetricsResponse {
+	snapshots := s.rl.GetAllMetrics()
+	response := make(map[string]MetricsResponse, len(snapshots))
+	for methodName, snapshot := range snapshots {
+		response[methodName] = newMetricsResponse(methodName, snapshot)
+	}
+	return response
+}
+
+// SetRate sets the rate of a single method, or a batch of rates atomically.
+func (s *TopDownControlServer) SetRate(ctx context.Context, req *structpb.Struct) (*structpb.Struct, error) {
+	var data struct {
+		Method    string             `json:"method"`
+		RateLimit *float64           `json:"rate_limit"`
+		MaxTokens *int64             `json:"max_tokens"`
+		Rates     map[string]float64 `json:"rates"`
+		Immediate bool               `json:"immediate"`
+
+		// TTLSeconds makes the rates temporary overrides, see SetTemporaryRateLimit.
+		TTLSeconds float64 `json:"ttl_seconds"`
+	}
+	if err := fromStruct(req, &data); err != nil {
+		return nil, err
+	}
+	ttl, err := ttlFromSeconds(data.TTLSeconds)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	opts := rateOptions{immediate: data.Immediate, ttl: ttl}
+
+	switch {
+	case data.Method != "" && (data.RateLimit != nil || data.MaxTokens != nil):
+		// The burst only changes if the rate is accepted too
+		if err := s.rl.setRateAndMaxTokens(data.Method, data.RateLimit, data.MaxTokens, opts, grpcSource(ctx)); err != nil {
+			switch {
+			case errors.Is(err, ErrRatesFixed), errors.Is(err, ErrBurstFixed):
+				return nil, status.Error(codes.FailedPrecondition, err.Error())
+			case errors.Is(err, ErrUnknownMethod):
+				return nil, status.Error(codes.NotFound, err.Error())
+			}
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return &structpb.Struct{}, nil
+	case data.Rates != nil:
+		return toStruct(s.rl.setRateLimitsResponse(data.Rates, opts, grpcSource(ctx)))
+	default:
+		return nil, status.Error(codes.InvalidArgument, "either 'method' and 'rate_limit' or 'rates' is required")
+	}
+}
+
+// SetSLO sets the SLO of a method, registering it if it isn't known yet.
+func (s *TopDownControlServer) SetSLO(ctx context.Context, req *structpb.Struct) (*structpb.Struct, error) {
+	method := req.GetFields()["method"].GetStringValue()
+	value, exists := req.GetFields()["slo"]
+	if method == "" || !exists {
+		return nil, status.Error(codes.InvalidArgument, "'method' and 'slo' are required")
+	}
+
+	raw, err := protojson.Marshal(value)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	slo, err := parseDuration(raw)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.rl.setSLO(method, slo, grpcSource(ctx)); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &structpb.Struct{}, nil
+}
+
+// SetConcurrency sets the concurrency limit of a method.
+func (s *TopDownControlServer) SetConcurrency(ctx context.Context, req *structpb.Struct) (*structpb.Struct, error) {
+	var data struct {
+		Method        string `json:"method"`
+		MaxConcurrent *int64 `json:"max_concurrent"`
+	}
+	if err := fromStruct(req, &data); err != nil {
+		return nil, err
+	}
+	if data.Method == "" || data.MaxConcurrent == nil {
+		return nil, status.Error(codes.InvalidArgument, "'method' and 'max_concurrent' are required")
+	}
+
+	if err := s.rl.SetMaxConcurrent(data.Method, *data.MaxConcurrent); err != nil {
+		if errors.Is(err, ErrUnknownMethod) {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &structpb.Struct{}, nil
+}
+
+// SetShed sets the shed probability of a method.
+func (s *TopDownControlServer) SetShed(ctx context.Context, req *structpb.Struct) (*structpb.Struct, error) {
+	var data struct {
+		Method      string   `json:"method"`
+		Probability *float64 `json:"probability"`
+	}
+	if err := fromStruct(req, &data); err != nil {
+		return nil, err
+	}
+	if data.Method == "" || data.Probability == nil {
+		return nil, status.Error(codes.InvalidArgument, "'method' and 'probability' are required")
+	}
+
+	if err := s.rl.SetShedProbability(data.Method, *data.Probability); err != nil {
+		if errors.Is(err, ErrUnknownMethod) {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &structpb.Struct{}, nil
+}
+
+// ListMethods returns the configuration of all registered methods.
+func (s *TopDownControlServer) ListMethods(ctx context.Context, req *structpb.Struct) (*structpb.Struct, error) {
+	return toStruct(struct {
+		Methods []MethodResponse `json:"methods"`
+	}{Methods: s.rl.methodResponses()})
+}
+
+// Watch streams the metrics of a method, or of all methods, after every metrics interval until
+// the client cancels the stream.
+func (s *TopDownControlServer) Watch(req *structpb.Struct, stream grpc.ServerStream) error {
+	method := req.GetFields()["method"].GetStringValue()
+	if method != "" && s.rl.registeredMetrics(method) == nil {
+		return status.Errorf(codes.NotFound, "%v: '%s'", ErrUnknownMethod, method)
+	}
+
+	intervals, unsubscribe := s.rl.subscribeIntervals()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-intervals:
+			response, err := s.GetMetrics(stream.Context(), req)
+			if err != nil {
+				return err
+			}
+			if err := stream.SendMsg(response); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// subscribeIntervals returns a channel that receives a value after every metrics interval, and
+// a function to cancel the subscription. Intervals a slow subscriber misses are coalesced.
+func (rl *TopDownRL) subscribeIntervals() (<-chan struct{}, func()) {
+	intervals := make(chan struct{}, 1)
+
+	rl.watchMutex.Lock()
+	if rl.watchers == nil {
+		rl.watchers = make(map[chan struct{}]struct{})
+	}
+	rl.watchers[intervals] = struct{}{}
+	rl.watchMutex.Unlock()
+
+	return intervals, func() {
+		rl.watchMutex.Lock()
+		defer rl.watchMutex.Unlock()
+		delete(rl.watchers, intervals)
+	}
+}
+
+// notifyIntervals wakes up all interval subscribers.
+func (rl *TopDownRL) notifyIntervals() {
+	rl.watchMutex.Lock()
+	defer rl.watchMutex.Unlock()
+
+	for intervals := range rl.watchers {
+		select {
+		case intervals <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// toStruct converts a value with a JSON shape into a structpb.Struct.
+func toStruct(v interface{}) (*structpb.Struct, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	result := &structpb.Struct{}
+	if err := protojson.Unmarshal(b, result); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return result, nil
+}
+
+// fromStruct decodes a structpb.Struct into v through its JSON shape.
+func fromStruct(s *structpb.Struct, v interface{}) error {
+	b, err := protojson.Marshal(s)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return nil
+}
+
+// ControlServiceDesc is the grpc.ServiceDesc of the control service, written by hand in the shape
+// protoc-gen-go-grpc generates for proto/control.proto.
+var ControlServiceDesc = grpc.ServiceDesc{
+	ServiceName: ControlServiceName,
+	HandlerType: (*ControlServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "GetMetrics", Handler: controlUnaryHandler("GetMetrics", ControlServer.GetMetrics)},
+		{MethodName: "SetRate", Handler: controlUnaryHandler("SetRate", ControlServer.SetRate)},
+		{MethodName: "SetSLO", Handler: controlUnaryHandler("SetSLO", ControlServer.SetSLO)},
+		{MethodName: "SetConcurrency", Handler: controlUnaryHandler("SetConcurrency", ControlServer.SetConcurrency)},
+		{MethodName: "SetShed", Handler: controlUnaryHandler("SetShed", ControlServer.SetShed)},
+		{MethodName: "ListMethods", Handler: controlUnaryHandler("ListMethods", ControlServer.ListMethods)},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "Watch", Handler: controlWatchHandler, ServerStreams: true},
+		{StreamName: "Control", Handler: controlStreamHandler, ServerStreams: true, ClientStreams: true},
+	},
+	Metadata: "proto/control.proto",
+}
+
+// controlUnaryHandler adapts a unary control method to a grpc.MethodDesc handler.
+func controlUnaryHandler(name string, method func(ControlServer, context.Context, *structpb.Struct) (*structpb.Struct, error)) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	fullMethod := "/" + ControlServiceName + "/" + name
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := &structpb.Struct{}
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		s := srv.(ControlServer)
+		if interceptor == nil {
+			return method(s, ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: fullMethod}
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return method(s, ctx, req.(*structpb.Struct))
+		}
+		return interceptor(ctx, req, info, handler)
+	}
+}
+
+// controlWatchHandler adapts Watch to a grpc.StreamDesc handler.
+func controlWatchHandler(srv interface{}, stream grpc.ServerStream) error {
+	req := &structpb.Struct{}
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	return srv.(ControlServer).Watch(req, stream)
+}
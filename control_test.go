@@ -0,0 +1,27 @@
+package topdown
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestSetRateRejectsBothOnInvalidRate(t *testing.T) {
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 10, RefillRate: 100}}, map[string]time.Duration{"/a": time.Second})
+	server := NewControlServer(rl)
+
+	req, err := structpb.NewStruct(map[string]interface{}{"method": "/a", "max_tokens": 50, "rate_limit": -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.SetRate(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("SetRate() = %v, want %v", err, codes.InvalidArgument)
+	}
+	if got := rl.registeredMetrics("/a").MaxTokens; got != 10 {
+		t.Errorf("max tokens = %d after a rejected update, want 10", got)
+	}
+}
@@ -0,0 +1,408 @@
+package topdown
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// ControllerMode selects who adjusts the refill rates automatically.
+type ControllerMode int
+
+const (
+	// ControllerExternal leaves the rates to an external agent using SetRateLimit or the control API.
+	ControllerExternal ControllerMode = iota
+	// ControllerAIMD adjusts the rates every interval with additive increase, multiplicative decrease.
+	ControllerAIMD
+	// ControllerPID adjusts the rates every interval with a proportional-integral controller
+	// targeting the SLO.
+	ControllerPID
+	// ControllerNone keeps the rates fixed; external rate updates are rejected.
+	ControllerNone
+)
+
+// ErrRatesFixed is returned when setting a rate while the controller mode is ControllerNone.
+var ErrRatesFixed = errors.New("rates are fixed in controller mode none")
+
+// ErrBurstFixed is returned when changing the burst of a method whose limiter doesn't implement BurstLimiter.
+var ErrBurstFixed = errors.New("limiter doesn't support changing the burst")
+
+// String returns the name of the mode as used by the control API.
+func (m ControllerMode) String() string {
+	switch m {
+	case ControllerExternal:
+		return "external"
+	case ControllerAIMD:
+		return "aimd"
+	case ControllerPID:
+		return "pid"
+	case ControllerNone:
+		return "none"
+	}
+	return fmt.Sprintf("ControllerMode(%d)", int(m))
+}
+
+// parseControllerMode parses the name of a controller mode.
+func parseControllerMode(name string) (ControllerMode, error) {
+	for _, mode := range []ControllerMode{ControllerExternal, ControllerAIMD, ControllerPID, ControllerNone} {
+		if mode.String() == name {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown controller mode '%s'", name)
+}
+
+// AIMDConfig holds the parameters of the AIMD controller.
+type AIMDConfig struct {
+	// Backoff multiplies the rate of a method after an overloaded interval, e.g. 0.9.
+	Backoff float64 `json:"backoff"`
+	// Increment is added to the rate of a method after every other interval with traffic.
+	Increment float64 `json:"increment"`
+	// ViolationThreshold is the share of SLO violations above which an interval counts as
+	// overloaded. Zero compares the tail latency with the SLO instead.
+	ViolationThreshold float64 `json:"violation_threshold"`
+	// MinRate and MaxRate bound the rates set by the controller; a MaxRate of zero means no bound.
+	MinRate float64 `json:"min_rate"`
+	MaxRate float64 `json:"max_rate"`
+}
+
+// DefaultAIMDConfig returns the default parameters of the AIMD controller.
+func DefaultAIMDConfig() AIMDConfig {
+	return AIMDConfig{
+		Backoff:   0.9,
+		Increment: 10,
+		MinRate:   1,
+	}
+}
+
+// validate checks that the controller converges with these parameters.
+func (c AIMDConfig) validate() error {
+	if !(c.Backoff > 0 && c.Backoff < 1) {
+		return fmt.Errorf("backoff must be in (0, 1), got %g", c.Backoff)
+	}
+	if c.Increment < 0 {
+		return fmt.Errorf("increment must not be negative, got %g", c.Increment)
+	}
+	if c.ViolationThreshold < 0 || c.ViolationThreshold >= 1 {
+		return fmt.Errorf("violation threshold must be in [0, 1), got %g", c.ViolationThreshold)
+	}
+	if c.MinRate < 0 || (c.MaxRate > 0 && c.MaxRate < c.MinRate) {
+		return fmt.Errorf("rate bounds [%g, %g] are invalid", c.MinRate, c.MaxRate)
+	}
+	return nil
+}
+
+// PIDConfig holds the parameters of the PID controller. Every interval the controller computes the
+// relative error e = (SLO - tail latency) / SLO, clamped to [-1, 1], adds it to the integral and
+// sets the rate to base * exp(Kp*e + Ki*integral), where base is the rate when the controller engaged.
+type PIDConfig struct {
+	Kp float64 `json:"kp"`
+	Ki float64 `json:"ki"`
+	// MaxIntegral bounds the integral to prevent windup; the integral also stops growing while
+	// the rate is held at MinRate or MaxRate.
+	MaxIntegral float64 `json:"max_integral"`
+	// MinRate and MaxRate bound the rates set by the controller; a MaxRate of zero means no bound.
+	MinRate float64 `json:"min_rate"`
+	MaxRate float64 `json:"max_rate"`
+}
+
+// DefaultPIDConfig returns the default parameters of the PID controller.
+func DefaultPIDConfig() PIDConfig {
+	return PIDConfig{
+		Kp:          0.1,
+		Ki:          0.1,
+		MaxIntegral: 30,
+		MinRate:     1,
+	}
+}
+
+// validate checks that the PID parameters are usable.
+func (c PIDConfig) validate() error {
+	if c.Kp < 0 || c.Ki < 0 {
+		return fmt.Errorf("gains must not be negative, got kp %g and ki %g", c.Kp, c.Ki)
+	}
+	if c.MaxIntegral < 0 {
+		return fmt.Errorf("max integral must not be negative, got %g", c.MaxIntegral)
+	}
+	if c.MinRate < 0 || (c.MaxRate > 0 && c.MaxRate < c.MinRate) {
+		return fmt.Errorf("rate bounds [%g, %g] are invalid", c.MinRate, c.MaxRate)
+	}
+	return nil
+}
+
+// PIDState is the internal state of the PID controller for a single method.
+type PIDState struct {
+	// Error is the relative error of the last interval, positive when the tail latency is below the SLO.
+	Error    float64 `json:"error"`
+	Integral float64 `json:"integral"`
+	// Adjustment is the last change of the rate made by the controller.
+	Adjustment float64 `json:"adjustment"`
+	// Base is the rate of the method when the controller engaged.
+	Base float64 `json:"base"`
+}
+
+// controllerConfig is the controller configuration, replaced as a whole so the tick reads it without locking.
+type controllerConfig struct {
+	mode ControllerMode
+	aimd AIMDConfig
+	pid  PIDConfig
+}
+
+// WithControllerMode selects who adjusts the rates automatically, see ControllerMode.
+func WithControllerMode(mode ControllerMode) Option {
+	return func(rl *TopDownRL) {
+		updated := *rl.controller.Load()
+		updated.mode = mode
+		rl.controller.Store(&updated)
+	}
+}
+
+// WithAIMDController enables the built-in AIMD controller with the given parameters.
+func WithAIMDController(config AIMDConfig) Option {
+	return func(rl *TopDownRL) {
+		updated := *rl.controller.Load()
+		updated.mode = ControllerAIMD
+		updated.aimd = config
+		rl.controller.Store(&updated)
+	}
+}
+
+// WithPIDController enables the built-in PID controller with the given parameters.
+func WithPIDController(config PIDConfig) Option {
+	return func(rl *TopDownRL) {
+		updated := *rl.controller.Load()
+		updated.mode = ControllerPID
+		updated.pid = config
+		rl.controller.Store(&updated)
+	}
+}
+
+// SetControllerMode switches who adjusts the rates automatically. The PID state of all methods is
+// reset, so a controller always starts from a clean state.
+func (rl *TopDownRL) SetControllerMode(mode ControllerMode) error {
+	if _, err := parseControllerMode(mode.String()); err != nil {
+		return err
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	updated := *rl.controller.Load()
+	updated.mode = mode
+	rl.controller.Store(&updated)
+	for _, metrics := range rl.interfaces {
+		metrics.mu.Lock()
+		metrics.pid = PIDState{}
+		metrics.mu.Unlock()
+	}
+	if rl.Debug {
+		rl.logger.Debugf("Set controller mode: %s", mode)
+	}
+	return nil
+}
+
+// PIDConfig returns the parameters of the PID controller.
+func (rl *TopDownRL) PIDConfig() PIDConfig {
+	return rl.controller.Load().pid
+}
+
+// SetPIDConfig updates the parameters of the PID controller; they apply from the next interval.
+func (rl *TopDownRL) SetPIDConfig(config PIDConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	updated := *rl.controller.Load()
+	updated.pid = config
+	rl.controller.Store(&updated)
+	if rl.Debug {
+		rl.logger.Debugf("Set new PID parameters: %+v", config)
+	}
+	return nil
+}
+
+// ControllerMode returns who currently adjusts the rates automatically.
+func (rl *TopDownRL) ControllerMode() ControllerMode {
+	return rl.controller.Load().mode
+}
+
+// AIMDConfig returns the parameters of the AIMD controller.
+func (rl *TopDownRL) AIMDConfig() AIMDConfig {
+	return rl.controller.Load().aimd
+}
+
+// SetAIMDConfig updates the parameters of the AIMD controller; they apply from the next interval.
+func (rl *TopDownRL) SetAIMDConfig(config AIMDConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	updated := *rl.controller.Load()
+	updated.aimd = config
+	rl.controller.Store(&updated)
+	if rl.Debug {
+		rl.logger.Debugf("Set new AIMD parameters: %+v", config)
+	}
+	return nil
+}
+
+// controlLocked lets the configured controller adjust the rate of a method after the interval that
+// just ended at now. The caller must hold metrics.mu and have rolled the interval over.
+func (rl *TopDownRL) controlLocked(metrics *InterfaceMetrics, tailLatency time.Duration, empty bool) {
+	if empty {
+		// Intervals without traffic carry no signal about the load
+		return
+	}
+	if metrics.override != nil {
+		// Temporary overrides hold until they expire, see SetTemporaryRateLimit
+		return
+	}
+	if metrics.schedule.activeLocked() {
+		// Scheduled rates hold until their entry ends, see WithRateSchedule
+		return
+	}
+
+	config := rl.controller.Load()
+	switch config.mode {
+	case ControllerAIMD:
+		rate := metrics.RefillRate
+		if aimdOverloaded(config.aimd, metrics, tailLatency) {
+			rate *= config.aimd.Backoff
+		} else {
+			rate += config.aimd.Increment
+		}
+		rl.setControlledRateLocked(metrics, rate, config.aimd.MinRate, config.aimd.MaxRate)
+	case ControllerPID:
+		rl.pidControlLocked(config.pid, metrics, tailLatency)
+	}
+}
+
+// pidControlLocked runs one step of the PID controller for a method. The caller must hold metrics.mu.
+func (rl *TopDownRL) pidControlLocked(config PIDConfig, metrics *InterfaceMetrics, tailLatency time.Duration) {
+	if metrics.pid.Base <= 0 {
+		metrics.pid = PIDState{Base: metrics.RefillRate}
+	}
+
+	e := float64(metrics.SLO-tailLatency) / float64(metrics.SLO)
+	if e < -1 {
+		e = -1
+	}
+
+	integral := metrics.pid.Integral + e
+	if integral > config.MaxIntegral {
+		integral = config.MaxIntegral
+	} else if integral < -config.MaxIntegral {
+		integral = -config.MaxIntegral
+	}
+
+	previous := metrics.RefillRate
+	target := metrics.pid.Base * math.Exp(config.Kp*e+config.Ki*integral)
+	rate := rl.setControlledRateLocked(metrics, target, config.MinRate, config.MaxRate)
+	// Conditional integration: a saturated rate must not keep winding the integral up
+	saturated := (rate < target && e > 0) || (rate > target && e < 0)
+	if !saturated {
+		metrics.pid.Integral = integral
+	}
+	metrics.pid.Error = e
+	metrics.pid.Adjustment = rate - previous
+}
+
+// aimdOverloaded reports whether the interval that just ended counts as overloaded.
+func aimdOverloaded(config AIMDConfig, metrics *InterfaceMetrics, tailLatency time.Duration) bool {
+	if config.ViolationThreshold == 0 {
+		return tailLatency > metrics.SLO
+	}
+	completed := metrics.CurrentGoodput + metrics.CurrentSloViolations
+	if completed == 0 {
+		return false
+	}
+	return float64(metrics.CurrentSloViolations)/float64(completed) > config.ViolationThreshold
+}
+
+// setControlledRateLocked sets a rate chosen by a controller, clamped to [minRate, maxRate] and the
+// method's rate bounds, and returns the rate that was set. The caller must hold metrics.mu.
+func (rl *TopDownRL) setControlledRateLocked(metrics *InterfaceMetrics, rate, minRate, maxRate float64) float64 {
+	if maxRate > 0 && rate > maxRate {
+		rate = maxRate
+	}
+	if metrics.MaxRefillRate > 0 && rate > metrics.MaxRefillRate {
+		rate = metrics.MaxRefillRate
+	}
+	if rate < metrics.MinRefillRate {
+		rate = metrics.MinRefillRate
+	}
+	if rate < minRate {
+		rate = minRate
+	}
+	// The controller takes over from a ramp in progress
+	metrics.ramp = nil
+	if rate == metrics.RefillRate {
+		return rate
+	}
+
+	setLimiterRateLocked(metrics, rate)
+	if rl.Debug {
+		rl.logger.Debugf("Controller changed rate limit from %f to %f", metrics.RefillRate, rate)
+	}
+	rl.recordChange(metrics.method, ChangeFieldRefillRate, metrics.RefillRate, rate, changeSource{source: ChangeSourceController})
+	metrics.RefillRate = rate
+	return rate
+}
+
+// controllerResponse is the JSON shape of the controller configuration served by HandleController.
+type controllerResponse struct {
+	Mode string     `json:"mode"`
+	AIMD AIMDConfig `json:"aimd"`
+	PID  PIDConfig  `json:"pid"`
+}
+
+// HandleController handles the GET requests to return the controller configuration and the POST
+// requests to update it with a body of {"mode": "pid", "aimd": {...}, "pid": {...}}; omitted fields are kept.
+func (rl *TopDownRL) HandleController(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleController called")
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		config := rl.controller.Load()
+		data := controllerResponse{Mode: config.mode.String(), AIMD: config.aimd, PID: config.pid}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeError(w, "Failed to decode request body", http.StatusBadRequest)
+			return
+		}
+		mode, err := parseControllerMode(data.Mode)
+		if err == nil {
+			err = data.AIMD.validate()
+		}
+		if err == nil {
+			err = data.PID.validate()
+		}
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rl.SetAIMDConfig(data.AIMD)
+		rl.SetPIDConfig(data.PID)
+		if mode != config.mode {
+			rl.SetControllerMode(mode)
+		}
+	default:
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	config := rl.controller.Load()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(controllerResponse{Mode: config.mode.String(), AIMD: config.aimd, PID: config.pid})
+}
@@ -0,0 +1,140 @@
+package topdown
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+// simulatedLatency is the latency of a server that handles 100 rps in 10ms and slows down by
+// 1ms for every request per second above that, so it meets an SLO of 50ms up to 140 rps.
+func simulatedLatency(rps int) time.Duration {
+	if rps <= 100 {
+		return 10 * time.Millisecond
+	}
+	return 10*time.Millisecond + time.Duration(rps-100)*time.Millisecond
+}
+
+// simulateInterval offers 1000 requests evenly spread over one second of the fake clock, records
+// the simulated latency of the admitted ones and rolls the interval over.
+func simulateInterval(rl *TopDownRL, clock *FakeClock, metrics *InterfaceMetrics) {
+	ctx := context.Background()
+	admitted := 0
+	for i := 0; i < 1000; i++ {
+		clock.Advance(time.Millisecond)
+		if rl.Allow(ctx, "/a") {
+			admitted++
+		}
+	}
+	for i := 0; i < admitted; i++ {
+		rl.postProcess(simulatedLatency(admitted), "/a", -1, 0, settlement{})
+	}
+	rl.rollover(metrics, clock.Now())
+}
+
+func TestAIMDConvergesToSLO(t *testing.T) {
+	const (
+		slo       = 50 * time.Millisecond
+		converged = 140 // rps at which the simulated latency meets the SLO
+	)
+	clock := NewFakeClock(time.Unix(1000, 0))
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 10, RefillRate: 20}},
+		map[string]time.Duration{"/a": slo}, WithClock(clock), WithMetricsInterval(time.Hour),
+		WithAIMDController(AIMDConfig{Backoff: 0.9, Increment: 10, MinRate: 1}))
+	metrics := rl.loadMetrics("/a")
+
+	// From 20 rps the rate grows by 10 per interval until the latency exceeds the SLO
+	for i := 0; i < 30; i++ {
+		simulateInterval(rl, clock, metrics)
+	}
+
+	// Afterwards it oscillates between backing off and probing around the rate meeting the SLO
+	var latencies time.Duration
+	overloaded := 0
+	const intervals = 50
+	for i := 0; i < intervals; i++ {
+		simulateInterval(rl, clock, metrics)
+		snapshot, err := rl.GetMetricsSnapshot("/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if snapshot.RefillRate < 0.85*converged || snapshot.RefillRate > converged+2*10 {
+			t.Errorf("interval %d: rate = %v, want it around %d rps", i, snapshot.RefillRate, converged)
+		}
+		latencies += snapshot.TailLatency95th
+		if snapshot.TailLatency95th > slo {
+			overloaded++
+		}
+	}
+	if mean := latencies / intervals; mean < slo*3/4 || mean > slo*5/4 {
+		t.Errorf("mean tail latency = %v, want it within 25%% of the %v SLO", mean, slo)
+	}
+	if overloaded == 0 || overloaded == intervals {
+		t.Errorf("%d of %d intervals exceeded the SLO, want the controller to back off and probe", overloaded, intervals)
+	}
+}
+
+func TestPIDIntegralSaturation(t *testing.T) {
+	const slo = 100 * time.Millisecond
+	clock := NewFakeClock(time.Unix(1000, 0))
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 10, RefillRate: 100}, "/b": {MaxTokens: 10, RefillRate: 100}},
+		map[string]time.Duration{"/a": slo, "/b": slo}, WithClock(clock), WithMetricsInterval(time.Hour),
+		WithPIDController(PIDConfig{Kp: 0.1, Ki: 0.1, MaxIntegral: 10, MinRate: 1, MaxRate: 150}))
+	a := rl.loadMetrics("/a")
+	interval := func(latency time.Duration) PIDState {
+		t.Helper()
+		clock.Advance(time.Second)
+		rl.postProcess(latency, "/a", -1, 0, settlement{})
+		rl.rollover(a, clock.Now())
+		snapshot, err := rl.GetMetricsSnapshot("/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if snapshot.PID == nil {
+			t.Fatal("no PID state in the snapshot")
+		}
+		return *snapshot.PID
+	}
+
+	// Every interval far below the SLO has an error of 1, so the rate grows until it is held at
+	// MaxRate and the integral stops growing with it
+	var state PIDState
+	for i := 0; i < 20; i++ {
+		state = interval(0)
+	}
+	if got := a.RefillRate; got != 150 {
+		t.Fatalf("rate = %v, want it held at MaxRate 150", got)
+	}
+	// 100 * exp(0.1 + 0.1*integral) stays below 150 up to an integral of 3
+	if state.Integral != 3 {
+		t.Errorf("integral = %v while saturated, want it frozen at 3", state.Integral)
+	}
+
+	// Without windup a single overloaded interval moves the rate off MaxRate
+	state = interval(2 * slo)
+	if want := 100 * math.Exp(-0.1+0.1*2); state.Error != -1 || math.Abs(a.RefillRate-want) > 1e-9 {
+		t.Errorf("rate = %v with error %v after an overloaded interval, want %v with error -1", a.RefillRate, state.Error, want)
+	}
+
+	// Without a MaxRate the integral is bounded by MaxIntegral
+	if err := rl.SetPIDConfig(PIDConfig{Kp: 0.1, Ki: 0.1, MaxIntegral: 10, MinRate: 1}); err != nil {
+		t.Fatal(err)
+	}
+	b := rl.loadMetrics("/b")
+	for i := 0; i < 20; i++ {
+		clock.Advance(time.Second)
+		rl.postProcess(0, "/b", -1, 0, settlement{})
+		rl.rollover(b, clock.Now())
+	}
+	snapshot, err := rl.GetMetricsSnapshot("/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.PID.Integral != 10 {
+		t.Errorf("integral = %v, want it capped at MaxIntegral 10", snapshot.PID.Integral)
+	}
+	if want := 100 * math.Exp(0.1+0.1*10); math.Abs(snapshot.RefillRate-want) > 1e-9 {
+		t.Errorf("rate = %v, want base * exp(Kp + Ki*MaxIntegral) = %v", snapshot.RefillRate, want)
+	}
+}
@@ -0,0 +1,200 @@
+package topdown
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// controlStateResponse is the first message of a control channel, with the full state of the
+// limiter, so an agent that reconnects starts over from it.
+type controlStateResponse struct {
+	Type    string                     `json:"type"`
+	Methods []MethodResponse           `json:"methods"`
+	Metrics map[string]MetricsResponse `json:"metrics"`
+}
+
+// controlIntervalResponse is the message of a control channel after every metrics interval.
+// StartSeq is the sequence number of the last update of the channel applied before the interval
+// started, and EndSeq of the last one applied before it ended, so the interval ran entirely on
+// the first if both are equal; zero is the state the channel attached to.
+type controlIntervalResponse struct {
+	Type string `json:"type"`
+	intervalEventResponse
+	StartSeq uint64 `json:"start_seq"`
+	EndSeq   uint64 `json:"end_seq"`
+}
+
+// controlUpdate is an update of a control channel, once applied.
+type controlUpdate struct {
+	seq     uint64
+	applied time.Time
+}
+
+// controlChannel tracks the updates of a control channel against the intervals. mu is held while
+// an update is applied, so an interval never misses an update that was applied before it ended.
+type controlChannel struct {
+	mu sync.Mutex
+	// last is the sequence number of the last update received, and applied of the last one
+	// applied before the last interval ended; pending are the updates applied since.
+	last    uint64
+	applied uint64
+	pending []controlUpdate
+}
+
+// interval returns the sequence numbers of the last updates applied before an interval started
+// and before it ended at end.
+func (c *controlChannel) interval(end time.Time) (uint64, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	start := c.applied
+	n := 0
+	for ; n < len(c.pending) && !c.pending[n].applied.After(end); n++ {
+		c.applied = c.pending[n].seq
+	}
+	c.pending = c.pending[n:]
+	return start, c.applied
+}
+
+// Control serves a control channel: it sends the configuration and metrics of all methods on
+// attach as a "state" message, then an "interval" message after every metrics interval. The
+// agent sends rate updates with the fields of SetRate and an increasing "seq", which are applied
+// immediately unless "immediate" is false, and each is answered with an "ack" message carrying its
+// seq and the result or the error. The interval messages report which updates were in effect, see
+// controlIntervalResponse. The channel ends once the client cancels it or the metrics goroutine
+// stops, and new channels are Unavailable until it is restarted; a reconnecting agent gets the
+// full state again.
+func (s *TopDownControlServer) Control(stream grpc.ServerStream) error {
+	// Subscribing before the state, so no interval falls between the state and the stream
+	subscriber, unsubscribe, err := s.rl.subscribeEvents()
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	defer unsubscribe()
+
+	state, err := toStruct(controlStateResponse{
+		Type:    "state",
+		Methods: s.rl.methodResponses(),
+		Metrics: s.allMetrics(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(state); err != nil {
+		return err
+	}
+
+	// Updates are received on their own goroutine, while the sends all happen here
+	channel := &controlChannel{}
+	acks := make(chan *structpb.Struct)
+	received := make(chan error, 1)
+	go func() {
+		received <- s.receiveUpdates(stream, channel, acks)
+	}()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case err := <-received:
+			if err != nil {
+				return err
+			}
+			// The client is done sending, but still receives the intervals
+			received = nil
+		case ack := <-acks:
+			if err := stream.SendMsg(ack); err != nil {
+				return err
+			}
+		case event, ok := <-subscriber.events:
+			if !ok {
+				return status.Error(codes.Unavailable, "limiter stopped")
+			}
+			response := controlIntervalResponse{
+				Type: "interval",
+				intervalEventResponse: intervalEventResponse{
+					Timestamp: unixSeconds(event.end),
+					Dropped:   subscriber.dropped.Load(),
+					Methods:   make(map[string]MetricsResponse, len(event.snapshots)),
+				},
+			}
+			for methodName, snapshot := range event.snapshots {
+				response.Methods[methodName] = newMetricsResponse(methodName, snapshot)
+			}
+			response.StartSeq, response.EndSeq = channel.interval(event.end)
+			message, err := toStruct(response)
+			if err != nil {
+				return err
+			}
+			if err := stream.SendMsg(message); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// receiveUpdates applies the updates of a control channel until the client is done sending, and
+// hands their acks to the sending goroutine.
+func (s *TopDownControlServer) receiveUpdates(stream grpc.ServerStream, channel *controlChannel, acks chan<- *structpb.Struct) error {
+	for {
+		req := &structpb.Struct{}
+		if err := stream.RecvMsg(req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if req.Fields == nil {
+			req.Fields = make(map[string]*structpb.Value)
+		}
+		seq := uint64(req.Fields["seq"].GetNumberValue())
+		if _, ok := req.Fields["immediate"]; !ok {
+			req.Fields["immediate"] = structpb.NewBoolValue(true)
+		}
+
+		ack := &structpb.Struct{Fields: map[string]*structpb.Value{
+			"type": structpb.NewStringValue("ack"),
+			"seq":  structpb.NewNumberValue(float64(seq)),
+		}}
+		channel.mu.Lock()
+		var response *structpb.Struct
+		err := status.Errorf(codes.InvalidArgument, "'seq' must be above %d", channel.last)
+		if seq > channel.last {
+			channel.last = seq
+			response, err = s.SetRate(stream.Context(), req)
+		}
+		if err == nil {
+			applied := s.rl.clock.Now()
+			channel.pending = append(channel.pending, controlUpdate{seq: seq, applied: applied})
+			ack.Fields["applied_at"] = structpb.NewNumberValue(unixSeconds(applied))
+			ack.Fields["result"] = structpb.NewStructValue(response)
+		}
+		channel.mu.Unlock()
+		if err != nil {
+			st := status.Convert(err)
+			ack.Fields["code"] = structpb.NewStringValue(st.Code().String())
+			ack.Fields["error"] = structpb.NewStringValue(st.Message())
+		}
+		if s.rl.Debug {
+			s.rl.logger.Debugf("Control channel update %d applied: %v", seq, err == nil)
+		}
+
+		select {
+		case acks <- ack:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// controlStreamHandler adapts Control to a grpc.StreamDesc handler.
+func controlStreamHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ControlServer).Control(stream)
+}
@@ -0,0 +1,32 @@
+package topdown
+
+import (
+	"context"
+)
+
+// CostFunc computes the number of tokens a request consumes, e.g. from a page size field of req.
+// A result of zero or less falls back to the static cost of the method.
+type CostFunc func(ctx context.Context, req interface{}) int64
+
+// WithCostFunc sets the function computing the cost of unary requests and, with
+// WithStreamMessageLimiting, of received stream messages. Streams themselves are charged the
+// static cost of their method when they are established, see BucketConfig.Cost.
+func WithCostFunc(cost CostFunc) Option {
+	return func(rl *TopDownRL) {
+		rl.costFunc = cost
+	}
+}
+
+// requestCost returns the number of tokens a request to methodName consumes. req is nil if the
+// request has no message yet, in which case the static cost applies.
+func (rl *TopDownRL) requestCost(ctx context.Context, methodName string, req interface{}) int64 {
+	if rl.costFunc != nil && req != nil {
+		if cost := rl.costFunc(ctx, req); cost > 0 {
+			return cost
+		}
+	}
+	if metrics := rl.registeredMetrics(methodName); metrics != nil && metrics.cost > 0 {
+		return metrics.cost
+	}
+	return 1
+}
@@ -0,0 +1,434 @@
+package topdown
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CPUSample is a measurement of the load of the process over the last sampling interval.
+type CPUSample struct {
+	// Utilization is the CPU time used by the process as a share of the CPU time available to it,
+	// GOMAXPROCS times the interval, so 1 means every P was busy.
+	Utilization float64
+	// SchedulerLatency is the 99th percentile of the time goroutines waited to be scheduled.
+	SchedulerLatency time.Duration
+}
+
+// CPUSampler measures the load of the process since it was called last; the first call measures
+// the load since its creation.
+type CPUSampler func() CPUSample
+
+// NewProcessCPUSampler returns a CPUSampler measuring the CPU time of the process through
+// getrusage and the scheduler latency through runtime/metrics. On platforms without getrusage
+// the utilization is always zero.
+func NewProcessCPUSampler() CPUSampler {
+	last := time.Now()
+	lastCPU, _ := processCPUTime()
+	schedSamples := []metrics.Sample{{Name: "/sched/latencies:seconds"}}
+	metrics.Read(schedSamples)
+	var lastCounts []uint64
+	if schedSamples[0].Value.Kind() == metrics.KindFloat64Histogram {
+		lastCounts = append(lastCounts, schedSamples[0].Value.Float64Histogram().Counts...)
+	}
+
+	var mu sync.Mutex
+	return func() CPUSample {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var sample CPUSample
+		now := time.Now()
+		if cpu, ok := processCPUTime(); ok {
+			if wall := now.Sub(last); wall > 0 {
+				sample.Utilization = float64(cpu-lastCPU) / (float64(wall) * float64(runtime.GOMAXPROCS(0)))
+			}
+			lastCPU = cpu
+		}
+		last = now
+
+		metrics.Read(schedSamples)
+		if schedSamples[0].Value.Kind() == metrics.KindFloat64Histogram {
+			histogram := schedSamples[0].Value.Float64Histogram()
+			sample.SchedulerLatency = histogramQuantile(histogram, lastCounts, 0.99)
+			lastCounts = append(lastCounts[:0], histogram.Counts...)
+		}
+		return sample
+	}
+}
+
+// histogramQuantile returns the upper bound of the bucket holding quantile q of the observations
+// a runtime/metrics histogram gained since it had the counts last.
+func histogramQuantile(histogram *metrics.Float64Histogram, last []uint64, q float64) time.Duration {
+	var total uint64
+	deltas := make([]uint64, len(histogram.Counts))
+	for i, count := range histogram.Counts {
+		if i < len(last) {
+			count -= last[i]
+		}
+		deltas[i] = count
+		total += count
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for i, count := range deltas {
+		seen += count
+		if seen >= rank {
+			// Bucket i spans Buckets[i] to Buckets[i+1]; the last one is unbounded
+			upper := histogram.Buckets[i+1]
+			if math.IsInf(upper, 1) {
+				upper = histogram.Buckets[i]
+			}
+			return time.Duration(upper * float64(time.Second))
+		}
+	}
+	return 0
+}
+
+// CPUConfig holds the parameters of CPU-aware throttling, see WithCPUThrottling.
+type CPUConfig struct {
+	// Target is the utilization above which the process counts as overloaded, in (0, 1].
+	Target float64
+	// SchedulerLatency, if set, also counts the process as overloaded while the 99th percentile
+	// scheduler latency exceeds it.
+	SchedulerLatency time.Duration
+	// Interval is how often the load is sampled.
+	Interval time.Duration
+	// Decrease multiplies the penalty factor after every overloaded sample, down to MinFactor,
+	// and Recovery is added back to it after every other sample, up to 1.
+	Decrease  float64
+	Recovery  float64
+	MinFactor float64
+	// Sampler measures the load; nil means NewProcessCPUSampler.
+	Sampler CPUSampler
+}
+
+// DefaultCPUConfig returns the default parameters of CPU-aware throttling.
+func DefaultCPUConfig() CPUConfig {
+	return CPUConfig{
+		Target:    0.8,
+		Interval:  time.Second,
+		Decrease:  0.8,
+		Recovery:  0.05,
+		MinFactor: 0.05,
+	}
+}
+
+// validate checks that the penalty can be applied and lifted again.
+func (c CPUConfig) validate() error {
+	if err := validateCPUTarget(c.Target); err != nil {
+		return err
+	}
+	if c.Interval <= 0 || c.SchedulerLatency < 0 {
+		return fmt.Errorf("interval %v must be positive and scheduler latency %v not negative", c.Interval, c.SchedulerLatency)
+	}
+	if !(c.Decrease > 0 && c.Decrease < 1) {
+		return fmt.Errorf("decrease must be in (0, 1), got %g", c.Decrease)
+	}
+	if !(c.Recovery > 0 && c.Recovery <= 1) || !(c.MinFactor > 0 && c.MinFactor <= 1) {
+		return fmt.Errorf("recovery %g and min factor %g must be in (0, 1]", c.Recovery, c.MinFactor)
+	}
+	return nil
+}
+
+// validateCPUTarget checks that a target utilization is in (0, 1].
+func validateCPUTarget(target float64) error {
+	if !(target > 0 && target <= 1) {
+		return fmt.Errorf("target utilization must be in (0, 1], got %g", target)
+	}
+	return nil
+}
+
+// WithCPUThrottling samples the load of the process every config.Interval and, while it's above
+// the target, rejects a growing share of the requests of every method before they reach their
+// buckets: the penalty factor shrinks multiplicatively after every overloaded sample and recovers
+// additively afterwards. A method with importance w admits a request with the probability
+// factor^(1/w), so important methods are throttled less, see BucketConfig.Importance.
+func WithCPUThrottling(config CPUConfig) Option {
+	return func(rl *TopDownRL) {
+		if config.Sampler == nil {
+			config.Sampler = NewProcessCPUSampler()
+		}
+		rl.cpu = &cpuThrottle{config: config, target: config.Target}
+		rl.cpu.factor.Store(math.Float64bits(1))
+	}
+}
+
+// CPUState is the state of CPU-aware throttling.
+type CPUState struct {
+	// Utilization and SchedulerLatency are the last sample, and Overloaded whether it exceeded
+	// the targets.
+	Utilization      float64
+	SchedulerLatency time.Duration
+	Overloaded       bool
+	Target           float64
+	SchedulerTarget  time.Duration
+	// PenaltyFactor is the admission probability of methods with an importance of 1.
+	PenaltyFactor float64
+}
+
+// CPUMetrics is the CPU throttling of a single method.
+type CPUMetrics struct {
+	Importance float64 `json:"importance"`
+	// AdmitProbability is the probability a request passes the throttling.
+	AdmitProbability float64 `json:"admit_probability"`
+	// Rejected counts the requests rejected by the throttling during the last interval.
+	Rejected      int64 `json:"rejected"`
+	RejectedTotal int64 `json:"rejected_total"`
+}
+
+// cpuThrottle tracks the load of the process and the penalty it calls for.
+type cpuThrottle struct {
+	config CPUConfig
+
+	mu         sync.Mutex
+	sample     CPUSample
+	overloaded bool
+	target     float64
+
+	factor atomic.Uint64 // math.Float64bits
+}
+
+// penalty returns the current penalty factor.
+func (c *cpuThrottle) penalty() float64 {
+	return math.Float64frombits(c.factor.Load())
+}
+
+// cpuLoop samples the load every interval until ctx is done.
+func (rl *TopDownRL) cpuLoop(ctx context.Context) {
+	ticker := rl.clock.NewTicker(rl.cpu.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			rl.updateCPU(rl.cpu.config.Sampler())
+		}
+	}
+}
+
+// updateCPU adjusts the penalty factor to a new sample of the load.
+func (rl *TopDownRL) updateCPU(sample CPUSample) {
+	c := rl.cpu
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	overloaded := sample.Utilization > c.target ||
+		(c.config.SchedulerLatency > 0 && sample.SchedulerLatency > c.config.SchedulerLatency)
+	factor := c.penalty()
+	if overloaded {
+		factor *= c.config.Decrease
+		if factor < c.config.MinFactor {
+			factor = c.config.MinFactor
+		}
+	} else {
+		factor = min(factor+c.config.Recovery, 1)
+	}
+	c.factor.Store(math.Float64bits(factor))
+
+	if overloaded != c.overloaded {
+		if overloaded {
+			rl.logger.Infof("CPU overloaded at %.0f%% utilization, throttling admission", sample.Utilization*100)
+		} else {
+			rl.logger.Infof("CPU recovered at %.0f%% utilization", sample.Utilization*100)
+		}
+	}
+	c.sample, c.overloaded = sample, overloaded
+	if rl.Debug {
+		rl.logger.Debugf("CPU utilization %.3f, scheduler latency %v, penalty factor %.3f", sample.Utilization, sample.SchedulerLatency, factor)
+	}
+}
+
+// cpuAdmitProbability returns the probability a request of a method passes the CPU throttling.
+func (rl *TopDownRL) cpuAdmitProbability(metrics *InterfaceMetrics) float64 {
+	factor := rl.cpu.penalty()
+	if factor >= 1 {
+		return 1
+	}
+	return math.Pow(factor, 1/metrics.loadImportance())
+}
+
+// cpuAdmits reports whether a request of a method passes the CPU throttling, if enabled.
+func (rl *TopDownRL) cpuAdmits(metrics *InterfaceMetrics) bool {
+	if rl.cpu == nil {
+		return true
+	}
+	p := rl.cpuAdmitProbability(metrics)
+	if p >= 1 || metrics.shed.float64() < p {
+		return true
+	}
+	metrics.cpuRejected.Add(1)
+	return false
+}
+
+// loadImportance returns the importance of a method.
+func (m *InterfaceMetrics) loadImportance() float64 {
+	return math.Float64frombits(m.importance.Load())
+}
+
+// storeImportance sets the importance of a method.
+func (m *InterfaceMetrics) storeImportance(weight float64) {
+	m.importance.Store(math.Float64bits(weight))
+}
+
+// validateImportance checks that an importance weight is positive and finite.
+func validateImportance(weight float64) error {
+	if !(weight > 0) || math.IsInf(weight, 1) {
+		return fmt.Errorf("importance must be positive and finite, got %g", weight)
+	}
+	return nil
+}
+
+// cpuMetricsLocked returns the CPU throttling of a method, or nil if it's disabled. The caller
+// must hold metrics.mu.
+func (rl *TopDownRL) cpuMetricsLocked(metrics *InterfaceMetrics) *CPUMetrics {
+	if rl.cpu == nil {
+		return nil
+	}
+	return &CPUMetrics{
+		Importance:       metrics.loadImportance(),
+		AdmitProbability: rl.cpuAdmitProbability(metrics),
+		Rejected:         metrics.CurrentCPURejected,
+		RejectedTotal:    metrics.CPURejectedTotal,
+	}
+}
+
+// CPU returns the state of CPU-aware throttling; it's the zero state unless enabled with
+// WithCPUThrottling.
+func (rl *TopDownRL) CPU() CPUState {
+	if rl.cpu == nil {
+		return CPUState{}
+	}
+	c := rl.cpu
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CPUState{
+		Utilization:      c.sample.Utilization,
+		SchedulerLatency: c.sample.SchedulerLatency,
+		Overloaded:       c.overloaded,
+		Target:           c.target,
+		SchedulerTarget:  c.config.SchedulerLatency,
+		PenaltyFactor:    c.penalty(),
+	}
+}
+
+// errCPUDisabled is returned when adjusting CPU throttling that isn't enabled.
+var errCPUDisabled = errors.New("CPU throttling is not enabled")
+
+// SetCPUTarget sets the utilization above which CPU throttling penalizes admission.
+func (rl *TopDownRL) SetCPUTarget(target float64) error {
+	if rl.cpu == nil {
+		return errCPUDisabled
+	}
+	if err := validateCPUTarget(target); err != nil {
+		return err
+	}
+	rl.cpu.mu.Lock()
+	rl.cpu.target = target
+	rl.cpu.mu.Unlock()
+	if rl.Debug {
+		rl.logger.Debugf("Set CPU target utilization: %g", target)
+	}
+	return nil
+}
+
+// SetImportance sets the importance weight of a method, which scales how much CPU throttling
+// penalizes it, see BucketConfig.Importance.
+func (rl *TopDownRL) SetImportance(method string, weight float64) error {
+	if err := validateImportance(weight); err != nil {
+		return err
+	}
+	metrics := rl.registeredMetrics(method)
+	if metrics == nil {
+		return fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+	}
+	metrics.storeImportance(weight)
+	if rl.Debug {
+		rl.logger.Debugf("Set importance for method '%s': %g", method, weight)
+	}
+	return nil
+}
+
+// cpuResponse is the JSON shape of the CPU throttling served by HandleCPU.
+type cpuResponse struct {
+	Utilization        float64            `json:"utilization"`
+	SchedulerLatencyMs float64            `json:"scheduler_latency_ms"`
+	Overloaded         bool               `json:"overloaded"`
+	Target             float64            `json:"target"`
+	SchedulerTargetMs  float64            `json:"scheduler_target_ms"`
+	PenaltyFactor      float64            `json:"penalty_factor"`
+	Importance         map[string]float64 `json:"importance"`
+}
+
+// HandleCPU handles the GET requests for the state of CPU throttling and the POST requests
+// adjusting it with a body of {"target": <float>, "importance": {"<method>": <float>}}, where
+// both fields are optional.
+func (rl *TopDownRL) HandleCPU(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleCPU called")
+	}
+	if rl.cpu == nil {
+		writeError(w, errCPUDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var data struct {
+			Target     *float64           `json:"target"`
+			Importance map[string]float64 `json:"importance"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeError(w, "Failed to decode request body", http.StatusBadRequest)
+			return
+		}
+		if data.Target != nil {
+			if err := rl.SetCPUTarget(*data.Target); err != nil {
+				writeError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		for method, weight := range data.Importance {
+			if err := rl.SetImportance(method, weight); err != nil {
+				status := http.StatusBadRequest
+				if errors.Is(err, ErrUnknownMethod) {
+					status = http.StatusNotFound
+				}
+				writeError(w, err.Error(), status)
+				return
+			}
+		}
+	default:
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	state := rl.CPU()
+	response := cpuResponse{
+		Utilization:        state.Utilization,
+		SchedulerLatencyMs: durationMs(state.SchedulerLatency),
+		Overloaded:         state.Overloaded,
+		Target:             state.Target,
+		SchedulerTargetMs:  durationMs(state.SchedulerTarget),
+		PenaltyFactor:      state.PenaltyFactor,
+		Importance:         make(map[string]float64),
+	}
+	for methodName, metrics := range *rl.published.Load() {
+		response.Importance[methodName] = metrics.loadImportance()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package topdown
+
+import "time"
+
+// processCPUTime reports that the CPU time of the process isn't available on this platform.
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,51 @@
+package topdown
+
+import (
+	"context"
+	"fmt"
+)
+
+// WithDeadlineCheck rejects unary requests whose remaining deadline is shorter than the tail
+// latency of their method in the last interval times safetyFactor, since they would most likely
+// time out anyway. They are rejected before taking a token. Requests without a deadline, and
+// methods without a tail latency yet, are not affected. A safetyFactor of zero disables the check.
+func WithDeadlineCheck(safetyFactor float64) Option {
+	return func(rl *TopDownRL) {
+		rl.deadlineFactor = safetyFactor
+	}
+}
+
+// validateDeadlineFactor checks that the safety factor of the deadline check is usable.
+func validateDeadlineFactor(factor float64) error {
+	if !(factor >= 0) {
+		return fmt.Errorf("deadline safety factor must not be negative, got %g", factor)
+	}
+	return nil
+}
+
+// doomed reports whether a request can't finish within its deadline according to the tail
+// latency of its method, and counts it if so.
+func (rl *TopDownRL) doomed(ctx context.Context, methodName string) bool {
+	if rl.deadlineFactor == 0 {
+		return false
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return false
+	}
+	metrics := rl.loadMetrics(methodName)
+	if metrics == nil {
+		return false
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	tailLatency := metrics.LastTailLatency95th
+	if tailLatency == 0 || float64(deadline.Sub(rl.clock.Now())) >= float64(tailLatency)*rl.deadlineFactor {
+		return false
+	}
+	metrics.DoomedCounter++
+	metrics.DoomedTotal++
+	return true
+}
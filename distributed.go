@@ -0,0 +1,337 @@
+package topdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Distributed mode defaults, see WithDistributed.
+const (
+	DefaultReplicaTTL      = 5 * time.Second
+	DefaultBackendTimeout  = time.Second
+	DefaultMinReplicaShare = 0.1
+)
+
+// Backend coordinates the replicas of a limiter in distributed mode, see WithDistributed. The
+// topdownredis package implements it with Redis.
+type Backend interface {
+	// Report stores the demand of a replica, in requests per second per method, for ttl, and
+	// returns the demands of all replicas whose reports haven't expired, keyed by replica.
+	Report(ctx context.Context, replica string, demand map[string]float64, ttl time.Duration) (map[string]map[string]float64, error)
+}
+
+// DistributedShare is the share of the cluster-wide rate a replica enforces for a method.
+type DistributedShare struct {
+	// Share is the replica's share of the method's refill rate.
+	Share float64
+	// ClusterDemand is the demand of all live replicas reporting the method, in requests per
+	// second, and Replicas their number, as of the last successful report.
+	ClusterDemand float64
+	Replicas      int
+}
+
+// distributedMode reports the demand of the replica after every interval and applies its shares.
+type distributedMode struct {
+	backend  Backend
+	replica  string
+	ttl      time.Duration
+	timeout  time.Duration
+	minShare float64
+	reports  chan struct{}
+	errors   atomic.Int64
+	replicas atomic.Int64
+}
+
+// WithDistributed coordinates the replicas of a service through backend, so that the refill rate
+// of a method is the rate of the whole cluster rather than of every replica. After every interval
+// each replica reports its demand, the arrivals per second of every method, and enforces the share
+// of the rate matching its share of the demand of the live replicas, or an equal share if no
+// requests arrived. Replicas with little demand keep a minimum share, see WithMinReplicaShare, so
+// they can take on traffic before their next report. A replica's report expires after the TTL,
+// WithReplicaTTL, which releases the share of a replica that stopped to the others. If the
+// backend can't be reached, the replica keeps its last shares; it enforces the whole rate until
+// its first report. replica identifies the replica and defaults to the host name and process ID.
+// The bucket capacities aren't divided.
+func WithDistributed(backend Backend, replica string) Option {
+	return func(rl *TopDownRL) {
+		if replica == "" {
+			host, _ := os.Hostname()
+			replica = fmt.Sprintf("%s-%d", host, os.Getpid())
+		}
+		rl.distributed = &distributedMode{
+			backend:  backend,
+			replica:  replica,
+			ttl:      DefaultReplicaTTL,
+			timeout:  DefaultBackendTimeout,
+			minShare: DefaultMinReplicaShare,
+			reports:  make(chan struct{}, 1),
+		}
+	}
+}
+
+// WithReplicaTTL sets how long the report of a replica counts in distributed mode; it should span
+// a few metrics intervals. Options are applied in order, so it must follow WithDistributed.
+func WithReplicaTTL(ttl time.Duration) Option {
+	return func(rl *TopDownRL) {
+		if rl.distributed != nil {
+			rl.distributed.ttl = ttl
+		}
+	}
+}
+
+// WithBackendTimeout sets the timeout of a report to the backend in distributed mode. Options are
+// applied in order, so it must follow WithDistributed.
+func WithBackendTimeout(d time.Duration) Option {
+	return func(rl *TopDownRL) {
+		if rl.distributed != nil {
+			rl.distributed.timeout = d
+		}
+	}
+}
+
+// WithMinReplicaShare sets the fraction of a method's rate, DefaultMinReplicaShare by default,
+// divided equally among the replicas in distributed mode as their minimum share; the replicas with
+// more demand share the rest of the rate in proportion to their demand. Zero divides the whole
+// rate by demand, so an idle replica rejects the first requests balanced to it. Options are
+// applied in order, so it must follow WithDistributed.
+func WithMinReplicaShare(fraction float64) Option {
+	return func(rl *TopDownRL) {
+		if rl.distributed != nil {
+			rl.distributed.minShare = fraction
+		}
+	}
+}
+
+// validate checks the distributed mode configuration.
+func (d *distributedMode) validate() error {
+	if d.backend == nil {
+		return errors.New("backend must not be nil")
+	}
+	if d.ttl <= 0 {
+		return fmt.Errorf("replica TTL must be positive, got %v", d.ttl)
+	}
+	if d.timeout <= 0 {
+		return fmt.Errorf("backend timeout must be positive, got %v", d.timeout)
+	}
+	if !(d.minShare >= 0 && d.minShare <= 1) {
+		return fmt.Errorf("minimum replica share must be between 0 and 1, got %g", d.minShare)
+	}
+	return nil
+}
+
+// Replicas returns the number of live replicas as of the last successful report, or zero if
+// distributed mode isn't enabled.
+func (rl *TopDownRL) Replicas() int {
+	if rl.distributed == nil {
+		return 0
+	}
+	return int(rl.distributed.replicas.Load())
+}
+
+// DistributedErrors returns the number of reports to the backend that failed.
+func (rl *TopDownRL) DistributedErrors() int64 {
+	if rl.distributed == nil {
+		return 0
+	}
+	return rl.distributed.errors.Load()
+}
+
+// setLimiterRateLocked sets the rate of a method's limiter to the replica's share of rate,
+// reduced by the factor of memory pressure. The caller must hold metrics.mu.
+func setLimiterRateLocked(metrics *InterfaceMetrics, rate float64) {
+	metrics.limiter.SetRate(rate * metrics.share * metrics.rateFactor)
+}
+
+// distributedStateLocked returns the share of a method in distributed mode, or nil if it isn't
+// enabled. The caller must hold metrics.mu.
+func (rl *TopDownRL) distributedStateLocked(metrics *InterfaceMetrics) *DistributedShare {
+	if rl.distributed == nil {
+		return nil
+	}
+	return &DistributedShare{Share: metrics.share, ClusterDemand: metrics.clusterDemand, Replicas: metrics.replicas}
+}
+
+// DistributedResponse is the JSON shape of a DistributedShare.
+type DistributedResponse struct {
+	Share         float64 `json:"share"`
+	ClusterDemand float64 `json:"cluster_demand"`
+	Replicas      int     `json:"replicas"`
+}
+
+// newDistributedResponse converts a share into its JSON shape, or nil if there is none.
+func newDistributedResponse(share *DistributedShare) *DistributedResponse {
+	if share == nil {
+		return nil
+	}
+	return &DistributedResponse{Share: share.Share, ClusterDemand: share.ClusterDemand, Replicas: share.Replicas}
+}
+
+// distributedLoop reports the demand of the replica whenever the metrics goroutine signals the
+// end of an interval, coalescing the signals like pushLoop.
+func (rl *TopDownRL) distributedLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-rl.distributed.reports:
+			rl.reportDemand(ctx)
+		}
+	}
+}
+
+// reportDemand reports the demand of the last interval to the backend and applies the shares
+// computed from the demands of all replicas.
+func (rl *TopDownRL) reportDemand(ctx context.Context) {
+	d := rl.distributed
+	snapshots := rl.GetAllMetrics()
+	seconds := rl.metricsInterval.Seconds()
+	demand := make(map[string]float64, len(snapshots))
+	for methodName, snapshot := range snapshots {
+		demand[methodName] = float64(snapshot.Arrivals) / seconds
+	}
+
+	reportCtx, cancel := context.WithTimeout(ctx, d.timeout)
+	demands, err := d.backend.Report(reportCtx, d.replica, demand, d.ttl)
+	cancel()
+	if err != nil {
+		if ctx.Err() == nil {
+			d.errors.Add(1)
+			rl.logger.Errorf("Failed to report demand to the distributed backend, keeping the last shares: %v", err)
+		}
+		return
+	}
+	if demands == nil {
+		demands = make(map[string]map[string]float64)
+	}
+	// The replica's own report counts even if the backend's view lags behind
+	demands[d.replica] = demand
+	d.replicas.Store(int64(len(demands)))
+	rl.applyShares(demand, demands)
+}
+
+// applyShares sets the share of every method reported in demand to its share of the demand of
+// the replicas reporting it, see replicaShare. Methods registered since the report keep their
+// shares.
+func (rl *TopDownRL) applyShares(demand map[string]float64, demands map[string]map[string]float64) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	for methodName, metrics := range rl.interfaces {
+		own, reported := demand[methodName]
+		if !reported {
+			continue
+		}
+		total, values := 0.0, make([]float64, 0, len(demands))
+		for _, replica := range demands {
+			if value, ok := replica[methodName]; ok {
+				total += value
+				values = append(values, value)
+			}
+		}
+		replicas := len(values)
+		share := 1 / float64(replicas)
+		if total > 0 {
+			share = replicaShare(own, values, rl.distributed.minShare)
+		}
+
+		metrics.mu.Lock()
+		metrics.clusterDemand = total
+		metrics.replicas = replicas
+		if share != metrics.share {
+			if rl.Debug {
+				rl.logger.Debugf("Changed share of method '%s' from %f to %f of %d replicas", methodName, metrics.share, share, replicas)
+			}
+			metrics.share = share
+			setLimiterRateLocked(metrics, metrics.RefillRate)
+		}
+		metrics.mu.Unlock()
+	}
+}
+
+// replicaShare returns the share of a replica with demand own among replicas with the given
+// demands, own included, which must not all be zero. Every replica gets at least minShare divided
+// by the replicas, and the busy ones, whose share of the demand is above that, split the rest of
+// the rate in proportion to their demand.
+func replicaShare(own float64, demands []float64, minShare float64) float64 {
+	floor := minShare / float64(len(demands))
+	raised := make([]bool, len(demands))
+	budget, busy := 1.0, 0.0
+	for {
+		budget, busy = 1, 0
+		for i, value := range demands {
+			if raised[i] {
+				budget -= floor
+			} else {
+				busy += value
+			}
+		}
+		// Raising a replica to the floor lowers the shares of the others, which may fall below it too
+		changed := false
+		for i, value := range demands {
+			if !raised[i] && budget*value < floor*busy {
+				raised[i] = true
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	if busy == 0 || budget*own < floor*busy {
+		return floor
+	}
+	return budget * own / busy
+}
+
+// MemoryBackend is a Backend keeping the reports in memory, which coordinates limiters within a
+// single process, e.g. in tests.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	reports map[string]memoryReport
+	clock   Clock
+}
+
+// memoryReport is the demand of a replica along with its expiry.
+type memoryReport struct {
+	demand  map[string]float64
+	expires time.Time
+}
+
+// NewMemoryBackend creates an empty MemoryBackend.
+func NewMemoryBackend() *MemoryBackend {
+	return NewMemoryBackendWithClock(realClock{})
+}
+
+// NewMemoryBackendWithClock creates an empty MemoryBackend whose reports expire by clock, e.g. the
+// FakeClock of the limiters sharing it.
+func NewMemoryBackendWithClock(clock Clock) *MemoryBackend {
+	return &MemoryBackend{reports: make(map[string]memoryReport), clock: clock}
+}
+
+// Report implements Backend.
+func (b *MemoryBackend) Report(ctx context.Context, replica string, demand map[string]float64, ttl time.Duration) (map[string]map[string]float64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock.Now()
+	copied := make(map[string]float64, len(demand))
+	for methodName, value := range demand {
+		copied[methodName] = value
+	}
+	b.reports[replica] = memoryReport{demand: copied, expires: now.Add(ttl)}
+
+	demands := make(map[string]map[string]float64, len(b.reports))
+	for name, report := range b.reports {
+		if !report.expires.After(now) {
+			delete(b.reports, name)
+			continue
+		}
+		demands[name] = report.demand
+	}
+	return demands, nil
+}
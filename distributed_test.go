@@ -0,0 +1,56 @@
+package topdown
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestReplicaShare(t *testing.T) {
+	tests := []struct {
+		name     string
+		own      float64
+		demands  []float64
+		minShare float64
+		want     float64
+	}{
+		{"proportional without a floor", 0, []float64{0, 100}, 0, 0},
+		{"idle replica gets the floor", 0, []float64{0, 100}, 0.1, 0.05},
+		{"busy replica gets the rest", 100, []float64{0, 100}, 0.1, 0.95},
+		{"busy replicas split the rest by demand", 30, []float64{0, 30, 70}, 0.3, 0.9 * 0.3},
+		{"replica raised by raising another", 10.5, []float64{0, 10.5, 89.5}, 0.3, 0.1},
+		{"replica left busy", 89.5, []float64{0, 10.5, 89.5}, 0.3, 0.8},
+		{"shares above the floor stay proportional", 40, []float64{40, 60}, 0.1, 0.4},
+	}
+	for _, tt := range tests {
+		if got := replicaShare(tt.own, tt.demands, tt.minShare); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: replicaShare(%v, %v, %v) = %v, want %v", tt.name, tt.own, tt.demands, tt.minShare, got, tt.want)
+		}
+	}
+}
+
+func TestIdleReplicaKeepsMinimumShare(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	backend := NewMemoryBackendWithClock(clock)
+	buckets := map[string]BucketConfig{"/a": {MaxTokens: 10, RefillRate: 100}}
+	slo := map[string]time.Duration{"/a": time.Second}
+	idle := newTestRL(t, buckets, slo, WithClock(clock), WithDistributed(backend, "idle"), WithMinReplicaShare(0.2))
+	ctx := context.Background()
+
+	if _, err := backend.Report(ctx, "busy", map[string]float64{"/a": 50}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	idle.reportDemand(ctx)
+
+	metrics := idle.loadMetrics("/a")
+	metrics.mu.Lock()
+	share, replicas := metrics.share, metrics.replicas
+	metrics.mu.Unlock()
+	if replicas != 2 || math.Abs(share-0.1) > 1e-9 {
+		t.Errorf("idle replica share = %v of %d replicas, want 0.1 of 2", share, replicas)
+	}
+	if got := metrics.limiter.Snapshot().Rate; math.Abs(got-10) > 1e-9 {
+		t.Errorf("idle replica rate = %v, want 10", got)
+	}
+}
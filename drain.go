@@ -0,0 +1,147 @@
+package topdown
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// drainState tracks the requests in flight across all methods so that Drain can wait for them.
+// Requests enter before checking the flag, so a drain either sees a request in flight or the
+// request sees the drain.
+type drainState struct {
+	draining atomic.Bool
+	inFlight atomic.Int64
+	rejected atomic.Int64
+	// idle is signalled whenever the last request in flight completes while draining.
+	idle chan struct{}
+}
+
+// enterDrain counts a request in flight, or rejects it while draining.
+func (rl *TopDownRL) enterDrain() bool {
+	rl.drain.inFlight.Add(1)
+	if rl.drain.draining.Load() {
+		rl.exitDrain()
+		rl.drain.rejected.Add(1)
+		return false
+	}
+	return true
+}
+
+// exitDrain counts a request in flight as completed.
+func (rl *TopDownRL) exitDrain() {
+	if rl.drain.inFlight.Add(-1) == 0 && rl.drain.draining.Load() {
+		select {
+		case rl.drain.idle <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Drain stops admitting requests, which are rejected with Unavailable so clients retry on another
+// backend, and waits until the requests in flight complete or ctx is done. Exempt requests are
+// still served. The limiter keeps draining after Drain returns, until Undrain.
+func (rl *TopDownRL) Drain(ctx context.Context) error {
+	if !rl.drain.draining.Swap(true) {
+		rl.drain.rejected.Store(0)
+		rl.logger.Infof("Draining, new requests are rejected")
+	}
+	for rl.drain.inFlight.Load() > 0 {
+		select {
+		case <-rl.drain.idle:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if rl.Debug {
+		rl.logger.Debugf("Drained all requests in flight")
+	}
+	return nil
+}
+
+// Undrain admits requests again after Drain, e.g. when a rollout is aborted.
+func (rl *TopDownRL) Undrain() {
+	if rl.drain.draining.Swap(false) {
+		rl.logger.Infof("Stopped draining after rejecting %d requests", rl.drain.rejected.Load())
+	}
+}
+
+// Draining reports whether the limiter is draining.
+func (rl *TopDownRL) Draining() bool {
+	return rl.drain.draining.Load()
+}
+
+// DrainRejected returns the number of requests rejected since the limiter started draining last.
+func (rl *TopDownRL) DrainRejected() int64 {
+	return rl.drain.rejected.Load()
+}
+
+// drainResponse is the JSON shape of the drain state served by HandleDrain.
+type drainResponse struct {
+	Draining bool `json:"draining"`
+	// Drained is set once no request is in flight while draining.
+	Drained  bool             `json:"drained"`
+	InFlight int64            `json:"in_flight"`
+	Methods  map[string]int64 `json:"in_flight_by_method"`
+	Rejected int64            `json:"rejected"`
+}
+
+// HandleDrain handles the POST requests to start draining, waiting for the requests in flight up
+// to the duration of an optional body of {"wait": "30s"} and answering 504 if they didn't complete
+// in time, the DELETE requests to stop draining and the GET requests for the drain state.
+func (rl *TopDownRL) HandleDrain(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleDrain called")
+	}
+
+	code := http.StatusOK
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var data struct {
+			Wait json.RawMessage `json:"wait"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, "Failed to decode request body", http.StatusBadRequest)
+			return
+		}
+		var wait time.Duration
+		if data.Wait != nil {
+			var err error
+			if wait, err = parseDuration(data.Wait); err != nil {
+				writeError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		if err := rl.Drain(ctx); err != nil && wait > 0 {
+			code = http.StatusGatewayTimeout
+		}
+	case http.MethodDelete:
+		rl.Undrain()
+	default:
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := drainResponse{
+		Draining: rl.Draining(),
+		InFlight: rl.drain.inFlight.Load(),
+		Methods:  make(map[string]int64),
+		Rejected: rl.DrainRejected(),
+	}
+	response.Drained = response.Draining && response.InFlight == 0
+	for methodName, metrics := range *rl.published.Load() {
+		response.Methods[methodName] = metrics.concurrency.current()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(response)
+}
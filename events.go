@@ -0,0 +1,271 @@
+package topdown
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// EventStreamBuffer is the number of intervals buffered for each subscriber of the event stream;
+// the intervals a subscriber can't keep up with are dropped, see HandleMetricsStream.
+const EventStreamBuffer = 16
+
+// intervalEvent holds the snapshots of all methods at the end of an interval.
+type intervalEvent struct {
+	end       time.Time
+	snapshots map[string]MetricsSnapshot
+}
+
+// eventSubscriber is a subscriber of the event stream. events is closed once the metrics goroutine
+// stops.
+type eventSubscriber struct {
+	events  chan intervalEvent
+	dropped atomic.Int64
+}
+
+// errEventsStopped is returned by subscribeEvents while the metrics goroutine isn't running, as
+// the stream would never get an event.
+var errEventsStopped = errors.New("metrics collection is stopped")
+
+// subscribeEvents returns a subscriber of the event stream and a function to cancel it, or
+// errEventsStopped once the metrics goroutine stopped.
+func (rl *TopDownRL) subscribeEvents() (*eventSubscriber, func(), error) {
+	subscriber := &eventSubscriber{events: make(chan intervalEvent, EventStreamBuffer)}
+
+	rl.eventMutex.Lock()
+	if !rl.eventsOpen {
+		rl.eventMutex.Unlock()
+		return nil, nil, errEventsStopped
+	}
+	if rl.eventSubscribers == nil {
+		rl.eventSubscribers = make(map[*eventSubscriber]struct{})
+	}
+	rl.eventSubscribers[subscriber] = struct{}{}
+	rl.eventMutex.Unlock()
+
+	return subscriber, func() {
+		rl.eventMutex.Lock()
+		defer rl.eventMutex.Unlock()
+		delete(rl.eventSubscribers, subscriber)
+	}, nil
+}
+
+// openEvents accepts subscribers of the event stream once the metrics goroutine starts.
+func (rl *TopDownRL) openEvents() {
+	rl.eventMutex.Lock()
+	defer rl.eventMutex.Unlock()
+	rl.eventsOpen = true
+}
+
+// publishEvents sends the snapshots of the interval that just ended to the subscribers of the
+// event stream, if any, without ever blocking the ticker.
+func (rl *TopDownRL) publishEvents() {
+	rl.eventMutex.Lock()
+	subscribed := len(rl.eventSubscribers) > 0
+	rl.eventMutex.Unlock()
+	if !subscribed {
+		return
+	}
+
+	event := intervalEvent{snapshots: rl.GetAllMetrics()}
+	for _, snapshot := range event.snapshots {
+		if snapshot.IntervalEnd.After(event.end) {
+			event.end = snapshot.IntervalEnd
+		}
+	}
+
+	rl.eventMutex.Lock()
+	defer rl.eventMutex.Unlock()
+	for subscriber := range rl.eventSubscribers {
+		select {
+		case subscriber.events <- event:
+		default:
+			subscriber.dropped.Add(1)
+			rl.eventsDropped.Add(1)
+		}
+	}
+}
+
+// closeEvents ends the event streams once the metrics goroutine stops, and refuses new
+// subscribers until it is restarted.
+func (rl *TopDownRL) closeEvents() {
+	rl.eventMutex.Lock()
+	defer rl.eventMutex.Unlock()
+
+	rl.eventsOpen = false
+	for subscriber := range rl.eventSubscribers {
+		close(subscriber.events)
+	}
+	rl.eventSubscribers = nil
+}
+
+// EventsDropped returns the number of intervals dropped for subscribers of the event stream that
+// didn't keep up.
+func (rl *TopDownRL) EventsDropped() int64 {
+	return rl.eventsDropped.Load()
+}
+
+// intervalEventResponse is the JSON shape of an event of the stream served by HandleMetricsStream.
+type intervalEventResponse struct {
+	// Timestamp is the end of the interval in (fractional) seconds since the Unix epoch, and
+	// Dropped the number of intervals dropped for this stream so far.
+	Timestamp float64                    `json:"timestamp"`
+	Dropped   int64                      `json:"dropped"`
+	Methods   map[string]MetricsResponse `json:"methods"`
+}
+
+// historyEventResponse is the JSON shape of an interval replayed from the history.
+type historyEventResponse struct {
+	Timestamp float64                     `json:"timestamp"`
+	Methods   map[string]IntervalResponse `json:"methods"`
+}
+
+// HandleMetricsStream handles the GET requests to stream the metrics of all methods, or of the
+// method of the 'method' parameter, as server-sent events: an 'interval' event after every metrics
+// interval, whose ID is the end of the interval in nanoseconds since the Unix epoch. With a
+// Last-Event-ID header, the later intervals still in the history are replayed first as 'history'
+// events. The stream ends once the metrics goroutine stops, e.g. with Stop, and new streams get a
+// 503 until it is restarted.
+func (rl *TopDownRL) HandleMetricsStream(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleMetricsStream called")
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	method := r.URL.Query().Get("method")
+	if method != "" && rl.registeredMetrics(method) == nil {
+		writeError(w, fmt.Sprintf("%v: '%s'", ErrUnknownMethod, method), http.StatusNotFound)
+		return
+	}
+	var lastID int64
+	if value := r.Header.Get("Last-Event-ID"); value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			writeError(w, "Invalid 'Last-Event-ID' header", http.StatusBadRequest)
+			return
+		}
+		lastID = id
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribing before the replay, so no interval falls between the history and the stream
+	subscriber, unsubscribe, err := rl.subscribeEvents()
+	if err != nil {
+		writeError(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	if lastID != 0 {
+		replayed, err := rl.replayEvents(w, method, lastID)
+		if err != nil {
+			return
+		}
+		if replayed > lastID {
+			lastID = replayed
+		}
+		flusher.Flush()
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-subscriber.events:
+			if !ok {
+				// The limiter stopped
+				return
+			}
+			id := event.end.UnixNano()
+			if id <= lastID {
+				continue
+			}
+			lastID = id
+
+			response := intervalEventResponse{
+				Timestamp: unixSeconds(event.end),
+				Dropped:   subscriber.dropped.Load(),
+				Methods:   make(map[string]MetricsResponse, len(event.snapshots)),
+			}
+			for methodName, snapshot := range event.snapshots {
+				if method == "" || methodName == method {
+					response.Methods[methodName] = newMetricsResponse(methodName, snapshot)
+				}
+			}
+			if err := writeEvent(w, "interval", id, response); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// replayEvents writes the intervals of the history that ended after the event ID lastID as
+// 'history' events, oldest first, and returns the ID of the last one.
+func (rl *TopDownRL) replayEvents(w http.ResponseWriter, method string, lastID int64) (int64, error) {
+	methods := []string{method}
+	if method == "" {
+		methods = methods[:0]
+		for methodName := range *rl.published.Load() {
+			methods = append(methods, methodName)
+		}
+	}
+
+	// The methods roll over at the same time, so their records of an interval share its end
+	since := time.Unix(0, lastID)
+	intervals := make(map[int64]map[string]IntervalResponse)
+	for _, methodName := range methods {
+		records, err := rl.GetHistory(methodName, since)
+		if err != nil {
+			continue
+		}
+		for _, record := range records {
+			id := record.Time.UnixNano()
+			if intervals[id] == nil {
+				intervals[id] = make(map[string]IntervalResponse)
+			}
+			intervals[id][methodName] = newIntervalResponse(record)
+		}
+	}
+	ids := make([]int64, 0, len(intervals))
+	for id := range intervals {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		response := historyEventResponse{Timestamp: unixSeconds(time.Unix(0, id)), Methods: intervals[id]}
+		if err := writeEvent(w, "history", id, response); err != nil {
+			return lastID, err
+		}
+		lastID = id
+	}
+	return lastID, nil
+}
+
+// writeEvent writes a server-sent event with a JSON payload.
+func writeEvent(w http.ResponseWriter, event string, id int64, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, event, data)
+	return err
+}
@@ -0,0 +1,80 @@
+package topdown
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// subscribers returns the number of subscribers of the event stream.
+func subscribers(rl *TopDownRL) int {
+	rl.eventMutex.Lock()
+	defer rl.eventMutex.Unlock()
+	return len(rl.eventSubscribers)
+}
+
+func TestHandleMetricsStream(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 5, RefillRate: 1}},
+		map[string]time.Duration{"/a": time.Second}, WithClock(clock))
+	server := httptest.NewServer(http.HandlerFunc(rl.HandleMetricsStream))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status = %d, content type = %q, want 200 and text/event-stream", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	waitUntil(t, func() bool { return subscribers(rl) == 1 })
+	clock.Advance(time.Second)
+
+	lines := bufio.NewScanner(resp.Body)
+	var event, data string
+	for lines.Scan() && lines.Text() != "" {
+		if value, ok := strings.CutPrefix(lines.Text(), "event: "); ok {
+			event = value
+		}
+		if value, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+			data = value
+		}
+	}
+	if event != "interval" {
+		t.Fatalf("event = %q, want interval", event)
+	}
+	var response intervalEventResponse
+	if err := json.Unmarshal([]byte(data), &response); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := response.Methods["/a"]; !ok || response.Timestamp != 1001 {
+		t.Errorf("event = %+v, want the metrics of /a at 1001", response)
+	}
+
+	// Stopping ends the stream and refuses new ones
+	if err := rl.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Errorf("stream ended with %v, want EOF", err)
+	}
+	refused, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.Body.Close()
+	if refused.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status after Stop = %d, want 503", refused.StatusCode)
+	}
+	if got := subscribers(rl); got != 0 {
+		t.Errorf("%d subscribers after Stop, want 0", got)
+	}
+}
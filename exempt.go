@@ -0,0 +1,201 @@
+package topdown
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// DefaultExemptions are the patterns of the methods exempt from rate limiting unless
+// WithoutDefaultExemptions is set: the health and reflection services, so load balancers don't
+// take overloaded backends for dead ones.
+var DefaultExemptions = []string{"/grpc.health.v1.*", "/grpc.reflection.*"}
+
+// WithExemptMethods exempts methods from rate limiting in addition to DefaultExemptions. A pattern
+// is either a full method name like "/grpc.health.v1.Health/Check" or a prefix followed by "*".
+func WithExemptMethods(patterns ...string) Option {
+	return func(rl *TopDownRL) {
+		exemptions := append(rl.loadExemptions(), patterns...)
+		rl.exemptions.Store(&exemptions)
+	}
+}
+
+// WithoutDefaultExemptions rate limits the health and reflection services like all other methods.
+// It only removes DefaultExemptions, so it may be combined with WithExemptMethods in any order.
+func WithoutDefaultExemptions() Option {
+	return func(rl *TopDownRL) {
+		rl.defaultExemptions = false
+	}
+}
+
+// WithExemptLatency records the outcome and latency of exempt requests to registered methods,
+// which are still admitted without taking tokens or concurrency slots.
+func WithExemptLatency(enabled bool) Option {
+	return func(rl *TopDownRL) {
+		rl.exemptLatency = enabled
+	}
+}
+
+// matchPattern reports whether a method name matches a pattern, which is either the exact name
+// or a prefix followed by "*".
+func matchPattern(pattern, method string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(method, prefix)
+	}
+	return pattern == method
+}
+
+// loadExemptions returns a copy of the current exemption patterns.
+func (rl *TopDownRL) loadExemptions() []string {
+	if exemptions := rl.exemptions.Load(); exemptions != nil {
+		return append([]string(nil), *exemptions...)
+	}
+	return nil
+}
+
+// exempt reports whether the method with the given full name is exempt from rate limiting.
+func (rl *TopDownRL) exempt(fullMethod string) bool {
+	exemptions := rl.exemptions.Load()
+	if exemptions == nil {
+		return false
+	}
+	for _, pattern := range *exemptions {
+		if matchPattern(pattern, fullMethod) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveExempt calls the handler of an exempt unary request without rate limiting it, recording
+// its outcome if WithExemptLatency is set.
+func (rl *TopDownRL) serveExempt(ctx context.Context, req interface{}, fullMethod string, handler grpc.UnaryHandler) (interface{}, error) {
+	if !rl.exemptLatency {
+		return handler(ctx, req)
+	}
+	methodName := rl.methodName(ctx, fullMethod)
+	startTime := rl.extractStartTime(ctx, methodName)
+	resp, err := handler(ctx, req)
+	rl.recordExempt(ctx, methodName, startTime, err)
+	return resp, err
+}
+
+// serveExemptStream handles an exempt stream like serveExempt.
+func (rl *TopDownRL) serveExemptStream(srv interface{}, ss grpc.ServerStream, fullMethod string, handler grpc.StreamHandler) error {
+	if !rl.exemptLatency {
+		return handler(srv, ss)
+	}
+	methodName := rl.methodName(ss.Context(), fullMethod)
+	startTime := rl.extractStartTime(ss.Context(), methodName)
+	err := handler(srv, ss)
+	rl.recordExempt(ss.Context(), methodName, startTime, err)
+	return err
+}
+
+// recordExempt records the outcome of an exempt request started at startTime if its method is
+// registered; exempt requests never register methods.
+func (rl *TopDownRL) recordExempt(ctx context.Context, methodName string, startTime time.Time, err error) {
+	if rl.registeredMetrics(methodName) == nil {
+		return
+	}
+	rl.recordOutcome(ctx, rl.clock.Now().Sub(startTime), methodName, rl.priorityTier(ctx), err)
+}
+
+// Exemptions returns the patterns of the methods exempt from rate limiting.
+func (rl *TopDownRL) Exemptions() []string {
+	exemptions := rl.loadExemptions()
+	if exemptions == nil {
+		return []string{}
+	}
+	return exemptions
+}
+
+// AddExemption exempts the methods matching pattern from rate limiting.
+func (rl *TopDownRL) AddExemption(pattern string) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	rl.addExemptionLocked(pattern)
+}
+
+// addExemptionLocked exempts the methods matching pattern. The caller must hold rl.mutex.
+func (rl *TopDownRL) addExemptionLocked(pattern string) {
+	for _, existing := range rl.loadExemptions() {
+		if existing == pattern {
+			return
+		}
+	}
+	exemptions := append(rl.loadExemptions(), pattern)
+	rl.exemptions.Store(&exemptions)
+	if rl.Debug {
+		rl.logger.Debugf("Added exemption '%s'", pattern)
+	}
+}
+
+// RemoveExemption rate limits the methods matching pattern again. It reports whether the pattern was exempt.
+func (rl *TopDownRL) RemoveExemption(pattern string) bool {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	return rl.removeExemptionLocked(pattern)
+}
+
+// removeExemptionLocked rate limits the methods matching pattern again. The caller must hold rl.mutex.
+func (rl *TopDownRL) removeExemptionLocked(pattern string) bool {
+	exemptions := rl.loadExemptions()
+	for i, existing := range exemptions {
+		if existing == pattern {
+			exemptions = append(exemptions[:i], exemptions[i+1:]...)
+			rl.exemptions.Store(&exemptions)
+			if rl.Debug {
+				rl.logger.Debugf("Removed exemption '%s'", pattern)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// HandleExemptions handles the GET requests listing the exemption patterns, the POST requests
+// adding one with a body of {"pattern": "<pattern>"} and the DELETE requests removing the one
+// given by the 'pattern' parameter.
+func (rl *TopDownRL) HandleExemptions(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleExemptions called")
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var data struct {
+			Pattern string `json:"pattern"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Pattern == "" {
+			writeError(w, "Failed to decode request body", http.StatusBadRequest)
+			return
+		}
+		rl.AddExemption(data.Pattern)
+	case http.MethodDelete:
+		pattern := r.URL.Query().Get("pattern")
+		if pattern == "" {
+			writeError(w, "Missing 'pattern' parameter", http.StatusBadRequest)
+			return
+		}
+		if !rl.RemoveExemption(pattern) {
+			writeError(w, "Unknown exemption '"+pattern+"'", http.StatusNotFound)
+			return
+		}
+	default:
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Exemptions []string `json:"exemptions"`
+	}{Exemptions: rl.Exemptions()})
+}
@@ -0,0 +1,325 @@
+package topdown
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ExportFormat is the format of the records written by WithMetricsExport.
+type ExportFormat int
+
+const (
+	// ExportCSV writes comma-separated records with a header line.
+	ExportCSV ExportFormat = iota
+	// ExportJSONL writes one JSON object per line.
+	ExportJSONL
+)
+
+// String returns the name of the format.
+func (f ExportFormat) String() string {
+	switch f {
+	case ExportCSV:
+		return "csv"
+	case ExportJSONL:
+		return "jsonl"
+	default:
+		return fmt.Sprintf("ExportFormat(%d)", int(f))
+	}
+}
+
+// ExportConfig configures the metrics export, see WithMetricsExport.
+type ExportConfig struct {
+	Format ExportFormat
+	// FlushInterval is how often the buffered records are written out; zero writes them at the
+	// end of every metrics interval. They're also written out on Stop.
+	FlushInterval time.Duration
+	// MaxSize rotates the file of WithMetricsExportFile once it grows beyond MaxSize bytes,
+	// moving it to the path with the suffix ".1"; zero never rotates.
+	MaxSize int64
+}
+
+// ExportRecord is the record of a method for one interval written by the metrics export.
+type ExportRecord struct {
+	Time          time.Time `json:"timestamp"`
+	Method        string    `json:"method"`
+	Goodput       int64     `json:"goodput"`
+	P50Ms         float64   `json:"p50_ms"`
+	P95Ms         float64   `json:"p95_ms"`
+	P99Ms         float64   `json:"p99_ms"`
+	SloMs         float64   `json:"slo_ms"`
+	SloViolations int64     `json:"slo_violations"`
+	Rejected      int64     `json:"rejected"`
+	RefillRate    float64   `json:"refill_rate"`
+	Tokens        float64   `json:"tokens"`
+}
+
+// exportHeader is the header line of the CSV format.
+var exportHeader = []string{"timestamp", "method", "goodput", "p50_ms", "p95_ms", "p99_ms", "slo_ms", "slo_violations", "rejected", "refill_rate", "tokens"}
+
+// exportPercentiles are the percentiles of the latency columns of the export.
+var exportPercentiles = []float64{0.5, 0.95, 0.99}
+
+// metricsExport writes the records of every interval to a buffered writer. The records of an
+// interval are queued while rolling over, under the locks of the methods, and written on the
+// metrics goroutine afterwards, so a slow or failing disk never affects admission. mu guards
+// the writer and is never held with any other lock.
+type metricsExport struct {
+	config ExportConfig
+	path   string
+	errors atomic.Int64
+
+	pendingMu sync.Mutex
+	pending   []ExportRecord
+
+	mu        sync.Mutex
+	writer    io.Writer
+	file      *os.File
+	size      int64
+	buffer    *bufio.Writer
+	header    bool
+	lastFlush time.Time
+}
+
+// WithMetricsExport appends a record per method and interval to w, e.g. to train a controller
+// offline from the logged traces: the goodput, the 50th, 95th and 99th percentile latency, the
+// SLO, the SLO violations, the rejections, the refill rate and the tokens of the method at the
+// end of the interval. Errors writing the records are logged and counted by ExportErrors.
+func WithMetricsExport(w io.Writer, config ExportConfig) Option {
+	return func(rl *TopDownRL) {
+		rl.export = &metricsExport{config: config, writer: w}
+	}
+}
+
+// WithMetricsExportFile is like WithMetricsExport, appending the records to the file at path and
+// rotating it once it grows beyond config.MaxSize.
+func WithMetricsExportFile(path string, config ExportConfig) Option {
+	return func(rl *TopDownRL) {
+		rl.export = &metricsExport{config: config, path: path}
+	}
+}
+
+// ExportErrors returns the number of failed writes of the metrics export.
+func (rl *TopDownRL) ExportErrors() int64 {
+	if rl.export == nil {
+		return 0
+	}
+	return rl.export.errors.Load()
+}
+
+// SwapMetricsExportWriter writes out the buffered records and makes the metrics export write to
+// w from now on, e.g. to rotate files by other criteria than their size. It returns the writer
+// replaced, which the caller may close, or an error if the export isn't enabled.
+func (rl *TopDownRL) SwapMetricsExportWriter(w io.Writer) (io.Writer, error) {
+	if rl.export == nil {
+		return nil, errors.New("metrics export not enabled")
+	}
+	e := rl.export
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.flushLocked(); err != nil {
+		rl.exportFailed(err)
+	}
+	previous := e.writer
+	if e.file != nil {
+		previous = e.file
+	}
+	e.writer, e.file, e.path, e.buffer, e.header = w, nil, "", nil, false
+	return previous, nil
+}
+
+// exportLocked queues the record of a method for the interval ending at now. The caller must
+// hold metrics.mu.
+func (rl *TopDownRL) exportLocked(metrics *InterfaceMetrics, now time.Time) {
+	if rl.export == nil {
+		return
+	}
+	record := ExportRecord{
+		Time:          now,
+		Method:        metrics.method,
+		Goodput:       metrics.CurrentGoodput,
+		P50Ms:         durationMs(metrics.exportLatencies[0.5]),
+		P95Ms:         durationMs(metrics.exportLatencies[0.95]),
+		P99Ms:         durationMs(metrics.exportLatencies[0.99]),
+		SloMs:         durationMs(metrics.SLO),
+		SloViolations: metrics.CurrentSloViolations,
+		Rejected:      metrics.CurrentRejected,
+		RefillRate:    metrics.RefillRate,
+		Tokens:        metrics.limiter.Snapshot().Available,
+	}
+	rl.export.pendingMu.Lock()
+	rl.export.pending = append(rl.export.pending, record)
+	rl.export.pendingMu.Unlock()
+}
+
+// exportIntervals writes the records queued while rolling over, in the order of the method names,
+// and writes out the buffer if the flush interval passed. It runs on the metrics goroutine only.
+func (rl *TopDownRL) exportIntervals() {
+	if rl.export == nil {
+		return
+	}
+	e := rl.export
+	e.pendingMu.Lock()
+	records := e.pending
+	e.pending = nil
+	e.pendingMu.Unlock()
+	sort.Slice(records, func(i, j int) bool { return records[i].Method < records[j].Method })
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, record := range records {
+		if err := e.writeLocked(record); err != nil {
+			rl.exportFailed(err)
+			return
+		}
+	}
+	now := rl.clock.Now()
+	if e.lastFlush.IsZero() {
+		e.lastFlush = now
+	}
+	if now.Sub(e.lastFlush) < e.config.FlushInterval {
+		return
+	}
+	e.lastFlush = now
+	if err := e.flushLocked(); err != nil {
+		rl.exportFailed(err)
+		return
+	}
+	if err := e.rotateLocked(); err != nil {
+		rl.exportFailed(err)
+	}
+}
+
+// flushExport writes out the buffered records, e.g. when the metrics goroutine stops.
+func (rl *TopDownRL) flushExport() {
+	if rl.export == nil {
+		return
+	}
+	rl.export.mu.Lock()
+	defer rl.export.mu.Unlock()
+
+	if err := rl.export.flushLocked(); err != nil {
+		rl.exportFailed(err)
+	}
+}
+
+// exportFailed counts and logs a failed write of the metrics export.
+func (rl *TopDownRL) exportFailed(err error) {
+	rl.export.errors.Add(1)
+	rl.logger.Errorf("Failed to export metrics: %v", err)
+}
+
+// exportSizeWriter counts the bytes written to the writer of the export, for rotating files.
+type exportSizeWriter struct {
+	e *metricsExport
+}
+
+// Write writes to the writer of the export; it's only called while holding e.mu.
+func (w exportSizeWriter) Write(p []byte) (int, error) {
+	n, err := w.e.writer.Write(p)
+	w.e.size += int64(n)
+	return n, err
+}
+
+// openLocked opens the file of the export, or sets up the buffer of the writer, if not done yet.
+// The caller must hold e.mu.
+func (e *metricsExport) openLocked() error {
+	if e.buffer != nil {
+		return nil
+	}
+	if e.path != "" && e.file == nil {
+		file, err := os.OpenFile(e.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		// A file appended to already has its header
+		e.file, e.writer, e.size, e.header = file, file, info.Size(), info.Size() > 0
+	}
+	e.buffer = bufio.NewWriter(exportSizeWriter{e})
+	return nil
+}
+
+// writeLocked buffers a record, preceded by the header if the CSV output doesn't have one yet.
+// The caller must hold e.mu.
+func (e *metricsExport) writeLocked(record ExportRecord) error {
+	if err := e.openLocked(); err != nil {
+		return err
+	}
+
+	if e.config.Format == ExportJSONL {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		e.buffer.Write(data)
+		e.buffer.WriteByte('\n')
+	} else {
+		w := csv.NewWriter(e.buffer)
+		if !e.header {
+			w.Write(exportHeader)
+			e.header = true
+		}
+		w.Write([]string{
+			record.Time.Format(time.RFC3339Nano),
+			record.Method,
+			strconv.FormatInt(record.Goodput, 10),
+			formatPlainFloat(record.P50Ms),
+			formatPlainFloat(record.P95Ms),
+			formatPlainFloat(record.P99Ms),
+			formatPlainFloat(record.SloMs),
+			strconv.FormatInt(record.SloViolations, 10),
+			strconv.FormatInt(record.Rejected, 10),
+			formatPlainFloat(record.RefillRate),
+			formatPlainFloat(record.Tokens),
+		})
+		w.Flush()
+	}
+	return nil
+}
+
+// flushLocked writes out the buffered records. A failed write drops them, and the file is
+// opened again for the next record. The caller must hold e.mu.
+func (e *metricsExport) flushLocked() error {
+	if e.buffer == nil {
+		return nil
+	}
+	err := e.buffer.Flush()
+	if err != nil {
+		e.buffer = nil
+		if e.file != nil {
+			e.file.Close()
+			e.file, e.writer = nil, nil
+		}
+	}
+	return err
+}
+
+// rotateLocked moves the file of the export aside once it grew beyond the maximum size, so the
+// next record opens a new one. The caller must hold e.mu after flushing the buffer.
+func (e *metricsExport) rotateLocked() error {
+	if e.file == nil || e.config.MaxSize <= 0 || e.size < e.config.MaxSize {
+		return nil
+	}
+	err := e.file.Close()
+	e.file, e.writer, e.buffer, e.header = nil, nil, nil, false
+	if err != nil {
+		return err
+	}
+	return os.Rename(e.path, e.path+".1")
+}
@@ -0,0 +1,157 @@
+package topdown
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// gcraLimiter implements the generic cell rate algorithm: instead of counting tokens it tracks the
+// theoretical arrival time (TAT) of the next request, which advances by the emission interval
+// 1/rate per unit of cost. A request is allowed if the TAT stays within the burst tolerance of now.
+type gcraLimiter struct {
+	clock Clock
+
+	mu    sync.Mutex
+	rate  float64
+	burst int64
+	tat   time.Time
+}
+
+// NewGCRALimiter creates a limiter using the generic cell rate algorithm with a sustained rate of
+// config.RefillRate and a burst of config.MaxTokens. It admits the same traffic as the token
+// bucket, but keeps a single timestamp instead of a token count.
+func NewGCRALimiter(config BucketConfig, clock Clock) Limiter {
+	return &gcraLimiter{
+		clock: clock,
+		rate:  config.RefillRate,
+		burst: config.MaxTokens,
+		tat:   clock.Now(),
+	}
+}
+
+// emissionInterval returns the time one unit of cost occupies at the current rate. The caller must hold g.mu.
+func (g *gcraLimiter) emissionInterval() time.Duration {
+	return time.Duration(float64(time.Second) / g.rate)
+}
+
+// availableLocked returns the units available at now. The caller must hold g.mu.
+func (g *gcraLimiter) availableLocked(now time.Time) float64 {
+	start := g.tat
+	if start.Before(now) {
+		start = now
+	}
+	tolerance := time.Duration(g.burst) * g.emissionInterval()
+	return float64(tolerance-start.Sub(now)) / float64(g.emissionInterval())
+}
+
+// requiredLocked returns the units that must be available to allow cost within share; like the
+// token bucket, requests that don't fit only require the full burst. The caller must hold g.mu.
+func (g *gcraLimiter) requiredLocked(cost int64, share float64) float64 {
+	need := float64(cost) + float64(g.burst)*(1-share)
+	if need > float64(g.burst) {
+		return float64(g.burst)
+	}
+	return need
+}
+
+// Allow advances the TAT by cost emission intervals if the result stays within the tolerance
+// available to the request's share.
+func (g *gcraLimiter) Allow(ctx context.Context, cost int64) bool {
+	now := g.clock.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.rate <= 0 || g.availableLocked(now) < g.requiredLocked(cost, PriorityShare(ctx)) {
+		return false
+	}
+	if g.tat.Before(now) {
+		g.tat = now
+	}
+	g.tat = g.tat.Add(time.Duration(cost) * g.emissionInterval())
+	return true
+}
+
+// SetRate changes the rate, keeping the units available at the old rate.
+func (g *gcraLimiter) SetRate(rate float64) {
+	now := g.clock.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.rate <= 0 || rate <= 0 {
+		g.rate = rate
+		g.tat = now
+		return
+	}
+	available := g.availableLocked(now)
+	g.rate = rate
+	g.tat = now.Add(time.Duration((float64(g.burst) - available) * float64(g.emissionInterval())))
+}
+
+// SetBurst changes the burst, keeping the units available up to the new burst.
+func (g *gcraLimiter) SetBurst(burst int64) {
+	now := g.clock.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.rate <= 0 {
+		g.burst = burst
+		return
+	}
+	available := g.availableLocked(now)
+	if available > float64(burst) {
+		available = float64(burst)
+	}
+	g.burst = burst
+	g.tat = now.Add(time.Duration((float64(burst) - available) * float64(g.emissionInterval())))
+}
+
+// Refund moves the TAT back by cost emission intervals, but not before now.
+func (g *gcraLimiter) Refund(cost int64) {
+	now := g.clock.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.rate <= 0 {
+		return
+	}
+	g.tat = g.tat.Add(-time.Duration(cost) * g.emissionInterval())
+	if g.tat.Before(now) {
+		g.tat = now
+	}
+}
+
+// Snapshot returns the rate, the available units and the burst.
+func (g *gcraLimiter) Snapshot() LimiterState {
+	now := g.clock.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	state := LimiterState{Rate: g.rate, Burst: g.burst}
+	if g.rate > 0 {
+		state.Available = g.availableLocked(now)
+	}
+	return state
+}
+
+// RetryAfter returns how long it takes until cost units are available within the request's share.
+func (g *gcraLimiter) RetryAfter(ctx context.Context, cost int64) (time.Duration, bool) {
+	now := g.clock.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.rate <= 0 {
+		return 0, false
+	}
+	deficit := g.requiredLocked(cost, PriorityShare(ctx)) - g.availableLocked(now)
+	if deficit <= 0 {
+		return 0, true
+	}
+	return time.Duration(deficit * float64(g.emissionInterval())), true
+}
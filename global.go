@@ -0,0 +1,118 @@
+package topdown
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// WithGlobalLimit enables a token bucket shared by all methods, holding up to maxTokens tokens and
+// refilled at refillRate tokens per second, which caps the capacity of the server as a whole.
+func WithGlobalLimit(maxTokens int64, refillRate float64) Option {
+	return func(rl *TopDownRL) {
+		rl.globalConfig = BucketConfig{MaxTokens: maxTokens, RefillRate: refillRate}
+	}
+}
+
+// GlobalLimitState is the state of the global bucket reported by the control API.
+type GlobalLimitState struct {
+	// MaxTokens is zero while the global limit is disabled.
+	MaxTokens  int64   `json:"max_tokens"`
+	RefillRate float64 `json:"refill_rate"`
+	Tokens     float64 `json:"tokens"`
+	// Rejected counts the requests rejected by the global bucket since start.
+	Rejected int64 `json:"rejected"`
+}
+
+// globalLimit is the token bucket shared by all methods.
+type globalLimit struct {
+	bucket   *tokenBucket
+	rejected atomic.Int64
+}
+
+// validateGlobalLimit checks the global bucket parameters; a maxTokens of zero disables the limit.
+func validateGlobalLimit(maxTokens int64, refillRate float64) error {
+	if maxTokens < 0 {
+		return fmt.Errorf("global max tokens must not be negative, got %d", maxTokens)
+	}
+	if maxTokens > 0 && !(refillRate > 0) {
+		return fmt.Errorf("global refill rate must be positive, got %g", refillRate)
+	}
+	return nil
+}
+
+// allowGlobal takes n tokens from the global bucket, if enabled, for a request the method's own
+// limit has admitted. The callers refund the tokens requests rejected here took from the
+// narrower limits, see refundTokens.
+func (rl *TopDownRL) allowGlobal(metrics *InterfaceMetrics, n int64) bool {
+	if rl.global.bucket.params.Load().maxTokens == 0 {
+		return true
+	}
+	if rl.global.bucket.takeShare(rl.clock.Now(), n, 1) {
+		return true
+	}
+	metrics.globalRejected.Add(1)
+	rl.global.rejected.Add(1)
+	return false
+}
+
+// GlobalLimit returns the state of the global bucket.
+func (rl *TopDownRL) GlobalLimit() GlobalLimitState {
+	p := rl.global.bucket.params.Load()
+	state := GlobalLimitState{
+		MaxTokens:  p.maxTokens / tokenScale,
+		RefillRate: p.rate,
+		Rejected:   rl.global.rejected.Load(),
+	}
+	if state.MaxTokens > 0 {
+		state.Tokens = rl.global.bucket.available(rl.clock.Now())
+	}
+	return state
+}
+
+// SetGlobalLimit changes the capacity and refill rate of the global bucket, keeping the tokens
+// it holds up to the new capacity. A maxTokens of zero disables the global limit.
+func (rl *TopDownRL) SetGlobalLimit(maxTokens int64, refillRate float64) error {
+	if err := validateGlobalLimit(maxTokens, refillRate); err != nil {
+		return err
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	rl.global.bucket.setLimits(maxTokens, refillRate, rl.clock.Now())
+	if rl.Debug {
+		rl.logger.Debugf("Set global limit: max tokens %d, refill rate %g", maxTokens, refillRate)
+	}
+	return nil
+}
+
+// HandleGlobalLimit handles the GET requests for the state of the global bucket and the POST
+// requests to change it with a body of {"max_tokens": <int>, "refill_rate": <float>}; omitted
+// fields keep their current value.
+func (rl *TopDownRL) HandleGlobalLimit(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleGlobalLimit called")
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		data := rl.GlobalLimit()
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeError(w, "Failed to decode request body", http.StatusBadRequest)
+			return
+		}
+		if err := rl.SetGlobalLimit(data.MaxTokens, data.RefillRate); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rl.GlobalLimit())
+}
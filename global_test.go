@@ -0,0 +1,102 @@
+package topdown
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGlobalRejectionRefundsNarrowerLimits(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	tenant := func(context.Context) string { return "t1" }
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 5, RefillRate: 0.1}, "/b": {MaxTokens: 5, RefillRate: 0.1, MaxQueueWait: time.Second}},
+		map[string]time.Duration{"/a": time.Second, "/b": time.Second},
+		WithClock(clock), WithGlobalLimit(1, 0.1), WithTenantLimit(TenantConfig{Key: tenant, MaxTokens: 5, RefillRate: 0.1}))
+	ctx := context.Background()
+
+	if !rl.AllowN(ctx, "/a", 1) {
+		t.Fatal("first request rejected, want it to take the only global token")
+	}
+	tests := []struct {
+		name  string
+		allow func() bool
+	}{
+		{"AllowN", func() bool { return rl.AllowN(ctx, "/b", 1) }},
+		{"admit", func() bool { return rl.admit(ctx, "/b", 1) == admitted }},
+	}
+	for _, tt := range tests {
+		if tt.allow() {
+			t.Fatalf("%s: request admitted, want the global bucket to reject it", tt.name)
+		}
+	}
+
+	metrics := rl.loadMetrics("/b")
+	if got := metrics.limiter.Snapshot().Available; got != 5 {
+		t.Errorf("method tokens = %v, want 5 after the refunds", got)
+	}
+	if got := metrics.tokensConsumed.Load(); got != 0 {
+		t.Errorf("tokens consumed = %d, want 0 for globally rejected requests", got)
+	}
+	metrics.tenants.mu.Lock()
+	entry := metrics.tenants.entries["t1"].Value.(*tenantEntry)
+	available, used := entry.bucket.available(clock.Now()), entry.used
+	metrics.tenants.mu.Unlock()
+	if available != 5 || used != 0 {
+		t.Errorf("tenant tokens = %v, used = %d, want 5 and 0 after the refunds", available, used)
+	}
+}
+
+func TestGlobalLimitCapsMethodAdmissions(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	methods := []string{"/a", "/b", "/c"}
+	buckets, slo := make(map[string]BucketConfig), make(map[string]time.Duration)
+	for _, method := range methods {
+		buckets[method], slo[method] = BucketConfig{MaxTokens: 100, RefillRate: 100}, time.Second
+	}
+	rl := newTestRL(t, buckets, slo, WithClock(clock), WithMetricsInterval(time.Hour), WithGlobalLimit(10, 10))
+	ctx := context.Background()
+
+	admitted := 0
+	for second := 0; second < 10; second++ {
+		for i := 0; i < 30; i++ {
+			if rl.AllowN(ctx, methods[i%len(methods)], 1) {
+				admitted++
+			}
+		}
+		clock.Advance(time.Second)
+	}
+	// The methods could admit all 300 requests, but together get the burst and 10/s over 9s
+	if admitted != 100 {
+		t.Errorf("methods admitted %d requests, want the 100 of the global burst and rate", admitted)
+	}
+
+	var limitRejected, globalRejected int64
+	for _, method := range methods {
+		metrics := rl.loadMetrics(method)
+		rl.rollover(metrics, clock.Now())
+		snapshot, err := rl.GetMetricsSnapshot(method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		limitRejected += snapshot.LimitRejected
+		globalRejected += snapshot.GlobalRejected
+	}
+	if limitRejected != 0 || globalRejected != 200 || rl.GlobalLimit().Rejected != 200 {
+		t.Errorf("limit rejected = %d, global rejected = %d (%d), want 0 and 200", limitRejected, globalRejected, rl.GlobalLimit().Rejected)
+	}
+
+	// Disabling the global limit over the control API leaves the method limits
+	rr := httptest.NewRecorder()
+	rl.HandleGlobalLimit(rr, httptest.NewRequest(http.MethodPost, "/global", strings.NewReader(`{"max_tokens": 0}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("set global limit status = %d, body %q", rr.Code, rr.Body.String())
+	}
+	for i := 0; i < 30; i++ {
+		if !rl.AllowN(ctx, methods[i%len(methods)], 1) {
+			t.Fatalf("request %d rejected without the global limit", i)
+		}
+	}
+}
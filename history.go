@@ -0,0 +1,229 @@
+package topdown
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultHistorySize is the default number of intervals kept in the per-method history.
+const DefaultHistorySize = 120
+
+// WithHistorySize sets the number of intervals kept in the per-method history; 0 disables it.
+func WithHistorySize(intervals int) Option {
+	return func(rl *TopDownRL) {
+		rl.historySize = intervals
+	}
+}
+
+// IntervalRecord holds the metrics of a single completed interval of a method.
+type IntervalRecord struct {
+	// Time is the end of the interval, Interval its length and Sequence its number, see
+	// MetricsSnapshot.Sequence.
+	Time            time.Time
+	Sequence        uint64
+	Interval        time.Duration
+	Goodput         int64
+	TailLatency95th time.Duration
+	SloViolations   int64
+	Rejected        int64
+	RefillRate      float64
+}
+
+// historyRing is a fixed-size ring of interval records.
+type historyRing struct {
+	records []IntervalRecord
+	next    int
+	full    bool
+}
+
+// newHistoryRing creates a ring holding up to size records.
+func newHistoryRing(size int) *historyRing {
+	return &historyRing{records: make([]IntervalRecord, size)}
+}
+
+// push adds a record, overwriting the oldest one once the ring is full.
+func (h *historyRing) push(record IntervalRecord) {
+	h.records[h.next] = record
+	h.next = (h.next + 1) % len(h.records)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// filter returns a copy of the records matching keep, oldest first.
+func (h *historyRing) filter(keep func(IntervalRecord) bool) []IntervalRecord {
+	var ordered []IntervalRecord
+	if h.full {
+		ordered = append(ordered, h.records[h.next:]...)
+	}
+	ordered = append(ordered, h.records[:h.next]...)
+
+	records := make([]IntervalRecord, 0, len(ordered))
+	for _, record := range ordered {
+		if keep(record) {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// recordIntervalLocked appends the interval that just ended at now to the history.
+// The caller must hold metrics.mu and have saved the interval's metrics.
+func (rl *TopDownRL) recordIntervalLocked(metrics *InterfaceMetrics, tailLatency time.Duration, now time.Time) {
+	start := metrics.intervalStart
+	metrics.intervalStart = now
+	metrics.Sequence++
+	metrics.IntervalEnd = now
+	notifyIntervalLocked(metrics)
+
+	if metrics.history == nil {
+		return
+	}
+	metrics.history.push(IntervalRecord{
+		Time:            now,
+		Sequence:        metrics.Sequence,
+		Interval:        now.Sub(start),
+		Goodput:         metrics.CurrentGoodput,
+		TailLatency95th: tailLatency,
+		SloViolations:   metrics.CurrentSloViolations,
+		Rejected:        metrics.CurrentRejected,
+		RefillRate:      metrics.RefillRate,
+	})
+}
+
+// GetHistory returns a copy of the recorded intervals of a method that ended after since, oldest first.
+func (rl *TopDownRL) GetHistory(method string, since time.Time) ([]IntervalRecord, error) {
+	return rl.history(method, func(record IntervalRecord) bool { return record.Time.After(since) })
+}
+
+// GetHistoryAfter returns a copy of the recorded intervals of a method with a sequence number
+// above sequence, oldest first, so the last sequence number read can be used as a cursor.
+func (rl *TopDownRL) GetHistoryAfter(method string, sequence uint64) ([]IntervalRecord, error) {
+	return rl.history(method, func(record IntervalRecord) bool { return record.Sequence > sequence })
+}
+
+// history returns a copy of the recorded intervals of a method matching keep, oldest first.
+func (rl *TopDownRL) history(method string, keep func(IntervalRecord) bool) ([]IntervalRecord, error) {
+	metrics := rl.registeredMetrics(method)
+	if metrics == nil {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	if metrics.history == nil {
+		return []IntervalRecord{}, nil
+	}
+	return metrics.history.filter(keep), nil
+}
+
+// unixSeconds returns t in (fractional) seconds since the Unix epoch, or 0 for the zero time.
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// IntervalResponse is the JSON shape of an IntervalRecord served by HandleGetHistory.
+type IntervalResponse struct {
+	// Timestamp is the end of the interval in (fractional) seconds since the Unix epoch.
+	Timestamp     float64 `json:"timestamp"`
+	Sequence      uint64  `json:"sequence"`
+	IntervalMs    float64 `json:"interval_ms"`
+	Goodput       int64   `json:"goodput"`
+	LatencyMs     float64 `json:"latency_ms"`
+	SloViolations int64   `json:"slo_violations"`
+	Rejected      int64   `json:"rejected"`
+	RefillRate    float64 `json:"refill_rate"`
+}
+
+// newIntervalResponse converts an IntervalRecord into its JSON shape.
+func newIntervalResponse(record IntervalRecord) IntervalResponse {
+	return IntervalResponse{
+		Timestamp:     unixSeconds(record.Time),
+		Sequence:      record.Sequence,
+		IntervalMs:    durationMs(record.Interval),
+		Goodput:       record.Goodput,
+		LatencyMs:     durationMs(record.TailLatency95th),
+		SloViolations: record.SloViolations,
+		Rejected:      record.Rejected,
+		RefillRate:    record.RefillRate,
+	}
+}
+
+// HandleGetHistory handles the GET requests to return the interval history of a method.
+// The optional 'since' parameter, in seconds since the Unix epoch, only returns newer intervals,
+// and 'after_sequence' only the intervals with a higher sequence number.
+func (rl *TopDownRL) HandleGetHistory(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleGetHistory called")
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	method := r.URL.Query().Get("method")
+	if method == "" {
+		writeError(w, "Missing 'method' parameter", http.StatusBadRequest)
+		return
+	}
+
+	if value := r.URL.Query().Get("after_sequence"); value != "" {
+		sequence, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			writeError(w, "Invalid 'after_sequence' parameter", http.StatusBadRequest)
+			return
+		}
+		records, err := rl.GetHistoryAfter(method, sequence)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		rl.writeHistory(w, method, records)
+		return
+	}
+
+	var since time.Time
+	if value := r.URL.Query().Get("since"); value != "" {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+			writeError(w, "Invalid 'since' parameter", http.StatusBadRequest)
+			return
+		}
+		whole, fraction := math.Modf(seconds)
+		since = time.Unix(int64(whole), int64(fraction*float64(time.Second)))
+	}
+
+	records, err := rl.GetHistory(method, since)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	rl.writeHistory(w, method, records)
+}
+
+// writeHistory writes the interval history of a method as JSON.
+func (rl *TopDownRL) writeHistory(w http.ResponseWriter, method string, records []IntervalRecord) {
+	intervals := make([]IntervalResponse, 0, len(records))
+	for _, record := range records {
+		intervals = append(intervals, newIntervalResponse(record))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Method     string             `json:"method"`
+		IntervalMs float64            `json:"interval_ms"`
+		Intervals  []IntervalResponse `json:"intervals"`
+	}{
+		Method:     method,
+		IntervalMs: durationMs(rl.MetricsInterval()),
+		Intervals:  intervals,
+	})
+}
@@ -0,0 +1,152 @@
+package topdown
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// RejectReason is the reason the interceptors rejected a request, see WithOnReject.
+type RejectReason string
+
+// Reasons for rejecting a request.
+const (
+	// RejectRateLimit is a rejection by the limits of the method, its tenant or the global bucket,
+	// including shedding and a full admission queue.
+	RejectRateLimit RejectReason = "rate_limit"
+	// RejectConcurrency is a rejection by the concurrency limit of the method.
+	RejectConcurrency RejectReason = "concurrency"
+	// RejectDeadline is a rejection of a request whose deadline is shorter than the expected
+	// latency, see WithDeadlineCheck.
+	RejectDeadline RejectReason = "deadline"
+	// RejectDraining is a rejection while the limiter is draining, see Drain.
+	RejectDraining RejectReason = "draining"
+	// RejectCircuitOpen is a rejection by the open circuit breaker of the method, see
+	// BucketConfig.Breaker.
+	RejectCircuitOpen RejectReason = "circuit_open"
+)
+
+// Outcome is how a completed request was counted, see RequestObserver.
+type Outcome string
+
+// Outcomes of completed requests.
+const (
+	// OutcomeGood is a request completed within its SLO, counting towards goodput.
+	OutcomeGood Outcome = "good"
+	// OutcomeViolating is a request completed with a good status code but after its SLO.
+	OutcomeViolating Outcome = "violating"
+	// OutcomeError is a request completed with a status code not counting towards goodput.
+	OutcomeError Outcome = "error"
+	// OutcomeCancelled is a request the client cancelled, see WithIncludeCancelled.
+	OutcomeCancelled Outcome = "cancelled"
+)
+
+// RequestObserver observes the requests going through the interceptors along with their
+// context, e.g. to annotate their spans. Its methods run like the hooks of WithOnAdmit and
+// WithOnReject, and Completed after the handler returned and the outcome was recorded; it isn't
+// called for the messages of streams measured with StreamLatencyPerMessage.
+type RequestObserver interface {
+	Admitted(ctx context.Context, method string, tokensRemaining float64)
+	Rejected(ctx context.Context, method string, reason RejectReason)
+	Completed(ctx context.Context, method string, latency time.Duration, outcome Outcome)
+}
+
+// WithRequestObserver adds an observer of the requests; several observers are called in the
+// order they were added.
+func WithRequestObserver(observer RequestObserver) Option {
+	return func(rl *TopDownRL) {
+		rl.observers = append(rl.observers, observer)
+	}
+}
+
+// WithOnAdmit calls hook whenever the interceptors admit a request, with the tokens left in the
+// bucket of the method, or +Inf if the method isn't limited. It runs on the goroutine of the
+// request after it took its tokens and before the handler is invoked.
+func WithOnAdmit(hook func(method string, tokensRemaining float64)) Option {
+	return func(rl *TopDownRL) {
+		rl.onAdmit = hook
+	}
+}
+
+// WithOnReject calls hook whenever the interceptors reject a request. It runs on the goroutine
+// of the request before the error is returned; the handler isn't invoked.
+func WithOnReject(hook func(method string, reason RejectReason)) Option {
+	return func(rl *TopDownRL) {
+		rl.onReject = hook
+	}
+}
+
+// WithOnInterval calls hook for every registered method, in the order of their names, with its
+// metrics at the end of each metrics interval. It runs on the metrics goroutine after all methods
+// rolled over and before the interval is pushed or served to watchers, so slow hooks delay the
+// next interval but never the requests.
+func WithOnInterval(hook func(method string, snapshot MetricsSnapshot)) Option {
+	return func(rl *TopDownRL) {
+		rl.onInterval = hook
+	}
+}
+
+// HookPanics returns the number of panics recovered from the hooks.
+func (rl *TopDownRL) HookPanics() int64 {
+	return rl.hookPanics.Load()
+}
+
+// runHook calls a hook, recovering and counting a panic. Hooks never run while holding any of
+// the limiter's locks.
+func (rl *TopDownRL) runHook(name string, hook func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			rl.hookPanics.Add(1)
+			rl.logger.Errorf("%s hook panicked: %v", name, r)
+		}
+	}()
+	hook()
+}
+
+// admitHook calls the OnAdmit hook and the observers, if any, for an admitted request.
+func (rl *TopDownRL) admitHook(ctx context.Context, methodName string) {
+	if rl.onAdmit == nil && len(rl.observers) == 0 {
+		return
+	}
+	tokens := rl.tokensAvailable(methodName)
+	if rl.onAdmit != nil {
+		rl.runHook("OnAdmit", func() { rl.onAdmit(methodName, tokens) })
+	}
+	for _, observer := range rl.observers {
+		rl.runHook("Observer", func() { observer.Admitted(ctx, methodName, tokens) })
+	}
+}
+
+// rejectHook calls the OnReject hook and the observers, if any, for a rejected request.
+func (rl *TopDownRL) rejectHook(ctx context.Context, methodName string, reason RejectReason) {
+	if rl.onReject != nil {
+		rl.runHook("OnReject", func() { rl.onReject(methodName, reason) })
+	}
+	for _, observer := range rl.observers {
+		rl.runHook("Observer", func() { observer.Rejected(ctx, methodName, reason) })
+	}
+}
+
+// completionHook calls the observers, if any, for a completed request.
+func (rl *TopDownRL) completionHook(ctx context.Context, methodName string, latency time.Duration, outcome Outcome) {
+	for _, observer := range rl.observers {
+		rl.runHook("Observer", func() { observer.Completed(ctx, methodName, latency, outcome) })
+	}
+}
+
+// intervalHooks calls the OnInterval hook, if any, with the metrics of every method copied
+// after the rollover.
+func (rl *TopDownRL) intervalHooks() {
+	if rl.onInterval == nil {
+		return
+	}
+	snapshots := rl.GetAllMetrics()
+	methods := make([]string, 0, len(snapshots))
+	for methodName := range snapshots {
+		methods = append(methods, methodName)
+	}
+	sort.Strings(methods)
+	for _, methodName := range methods {
+		rl.runHook("OnInterval", func() { rl.onInterval(methodName, snapshots[methodName]) })
+	}
+}
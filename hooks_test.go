@@ -0,0 +1,142 @@
+package topdown
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// eventLog records the order of the hooks and handler calls.
+type eventLog struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *eventLog) add(event string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *eventLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.events...)
+}
+
+// loggingObserver is a RequestObserver adding its calls to an eventLog.
+type loggingObserver struct {
+	log *eventLog
+}
+
+func (o loggingObserver) Admitted(context.Context, string, float64) { o.log.add("observer admitted") }
+func (o loggingObserver) Rejected(context.Context, string, RejectReason) {
+	o.log.add("observer rejected")
+}
+func (o loggingObserver) Completed(_ context.Context, _ string, _ time.Duration, outcome Outcome) {
+	o.log.add("observer " + string(outcome))
+}
+
+func TestHookOrdering(t *testing.T) {
+	events := &eventLog{}
+	var rl *TopDownRL
+	var tokens float64
+	rl = newTestRL(t, map[string]BucketConfig{echoMethod: {MaxTokens: 1, RefillRate: 0.1}},
+		map[string]time.Duration{echoMethod: time.Second}, WithClock(NewFakeClock(time.Unix(1000, 0))), WithMetricsInterval(time.Hour),
+		WithOnAdmit(func(method string, tokensRemaining float64) {
+			// Hooks run outside the locks, so they may read the limiter
+			if _, err := rl.GetMetricsSnapshot(method); err != nil {
+				t.Error(err)
+			}
+			tokens = tokensRemaining
+			events.add("admit")
+		}),
+		WithOnReject(func(method string, reason RejectReason) { events.add("reject " + string(reason)) }),
+		WithRequestObserver(loggingObserver{events}))
+	handler := func(context.Context) error {
+		events.add("handler")
+		return nil
+	}
+	conn := newTestServer(t, handler, []grpc.ServerOption{grpc.UnaryInterceptor(rl.UnaryInterceptor)})
+
+	if err := echo(context.Background(), conn, &structpb.Struct{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(context.Background(), conn, &structpb.Struct{}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("second call error = %v, want %v", err, codes.ResourceExhausted)
+	}
+	want := []string{"admit", "observer admitted", "handler", "observer good", "reject rate_limit", "observer rejected"}
+	got := events.get()
+	if len(got) != len(want) {
+		t.Fatalf("events = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("events = %q, want %q", got, want)
+		}
+	}
+	if tokens != 0 {
+		t.Errorf("tokens remaining = %v, want 0 after taking the only token", tokens)
+	}
+}
+
+func TestHookPanicsAreRecovered(t *testing.T) {
+	logger := &recordingLogger{}
+	rl := newTestRL(t, map[string]BucketConfig{echoMethod: {MaxTokens: 1, RefillRate: 0.1}},
+		map[string]time.Duration{echoMethod: time.Second}, WithMetricsInterval(time.Hour), WithLogger(logger),
+		WithOnAdmit(func(string, float64) { panic("admit") }),
+		WithOnReject(func(string, RejectReason) { panic("reject") }))
+	conn := newTestServer(t, nil, []grpc.ServerOption{grpc.UnaryInterceptor(rl.UnaryInterceptor)})
+
+	if err := echo(context.Background(), conn, &structpb.Struct{}); err != nil {
+		t.Fatalf("admitted call failed: %v", err)
+	}
+	if err := echo(context.Background(), conn, &structpb.Struct{}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("rejected call error = %v, want %v", err, codes.ResourceExhausted)
+	}
+	if got := rl.HookPanics(); got != 2 {
+		t.Errorf("hook panics = %d, want 2", got)
+	}
+	if got := logger.reset(); len(got) != 2 {
+		t.Errorf("logged %q, want the 2 panics", got)
+	}
+}
+
+func TestOnIntervalAfterRollover(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	type call struct {
+		method   string
+		arrivals int64
+	}
+	calls := make(chan call, 4)
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 10, RefillRate: 1}, "/b": {MaxTokens: 10, RefillRate: 1}},
+		map[string]time.Duration{"/a": time.Second, "/b": time.Second}, WithClock(clock),
+		WithOnInterval(func(method string, snapshot MetricsSnapshot) { calls <- call{method, snapshot.ArrivalsTotal} }))
+	intervals, unsubscribe := rl.subscribeIntervals()
+	defer unsubscribe()
+
+	for i := 0; i < 3; i++ {
+		rl.recordArrival(context.Background(), "/b")
+	}
+	clock.Advance(time.Second)
+	<-intervals
+
+	// The hooks ran for every method, in order, before the interval was served
+	want := []call{{"/a", 0}, {"/b", 3}}
+	for _, w := range want {
+		select {
+		case got := <-calls:
+			if got != w {
+				t.Errorf("OnInterval(%s, arrivals %d), want (%s, %d)", got.method, got.arrivals, w.method, w.arrivals)
+			}
+		default:
+			t.Fatalf("OnInterval not called for %s before the interval was served", w.method)
+		}
+	}
+}
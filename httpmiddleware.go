@@ -0,0 +1,222 @@
+package topdown
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// HTTPMethodFunc maps an HTTP request to the method it's limited and measured as. Requests
+// mapped to the name of a gRPC method share its limits and metrics; an empty name lets the
+// request through without rate limiting.
+type HTTPMethodFunc func(r *http.Request) string
+
+// DefaultHTTPMethod maps a request to its HTTP method and path, e.g. "GET /v1/items".
+func DefaultHTTPMethod(r *http.Request) string {
+	return r.Method + " " + r.URL.Path
+}
+
+// WithHTTPMethodFunc sets how HTTPMiddleware maps requests to methods; the default is
+// DefaultHTTPMethod.
+func WithHTTPMethodFunc(f HTTPMethodFunc) Option {
+	return func(rl *TopDownRL) {
+		rl.httpMethodFunc = f
+	}
+}
+
+// WithHTTPStartTimeHeader sets the header HTTPMiddleware reads the start time of a request from,
+// in the format set with WithTimestampFormat. By default it's the header named like the timestamp
+// key; requests without it are measured from the time the middleware got them.
+func WithHTTPStartTimeHeader(header string) Option {
+	return func(rl *TopDownRL) {
+		rl.httpStartHeader = header
+	}
+}
+
+// HTTPMiddleware wraps next to limit and measure HTTP requests like UnaryInterceptor does gRPC
+// requests, e.g. those of a grpc-gateway: requests over the limit get 429 Too Many Requests with a
+// Retry-After header in seconds, and responses with a 5xx status, or a 4xx status other than one
+// mapping to a good gRPC code, count as errors. The request headers are available to the
+// limiter as incoming metadata with lowercase keys, so the method key, priority tiers and tenant
+// header apply to HTTP requests as well.
+func (rl *TopDownRL) HTTPMiddleware(next http.Handler) http.Handler {
+	methodFunc := rl.httpMethodFunc
+	if methodFunc == nil {
+		methodFunc = DefaultHTTPMethod
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := rl.httpContext(r)
+		methodName := rl.methodName(ctx, methodFunc(r))
+		if methodName == "" || rl.exempt(methodName) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rl.recordArrival(ctx, methodName)
+		if !rl.enterDrain() {
+			rl.rejectHook(ctx, methodName, RejectDraining)
+			http.Error(w, "Server is draining, request denied", http.StatusServiceUnavailable)
+			return
+		}
+		defer rl.exitDrain()
+		startTime := rl.extractStartTime(ctx, methodName)
+		tier := rl.priorityTier(ctx)
+
+		if !rl.breakerAllows(methodName) {
+			rl.rejectHook(ctx, methodName, RejectCircuitOpen)
+			http.Error(w, "Circuit open, request denied", http.StatusServiceUnavailable)
+			return
+		}
+		if rl.doomed(ctx, methodName) {
+			rl.rejectHook(ctx, methodName, RejectDeadline)
+			http.Error(w, "Deadline shorter than the expected latency, request denied", http.StatusTooManyRequests)
+			return
+		}
+		release, ok := rl.acquireSlot(ctx, methodName)
+		if !ok {
+			rl.recordConcurrencyRejection(methodName)
+			rl.rejectHook(ctx, methodName, RejectConcurrency)
+			http.Error(w, "Concurrency limit exceeded, request denied", http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+		cost := rl.requestCost(ctx, methodName, nil)
+		switch rl.admit(ctx, methodName, cost) {
+		case abandoned:
+			// The client is gone, so there is no one to answer
+			return
+		case rejected:
+			rl.recordRejection(methodName, tier)
+			rl.recordTenantOutcome(ctx, methodName, 0, nil, true)
+			rl.rejectHook(ctx, methodName, RejectRateLimit)
+			if wait, ok := rl.retryAfter(methodName); ok {
+				// Round up so clients never retry before the token is there
+				w.Header().Set("Retry-After", strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10))
+			}
+			http.Error(w, "Rate limit exceeded, request denied", http.StatusTooManyRequests)
+			return
+		}
+		rl.recordAdmission(methodName)
+		rl.admitHook(ctx, methodName)
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		r = r.WithContext(rl.withAdmission(r.Context(), methodName, tier, cost))
+		// The outcome is recorded with the report the handler filled in
+		ctx = context.WithValue(ctx, reportKey{}, reportFrom(r.Context()))
+		next.ServeHTTP(recorder, r)
+
+		err := httpStatusError(r.Context(), recorder.status)
+		latency := rl.clock.Now().Sub(startTime)
+		outcome := rl.recordOutcome(ctx, latency, methodName, tier, err)
+		rl.recordTenantOutcome(ctx, methodName, latency, err, false)
+		rl.completionHook(ctx, methodName, latency, outcome)
+	})
+}
+
+// httpContext returns the context of an HTTP request as the limiter sees it, with the headers as
+// incoming metadata and the remote address as peer.
+func (rl *TopDownRL) httpContext(r *http.Request) context.Context {
+	md := make(metadata.MD, len(r.Header))
+	for name, values := range r.Header {
+		md[strings.ToLower(name)] = values
+	}
+	if rl.httpStartHeader != "" {
+		md[rl.timestampKeys[0]] = r.Header.Values(rl.httpStartHeader)
+	}
+	ctx := metadata.NewIncomingContext(r.Context(), md)
+	return peer.NewContext(ctx, &peer.Peer{Addr: httpAddr(r.RemoteAddr)})
+}
+
+// httpAddr is the remote address of an HTTP request.
+type httpAddr string
+
+// Network implements net.Addr.
+func (a httpAddr) Network() string { return "tcp" }
+
+// String implements net.Addr.
+func (a httpAddr) String() string { return string(a) }
+
+// httpStatusError converts the status of an HTTP response into the error a gRPC handler would
+// have returned, or nil for successful responses.
+func httpStatusError(ctx context.Context, code int) error {
+	if ctx.Err() == context.Canceled {
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	if code < 400 {
+		return nil
+	}
+	return status.Error(httpStatusCode(code), http.StatusText(code))
+}
+
+// httpStatusCode maps an HTTP error status to the gRPC code grpc-gateway maps to it.
+func httpStatusCode(code int) codes.Code {
+	switch code {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusPreconditionFailed:
+		return codes.FailedPrecondition
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case 499:
+		return codes.Canceled
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	if code < 500 {
+		return codes.FailedPrecondition
+	}
+	return codes.Internal
+}
+
+// statusRecorder records the status of an HTTP response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (s *statusRecorder) WriteHeader(code int) {
+	if !s.wroteHeader {
+		s.status, s.wroteHeader = code, true
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter.
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher for streaming responses.
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		s.wroteHeader = true
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,77 @@
+package topdown
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// WithMethodKeys sets the metadata keys carrying the method name used for rate limiting, in order
+// of precedence: the first key with a non-empty value wins. The default is "method". Keys are
+// case-insensitive, since gRPC lowercases metadata keys.
+func WithMethodKeys(keys ...string) Option {
+	return func(rl *TopDownRL) {
+		rl.methodKeys = normalizeKeys(keys)
+	}
+}
+
+// WithTimestampKeys sets the metadata keys carrying the request start time, in order of
+// precedence like WithMethodKeys. The default is "timestamp".
+func WithTimestampKeys(keys ...string) Option {
+	return func(rl *TopDownRL) {
+		rl.timestampKeys = normalizeKeys(keys)
+	}
+}
+
+// ClientOptions returns the options making ClientUnaryInterceptor and ClientStreamInterceptor
+// stamp the metadata the limiter reads: the first method and timestamp keys, and the timestamp
+// format unless it's TimestampAuto.
+func (rl *TopDownRL) ClientOptions() []ClientOption {
+	opts := []ClientOption{
+		WithClientMethodKey(rl.methodKeys[0]),
+		WithClientTimestampKey(rl.timestampKeys[0]),
+	}
+	if rl.timestampFormat != TimestampAuto {
+		opts = append(opts, WithClientTimestampFormat(rl.timestampFormat))
+	}
+	return opts
+}
+
+// normalizeKeys lowercases metadata keys like gRPC does on the wire.
+func normalizeKeys(keys []string) []string {
+	normalized := make([]string, len(keys))
+	for i, key := range keys {
+		normalized[i] = strings.ToLower(strings.TrimSpace(key))
+	}
+	return normalized
+}
+
+// validateKeys checks that there's at least one key and that all of them are usable for text
+// metadata.
+func validateKeys(keys []string) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("at least one key is required")
+	}
+	for _, key := range keys {
+		if key == "" {
+			return fmt.Errorf("keys must not be empty")
+		}
+		if strings.HasSuffix(key, "-bin") {
+			return fmt.Errorf("key '%s' is reserved for binary metadata", key)
+		}
+	}
+	return nil
+}
+
+// firstValue returns the first non-empty value of the keys in md, in order.
+func firstValue(md metadata.MD, keys []string) (string, bool) {
+	for _, key := range keys {
+		for _, value := range md[key] {
+			if value != "" {
+				return value, true
+			}
+		}
+	}
+	return "", false
+}
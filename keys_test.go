@@ -0,0 +1,67 @@
+package topdown
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestMetadataKeyPrecedence(t *testing.T) {
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 1, RefillRate: 1}},
+		map[string]time.Duration{"/a": time.Second},
+		WithMethodKeys("X-Route", "Method"), WithTimestampKeys("X-Start", "Timestamp"), WithTimestampFormat(TimestampUnixMillis))
+
+	tests := []struct {
+		name       string
+		md         metadata.MD
+		wantMethod string
+		wantStart  int64
+	}{
+		{"first key wins", metadata.Pairs("x-route", "/first", "method", "/second", "x-start", "1000", "timestamp", "2000"), "/first", 1000},
+		{"empty values are skipped", metadata.Pairs("x-route", "", "method", "/second", "x-start", "", "timestamp", "2000"), "/second", 2000},
+		{"keys set in mixed case", metadata.Pairs("X-Route", "/first", "X-Start", "1000"), "/first", 1000},
+		{"no keys", metadata.Pairs("other", "/other"), "/full", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), tt.md)
+			if got := rl.methodName(ctx, "/full"); got != tt.wantMethod {
+				t.Errorf("methodName() = %q, want %q", got, tt.wantMethod)
+			}
+			start, ok := rl.clientStartTime(ctx, "/a")
+			if ok != (tt.wantStart != 0) || ok && start.UnixMilli() != tt.wantStart {
+				t.Errorf("clientStartTime() = %v, %t, want %d ms", start.UnixMilli(), ok, tt.wantStart)
+			}
+		})
+	}
+}
+
+func TestMixedCaseKeysEndToEnd(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewFakeClock(start)
+	rl := newTestRL(t, map[string]BucketConfig{"/routed": {MaxTokens: 1, RefillRate: 1}},
+		map[string]time.Duration{"/routed": time.Second}, WithClock(clock), WithMetricsInterval(time.Hour),
+		WithMethodKeys("X-Route"), WithTimestampKeys("X-Start"), WithTimestampFormat(TimestampUnixMillis))
+	// The client clock is 2s behind, so the request violates its SLO if the server read the timestamp
+	clientOpts := append(rl.ClientOptions(), WithClientClock(NewFakeClock(start.Add(-2*time.Second))))
+	conn := newTestServer(t, nil, []grpc.ServerOption{grpc.UnaryInterceptor(rl.UnaryInterceptor)},
+		grpc.WithUnaryInterceptor(ClientUnaryInterceptor(clientOpts...)))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "X-Route", "/routed")
+	if err := echo(ctx, conn, &structpb.Struct{}); err != nil {
+		t.Fatal(err)
+	}
+	rl.rollover(rl.loadMetrics("/routed"), clock.Now())
+	snapshot, err := rl.GetMetricsSnapshot("/routed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Arrivals != 1 || snapshot.SloViolations != 1 || snapshot.UnparseableTimestamps != 0 {
+		t.Errorf("arrivals = %d, violations = %d, unparseable = %d, want 1, 1 and 0",
+			snapshot.Arrivals, snapshot.SloViolations, snapshot.UnparseableTimestamps)
+	}
+}
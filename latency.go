@@ -0,0 +1,193 @@
+package topdown
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// DefaultLatencyPrecision is the default number of significant bits kept by latency histograms,
+// which bounds the relative quantile error to 2^-(precision-1), i.e. about 1.6%.
+const DefaultLatencyPrecision = 7
+
+// validateLatencyPrecision checks that a latency histogram precision is between 1 and 14 bits.
+func validateLatencyPrecision(precision int) error {
+	if precision < 1 || precision > 14 {
+		return fmt.Errorf("latency precision must be between 1 and 14 bits, got %d", precision)
+	}
+	return nil
+}
+
+// maxTrackableLatency is the largest latency a histogram distinguishes; larger values are
+// counted in the last bucket. 2^40ns is a little over 18 minutes.
+const maxTrackableLatency = 1<<40 - 1
+
+// latencyHistogram is an HDR-style log-linear histogram of latencies in nanoseconds.
+// Values below 2^precision get a bucket each; above that, every power of two is split into
+// 2^(precision-1) equal buckets. Recording is O(1) and reading a quantile scans the buckets,
+// so the ticker never has to sort samples.
+type latencyHistogram struct {
+	precision uint
+	counts    []uint64
+	total     uint64
+}
+
+// newLatencyHistogram creates an empty histogram keeping precision significant bits.
+func newLatencyHistogram(precision int) *latencyHistogram {
+	h := &latencyHistogram{precision: uint(precision)}
+	h.counts = make([]uint64, h.bucketIndex(maxTrackableLatency)+1)
+	return h
+}
+
+// bucketIndex returns the index of the bucket holding v.
+func (h *latencyHistogram) bucketIndex(v int64) int {
+	subCount := int64(1) << h.precision
+	if v < subCount {
+		return int(v)
+	}
+	half := subCount >> 1
+	shift := uint(bits.Len64(uint64(v))) - h.precision
+	mantissa := v >> shift
+	return int(subCount + int64(shift-1)*half + (mantissa - half))
+}
+
+// bucketRange returns the lowest value and the width of bucket i.
+func (h *latencyHistogram) bucketRange(i int) (int64, int64) {
+	subCount := int64(1) << h.precision
+	if int64(i) < subCount {
+		return int64(i), 1
+	}
+	half := subCount >> 1
+	k := int64(i) - subCount
+	shift := uint(k/half) + 1
+	mantissa := k%half + half
+	return mantissa << shift, int64(1) << shift
+}
+
+// Record adds a single latency to the histogram. Negative latencies are counted as zero.
+func (h *latencyHistogram) Record(latency time.Duration) {
+	v := int64(latency)
+	if v < 0 {
+		v = 0
+	}
+	if v > maxTrackableLatency {
+		v = maxTrackableLatency
+	}
+	h.counts[h.bucketIndex(v)]++
+	h.total++
+}
+
+// Count returns the number of recorded latencies.
+func (h *latencyHistogram) Count() uint64 {
+	return h.total
+}
+
+// Quantile returns the nearest-rank quantile p (in (0, 1]) of the recorded latencies, i.e. the
+// midpoint of the bucket holding the smallest sample that is greater than or equal to p of all
+// samples. It returns 0 if the histogram is empty.
+func (h *latencyHistogram) Quantile(p float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(p * float64(h.total)))
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i, count := range h.counts {
+		seen += count
+		if seen >= rank {
+			lowest, width := h.bucketRange(i)
+			return time.Duration(lowest + (width-1)/2)
+		}
+	}
+	return maxTrackableLatency
+}
+
+// Merge adds all latencies recorded in other, which must have the same precision.
+func (h *latencyHistogram) Merge(other *latencyHistogram) {
+	for i, count := range other.counts {
+		h.counts[i] += count
+	}
+	h.total += other.total
+}
+
+// subtract removes the latencies recorded in other, which must have been merged into h before.
+func (h *latencyHistogram) subtract(other *latencyHistogram) {
+	for i, count := range other.counts {
+		h.counts[i] -= count
+	}
+	h.total -= other.total
+}
+
+// Reset clears the histogram without releasing its buckets.
+func (h *latencyHistogram) Reset() {
+	clear(h.counts)
+	h.total = 0
+}
+
+// copyFrom overwrites h with the contents of other. If their precisions differ, the latencies of
+// each bucket of other are counted at its midpoint, which is exact when other is finer than h.
+func (h *latencyHistogram) copyFrom(other *latencyHistogram) {
+	h.total = other.total
+	if h.precision == other.precision {
+		copy(h.counts, other.counts)
+		return
+	}
+	clear(h.counts)
+	for i, count := range other.counts {
+		if count > 0 {
+			lowest, width := other.bucketRange(i)
+			h.counts[h.bucketIndex(lowest+(width-1)/2)] += count
+		}
+	}
+}
+
+// latencyWindows keeps the histograms of the last intervals in a ring shared by several rolling
+// windows, each holding the merged total of its own last intervals. A window costs a single
+// histogram on top of the ring, and its totals are updated once per interval.
+type latencyWindows struct {
+	intervals []*latencyHistogram
+	next      int
+	filled    int
+	// sizes are the number of intervals of each window and merged their totals.
+	sizes  []int
+	merged []*latencyHistogram
+}
+
+// newLatencyWindows creates rolling windows over the given numbers of intervals.
+func newLatencyWindows(sizes []int, precision int) *latencyWindows {
+	w := &latencyWindows{sizes: sizes, merged: make([]*latencyHistogram, len(sizes))}
+	longest := 0
+	for i, size := range sizes {
+		if size > longest {
+			longest = size
+		}
+		w.merged[i] = newLatencyHistogram(precision)
+	}
+	w.intervals = make([]*latencyHistogram, longest)
+	for i := range w.intervals {
+		w.intervals[i] = newLatencyHistogram(precision)
+	}
+	return w
+}
+
+// push adds a completed interval to the windows, evicting the oldest interval of each full one.
+func (w *latencyWindows) push(interval *latencyHistogram) {
+	for i, size := range w.sizes {
+		if w.filled >= size {
+			w.merged[i].subtract(w.intervals[(w.next-size+len(w.intervals))%len(w.intervals)])
+		}
+	}
+	slot := w.intervals[w.next]
+	slot.copyFrom(interval)
+	for _, merged := range w.merged {
+		merged.Merge(slot)
+	}
+	w.next = (w.next + 1) % len(w.intervals)
+	if w.filled < len(w.intervals) {
+		w.filled++
+	}
+}
@@ -0,0 +1,162 @@
+package topdown
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMethodLatencyPrecision(t *testing.T) {
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 1, RefillRate: 1}, "/b": {MaxTokens: 1, RefillRate: 1}},
+		map[string]time.Duration{"/a": time.Second, "/b": time.Second}, WithMethodLatencyPrecision("/a", 12))
+
+	if got := rl.loadMetrics("/a").latencies.precision; got != 12 {
+		t.Errorf("precision of /a = %d, want 12", got)
+	}
+	if got := rl.loadMetrics("/b").latencies.precision; got != DefaultLatencyPrecision {
+		t.Errorf("precision of /b = %d, want %d", got, DefaultLatencyPrecision)
+	}
+
+	_, err := NewTopDownRLWithBuckets(nil, nil, false, WithMethodLatencyPrecision("/a", 15))
+	if err == nil {
+		t.Error("NewTopDownRLWithBuckets() accepted a precision of 15 bits")
+	}
+}
+
+func TestLatencyHistogramCopyFromFinerPrecision(t *testing.T) {
+	fine, coarse := newLatencyHistogram(12), newLatencyHistogram(DefaultLatencyPrecision)
+	want := newLatencyHistogram(DefaultLatencyPrecision)
+	for _, latency := range []time.Duration{0, 3, 200, 1234567, 5 * time.Millisecond, time.Second} {
+		fine.Record(latency)
+		want.Record(latency)
+	}
+
+	coarse.copyFrom(fine)
+	if coarse.Count() != want.Count() {
+		t.Fatalf("Count() = %d, want %d", coarse.Count(), want.Count())
+	}
+	for i := range want.counts {
+		if coarse.counts[i] != want.counts[i] {
+			t.Errorf("bucket %d = %d, want %d", i, coarse.counts[i], want.counts[i])
+		}
+	}
+}
+
+// logNormalLatencies returns n latencies around a median of 10ms with a long tail.
+func logNormalLatencies(n int) []time.Duration {
+	r := rand.New(rand.NewPCG(1, 2))
+	latencies := make([]time.Duration, n)
+	for i := range latencies {
+		latencies[i] = time.Duration(float64(10*time.Millisecond) * math.Exp(r.NormFloat64()))
+	}
+	return latencies
+}
+
+// nearestRank returns the nearest-rank quantile p of sorted.
+func nearestRank(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func TestLatencyHistogramQuantileError(t *testing.T) {
+	latencies := logNormalLatencies(100000)
+	sorted := slices.Clone(latencies)
+	slices.Sort(sorted)
+
+	for _, precision := range []int{4, DefaultLatencyPrecision, 10} {
+		h := newLatencyHistogram(precision)
+		for _, latency := range latencies {
+			h.Record(latency)
+		}
+		bound := math.Ldexp(1, -(precision - 1))
+		for _, p := range []float64{0.01, 0.5, 0.9, 0.95, 0.99, 0.999, 1} {
+			exact, got := nearestRank(sorted, p), h.Quantile(p)
+			if relative := math.Abs(float64(got-exact)) / float64(exact); relative > bound {
+				t.Errorf("precision %d: p%g = %v, want %v within %.2f%%, got %.2f%%", precision, p*100, got, exact, bound*100, relative*100)
+			}
+		}
+	}
+}
+
+// BenchmarkIntervalQuantiles compares sorting the latencies of an interval of 100k requests with
+// recording them in a histogram, both reading p95 and p99 at the end of the interval.
+func BenchmarkIntervalQuantiles(b *testing.B) {
+	latencies := logNormalLatencies(100000)
+
+	b.Run("sort", func(b *testing.B) {
+		b.ReportAllocs()
+		samples := make([]time.Duration, 0, len(latencies))
+		for i := 0; i < b.N; i++ {
+			samples = append(samples[:0], latencies...)
+			slices.Sort(samples)
+			nearestRank(samples, 0.95)
+			nearestRank(samples, 0.99)
+		}
+	})
+	b.Run("histogram", func(b *testing.B) {
+		b.ReportAllocs()
+		h := newLatencyHistogram(DefaultLatencyPrecision)
+		for i := 0; i < b.N; i++ {
+			h.Reset()
+			for _, latency := range latencies {
+				h.Record(latency)
+			}
+			h.Quantile(0.95)
+			h.Quantile(0.99)
+		}
+	})
+}
+
+func TestEmptyIntervalsThenTrafficResumes(t *testing.T) {
+	near := func(got, want time.Duration) bool { return got > want*99/100 && got < want*101/100 }
+	for _, mode := range []EmptyLatencyMode{EmptyLatencyHold, EmptyLatencyClear} {
+		clock := NewFakeClock(time.Unix(1000, 0))
+		rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 10, RefillRate: 1}},
+			map[string]time.Duration{"/a": time.Second}, WithClock(clock), WithMetricsInterval(time.Hour), WithEmptyLatencyMode(mode))
+		metrics := rl.loadMetrics("/a")
+		ctx := context.Background()
+
+		// interval records the latencies, ends an interval and returns its snapshot and JSON latency
+		interval := func(latencies ...time.Duration) (MetricsSnapshot, *float64) {
+			for _, latency := range latencies {
+				rl.recordOutcome(ctx, latency, "/a", 0, nil)
+			}
+			clock.Advance(time.Second)
+			rl.rollover(metrics, clock.Now())
+			snapshot, err := rl.GetMetricsSnapshot("/a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return snapshot, newMetricsResponse("/a", snapshot).LatencyMs
+		}
+
+		if snapshot, _ := interval(100 * time.Millisecond); snapshot.SampleCount != 1 || !near(snapshot.TailLatency95th, 100*time.Millisecond) {
+			t.Fatalf("mode %d: samples = %d, latency = %v, want 1 and 100ms", mode, snapshot.SampleCount, snapshot.TailLatency95th)
+		}
+		for i := 0; i < 2; i++ {
+			snapshot, latencyMs := interval()
+			if snapshot.SampleCount != 0 {
+				t.Errorf("mode %d, empty interval %d: samples = %d, want 0", mode, i, snapshot.SampleCount)
+			}
+			switch mode {
+			case EmptyLatencyHold:
+				if !near(snapshot.TailLatency95th, 100*time.Millisecond) || latencyMs == nil {
+					t.Errorf("held empty interval %d: latency = %v, JSON %v, want the last 100ms", i, snapshot.TailLatency95th, latencyMs)
+				}
+			case EmptyLatencyClear:
+				if snapshot.TailLatency95th != 0 || len(snapshot.TailLatencies) != 0 || latencyMs != nil {
+					t.Errorf("cleared empty interval %d: latency = %v, JSON %v, want none", i, snapshot.TailLatency95th, latencyMs)
+				}
+			}
+		}
+		if snapshot, latencyMs := interval(200 * time.Millisecond); snapshot.SampleCount != 1 || !near(snapshot.TailLatency95th, 200*time.Millisecond) || latencyMs == nil {
+			t.Errorf("mode %d, traffic resumed: samples = %d, latency = %v, JSON %v, want 1 and 200ms", mode, snapshot.SampleCount, snapshot.TailLatency95th, latencyMs)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package topdown
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"time"
+)
+
+// sloBucketFactors are the multiples of the SLO used as latency bucket bounds by default.
+var sloBucketFactors = []float64{0.1, 0.25, 0.5, 0.75, 1, 1.5, 2, 5, 10}
+
+// LatencyBuckets holds the latencies of the last interval counted in fixed buckets, the requests
+// counted towards goodput or SLO violations. Counts[i] is the number of requests with a latency
+// above Bounds[i-1] and up to Bounds[i]; the last count, Counts[len(Bounds)], holds the requests
+// above the last bound.
+type LatencyBuckets struct {
+	Bounds []time.Duration
+	Counts []uint64
+}
+
+// WithLatencyBuckets sets the bounds of the latency buckets counted for every method, in
+// increasing order, e.g. ExponentialLatencyBuckets(time.Millisecond, 2, 14) for 1ms to about 8s.
+// By default the bounds are 0.1, 0.25, 0.5, 0.75, 1, 1.5, 2, 5 and 10 times the method's SLO.
+func WithLatencyBuckets(bounds ...time.Duration) Option {
+	return func(rl *TopDownRL) {
+		rl.latencyBounds = append([]time.Duration(nil), bounds...)
+	}
+}
+
+// ExponentialLatencyBuckets returns count bucket bounds starting at start, each factor times the
+// previous one.
+func ExponentialLatencyBuckets(start time.Duration, factor float64, count int) []time.Duration {
+	bounds := make([]time.Duration, count)
+	for i := range bounds {
+		bounds[i] = time.Duration(float64(start) * math.Pow(factor, float64(i)))
+	}
+	return bounds
+}
+
+// validateLatencyBounds checks that the bounds are positive and strictly increasing.
+func validateLatencyBounds(bounds []time.Duration) error {
+	for i, bound := range bounds {
+		if bound <= 0 {
+			return fmt.Errorf("bounds must be positive, got %v", bound)
+		}
+		if i > 0 && bound <= bounds[i-1] {
+			return fmt.Errorf("bounds must be strictly increasing, got %v after %v", bound, bounds[i-1])
+		}
+	}
+	return nil
+}
+
+// latencyBuckets counts the latencies of the current interval of a method in fixed buckets.
+type latencyBuckets struct {
+	bounds []time.Duration
+	counts []uint64
+	// slo is the SLO the bounds derive from, or zero if they are configured.
+	slo time.Duration
+}
+
+// newLatencyBuckets creates the buckets of a method with the given SLO.
+func (rl *TopDownRL) newLatencyBuckets(slo time.Duration) *latencyBuckets {
+	if len(rl.latencyBounds) > 0 {
+		return &latencyBuckets{bounds: rl.latencyBounds, counts: make([]uint64, len(rl.latencyBounds)+1)}
+	}
+	bounds := make([]time.Duration, len(sloBucketFactors))
+	for i, factor := range sloBucketFactors {
+		bounds[i] = time.Duration(float64(slo) * factor)
+	}
+	return &latencyBuckets{bounds: bounds, counts: make([]uint64, len(bounds)+1), slo: slo}
+}
+
+// record counts a single latency.
+func (b *latencyBuckets) record(latency time.Duration) {
+	b.counts[sort.Search(len(b.bounds), func(i int) bool { return latency <= b.bounds[i] })]++
+}
+
+// rolloverLatencyBucketsLocked saves the bucket counts of the interval and resets them, deriving
+// the bounds from the SLO again if it changed. The caller must hold metrics.mu.
+func (rl *TopDownRL) rolloverLatencyBucketsLocked(metrics *InterfaceMetrics) {
+	b := metrics.latencyBuckets
+	metrics.LastLatencyBuckets = LatencyBuckets{Bounds: b.bounds, Counts: b.counts}
+	if b.slo != 0 && b.slo != metrics.SLO {
+		metrics.latencyBuckets = rl.newLatencyBuckets(metrics.SLO)
+		return
+	}
+	// The saved counts are handed out by snapshots, so they are never written again
+	b.counts = make([]uint64, len(b.bounds)+1)
+}
+
+// copyLatencyBuckets returns a copy of buckets safe to hand out.
+func copyLatencyBuckets(buckets LatencyBuckets) LatencyBuckets {
+	return LatencyBuckets{Bounds: slices.Clone(buckets.Bounds), Counts: slices.Clone(buckets.Counts)}
+}
+
+// LatencyBucketsResponse is the JSON shape of LatencyBuckets, with the bounds in milliseconds.
+type LatencyBucketsResponse struct {
+	BoundsMs []float64 `json:"bounds_ms"`
+	Counts   []uint64  `json:"counts"`
+}
+
+// newLatencyBucketsResponse converts latency buckets into their JSON shape.
+func newLatencyBucketsResponse(buckets LatencyBuckets) LatencyBucketsResponse {
+	bounds := make([]float64, len(buckets.Bounds))
+	for i, bound := range buckets.Bounds {
+		bounds[i] = durationMs(bound)
+	}
+	return LatencyBucketsResponse{BoundsMs: bounds, Counts: buckets.Counts}
+}
@@ -1,121 +1,558 @@
 package topdown
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
-	"sync/atomic"
+	"strings"
 )
 
 // StartServer starts the HTTP server that handles GET and SET requests for metrics and rate limits.
+// It blocks until the server fails or is shut down by Stop, and returns nil after Stop.
 func (rl *TopDownRL) StartServer(portn int) error {
-	http.HandleFunc("/metrics", rl.HandleGetMetrics)    // Handles GET requests to fetch metrics
-	http.HandleFunc("/set_rate", rl.HandleSetRateLimit) // Handles POST requests to set the rate limit
+	return rl.serve(rl.NewServer(portn), (*http.Server).ListenAndServe)
+}
 
-	portStr := fmt.Sprintf(":%d", portn)
-	log.Println("Starting Topdown RL agent server on", portStr)
-	if err := http.ListenAndServe(portStr, nil); err != nil {
-		log.Fatalf("Could not start server: %s\n", err)
-		return err
+// StartServerTLS is like StartServer but serves HTTPS with config, which must carry the server
+// certificate. Set config.ClientAuth to require client certificates, see LoadTLSConfig.
+func (rl *TopDownRL) StartServerTLS(portn int, config *tls.Config) error {
+	server := rl.NewServer(portn)
+	server.TLSConfig = config
+	return rl.serve(server, func(s *http.Server) error { return s.ListenAndServeTLS("", "") })
+}
+
+// StartServerOn is like StartServer but serves on an already bound listener, e.g. a unix domain
+// socket for sidecar setups. Wrap the listener with tls.NewListener to serve HTTPS.
+func (rl *TopDownRL) StartServerOn(l net.Listener) error {
+	server := rl.NewServer(0)
+	server.Addr = l.Addr().String()
+	return rl.serve(server, func(s *http.Server) error { return s.Serve(l) })
+}
+
+// StartServerBackground binds the control server to portn and serves it on a new goroutine.
+// Unlike StartServer it returns as soon as the port is bound, with an error if it can't be;
+// later serving errors are logged. Stop shuts the server down.
+func (rl *TopDownRL) StartServerBackground(portn int) error {
+	server := rl.NewServer(portn)
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return fmt.Errorf("could not start server: %w", err)
+	}
+
+	// The server is registered before returning so that Stop always finds it
+	rl.registerServer(server)
+	go func() {
+		if err := rl.runServer(server, func(s *http.Server) error { return s.Serve(l) }); err != nil {
+			rl.logger.Errorf("Control server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Server returns the running control server, or nil if none was started or it was stopped.
+func (rl *TopDownRL) Server() *http.Server {
+	rl.lifecycleMutex.Lock()
+	defer rl.lifecycleMutex.Unlock()
+
+	return rl.server
+}
+
+// serve registers server for Stop and runs it until it fails or is shut down.
+func (rl *TopDownRL) serve(server *http.Server, run func(*http.Server) error) error {
+	rl.registerServer(server)
+	return rl.runServer(server, run)
+}
+
+// registerServer makes server the control server shut down by Stop.
+func (rl *TopDownRL) registerServer(server *http.Server) {
+	rl.lifecycleMutex.Lock()
+	defer rl.lifecycleMutex.Unlock()
+
+	rl.server = server
+}
+
+// runServer runs a registered server until it fails or is shut down.
+func (rl *TopDownRL) runServer(server *http.Server, run func(*http.Server) error) error {
+	rl.logger.Infof("Starting Topdown RL agent server on %s", server.Addr)
+	if err := run(server); err != nil && err != http.ErrServerClosed {
+		rl.lifecycleMutex.Lock()
+		if rl.server == server {
+			rl.server = nil
+		}
+		rl.lifecycleMutex.Unlock()
+		return fmt.Errorf("could not start server: %w", err)
 	}
 	return nil
 }
 
-// SetRateLimit sets the rate limit (token bucket refill rate) from an external source.
+// NewServer returns an HTTP server for the control endpoints listening on portn, backed by
+// a ServeMux owned by this TopDownRL. The caller is responsible for starting and stopping it.
+// The server has default timeouts, which WithServerConfig can adjust.
+func (rl *TopDownRL) NewServer(portn int) *http.Server {
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", portn),
+		Handler:           rl.Handler(),
+		ReadHeaderTimeout: DefaultReadHeaderTimeout,
+		IdleTimeout:       DefaultIdleTimeout,
+	}
+	if rl.serverConfig != nil {
+		rl.serverConfig(server)
+	}
+	return server
+}
+
+// Handler returns a new http.Handler serving the control endpoints at the root path.
+func (rl *TopDownRL) Handler() http.Handler {
+	mux := http.NewServeMux()
+	rl.RegisterHandlers(mux, "")
+	return mux
+}
+
+// RegisterHandlers mounts the control endpoints onto mux under the given path prefix,
+// e.g. a prefix of "/topdown" serves metrics at "/topdown/v1/metrics" and "/topdown/metrics", see
+// APIVersion. Errors are answered with an ErrorResponse. All endpoints but /healthz,
+// which load balancers probe, require authentication if configured with WithAuthToken or WithAuthFunc.
+func (rl *TopDownRL) RegisterHandlers(mux *http.ServeMux, prefix string) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	// Every endpoint is served under the API version and, for older agents, at its unversioned path
+	handle := func(path string, handler http.Handler) {
+		handler = rl.limitBody(handler)
+		mux.Handle(prefix+"/"+APIVersion+path, handler)
+		mux.Handle(prefix+path, handler)
+	}
+	handle("/metrics", rl.authenticate(rl.HandleGetMetrics))             // Handles GET requests to fetch metrics
+	handle("/metrics/tenants", rl.authenticate(rl.HandleTenantMetrics))  // Handles GET requests to fetch the metrics of the busiest tenants
+	handle("/metrics/history", rl.authenticate(rl.HandleGetHistory))     // Handles GET requests to fetch the interval history
+	handle("/metrics/next", rl.authenticate(rl.HandleNextMetrics))       // Handles GET requests to wait for the next interval
+	handle("/metrics/stream", rl.authenticate(rl.HandleMetricsStream))   // Handles GET requests to stream the metrics as server-sent events
+	handle("/peer_metrics", rl.authenticate(rl.HandlePeerMetrics))       // Handles POST requests with the metrics of the peers
+	handle("/budget", rl.authenticate(rl.HandleBudget))                  // Handles GET requests to fetch the error budget of a method
+	handle("/alerts", rl.authenticate(rl.HandleAlerts))                  // Handles GET requests to list the alert rules and their firing state
+	handle("/set_rate", rl.authenticate(rl.HandleSetRateLimit))          // Handles POST requests to set the rate limit
+	handle("/prometheus", rl.authenticate(rl.HandlePrometheus))          // Handles Prometheus scrapes
+	handle("/set_slo", rl.authenticate(rl.HandleSetSLO))                 // Handles POST requests to set the SLO
+	handle("/methods", rl.authenticate(rl.HandleMethods))                // Handles requests to list, register and unregister methods
+	handle("/config", rl.authenticate(rl.HandleConfig))                  // Handles requests to get and update the configuration
+	handle("/controller", rl.authenticate(rl.HandleController))          // Handles requests to get and update the rate controller
+	handle("/set_shadow", rl.authenticate(rl.HandleSetShadowMode))       // Handles POST requests to toggle shadow mode
+	handle("/set_concurrency", rl.authenticate(rl.HandleSetConcurrency)) // Handles POST requests to set the concurrency limit
+	handle("/set_bounds", rl.authenticate(rl.HandleSetBounds))           // Handles POST requests to set the rate bounds
+	handle("/set_shed", rl.authenticate(rl.HandleSetShed))               // Handles POST requests to set the shed probability
+	handle("/buckets", rl.authenticate(rl.HandleBuckets))                // Handles GET requests to list the bucket state of all methods
+	handle("/changes", rl.authenticate(rl.HandleChanges))                // Handles GET requests to list the latest rate, capacity and SLO changes
+	handle("/global", rl.authenticate(rl.HandleGlobalLimit))             // Handles GET and POST requests for the global limit
+	handle("/exemptions", rl.authenticate(rl.HandleExemptions))          // Handles GET, POST and DELETE requests for the exempt methods
+	handle("/groups", rl.authenticate(rl.HandleBorrowingGroups))         // Handles GET and POST requests for the borrowing groups
+	handle("/method_groups", rl.authenticate(rl.HandleMethodGroups))     // Handles GET and POST requests for the method groups
+	handle("/healthz", http.HandlerFunc(rl.HandleHealth))                // Handles GET requests for the overload state
+	handle("/drain", rl.authenticate(rl.HandleDrain))                    // Handles requests to start, stop and check draining
+	handle("/breaker", rl.authenticate(rl.HandleBreaker))                // Handles GET and POST requests for the circuit breakers
+	handle("/cpu", rl.authenticate(rl.HandleCPU))                        // Handles GET and POST requests for the CPU throttling
+}
+
+// SetRateLimit sets the rate limit (token bucket refill rate) from an external source. Rates
+// outside the bounds of the method are clamped or rejected, see WithRateBoundsMode, while
+// negative, infinite and NaN rates are always rejected. With WithRateRamp, the rate moves toward
+// the new one over the ramp duration.
 func (rl *TopDownRL) SetRateLimit(method string, rateLimit float64) {
+	rl.setRateLimit(method, rateLimit, rateOptions{}, apiSource)
+}
+
+// SetRateLimitImmediately sets the rate limit like SetRateLimit, but bypasses the ramp set
+// through WithRateRamp, e.g. to cut the rate of an overloaded method at once.
+func (rl *TopDownRL) SetRateLimitImmediately(method string, rateLimit float64) {
+	rl.setRateLimit(method, rateLimit, rateOptions{immediate: true}, apiSource)
+}
+
+// setRateLimit sets the rate limit of a method on behalf of source as opts say, logging failures.
+func (rl *TopDownRL) setRateLimit(method string, rateLimit float64, opts rateOptions, source changeSource) error {
+	// The change log is written once the lock is released
+	defer rl.changes.flush()
 	rl.mutex.Lock()
 	defer rl.mutex.Unlock()
-	// rl.refillRate = int64(rateLimit)
 
-	if metrics, exists := rl.interfaces[method]; exists {
-		metrics.RefillRate = int64(rateLimit)
-		if rl.Debug {
-			log.Printf("[DEBUG] Set new rate limit for method '%s': %f\n", method, rateLimit)
+	err := rl.setRateLimitLocked(method, rateLimit, opts, source)
+	if err != nil {
+		rl.logger.Errorf("Failed to set rate limit for method '%s': %v", method, err)
+	}
+	return err
+}
+
+// SetRateLimits sets the rate limits of several methods atomically, so no request observes
+// a mix of old and new rates. It returns the error for every method that couldn't be updated.
+func (rl *TopDownRL) SetRateLimits(rates map[string]float64) map[string]error {
+	return rl.setRateLimits(rates, rateOptions{}, apiSource)
+}
+
+// setRateLimits sets the rate limits of several methods atomically on behalf of source.
+func (rl *TopDownRL) setRateLimits(rates map[string]float64, opts rateOptions, source changeSource) map[string]error {
+	defer rl.changes.flush()
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	errs := make(map[string]error)
+	for method, rateLimit := range rates {
+		if err := rl.setRateLimitLocked(method, rateLimit, opts, source); err != nil {
+			errs[method] = err
 		}
+	}
+	return errs
+}
+
+// checkRateLimitLocked checks that setRateLimitLocked accepts a rate for a method, without
+// changing anything. The caller must hold rl.mutex.
+func (rl *TopDownRL) checkRateLimitLocked(method string, rateLimit float64) error {
+	if err := validateRate(rateLimit); err != nil {
+		return err
+	}
+	method = rl.methodGroupOf(method)
+	metrics, exists := rl.interfaces[method]
+	if !exists {
+		return fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+	}
+	if rl.ControllerMode() == ControllerNone {
+		return ErrRatesFixed
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	_, err := rl.boundRateLocked(method, metrics, rateLimit)
+	return err
+}
+
+// setRateLimitLocked updates the refill rate of a single method on behalf of source, or starts
+// ramping toward it, as opts say. The caller must hold rl.mutex.
+func (rl *TopDownRL) setRateLimitLocked(method string, rateLimit float64, opts rateOptions, source changeSource) error {
+	if err := validateRate(rateLimit); err != nil {
+		return err
+	}
+	// The members of method groups share the rate of their group
+	method = rl.methodGroupOf(method)
+	metrics, exists := rl.interfaces[method]
+	if !exists {
+		return fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+	}
+
+	mode := rl.ControllerMode()
+	if mode == ControllerNone {
+		return ErrRatesFixed
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	requested := rateLimit
+	rateLimit, err := rl.boundRateLocked(method, metrics, rateLimit)
+	if err != nil {
+		return err
+	}
+	if mode != ControllerExternal {
+		rl.logger.Infof("Rate limit for method '%s' set externally while the %s controller is active; it applies until the controller's next adjustment", method, mode)
+	}
+	if opts.ttl <= 0 && metrics.schedule.activeLocked() {
+		// Scheduled rates take precedence over the baseline until their entry ends
+		rl.logger.Infof("Rate limit for method '%s' set while a rate schedule entry is active; it applies once the entry ends", method)
+		metrics.schedule.baseline = rateLimit
+		if metrics.override != nil {
+			scheduled := rl.scheduledRateLocked(metrics)
+			rl.recordChange(method, ChangeFieldRefillRate, targetRateLocked(metrics), scheduled, source)
+			metrics.override = nil
+			rl.startRampLocked(metrics, scheduled, opts.immediate)
+		}
+		return nil
+	}
+	// The change log records the target of a ramp rather than its steps
+	if previous := targetRateLocked(metrics); rateLimit != requested {
+		rl.recordClampedChange(method, ChangeFieldRefillRate, previous, rateLimit, requested, source)
 	} else {
-		log.Printf("[ERROR] Method '%s' not found when trying to set rate limit\n", method)
+		rl.recordChange(method, ChangeFieldRefillRate, previous, rateLimit, source)
 	}
+	rl.overrideLocked(metrics, opts.ttl)
+	rl.startRampLocked(metrics, rateLimit, opts.immediate)
+	// The PID controller continues from the new rate
+	metrics.pid = PIDState{}
+	if rl.Debug {
+		rl.logger.Debugf("Set new rate limit for method '%s': %f", method, rateLimit)
+	}
+	return nil
 }
 
-// GetMetrics returns the current goodput and latency.
-func (rl *TopDownRL) GetMetrics(method string) (float64, float64) {
+// SetMaxTokens changes the capacity (burst size) of a method's bucket. The tokens beyond the new
+// capacity are discarded, while a larger capacity fills up at the refill rate.
+func (rl *TopDownRL) SetMaxTokens(method string, maxTokens int64) error {
+	return rl.setMaxTokens(method, maxTokens, apiSource)
+}
+
+// setMaxTokens changes the capacity of a method's bucket on behalf of source.
+func (rl *TopDownRL) setMaxTokens(method string, maxTokens int64, source changeSource) error {
+	if maxTokens <= 0 {
+		return fmt.Errorf("max tokens must be positive, got %d", maxTokens)
+	}
+
+	defer rl.changes.flush()
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	return rl.setMaxTokensLocked(method, maxTokens, source)
+}
+
+// checkMaxTokensLocked checks that setMaxTokensLocked accepts a capacity for a method, without
+// changing anything. The caller must hold rl.mutex.
+func (rl *TopDownRL) checkMaxTokensLocked(method string, maxTokens int64) error {
+	if maxTokens <= 0 {
+		return fmt.Errorf("max tokens must be positive, got %d", maxTokens)
+	}
+	method = rl.methodGroupOf(method)
+	metrics, exists := rl.interfaces[method]
+	if !exists {
+		return fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+	}
+	if _, ok := metrics.limiter.(BurstLimiter); !ok {
+		return fmt.Errorf("%w: '%s'", ErrBurstFixed, method)
+	}
+	return nil
+}
+
+// setRateAndMaxTokens sets the rate and the capacity of a method on behalf of source, either of
+// which may be nil. Both are validated before either applies, under one hold of rl.mutex, so a
+// rejected update changes neither.
+func (rl *TopDownRL) setRateAndMaxTokens(method string, rateLimit *float64, maxTokens *int64, opts rateOptions, source changeSource) error {
+	defer rl.changes.flush()
 	rl.mutex.Lock()
 	defer rl.mutex.Unlock()
 
-	if metrics, exists := rl.interfaces[method]; exists {
-		return float64(atomic.LoadInt64(&metrics.CurrentGoodput)), float64(metrics.LastTailLatency95th.Milliseconds())
+	err := rl.checkRateAndMaxTokensLocked(method, rateLimit, maxTokens)
+	if err == nil && maxTokens != nil {
+		err = rl.setMaxTokensLocked(method, *maxTokens, source)
+	}
+	if err == nil && rateLimit != nil {
+		err = rl.setRateLimitLocked(method, *rateLimit, opts, source)
+	}
+	if err != nil {
+		rl.logger.Errorf("Failed to update method '%s': %v", method, err)
+	}
+	return err
+}
+
+// checkRateAndMaxTokensLocked checks the rate and the capacity of an update of a method, either
+// of which may be nil. The caller must hold rl.mutex.
+func (rl *TopDownRL) checkRateAndMaxTokensLocked(method string, rateLimit *float64, maxTokens *int64) error {
+	if maxTokens != nil {
+		if err := rl.checkMaxTokensLocked(method, *maxTokens); err != nil {
+			return err
+		}
+	}
+	if rateLimit != nil {
+		return rl.checkRateLimitLocked(method, *rateLimit)
+	}
+	return nil
+}
+
+// setMaxTokensLocked changes the validated capacity of a method's bucket on behalf of source. The
+// caller must hold rl.mutex.
+func (rl *TopDownRL) setMaxTokensLocked(method string, maxTokens int64, source changeSource) error {
+	method = rl.methodGroupOf(method)
+	metrics, exists := rl.interfaces[method]
+	if !exists {
+		return fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+	}
+	limiter, ok := metrics.limiter.(BurstLimiter)
+	if !ok {
+		return fmt.Errorf("%w: '%s'", ErrBurstFixed, method)
 	}
 
-	log.Printf("[ERROR] Method '%s' not found when trying to get metrics\n", method)
-	return 0, 0
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	limiter.SetBurst(maxTokens)
+	rl.recordChange(method, ChangeFieldMaxTokens, float64(metrics.MaxTokens), float64(maxTokens), source)
+	metrics.MaxTokens = maxTokens
+	if metrics.schedule.activeLocked() {
+		// The burst also holds once the active schedule entry ends
+		metrics.schedule.baselineTokens = maxTokens
+	}
+	if rl.Debug {
+		rl.logger.Debugf("Set new max tokens for method '%s': %d", method, maxTokens)
+	}
+	return nil
 }
 
-// handleSetRateLimit handles the SET requests to update the rate limit.
+// GetMetrics returns the current goodput and the 95th percentile tail latency in milliseconds,
+// smoothed if enabled with WithSmoothing. Use GetMetricsSnapshot for the full set of metrics.
+func (rl *TopDownRL) GetMetrics(method string) (float64, float64) {
+	snapshot, err := rl.GetMetricsSnapshot(method)
+	if err != nil {
+		rl.logger.Errorf("Method '%s' not found when trying to get metrics", method)
+		return 0, 0
+	}
+	return snapshot.SmoothedGoodput, float64(snapshot.SmoothedTailLatency.Milliseconds())
+}
+
+// handleSetRateLimit handles the SET requests to update the rate limit, see SetRateRequest. Rates,
+// bursts and TTLs that fail validation are answered with 422.
 func (rl *TopDownRL) HandleSetRateLimit(w http.ResponseWriter, r *http.Request) {
 	if rl.Debug {
-		log.Println("[DEBUG] HandleSetRateLimit called")
+		rl.logger.Debugf("HandleSetRateLimit called")
 	}
 
 	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Extract the method from query parameters
+	var data SetRateRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeError(w, "Failed to decode request body", http.StatusBadRequest)
+		return
+	}
+
+	// Extract the method from query parameters; without it the body carries a batch of rates
 	method := r.URL.Query().Get("method")
 	if method == "" {
-		http.Error(w, "Missing 'method' parameter", http.StatusBadRequest)
+		rl.handleSetRateLimits(w, r, data)
 		return
 	}
 
-	var data struct {
-		RateLimit float64 `json:"rate_limit"`
+	ttl, err := ttlFromSeconds(data.TTLSeconds)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusUnprocessableEntity)
+		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, "Failed to decode request body", http.StatusBadRequest)
+
+	// The burst may change on its own, even while the rates are fixed
+	setRate := data.RateLimit != nil || data.MaxTokens == nil
+	if setRate && rl.ControllerMode() == ControllerNone {
+		writeError(w, ErrRatesFixed.Error(), http.StatusConflict)
+		return
+	}
+	var rateLimit *float64
+	if setRate {
+		rateLimit = new(float64)
+		if data.RateLimit != nil {
+			*rateLimit = *data.RateLimit
+		}
+		if rl.Debug {
+			rl.logger.Debugf("Received new rate limit: %f", *rateLimit)
+		}
+	}
+	// The burst only changes if the rate is accepted too
+	opts := rateOptions{immediate: data.Immediate, ttl: ttl}
+	if err := rl.setRateAndMaxTokens(method, rateLimit, data.MaxTokens, opts, httpSource(r)); err != nil {
+		status := http.StatusUnprocessableEntity
+		switch {
+		case errors.Is(err, ErrUnknownMethod):
+			status = http.StatusNotFound
+		case errors.Is(err, ErrRatesFixed), errors.Is(err, ErrBurstFixed):
+			status = http.StatusConflict
+		}
+		writeError(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// RateUpdateResult reports the outcome of one method's update in a batch rate update.
+type RateUpdateResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// RateUpdateResponse is the response to a batch rate update.
+type RateUpdateResponse struct {
+	Results map[string]RateUpdateResult `json:"results"`
+}
+
+// handleSetRateLimits applies a batch of rate limits of the form {"rates": {"<method>": <float>}}.
+func (rl *TopDownRL) handleSetRateLimits(w http.ResponseWriter, r *http.Request, data SetRateRequest) {
+	if data.Rates == nil {
+		writeError(w, "Failed to decode request body", http.StatusBadRequest)
+		return
+	}
+	ttl, err := ttlFromSeconds(data.TTLSeconds)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
 
 	if rl.Debug {
-		log.Printf("[DEBUG] Received new rate limit: %f\n", data.RateLimit)
+		rl.logger.Debugf("Received new rate limits: %v", data.Rates)
 	}
 
-	rl.SetRateLimit(method, data.RateLimit)
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rl.setRateLimitsResponse(data.Rates, rateOptions{immediate: data.Immediate, ttl: ttl}, httpSource(r)))
+}
+
+// setRateLimitsResponse applies a batch of rate limits on behalf of source and reports the
+// outcome per method.
+func (rl *TopDownRL) setRateLimitsResponse(rates map[string]float64, opts rateOptions, source changeSource) RateUpdateResponse {
+	errs := rl.setRateLimits(rates, opts, source)
+	results := make(map[string]RateUpdateResult, len(rates))
+	for method := range rates {
+		if err, failed := errs[method]; failed {
+			results[method] = RateUpdateResult{Error: err.Error()}
+		} else {
+			results[method] = RateUpdateResult{OK: true}
+		}
+	}
+	return RateUpdateResponse{Results: results}
 }
 
 // handleGetMetrics handles the GET requests to return goodput and latency.
+// Without a 'method' parameter it returns the metrics of all methods keyed by method name.
 func (rl *TopDownRL) HandleGetMetrics(w http.ResponseWriter, r *http.Request) {
 	if rl.Debug {
-		log.Println("[DEBUG] HandleGetMetrics called")
+		rl.logger.Debugf("HandleGetMetrics called")
 	}
 	if r.Method != http.MethodGet {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Query().Get("scope") == "cluster" {
+		rl.handleClusterMetrics(w)
 		return
 	}
 
 	// Extract the method from query parameters
 	method := r.URL.Query().Get("method")
 	if method == "" {
-		http.Error(w, "Missing 'method' parameter", http.StatusBadRequest)
+		snapshots := rl.GetAllMetrics()
+		response := make(map[string]MetricsResponse, len(snapshots))
+		for methodName, snapshot := range snapshots {
+			response[methodName] = newMetricsResponse(methodName, snapshot)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
 		return
 	}
 
-	goodput, latency := rl.GetMetrics(method)
-
+	snapshot, err := rl.GetMetricsSnapshot(method)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if rl.Debug {
-		log.Printf("[DEBUG] Returning metrics: Goodput=%f, Latency=%f\n", goodput, latency)
+		rl.logger.Debugf("Returning metrics: %+v", snapshot)
 	}
 
-	response := struct {
-		Goodput float64 `json:"goodput"`
-		Latency float64 `json:"latency"`
-	}{
-		Goodput: goodput,
-		Latency: latency,
+	w.Header().Set("Content-Type", "application/json")
+
+	// The legacy shape only carries goodput and latency in milliseconds, like GetMetrics
+	if r.URL.Query().Get("format") == "legacy" {
+		response := struct {
+			Goodput float64 `json:"goodput"`
+			Latency float64 `json:"latency"`
+		}{
+			Goodput: snapshot.SmoothedGoodput,
+			Latency: float64(snapshot.SmoothedTailLatency.Milliseconds()),
+		}
+		json.NewEncoder(w).Encode(response)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(newMetricsResponse(method, snapshot))
 }
@@ -0,0 +1,38 @@
+package topdown
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleSetRateLimitRejectsBothOnInvalidRate(t *testing.T) {
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 10, RefillRate: 100, MaxRefillRate: 200}},
+		map[string]time.Duration{"/a": time.Second}, WithRateBoundsMode(RejectOutOfBounds))
+
+	for _, body := range []string{
+		`{"max_tokens": 50, "rate_limit": -1}`,
+		`{"max_tokens": 50, "rate_limit": 500}`,
+	} {
+		rr := httptest.NewRecorder()
+		rl.HandleSetRateLimit(rr, httptest.NewRequest(http.MethodPost, "/set_rate?method=/a", strings.NewReader(body)))
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: status = %d, want %d", body, rr.Code, http.StatusUnprocessableEntity)
+		}
+		if got := rl.registeredMetrics("/a").MaxTokens; got != 10 {
+			t.Errorf("%s: max tokens = %d after a rejected update, want 10", body, got)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	rl.HandleSetRateLimit(rr, httptest.NewRequest(http.MethodPost, "/set_rate?method=/a", strings.NewReader(`{"max_tokens": 50, "rate_limit": 150, "immediate": true}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	metrics := rl.registeredMetrics("/a")
+	if metrics.MaxTokens != 50 || metrics.RefillRate != 150 {
+		t.Errorf("max tokens and rate = %d and %g, want 50 and 150", metrics.MaxTokens, metrics.RefillRate)
+	}
+}
@@ -0,0 +1,138 @@
+package topdown
+
+import (
+	"context"
+	"time"
+)
+
+// Limiter decides whether the requests of a method may proceed. The token bucket is the default;
+// set BucketConfig.NewLimiter to use another algorithm for a method. Implementations must be
+// safe for concurrent use, while calls to SetRate are serialized by the caller.
+type Limiter interface {
+	// Allow consumes cost units of capacity and reports whether the request may proceed. The
+	// capacity a request may use is limited by PriorityShare(ctx) when priority tiers are enabled.
+	Allow(ctx context.Context, cost int64) bool
+	// SetRate changes the sustained rate in units per second.
+	SetRate(rate float64)
+	// Snapshot returns the current state of the limiter.
+	Snapshot() LimiterState
+}
+
+// RetryAfterLimiter is implemented by limiters that can tell how long a request has to wait until
+// it would be allowed. It's used for the retry hints sent to rejected clients and to wake requests
+// in the admission queue; queued requests of other limiters check back every QueuePollInterval.
+type RetryAfterLimiter interface {
+	Limiter
+	// RetryAfter returns how long it takes until a request costing cost would be allowed, or
+	// false if it won't be allowed at the current rate.
+	RetryAfter(ctx context.Context, cost int64) (time.Duration, bool)
+}
+
+// BurstLimiter is implemented by limiters whose burst can change at runtime, see SetMaxTokens.
+type BurstLimiter interface {
+	Limiter
+	// SetBurst changes the burst, reducing the capacity available right now if it exceeds it.
+	SetBurst(burst int64)
+}
+
+// RefundLimiter is implemented by limiters that can give capacity back, for the requests they
+// allowed that a wider limit rejected, e.g. the global bucket. Other limiters keep the capacity.
+type RefundLimiter interface {
+	Limiter
+	// Refund returns cost units of capacity taken by Allow, up to the burst.
+	Refund(cost int64)
+}
+
+// LimiterState is the state of a Limiter reported in the metrics.
+type LimiterState struct {
+	Rate float64
+	// Available is the capacity available right now, e.g. the tokens in a bucket. It may be
+	// negative while the limiter is in debt after a request costing more than Burst.
+	Available float64
+	Burst     int64
+}
+
+// LimiterFactory creates the limiter of a method from its bucket parameters.
+type LimiterFactory func(config BucketConfig, clock Clock) Limiter
+
+// QueuePollInterval is how often requests in the admission queue of a limiter that doesn't
+// implement RetryAfterLimiter check whether they are allowed.
+const QueuePollInterval = time.Millisecond
+
+// WithDefaultLimiter sets the limiter of methods without a bucket configuration, see BucketConfig.NewLimiter.
+func WithDefaultLimiter(factory LimiterFactory) Option {
+	return func(rl *TopDownRL) {
+		rl.defaultBucket.NewLimiter = factory
+	}
+}
+
+// shareKey is the context key of the priority share, see PriorityShare.
+type shareKey struct{}
+
+// PriorityShare returns the share of a limiter's capacity that a request may use, which is less
+// than 1 for requests of priority tiers with a smaller share.
+func PriorityShare(ctx context.Context) float64 {
+	if share, ok := ctx.Value(shareKey{}).(float64); ok {
+		return share
+	}
+	return 1
+}
+
+// limiterContext returns the context passed to the limiter, carrying the share of the request's
+// priority tier and attempt if it's less than the whole capacity.
+func (rl *TopDownRL) limiterContext(ctx context.Context) context.Context {
+	if share := rl.tierShare(rl.priorityTier(ctx)) * rl.retryShareOf(ctx); share < 1 {
+		return context.WithValue(ctx, shareKey{}, share)
+	}
+	return ctx
+}
+
+// tokenBucketLimiter adapts the lock-free tokenBucket to the Limiter interface.
+type tokenBucketLimiter struct {
+	bucket *tokenBucket
+	clock  Clock
+}
+
+// NewTokenBucketLimiter creates the default limiter: a token bucket holding up to config.MaxTokens
+// tokens, refilled at config.RefillRate tokens per second, which starts full.
+func NewTokenBucketLimiter(config BucketConfig, clock Clock) Limiter {
+	return &tokenBucketLimiter{
+		bucket: newTokenBucket(config.MaxTokens, config.RefillRate, clock.Now()),
+		clock:  clock,
+	}
+}
+
+// Allow takes cost tokens if the bucket holds them within the request's share.
+func (l *tokenBucketLimiter) Allow(ctx context.Context, cost int64) bool {
+	return l.bucket.takeShare(l.clock.Now(), cost, PriorityShare(ctx))
+}
+
+// SetRate changes the refill rate, keeping the tokens accrued at the old rate.
+func (l *tokenBucketLimiter) SetRate(rate float64) {
+	l.bucket.setRate(rate, l.clock.Now())
+}
+
+// SetBurst changes the capacity of the bucket, discarding the tokens beyond it.
+func (l *tokenBucketLimiter) SetBurst(burst int64) {
+	l.bucket.setLimits(burst, l.bucket.params.Load().rate, l.clock.Now())
+}
+
+// Refund puts cost tokens back into the bucket, up to its capacity.
+func (l *tokenBucketLimiter) Refund(cost int64) {
+	l.bucket.refund(cost)
+}
+
+// Snapshot returns the rate, the available tokens and the capacity of the bucket.
+func (l *tokenBucketLimiter) Snapshot() LimiterState {
+	p := l.bucket.params.Load()
+	return LimiterState{
+		Rate:      p.rate,
+		Available: l.bucket.available(l.clock.Now()),
+		Burst:     p.maxTokens / tokenScale,
+	}
+}
+
+// RetryAfter returns how long it takes until the bucket holds cost tokens within the request's share.
+func (l *tokenBucketLimiter) RetryAfter(ctx context.Context, cost int64) (time.Duration, bool) {
+	return l.bucket.retryAfterShare(l.clock.Now(), cost, PriorityShare(ctx))
+}
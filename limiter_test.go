@@ -0,0 +1,77 @@
+package topdown
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestInterceptorWithLimiters(t *testing.T) {
+	tests := []struct {
+		name    string
+		factory LimiterFactory
+	}{
+		{"token bucket", NewTokenBucketLimiter},
+		{"GCRA", NewGCRALimiter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := NewFakeClock(time.Unix(1000, 0))
+			rl := newTestRL(t, map[string]BucketConfig{echoMethod: {MaxTokens: 3, RefillRate: 1}},
+				map[string]time.Duration{echoMethod: time.Second},
+				WithClock(clock), WithMetricsInterval(time.Hour), WithDefaultLimiter(tt.factory))
+			conn := newTestServer(t, nil, []grpc.ServerOption{grpc.UnaryInterceptor(rl.UnaryInterceptor)})
+			ctx := context.Background()
+
+			// calls returns how many of n calls were admitted, failing on errors other than rejections
+			calls := func(n int) int {
+				admitted := 0
+				for i := 0; i < n; i++ {
+					err := echo(ctx, conn, &structpb.Struct{})
+					switch status.Code(err) {
+					case codes.OK:
+						admitted++
+					case codes.ResourceExhausted:
+					default:
+						t.Fatalf("call failed: %v", err)
+					}
+				}
+				return admitted
+			}
+
+			if got := calls(5); got != 3 {
+				t.Errorf("admitted %d of 5 calls, want the burst of 3", got)
+			}
+			clock.Advance(time.Second)
+			if got := calls(2); got != 1 {
+				t.Errorf("admitted %d of 2 calls after 1s, want 1 at 1/s", got)
+			}
+
+			// The HTTP rate path works against the limiter
+			rr := httptest.NewRecorder()
+			rl.HandleSetRateLimit(rr, httptest.NewRequest(http.MethodPost, "/set_rate?method="+echoMethod, strings.NewReader(`{"rate_limit": 2}`)))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("set rate status = %d, body %q", rr.Code, rr.Body.String())
+			}
+			clock.Advance(time.Second)
+			snapshot, err := rl.GetMetricsSnapshot(echoMethod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if snapshot.RefillRate != 2 || snapshot.CurrentTokens != 2 {
+				t.Errorf("snapshot rate = %v, tokens = %v, want 2 and 2", snapshot.RefillRate, snapshot.CurrentTokens)
+			}
+			if got := calls(3); got != 2 {
+				t.Errorf("admitted %d of 3 calls after 1s, want 2 at 2/s", got)
+			}
+		})
+	}
+}
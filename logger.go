@@ -0,0 +1,58 @@
+package topdown
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+)
+
+// Logger receives the log messages of the limiter, see WithLogger. Debug messages are only
+// passed while Debug is set, so the request path doesn't format them otherwise.
+type Logger interface {
+	Debugf(format string, args ...any)
+	Infof(format string, args ...any)
+	Warnf(format string, args ...any)
+	Errorf(format string, args ...any)
+}
+
+// WithLogger routes the log messages of the limiter to logger instead of the standard logger of
+// the log package. A nil logger restores the standard logger.
+func WithLogger(logger Logger) Option {
+	return func(rl *TopDownRL) {
+		rl.logger = logger
+	}
+}
+
+// stdLogger is the default Logger, writing to the standard logger with the level as prefix.
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, args ...any) { log.Printf("[DEBUG] "+format, args...) }
+func (stdLogger) Infof(format string, args ...any)  { log.Printf("[INFO] "+format, args...) }
+func (stdLogger) Warnf(format string, args ...any)  { log.Printf("[WARN] "+format, args...) }
+func (stdLogger) Errorf(format string, args ...any) { log.Printf("[ERROR] "+format, args...) }
+
+// slogLogger is a Logger writing to a *slog.Logger.
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger returns a Logger writing the messages to logger at the matching levels, for use
+// with WithLogger.
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return slogLogger{logger: logger}
+}
+
+func (l slogLogger) Debugf(format string, args ...any) { l.logf(slog.LevelDebug, format, args) }
+func (l slogLogger) Infof(format string, args ...any)  { l.logf(slog.LevelInfo, format, args) }
+func (l slogLogger) Warnf(format string, args ...any)  { l.logf(slog.LevelWarn, format, args) }
+func (l slogLogger) Errorf(format string, args ...any) { l.logf(slog.LevelError, format, args) }
+
+// logf formats the message only if the handler is enabled for level.
+func (l slogLogger) logf(level slog.Level, format string, args []any) {
+	ctx := context.Background()
+	if !l.logger.Enabled(ctx, level) {
+		return
+	}
+	l.logger.Log(ctx, level, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,67 @@
+package topdown
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// recordingLogger is a Logger keeping the messages it receives, prefixed with their level.
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) record(level, format string, args []any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...any) { l.record("DEBUG", format, args) }
+func (l *recordingLogger) Infof(format string, args ...any)  { l.record("INFO", format, args) }
+func (l *recordingLogger) Warnf(format string, args ...any)  { l.record("WARN", format, args) }
+func (l *recordingLogger) Errorf(format string, args ...any) { l.record("ERROR", format, args) }
+
+// reset returns the messages received so far and forgets them.
+func (l *recordingLogger) reset() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	messages := l.messages
+	l.messages = nil
+	return messages
+}
+
+func TestNoLoggingOnRequestPath(t *testing.T) {
+	logger := &recordingLogger{}
+	rl := newTestRL(t, map[string]BucketConfig{echoMethod: {MaxTokens: 2, RefillRate: 0.1}},
+		map[string]time.Duration{echoMethod: time.Second}, WithLogger(logger), WithMetricsInterval(time.Hour))
+	conn := newTestServer(t, nil, []grpc.ServerOption{grpc.UnaryInterceptor(rl.UnaryInterceptor)})
+	logger.reset()
+
+	// Admitted and rejected requests alike
+	for i := 0; i < 5; i++ {
+		echo(context.Background(), conn, &structpb.Struct{})
+	}
+	rl.AllowN(context.Background(), echoMethod, 1)
+	if messages := logger.reset(); len(messages) != 0 {
+		t.Errorf("logged %q on the request path with debug off, want nothing", messages)
+	}
+
+	// The Debug flag filters the debug messages, e.g. those of the rollover
+	metrics := rl.loadMetrics(echoMethod)
+	rl.rollover(metrics, time.Now())
+	if messages := logger.reset(); len(messages) != 0 {
+		t.Errorf("logged %q on rollover with debug off, want nothing", messages)
+	}
+	rl.Debug = true
+	rl.rollover(metrics, time.Now())
+	if messages := logger.reset(); len(messages) == 0 {
+		t.Error("logged nothing on rollover with debug on, want the goodput of the interval")
+	}
+}
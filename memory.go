@@ -0,0 +1,255 @@
+package topdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ResourceSample is a measurement of a resource of the process, e.g. its memory.
+type ResourceSample struct {
+	// Pressure is the share of the resource in use, Used out of Limit for a heap probe; it may
+	// exceed 1.
+	Pressure float64
+	Used     uint64
+	Limit    uint64
+}
+
+// ResourceProbe measures a resource of the process, see WithMemoryPressure.
+type ResourceProbe func() (ResourceSample, error)
+
+// NewHeapProbe returns a ResourceProbe measuring the heap in use, as reported by runtime.MemStats,
+// against limit in bytes and the memory limit set through GOMEMLIMIT or debug.SetMemoryLimit,
+// whichever is lower; a limit of zero only uses the latter. The probe fails if neither is set.
+func NewHeapProbe(limit uint64) ResourceProbe {
+	return func() (ResourceSample, error) {
+		effective := limit
+		if memLimit := debug.SetMemoryLimit(-1); memLimit > 0 && memLimit < math.MaxInt64 {
+			if effective == 0 || uint64(memLimit) < effective {
+				effective = uint64(memLimit)
+			}
+		}
+		if effective == 0 {
+			return ResourceSample{}, errors.New("no heap limit configured and GOMEMLIMIT not set")
+		}
+
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return ResourceSample{
+			Pressure: float64(stats.HeapInuse) / float64(effective),
+			Used:     stats.HeapInuse,
+			Limit:    effective,
+		}, nil
+	}
+}
+
+// MemoryConfig holds the parameters of memory-pressure shedding, see WithMemoryPressure.
+type MemoryConfig struct {
+	// Probe measures the memory every metrics interval.
+	Probe ResourceProbe
+	// Threshold is the pressure above which the limiter comes under pressure, and
+	// RecoveryThreshold the pressure at or below which it recovers, so the state doesn't flap
+	// around a single value.
+	Threshold         float64
+	RecoveryThreshold float64
+	// RateFactor multiplies the rates of all methods while under pressure, in (0, 1].
+	RateFactor float64
+}
+
+// DefaultMemoryConfig returns the default parameters of memory-pressure shedding for a heap
+// limit in bytes, see NewHeapProbe.
+func DefaultMemoryConfig(limit uint64) MemoryConfig {
+	return MemoryConfig{
+		Probe:             NewHeapProbe(limit),
+		Threshold:         0.9,
+		RecoveryThreshold: 0.8,
+		RateFactor:        0.5,
+	}
+}
+
+// validate checks that the limiter can come under pressure and recover.
+func (c MemoryConfig) validate() error {
+	if c.Probe == nil {
+		return errors.New("probe must be set")
+	}
+	if !(c.Threshold > 0) || !(c.RecoveryThreshold > 0 && c.RecoveryThreshold <= c.Threshold) {
+		return fmt.Errorf("threshold %g must be positive and recovery threshold %g in (0, threshold]", c.Threshold, c.RecoveryThreshold)
+	}
+	if !(c.RateFactor > 0 && c.RateFactor <= 1) {
+		return fmt.Errorf("rate factor must be in (0, 1], got %g", c.RateFactor)
+	}
+	return nil
+}
+
+// WithMemoryPressure samples config.Probe every metrics interval. Once the pressure exceeds the
+// threshold, the rates of all methods are multiplied by the rate factor and, if priority tiers
+// are enabled, the requests of the lowest tier are rejected before they reach the buckets, one
+// more tier for every further interval under pressure, down to the highest tier, which is always
+// admitted. Both are lifted once the pressure is back at the recovery threshold.
+func WithMemoryPressure(config MemoryConfig) Option {
+	return func(rl *TopDownRL) {
+		rl.memory = &memoryPressure{config: config}
+	}
+}
+
+// MemoryPressure is the memory-pressure state of the limiter.
+type MemoryPressure struct {
+	// Pressure, Used and Limit are the last sample of the probe.
+	Pressure float64 `json:"pressure"`
+	Used     uint64  `json:"used_bytes"`
+	Limit    uint64  `json:"limit_bytes"`
+	// Pressured reports whether the limiter is under pressure, since Since.
+	Pressured bool      `json:"pressured"`
+	Since     time.Time `json:"since,omitempty"`
+	// RateFactor is the factor applied to the rates and ShedTiers the number of the lowest
+	// priority tiers whose requests are rejected.
+	RateFactor float64 `json:"rate_factor"`
+	ShedTiers  int     `json:"shed_tiers"`
+	// Rejected counts the requests of the method rejected by the tier shedding during the last
+	// interval; it's only set in the snapshots of methods.
+	Rejected int64 `json:"rejected"`
+}
+
+// memoryPressure tracks the memory pressure of the process. shedTiers is read on the request path
+// without taking mu.
+type memoryPressure struct {
+	config MemoryConfig
+
+	mu        sync.Mutex
+	sample    ResourceSample
+	pressured bool
+	since     time.Time
+
+	shedTiers atomic.Int32
+	errors    atomic.Int64
+}
+
+// rateFactor returns the factor applied to the rates in the current state.
+func (m *memoryPressure) rateFactor() float64 {
+	if m == nil {
+		return 1
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pressured {
+		return m.config.RateFactor
+	}
+	return 1
+}
+
+// sampleMemory probes the memory at the start of a tick and updates the pressure state, applying
+// the rate factor to every method when it flips.
+func (rl *TopDownRL) sampleMemory(now time.Time) {
+	m := rl.memory
+	if m == nil {
+		return
+	}
+	sample, err := m.config.Probe()
+	if err != nil {
+		// The state is kept, so a failing probe neither starts nor ends shedding
+		m.errors.Add(1)
+		rl.logger.Errorf("Failed to probe memory: %v", err)
+		return
+	}
+
+	m.mu.Lock()
+	m.sample = sample
+	flipped := false
+	switch {
+	case !m.pressured && sample.Pressure > m.config.Threshold:
+		m.pressured, m.since, flipped = true, now, true
+	case m.pressured && sample.Pressure <= m.config.RecoveryThreshold:
+		m.pressured, m.since, flipped = false, now, true
+		m.shedTiers.Store(0)
+	case m.pressured && int(m.shedTiers.Load()) < len(rl.priorities)-1:
+		// The lowest tier is shed first, then one more for every interval the pressure lasts
+		m.shedTiers.Add(1)
+	}
+	if flipped && m.pressured && len(rl.priorities) > 1 {
+		m.shedTiers.Store(1)
+	}
+	pressured := m.pressured
+	m.mu.Unlock()
+
+	if !flipped {
+		return
+	}
+	if pressured {
+		rl.logger.Infof("Memory pressure %.2f above %.2f, reducing rates", sample.Pressure, m.config.Threshold)
+	} else {
+		rl.logger.Infof("Memory pressure %.2f recovered", sample.Pressure)
+	}
+	factor := m.rateFactor()
+	for _, metrics := range *rl.published.Load() {
+		metrics.mu.Lock()
+		metrics.rateFactor = factor
+		setLimiterRateLocked(metrics, metrics.RefillRate)
+		metrics.mu.Unlock()
+	}
+}
+
+// memoryAdmits reports whether a request passes the tier shedding under memory pressure, if
+// enabled, counting it for the method if not.
+func (rl *TopDownRL) memoryAdmits(ctx context.Context, metrics *InterfaceMetrics) bool {
+	if rl.memory == nil {
+		return true
+	}
+	shedTiers := int(rl.memory.shedTiers.Load())
+	if shedTiers == 0 {
+		return true
+	}
+	if tier := rl.priorityTier(ctx); tier < 0 || tier < len(rl.priorities)-shedTiers {
+		return true
+	}
+	metrics.memoryRejected.Add(1)
+	return false
+}
+
+// MemoryPressure returns the memory-pressure state of the limiter; it's the zero state unless
+// enabled with WithMemoryPressure.
+func (rl *TopDownRL) MemoryPressure() MemoryPressure {
+	m := rl.memory
+	if m == nil {
+		return MemoryPressure{RateFactor: 1}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state := MemoryPressure{
+		Pressure:   m.sample.Pressure,
+		Used:       m.sample.Used,
+		Limit:      m.sample.Limit,
+		Pressured:  m.pressured,
+		Since:      m.since,
+		RateFactor: 1,
+		ShedTiers:  int(m.shedTiers.Load()),
+	}
+	if m.pressured {
+		state.RateFactor = m.config.RateFactor
+	}
+	return state
+}
+
+// MemoryProbeErrors returns the number of memory probes that failed.
+func (rl *TopDownRL) MemoryProbeErrors() int64 {
+	if rl.memory == nil {
+		return 0
+	}
+	return rl.memory.errors.Load()
+}
+
+// memoryPressureLocked returns the memory-pressure state with the rejections of a method, or nil
+// if it's disabled. The caller must hold metrics.mu.
+func (rl *TopDownRL) memoryPressureLocked(metrics *InterfaceMetrics) *MemoryPressure {
+	if rl.memory == nil {
+		return nil
+	}
+	state := rl.MemoryPressure()
+	state.Rejected = metrics.CurrentMemoryRejected
+	return &state
+}
@@ -0,0 +1,220 @@
+package topdown
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// WithMethodGroup declares a method group: the requests of its member methods share the bucket,
+// SLO and metrics of the method registered under the group's name, e.g. the Get, BatchGet and
+// List methods of one backend resource. The group needs an SLO of its own, in the SLO map or from
+// a matching pattern, while the SLOs of its members are ignored. The metrics are reported under
+// the group's name with the arrivals broken down by member, see MetricsSnapshot.MemberArrivals,
+// and rate, rate bound and concurrency updates for a member update its group. A method belongs
+// to at most one group, and SetMethodGroup changes the membership at runtime.
+func WithMethodGroup(name string, methods ...string) Option {
+	return func(rl *TopDownRL) {
+		rl.methodGroupConfigs = append(rl.methodGroupConfigs, methodGroupConfig{name: name, methods: methods})
+	}
+}
+
+// methodGroupConfig is a group declared with WithMethodGroup.
+type methodGroupConfig struct {
+	name    string
+	methods []string
+}
+
+// groupMember is a method of a method group. arrivals counts its requests during the current
+// interval; a method moving to another group gets a new groupMember, so it starts from zero there.
+type groupMember struct {
+	group    string
+	arrivals atomic.Int64
+}
+
+// validateMethodGroups checks that the groups have unique names, that no method belongs to
+// several groups and that no group is a member of another one.
+func (rl *TopDownRL) validateMethodGroups() error {
+	names := make(map[string]bool, len(rl.methodGroupConfigs))
+	members := make(map[string]string)
+	for _, group := range rl.methodGroupConfigs {
+		if group.name == "" || isPattern(group.name) || names[group.name] {
+			return fmt.Errorf("method group names must be unique, not empty and not patterns, got '%s'", group.name)
+		}
+		names[group.name] = true
+		if len(group.methods) == 0 {
+			return fmt.Errorf("method group '%s' has no methods", group.name)
+		}
+		for _, methodName := range group.methods {
+			if methodName == "" || isPattern(methodName) {
+				return fmt.Errorf("method group '%s' has an invalid method '%s'", group.name, methodName)
+			}
+			if other, exists := members[methodName]; exists {
+				return fmt.Errorf("method '%s' belongs to method groups '%s' and '%s'", methodName, other, group.name)
+			}
+			members[methodName] = group.name
+		}
+	}
+	for methodName, group := range members {
+		if names[methodName] {
+			return fmt.Errorf("method group '%s' is a member of method group '%s'", methodName, group)
+		}
+	}
+	return nil
+}
+
+// newMethodGroups publishes the members of the declared groups.
+func (rl *TopDownRL) newMethodGroups() {
+	groups := make(map[string]*groupMember)
+	for _, config := range rl.methodGroupConfigs {
+		for _, methodName := range config.methods {
+			groups[methodName] = &groupMember{group: config.name}
+		}
+	}
+	rl.methodGroups.Store(&groups)
+}
+
+// methodGroupOf returns the name of the group of a method, or the method itself if it isn't a
+// member of a group, without taking rl.mutex.
+func (rl *TopDownRL) methodGroupOf(methodName string) string {
+	if member := (*rl.methodGroups.Load())[methodName]; member != nil {
+		return member.group
+	}
+	return methodName
+}
+
+// recordMemberArrival counts a request of a method for the breakdown of its group, if any.
+func (rl *TopDownRL) recordMemberArrival(methodName string) {
+	if member := (*rl.methodGroups.Load())[methodName]; member != nil {
+		member.arrivals.Add(1)
+	}
+}
+
+// swapMemberArrivals returns the arrivals of the members of a group during the interval that
+// ends and resets them, or nil if it has no members.
+func (rl *TopDownRL) swapMemberArrivals(group string) map[string]int64 {
+	var arrivals map[string]int64
+	for methodName, member := range *rl.methodGroups.Load() {
+		if member.group != group {
+			continue
+		}
+		if arrivals == nil {
+			arrivals = make(map[string]int64)
+		}
+		arrivals[methodName] = member.arrivals.Swap(0)
+	}
+	return arrivals
+}
+
+// SetMethodGroup moves a method into the method group group, or out of its group if group is
+// empty, see WithMethodGroup. The group must be registered or match an SLO pattern, and is
+// registered in the latter case. The method starts afresh: its arrivals are counted from zero in
+// its new group and the metrics it had on its own, if any, are dropped, while the totals of its
+// previous group keep what it contributed. Requests in flight complete in its new group. Out of a
+// group, the method is limited on its own once registered, e.g. with RegisterMethod.
+func (rl *TopDownRL) SetMethodGroup(method, group string) error {
+	if method == "" || isPattern(method) || isPattern(group) {
+		return fmt.Errorf("method and group must be method names, got '%s' and '%s'", method, group)
+	}
+	if method == group {
+		return fmt.Errorf("method '%s' can't be its own group", method)
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	groups := *rl.methodGroups.Load()
+	for methodName, member := range groups {
+		if member.group == method {
+			return fmt.Errorf("method '%s' is the group of method '%s'", method, methodName)
+		}
+	}
+	if member := groups[group]; member != nil {
+		return fmt.Errorf("method group '%s' is a member of method group '%s'", group, member.group)
+	}
+	if current := groups[method]; current == nil && group == "" || current != nil && current.group == group {
+		return nil
+	}
+	if group != "" {
+		// Like with WithMethodGroup, the group needs an SLO, and it's limited before its new
+		// member resolves to it
+		if _, registered := rl.interfaces[group]; !registered {
+			if _, matched := rl.matchSLO(group); !matched {
+				return fmt.Errorf("%w: method group '%s' must be registered or match an SLO pattern", ErrUnknownMethod, group)
+			}
+			rl.lookupMetrics(group)
+		}
+	}
+
+	updated := make(map[string]*groupMember, len(groups)+1)
+	for methodName, member := range groups {
+		if methodName != method {
+			updated[methodName] = member
+		}
+	}
+	if group != "" {
+		updated[method] = &groupMember{group: group}
+	}
+	rl.methodGroups.Store(&updated)
+	if _, registered := rl.interfaces[method]; registered && group != "" {
+		delete(rl.interfaces, method)
+		rl.publishInterfacesLocked()
+	}
+	if rl.Debug {
+		rl.logger.Debugf("Moved method '%s' to method group '%s'", method, group)
+	}
+	return nil
+}
+
+// MethodGroups returns the members of every method group keyed by group name.
+func (rl *TopDownRL) MethodGroups() map[string][]string {
+	groups := make(map[string][]string)
+	for methodName, member := range *rl.methodGroups.Load() {
+		groups[member.group] = append(groups[member.group], methodName)
+	}
+	for _, members := range groups {
+		sort.Strings(members)
+	}
+	return groups
+}
+
+// HandleMethodGroups handles the GET requests to list the members of the method groups, and the
+// POST requests of the form {"group": "<name>"} to move the method of the 'method' parameter into
+// a group, or out of its group with an empty name.
+func (rl *TopDownRL) HandleMethodGroups(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleMethodGroups called")
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rl.MethodGroups())
+	case http.MethodPost:
+		method := r.URL.Query().Get("method")
+		if method == "" {
+			writeError(w, "Missing 'method' parameter", http.StatusBadRequest)
+			return
+		}
+		var data struct {
+			Group *string `json:"group"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Group == nil {
+			writeError(w, "Failed to decode request body", http.StatusBadRequest)
+			return
+		}
+		if err := rl.SetMethodGroup(method, *data.Group); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrUnknownMethod) {
+				status = http.StatusNotFound
+			}
+			writeError(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
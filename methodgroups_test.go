@@ -0,0 +1,26 @@
+package topdown
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemberUpdatesApplyToGroup(t *testing.T) {
+	rl := newTestRL(t, map[string]BucketConfig{"/res": {MaxTokens: 10, RefillRate: 10}},
+		map[string]time.Duration{"/res": time.Second}, WithMethodGroup("/res", "/res/Get", "/res/List"))
+
+	if err := rl.SetRateBounds("/res/Get", 5, 50); err != nil {
+		t.Fatalf("SetRateBounds() of a member = %v, want it applied to the group", err)
+	}
+	if err := rl.SetMaxConcurrent("/res/List", 3); err != nil {
+		t.Fatalf("SetMaxConcurrent() of a member = %v, want it applied to the group", err)
+	}
+	snapshot, err := rl.GetMetricsSnapshot("/res")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.MinRefillRate != 5 || snapshot.MaxRefillRate != 50 || snapshot.MaxConcurrent != 3 {
+		t.Errorf("group bounds = %g to %g, max concurrent = %d, want 5 to 50 and 3",
+			snapshot.MinRefillRate, snapshot.MaxRefillRate, snapshot.MaxConcurrent)
+	}
+}
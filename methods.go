@@ -0,0 +1,268 @@
+package topdown
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ErrMethodRegistered is returned when registering a method that is already registered.
+var ErrMethodRegistered = errors.New("method already registered")
+
+// MethodConfig describes the configuration of a registered method.
+type MethodConfig struct {
+	SLO           time.Duration
+	MaxTokens     int64
+	RefillRate    float64
+	MinRefillRate float64
+	MaxRefillRate float64
+	MaxConcurrent int64
+	Cost          int64
+	// Pattern and BucketPattern are the patterns the SLO and the bucket parameters were
+	// resolved from, empty if configured for the method itself or taken from the defaults.
+	Pattern       string
+	BucketPattern string
+
+	// OverrideRemaining is the time left until the temporary rate set through
+	// SetTemporaryRateLimit reverts, zero without an override.
+	OverrideRemaining time.Duration
+	// Percentiles are the tail latency percentiles computed for the method, and ShadowMode
+	// reports whether it's in shadow mode, on its own or through the global switch.
+	Percentiles []float64
+	ShadowMode  bool
+	// Schedule is the rate schedule of the method and its active entry, nil without one, see
+	// WithRateSchedule.
+	Schedule *ScheduleState
+}
+
+// RegisterMethod starts rate limiting a method with the given SLO and a full token bucket.
+// It fails if the method is already registered or the parameters are invalid. Registering a
+// pattern like "/inventory.Service/*" configures the matching methods without their own
+// configuration, and resolves again those registered from a less specific pattern.
+func (rl *TopDownRL) RegisterMethod(method string, slo time.Duration, maxTokens, refillRate int64) error {
+	if method == "" {
+		return errors.New("method name must not be empty")
+	}
+	if slo <= 0 {
+		return fmt.Errorf("SLO must be positive, got %v", slo)
+	}
+	bucket := BucketConfig{MaxTokens: maxTokens, RefillRate: float64(refillRate)}
+	if err := bucket.validate(); err != nil {
+		return err
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	return rl.registerMethodLocked(method, slo, bucket)
+}
+
+// registerMethodLocked registers a method or pattern with validated parameters. The caller must
+// hold rl.mutex.
+func (rl *TopDownRL) registerMethodLocked(method string, slo time.Duration, bucket BucketConfig) error {
+	if isPattern(method) {
+		if _, exists := rl.buckets[method]; exists {
+			return fmt.Errorf("%w: '%s'", ErrMethodRegistered, method)
+		}
+		rl.buckets[method] = bucket
+		rl.storeSLORuleLocked(method, slo)
+		if rl.Debug {
+			rl.logger.Debugf("Registered pattern '%s' with SLO %v, max tokens %d and refill rate %g", method, slo, bucket.MaxTokens, bucket.RefillRate)
+		}
+		rl.resolveLocked(method)
+		return nil
+	}
+	if _, exists := rl.interfaces[method]; exists {
+		return fmt.Errorf("%w: '%s'", ErrMethodRegistered, method)
+	}
+	rl.buckets[method] = bucket
+	rl.interfaces[method] = rl.newInterfaceMetrics(method, slo)
+	rl.publishInterfacesLocked()
+	if rl.Debug {
+		rl.logger.Debugf("Registered method '%s' with SLO %v, max tokens %d and refill rate %g", method, slo, bucket.MaxTokens, bucket.RefillRate)
+	}
+	return nil
+}
+
+// UnregisterMethod stops rate limiting and accounting for a method. Requests already admitted
+// complete normally but are no longer counted. Under UnknownMethodRegister a later request
+// registers the method again with the default configuration. Unregistering a pattern removes its
+// configuration; the methods already resolved from it keep theirs.
+func (rl *TopDownRL) UnregisterMethod(method string) error {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	return rl.unregisterMethodLocked(method)
+}
+
+// unregisterMethodLocked unregisters a method or pattern. The caller must hold rl.mutex.
+func (rl *TopDownRL) unregisterMethodLocked(method string) error {
+	if isPattern(method) {
+		_, exists := rl.buckets[method]
+		if !rl.removeSLORuleLocked(method) && !exists {
+			return fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+		}
+		delete(rl.buckets, method)
+		if rl.Debug {
+			rl.logger.Debugf("Unregistered pattern '%s'", method)
+		}
+		return nil
+	}
+
+	if _, exists := rl.interfaces[method]; !exists {
+		return fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+	}
+	delete(rl.interfaces, method)
+	delete(rl.buckets, method)
+	rl.publishInterfacesLocked()
+	if rl.Debug {
+		rl.logger.Debugf("Unregistered method '%s'", method)
+	}
+	return nil
+}
+
+// Methods returns the configuration of all registered methods keyed by method name.
+func (rl *TopDownRL) Methods() map[string]MethodConfig {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	return rl.methodsLocked()
+}
+
+// methodsLocked returns the configuration of all registered methods. The caller must hold rl.mutex.
+func (rl *TopDownRL) methodsLocked() map[string]MethodConfig {
+	configs := make(map[string]MethodConfig, len(rl.interfaces))
+	for methodName, metrics := range rl.interfaces {
+		metrics.mu.Lock()
+		configs[methodName] = MethodConfig{
+			SLO:           metrics.SLO,
+			MaxTokens:     metrics.MaxTokens,
+			RefillRate:    metrics.RefillRate,
+			MinRefillRate: metrics.MinRefillRate,
+			MaxRefillRate: metrics.MaxRefillRate,
+			MaxConcurrent: metrics.MaxConcurrent,
+			Cost:          metrics.cost,
+			Pattern:       metrics.sloPattern,
+			BucketPattern: metrics.bucketPattern,
+
+			OverrideRemaining: rl.overrideRemainingLocked(metrics),
+			Percentiles:       append([]float64(nil), metrics.Percentiles...),
+			ShadowMode:        rl.inShadowMode(metrics),
+			Schedule:          metrics.schedule.stateLocked(),
+		}
+		metrics.mu.Unlock()
+	}
+	return configs
+}
+
+// MethodResponse is the JSON shape of a MethodConfig served by HandleMethods.
+type MethodResponse struct {
+	Method        string  `json:"method"`
+	SloMs         float64 `json:"slo_ms"`
+	MaxTokens     int64   `json:"max_tokens"`
+	RefillRate    float64 `json:"refill_rate"`
+	MinRefillRate float64 `json:"min_refill_rate"`
+	MaxRefillRate float64 `json:"max_refill_rate"`
+	MaxConcurrent int64   `json:"max_concurrent"`
+	Cost          int64   `json:"cost"`
+	Pattern       string  `json:"pattern,omitempty"`
+	BucketPattern string  `json:"bucket_pattern,omitempty"`
+
+	OverrideRemainingMs float64 `json:"override_remaining_ms,omitempty"`
+}
+
+// HandleMethods handles the requests to list (GET), register (POST) and unregister (DELETE) methods.
+func (rl *TopDownRL) HandleMethods(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleMethods called")
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rl.handleListMethods(w)
+	case http.MethodPost:
+		rl.handleRegisterMethod(w, r)
+	case http.MethodDelete:
+		rl.handleUnregisterMethod(w, r)
+	default:
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleListMethods returns the configuration of all registered methods sorted by name.
+func (rl *TopDownRL) handleListMethods(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rl.methodResponses())
+}
+
+// methodResponses returns the configuration of all registered methods in their JSON shape, sorted by name.
+func (rl *TopDownRL) methodResponses() []MethodResponse {
+	configs := rl.Methods()
+	response := make([]MethodResponse, 0, len(configs))
+	for methodName, config := range configs {
+		response = append(response, MethodResponse{
+			Method:        methodName,
+			SloMs:         durationMs(config.SLO),
+			MaxTokens:     config.MaxTokens,
+			RefillRate:    config.RefillRate,
+			MinRefillRate: config.MinRefillRate,
+			MaxRefillRate: config.MaxRefillRate,
+			MaxConcurrent: config.MaxConcurrent,
+			Cost:          config.Cost,
+			Pattern:       config.Pattern,
+			BucketPattern: config.BucketPattern,
+
+			OverrideRemainingMs: durationMs(config.OverrideRemaining),
+		})
+	}
+	sort.Slice(response, func(i, j int) bool { return response[i].Method < response[j].Method })
+	return response
+}
+
+// handleRegisterMethod registers a method from a body of the form
+// {"method": "<name>", "slo": "150ms", "max_tokens": <int>, "refill_rate": <int>}.
+func (rl *TopDownRL) handleRegisterMethod(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Method     string          `json:"method"`
+		SLO        json.RawMessage `json:"slo"`
+		MaxTokens  int64           `json:"max_tokens"`
+		RefillRate int64           `json:"refill_rate"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.SLO == nil {
+		writeError(w, "Failed to decode request body", http.StatusBadRequest)
+		return
+	}
+	slo, err := parseDuration(data.SLO)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := rl.RegisterMethod(data.Method, slo, data.MaxTokens, data.RefillRate); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrMethodRegistered) {
+			status = http.StatusConflict
+		}
+		writeError(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleUnregisterMethod unregisters the method given by the 'method' parameter.
+func (rl *TopDownRL) handleUnregisterMethod(w http.ResponseWriter, r *http.Request) {
+	method := r.URL.Query().Get("method")
+	if method == "" {
+		writeError(w, "Missing 'method' parameter", http.StatusBadRequest)
+		return
+	}
+
+	if err := rl.UnregisterMethod(method); err != nil {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
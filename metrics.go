@@ -0,0 +1,501 @@
+package topdown
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// ErrUnknownMethod is returned when metrics are requested for a method that is not registered.
+var ErrUnknownMethod = errors.New("unknown method")
+
+// MetricsSnapshot holds the metrics and bucket state of a single API (method).
+// Goodput, TailLatency95th and Rejected refer to the last completed interval.
+type MetricsSnapshot struct {
+	Goodput int64
+	// TailLatency95th is the tail latency at the method's primary percentile, the 95th by default.
+	TailLatency95th time.Duration
+	// TailLatencies holds the tail latency of every configured percentile. It's empty until the
+	// first latency is recorded, and after intervals without latencies with EmptyLatencyClear.
+	TailLatencies map[float64]time.Duration
+	// SampleCount is the number of latencies the tail latencies of the last interval were
+	// calculated from; 0 means the interval had none, see WithEmptyLatencyMode.
+	SampleCount uint64
+	// WindowTailLatencies holds the tail latencies over the rolling latency window, if enabled.
+	WindowTailLatencies map[float64]time.Duration
+	Rejected            int64
+	// Errors counts the requests of the last interval that completed with a status code not
+	// counting towards goodput; ErrorsByCode breaks them down by code name.
+	Errors             int64
+	ErrorsByCode       map[string]int64
+	ErrorsTotal        int64
+	ErrorTailLatencies map[float64]time.Duration
+	// Panics counts the handlers that panicked during the last interval, see WithPanicRecovery.
+	Panics      int64
+	PanicsTotal int64
+	// Degraded counts the requests of the last interval marked with MarkDegraded, which are also
+	// counted as SLO violations.
+	Degraded      int64
+	DegradedTotal int64
+	// External counts the requests of the last interval that spent time in external calls, which
+	// is excluded from the tail latencies and the SLO, see StartExternalCall. TotalTailLatencies
+	// holds the tail latencies including it, and is empty if there were none.
+	External           int64
+	TotalTailLatencies map[float64]time.Duration
+	// Cancelled counts the requests of the last interval cancelled by the client, which are
+	// neither goodput nor errors unless WithIncludeCancelled is set.
+	Cancelled      int64
+	CancelledTotal int64
+	// NegativeLatencies is the number of requests since start whose latency was negative and clamped to zero.
+	NegativeLatencies int64
+	// UnparseableTimestamps is the number of requests since start whose start time metadata couldn't be parsed.
+	UnparseableTimestamps int64
+	// RejectedTotal is the number of rejected requests since start.
+	RejectedTotal int64
+	// Tiers holds the goodput and rejections of the last interval per priority tier, if enabled.
+	Tiers map[string]TierMetrics
+	// InFlight is the number of requests in flight at the time of the snapshot. ConcurrencyRejected
+	// counts the requests rejected during the last interval because of the concurrency limit.
+	InFlight                 int64
+	MaxConcurrent            int64
+	ConcurrencyRejected      int64
+	ConcurrencyRejectedTotal int64
+	// Doomed counts the requests rejected during the last interval because their deadline was
+	// shorter than the tail latency, see WithDeadlineCheck.
+	Doomed      int64
+	DoomedTotal int64
+	// QueueDepth is the number of requests waiting in the admission queue at the time of the snapshot.
+	// QueueWaits holds the percentiles of the time the requests admitted from the queue waited in it,
+	// and Abandoned counts the requests cancelled while waiting, both during the last interval.
+	QueueDepth     int64
+	QueueWaits     map[float64]time.Duration
+	Abandoned      int64
+	AbandonedTotal int64
+	// LimitRejected and GlobalRejected split the rejections of the last interval by the limit that
+	// caused them: the method's own limit, including its admission queue, or the global bucket.
+	LimitRejected       int64
+	GlobalRejected      int64
+	GlobalRejectedTotal int64
+	// TenantRejected counts the requests rejected by the buckets of their tenants during the last
+	// interval, see WithTenantLimit.
+	TenantRejected int64
+	// Borrowed is the number of tokens borrowed from the pool of the method's borrowing group
+	// during the last interval.
+	Borrowed      int64
+	BorrowedTotal int64
+	// ShedProbability is the probability with which requests are shed. Shed counts the requests
+	// shed during the last interval, which are also counted as rejected, and ShedRate is their
+	// share of the requests checked, i.e. the effective shed probability.
+	ShedProbability float64
+	Shed            int64
+	ShedTotal       int64
+	ShedRate        float64
+	// ShadowMode reports whether the method is in shadow mode. WouldReject and ShadowAdmitted count
+	// the requests the bucket would have rejected and admitted during the last interval in shadow mode;
+	// WouldReject also counts the requests admitted by the warm-up, see WithWarmup.
+	ShadowMode       bool
+	WouldReject      int64
+	WouldRejectTotal int64
+	ShadowAdmitted   int64
+	// SloViolations is the number of requests that completed with a good status code but after
+	// the SLO during the last interval, and SloViolationRatio their share of those requests.
+	SloViolations      int64
+	SloViolationsTotal int64
+	SloViolationRatio  float64
+	// CurrentTokens is the number of tokens available at the time of the snapshot; it's negative
+	// while the bucket is in debt after admitting a request costing more than MaxTokens.
+	// TokensConsumed is the number of tokens admitted requests consumed during the last interval.
+	// EmptyIntervals is the number of consecutive intervals that ended with less than one token.
+	CurrentTokens  float64
+	TokensConsumed int64
+	EmptyIntervals int64
+	RefillRate     float64
+	MaxTokens      int64
+	SLO            time.Duration
+	// TargetRefillRate is the rate RefillRate is ramping to, see WithRateRamp; it equals
+	// RefillRate when no ramp is in progress.
+	TargetRefillRate float64
+	// OverrideRemaining is the time left until the temporary rate set through
+	// SetTemporaryRateLimit reverts to OverrideBaseline; both are zero without an override.
+	OverrideRemaining time.Duration
+	OverrideBaseline  float64
+	// Overloaded reports whether the method met an overload condition in the last interval, see
+	// WithOverloadDetection.
+	Overloaded bool
+	// Arrivals counts the requests that reached the interceptors during the last interval, before
+	// any admission decision, and Admitted those admitted; AdmissionRatio is their ratio, 1 if no
+	// request arrived. They roll over along with the goodput, so they describe the same interval.
+	Arrivals       int64
+	Admitted       int64
+	AdmissionRatio float64
+	ArrivalsTotal  int64
+	AdmittedTotal  int64
+	// MemberArrivals breaks Arrivals down by member method if the method is a method group, see
+	// WithMethodGroup; requests naming the group itself aren't included.
+	MemberArrivals map[string]int64
+	// LatencyBuckets holds the latencies of the last interval counted in fixed buckets, see
+	// WithLatencyBuckets.
+	LatencyBuckets LatencyBuckets
+	// LatencyWindows holds the tail latencies over the windows set with WithLatencyWindows, in
+	// their order.
+	LatencyWindows []WindowLatencies
+	// SmoothedGoodput and SmoothedTailLatency are the goodput and primary tail latency smoothed
+	// with WithSmoothing, as returned by GetMetrics; without smoothing they are Goodput and
+	// TailLatency95th.
+	SmoothedGoodput     float64
+	SmoothedTailLatency time.Duration
+	// Retries holds the retries of the method, nil unless enabled with WithRetryAttempts. Goodput
+	// only counts the attempts up to WithGoodputAttempts.
+	Retries *RetryMetrics
+	// Budget is the state of the error budget, nil unless enabled with WithErrorBudget.
+	Budget *ErrorBudget
+	// Distributed is the share of the replica in distributed mode, nil unless enabled with
+	// WithDistributed; RefillRate is then the rate of the whole cluster.
+	Distributed *DistributedShare
+	// MinRefillRate and MaxRefillRate are the bounds of the rates SetRateLimit may set; a
+	// MaxRefillRate of zero means no cap.
+	MinRefillRate float64
+	MaxRefillRate float64
+	// PID is the state of the PID controller; it's nil unless the controller mode is ControllerPID.
+	PID *PIDState
+	// CoDel is the state of latency-based shedding; it's nil unless enabled for the method.
+	CoDel *CoDelState
+	// Breaker is the state of the circuit breaker; it's nil unless enabled for the method.
+	Breaker *BreakerMetrics
+	// CPU is the CPU throttling of the method, nil unless enabled with WithCPUThrottling.
+	CPU *CPUMetrics
+	// Memory is the memory-pressure state, nil unless enabled with WithMemoryPressure.
+	Memory *MemoryPressure
+	// Sequence numbers the intervals of the method from 1 and IntervalEnd is the end of the last
+	// one; both are zero before it ended. The metrics of the last interval, such as Goodput, the
+	// tail latencies and SloViolations, always belong to the interval with this number.
+	Sequence    uint64
+	IntervalEnd time.Time
+}
+
+// GetMetricsSnapshot returns the current metrics for method, or ErrUnknownMethod if it isn't registered.
+func (rl *TopDownRL) GetMetricsSnapshot(method string) (MetricsSnapshot, error) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	metrics, exists := rl.interfaces[method]
+	if !exists {
+		return MetricsSnapshot{}, fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+	}
+	return rl.snapshotLocked(method, metrics), nil
+}
+
+// GetAllMetrics returns the current metrics of every registered method, taken as a single
+// consistent snapshot.
+func (rl *TopDownRL) GetAllMetrics() map[string]MetricsSnapshot {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	snapshots := make(map[string]MetricsSnapshot, len(rl.interfaces))
+	for methodName, metrics := range rl.interfaces {
+		snapshots[methodName] = rl.snapshotLocked(methodName, metrics)
+	}
+	return snapshots
+}
+
+// snapshotLocked builds the snapshot of a single method. The caller must hold rl.mutex.
+func (rl *TopDownRL) snapshotLocked(method string, metrics *InterfaceMetrics) MetricsSnapshot {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	snapshot := MetricsSnapshot{
+		Sequence:            metrics.Sequence,
+		IntervalEnd:         metrics.IntervalEnd,
+		Goodput:             metrics.CurrentGoodput,
+		TailLatency95th:     metrics.LastTailLatency95th,
+		TailLatencies:       copyLatencies(metrics.LastTailLatencies),
+		SampleCount:         metrics.LastSampleCount,
+		WindowTailLatencies: copyLatencies(metrics.WindowTailLatencies),
+		LatencyBuckets:      copyLatencyBuckets(metrics.LastLatencyBuckets),
+		LatencyWindows:      copyWindowLatencies(metrics.LatencyWindows),
+		SmoothedGoodput:     metrics.smoothedGoodput,
+		SmoothedTailLatency: metrics.smoothedLatency,
+		Rejected:            metrics.CurrentRejected,
+		RejectedTotal:       metrics.RejectedTotal,
+		Tiers:               rl.tierMetricsLocked(metrics),
+		InFlight:            metrics.concurrency.current(),
+		MaxConcurrent:       metrics.MaxConcurrent,
+		ConcurrencyRejected: metrics.CurrentConcurrencyRejected,
+
+		ConcurrencyRejectedTotal: metrics.ConcurrencyRejectedTotal,
+		Doomed:                   metrics.CurrentDoomed,
+		DoomedTotal:              metrics.DoomedTotal,
+		QueueDepth:               metrics.queue.currentDepth(),
+		QueueWaits:               copyLatencies(metrics.LastQueueWaits),
+		Abandoned:                metrics.CurrentAbandoned,
+		AbandonedTotal:           metrics.AbandonedTotal,
+		LimitRejected:            metrics.CurrentLimitRejected,
+		GlobalRejected:           metrics.CurrentGlobalRejected,
+		GlobalRejectedTotal:      metrics.GlobalRejectedTotal,
+		TenantRejected:           metrics.CurrentTenantRejected,
+		Borrowed:                 metrics.CurrentBorrowed,
+		BorrowedTotal:            metrics.BorrowedTotal,
+		ShedProbability:          metrics.shed.load(),
+		Shed:                     metrics.CurrentShed,
+		ShedTotal:                metrics.ShedTotal,
+		ShedRate:                 ratio(metrics.CurrentShed, metrics.CurrentShedEvaluated),
+		ShadowMode:               rl.inShadowMode(metrics),
+		WouldReject:              metrics.CurrentWouldReject,
+		WouldRejectTotal:         metrics.WouldRejectTotal,
+		ShadowAdmitted:           metrics.CurrentShadowAdmitted,
+		Panics:                   metrics.CurrentPanics,
+		PanicsTotal:              metrics.PanicsTotal,
+		Degraded:                 metrics.CurrentDegraded,
+		DegradedTotal:            metrics.DegradedTotal,
+		External:                 metrics.CurrentExternal,
+		TotalTailLatencies:       copyLatencies(metrics.LastTotalTailLatencies),
+		Cancelled:                metrics.CurrentCancelled,
+		CancelledTotal:           metrics.CancelledTotal,
+		Errors:                   metrics.CurrentErrors,
+		ErrorsByCode:             errorsByCodeName(metrics.CurrentErrorsByCode),
+		ErrorsTotal:              metrics.ErrorsTotal,
+		ErrorTailLatencies:       copyLatencies(metrics.LastErrorTailLatencies),
+		NegativeLatencies:        metrics.NegativeLatencies,
+
+		UnparseableTimestamps: metrics.UnparseableTimestamps,
+		SloViolations:         metrics.CurrentSloViolations,
+		SloViolationsTotal:    metrics.SloViolationsTotal,
+		SloViolationRatio:     ratio(metrics.CurrentSloViolations, metrics.CurrentGoodput+metrics.CurrentSloViolations),
+		CurrentTokens:         metrics.limiter.Snapshot().Available,
+		TokensConsumed:        metrics.CurrentTokensConsumed,
+		EmptyIntervals:        metrics.EmptyIntervals,
+		RefillRate:            metrics.RefillRate,
+		MaxTokens:             metrics.MaxTokens,
+		SLO:                   metrics.SLO,
+		MinRefillRate:         metrics.MinRefillRate,
+		MaxRefillRate:         metrics.MaxRefillRate,
+		PID:                   rl.pidStateLocked(metrics),
+		CoDel:                 codelStateLocked(metrics),
+
+		TargetRefillRate:  targetRateLocked(metrics),
+		OverrideRemaining: rl.overrideRemainingLocked(metrics),
+		Overloaded:        metrics.overloaded,
+		Arrivals:          metrics.CurrentArrivals,
+		Admitted:          metrics.CurrentAdmitted,
+		AdmissionRatio:    admissionRatio(metrics.CurrentAdmitted, metrics.CurrentArrivals),
+		ArrivalsTotal:     metrics.ArrivalsTotal,
+		AdmittedTotal:     metrics.AdmittedTotal,
+		MemberArrivals:    maps.Clone(metrics.CurrentMemberArrivals),
+		Retries:           rl.retryMetricsLocked(metrics),
+		Budget:            rl.budgetStateLocked(metrics),
+		Distributed:       rl.distributedStateLocked(metrics),
+		Breaker:           rl.breakerStateLocked(metrics),
+		CPU:               rl.cpuMetricsLocked(metrics),
+		Memory:            rl.memoryPressureLocked(metrics),
+	}
+	if metrics.override != nil {
+		snapshot.OverrideBaseline = metrics.override.baseline
+	}
+	return snapshot
+}
+
+// pidStateLocked returns a copy of the PID state of a method if the PID controller is active.
+// The caller must hold metrics.mu.
+func (rl *TopDownRL) pidStateLocked(metrics *InterfaceMetrics) *PIDState {
+	if rl.ControllerMode() != ControllerPID {
+		return nil
+	}
+	state := metrics.pid
+	return &state
+}
+
+// errorsByCodeName converts error counts keyed by status code to counts keyed by code name.
+func errorsByCodeName(errorsByCode map[codes.Code]int64) map[string]int64 {
+	converted := make(map[string]int64, len(errorsByCode))
+	for code, count := range errorsByCode {
+		converted[code.String()] = count
+	}
+	return converted
+}
+
+// copyLatencies returns a copy of a percentile to latency map.
+func copyLatencies(latencies map[float64]time.Duration) map[float64]time.Duration {
+	copied := make(map[float64]time.Duration, len(latencies))
+	for percentile, latency := range latencies {
+		copied[percentile] = latency
+	}
+	return copied
+}
+
+// MetricsResponse is the JSON shape of a MetricsSnapshot served by HandleGetMetrics.
+type MetricsResponse struct {
+	Method  string `json:"method"`
+	Goodput int64  `json:"goodput"`
+	// Sequence is the number of the last interval and Timestamp its end in (fractional) seconds
+	// since the Unix epoch; both are 0 before the first interval ended.
+	Sequence  uint64  `json:"sequence"`
+	Timestamp float64 `json:"timestamp"`
+	// LatencyMs is null and PercentilesMs empty while the tail latencies are unknown, and
+	// SampleCount counts the latencies of the last interval.
+	LatencyMs   *float64 `json:"latency_ms"`
+	SampleCount uint64   `json:"sample_count"`
+	// PercentilesMs maps each configured percentile, e.g. "0.99", to its latency in milliseconds.
+	PercentilesMs       map[string]float64     `json:"percentiles_ms"`
+	WindowPercentilesMs map[string]float64     `json:"window_percentiles_ms,omitempty"`
+	LatencyBuckets      LatencyBucketsResponse `json:"latency_buckets"`
+	Rejected            int64                  `json:"rejected"`
+	Arrivals            int64                  `json:"arrivals"`
+	MemberArrivals      map[string]int64       `json:"member_arrivals,omitempty"`
+	Admitted            int64                  `json:"admitted"`
+	AdmissionRatio      float64                `json:"admission_ratio"`
+	Tiers               map[string]TierMetrics `json:"tiers,omitempty"`
+	InFlight            int64                  `json:"in_flight"`
+	MaxConcurrent       int64                  `json:"max_concurrent"`
+	ConcurrencyRejected int64                  `json:"concurrency_rejected"`
+	Doomed              int64                  `json:"doomed"`
+	QueueDepth          int64                  `json:"queue_depth"`
+	QueueWaitsMs        map[string]float64     `json:"queue_wait_percentiles_ms"`
+	Abandoned           int64                  `json:"abandoned"`
+	LimitRejected       int64                  `json:"limit_rejected"`
+	GlobalRejected      int64                  `json:"global_rejected"`
+	TenantRejected      int64                  `json:"tenant_rejected"`
+	Borrowed            int64                  `json:"borrowed"`
+	ShedProbability     float64                `json:"shed_probability"`
+	Shed                int64                  `json:"shed"`
+	ShedRate            float64                `json:"shed_rate"`
+	ShadowMode          bool                   `json:"shadow_mode"`
+	WouldReject         int64                  `json:"would_reject"`
+	ShadowAdmitted      int64                  `json:"shadow_admitted"`
+	Panics              int64                  `json:"panics"`
+	Degraded            int64                  `json:"degraded"`
+	Cancelled           int64                  `json:"cancelled"`
+	Errors              int64                  `json:"errors"`
+	ErrorsByCode        map[string]int64       `json:"errors_by_code"`
+	ErrorPercentilesMs  map[string]float64     `json:"error_percentiles_ms"`
+	ExternalRequests    int64                  `json:"external_requests"`
+	TotalPercentilesMs  map[string]float64     `json:"total_percentiles_ms,omitempty"`
+	SloViolations       int64                  `json:"slo_violations"`
+	SloViolationRatio   float64                `json:"slo_violation_ratio"`
+	NegativeLatencies   int64                  `json:"negative_latencies"`
+	// UnparseableTimestamps counts start time metadata that couldn't be parsed, a sign of a misconfigured format.
+	UnparseableTimestamps int64       `json:"unparseable_timestamps"`
+	Tokens                float64     `json:"tokens"`
+	TokensConsumed        int64       `json:"tokens_consumed"`
+	EmptyIntervals        int64       `json:"empty_intervals"`
+	RefillRate            float64     `json:"refill_rate"`
+	MaxTokens             int64       `json:"max_tokens"`
+	SloMs                 float64     `json:"slo_ms"`
+	MinRefillRate         float64     `json:"min_refill_rate"`
+	MaxRefillRate         float64     `json:"max_refill_rate"`
+	TargetRefillRate      float64     `json:"target_refill_rate"`
+	OverrideRemainingMs   float64     `json:"override_remaining_ms,omitempty"`
+	OverrideBaseline      float64     `json:"override_baseline,omitempty"`
+	Overloaded            bool        `json:"overloaded"`
+	PID                   *PIDState   `json:"pid,omitempty"`
+	CoDel                 *CoDelState `json:"codel,omitempty"`
+
+	LatencyWindows []WindowLatenciesResponse `json:"latency_windows,omitempty"`
+	// SmoothedGoodput and SmoothedLatencyMs are the values smoothed with WithSmoothing.
+	SmoothedGoodput   float64 `json:"smoothed_goodput"`
+	SmoothedLatencyMs float64 `json:"smoothed_latency_ms"`
+
+	Retries     *RetryMetrics        `json:"retries,omitempty"`
+	Budget      *BudgetResponse      `json:"budget,omitempty"`
+	Distributed *DistributedResponse `json:"distributed,omitempty"`
+	Breaker     *BreakerMetrics      `json:"breaker,omitempty"`
+	CPU         *CPUMetrics          `json:"cpu,omitempty"`
+	Memory      *MemoryPressure      `json:"memory,omitempty"`
+}
+
+// newMetricsResponse converts a snapshot into its JSON shape.
+func newMetricsResponse(method string, snapshot MetricsSnapshot) MetricsResponse {
+	return MetricsResponse{
+		Method:              method,
+		Goodput:             snapshot.Goodput,
+		Sequence:            snapshot.Sequence,
+		Timestamp:           unixSeconds(snapshot.IntervalEnd),
+		LatencyMs:           latencyMs(snapshot),
+		SampleCount:         snapshot.SampleCount,
+		PercentilesMs:       percentilesMs(snapshot.TailLatencies),
+		WindowPercentilesMs: percentilesMs(snapshot.WindowTailLatencies),
+		LatencyBuckets:      newLatencyBucketsResponse(snapshot.LatencyBuckets),
+		LatencyWindows:      newWindowLatenciesResponse(snapshot.LatencyWindows),
+		SmoothedGoodput:     snapshot.SmoothedGoodput,
+		SmoothedLatencyMs:   durationMs(snapshot.SmoothedTailLatency),
+		Rejected:            snapshot.Rejected,
+		Arrivals:            snapshot.Arrivals,
+		MemberArrivals:      snapshot.MemberArrivals,
+		Admitted:            snapshot.Admitted,
+		AdmissionRatio:      snapshot.AdmissionRatio,
+		Tiers:               snapshot.Tiers,
+		InFlight:            snapshot.InFlight,
+		MaxConcurrent:       snapshot.MaxConcurrent,
+		ConcurrencyRejected: snapshot.ConcurrencyRejected,
+		Doomed:              snapshot.Doomed,
+		QueueDepth:          snapshot.QueueDepth,
+		QueueWaitsMs:        percentilesMs(snapshot.QueueWaits),
+		Abandoned:           snapshot.Abandoned,
+		LimitRejected:       snapshot.LimitRejected,
+		GlobalRejected:      snapshot.GlobalRejected,
+		TenantRejected:      snapshot.TenantRejected,
+		Borrowed:            snapshot.Borrowed,
+		ShedProbability:     snapshot.ShedProbability,
+		Shed:                snapshot.Shed,
+		ShedRate:            snapshot.ShedRate,
+		ShadowMode:          snapshot.ShadowMode,
+		WouldReject:         snapshot.WouldReject,
+		ShadowAdmitted:      snapshot.ShadowAdmitted,
+		Panics:              snapshot.Panics,
+		Degraded:            snapshot.Degraded,
+		Cancelled:           snapshot.Cancelled,
+		Errors:              snapshot.Errors,
+		ErrorsByCode:        snapshot.ErrorsByCode,
+		ErrorPercentilesMs:  percentilesMs(snapshot.ErrorTailLatencies),
+		SloViolations:       snapshot.SloViolations,
+		SloViolationRatio:   snapshot.SloViolationRatio,
+		NegativeLatencies:   snapshot.NegativeLatencies,
+		ExternalRequests:    snapshot.External,
+		TotalPercentilesMs:  percentilesMs(snapshot.TotalTailLatencies),
+
+		UnparseableTimestamps: snapshot.UnparseableTimestamps,
+		Tokens:                snapshot.CurrentTokens,
+		TokensConsumed:        snapshot.TokensConsumed,
+		EmptyIntervals:        snapshot.EmptyIntervals,
+		RefillRate:            snapshot.RefillRate,
+		MaxTokens:             snapshot.MaxTokens,
+		SloMs:                 durationMs(snapshot.SLO),
+		MinRefillRate:         snapshot.MinRefillRate,
+		MaxRefillRate:         snapshot.MaxRefillRate,
+		TargetRefillRate:      snapshot.TargetRefillRate,
+		OverrideRemainingMs:   durationMs(snapshot.OverrideRemaining),
+		OverrideBaseline:      snapshot.OverrideBaseline,
+		Overloaded:            snapshot.Overloaded,
+		PID:                   snapshot.PID,
+		CoDel:                 snapshot.CoDel,
+
+		Retries:     snapshot.Retries,
+		Budget:      newBudgetResponse("", snapshot.Budget),
+		Distributed: newDistributedResponse(snapshot.Distributed),
+		Breaker:     snapshot.Breaker,
+		CPU:         snapshot.CPU,
+		Memory:      snapshot.Memory,
+	}
+}
+
+// latencyMs returns the primary tail latency of a snapshot in milliseconds, or nil if it's unknown.
+func latencyMs(snapshot MetricsSnapshot) *float64 {
+	if len(snapshot.TailLatencies) == 0 {
+		return nil
+	}
+	latency := durationMs(snapshot.TailLatency95th)
+	return &latency
+}
+
+// percentilesMs converts a percentile to latency map into its JSON shape, keyed by the percentile
+// (e.g. "0.99") with latencies in milliseconds.
+func percentilesMs(latencies map[float64]time.Duration) map[string]float64 {
+	converted := make(map[string]float64, len(latencies))
+	for percentile, latency := range latencies {
+		converted[strconv.FormatFloat(percentile, 'g', -1, 64)] = durationMs(latency)
+	}
+	return converted
+}
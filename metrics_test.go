@@ -0,0 +1,46 @@
+package topdown
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+func TestRejectedCounterResetsEachInterval(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	rl, err := NewTopDownRLWithBuckets(map[string]BucketConfig{"/a": {MaxTokens: 2, RefillRate: 1e-9}},
+		map[string]time.Duration{"/a": 5 * time.Millisecond}, false, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Roll the intervals over by hand instead of on the ticker
+	rl.Stop(context.Background())
+	metrics := rl.loadMetrics("/a")
+	info := &grpc.UnaryServerInfo{FullMethod: "/a"}
+	slow := func(ctx context.Context, req interface{}) (interface{}, error) {
+		clock.Advance(10 * time.Millisecond)
+		return nil, nil
+	}
+	ctx := context.Background()
+
+	// Two requests are admitted and miss the SLO, three are rejected
+	for i := 0; i < 5; i++ {
+		rl.UnaryInterceptor(ctx, nil, info, slow)
+	}
+	rl.rollover(metrics, clock.Now())
+	snapshot, err := rl.GetMetricsSnapshot("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Rejected != 3 || snapshot.Goodput != 0 {
+		t.Errorf("%d rejected requests and goodput %d, want the 3 that found the bucket empty and 0", snapshot.Rejected, snapshot.Goodput)
+	}
+
+	clock.Advance(time.Second)
+	rl.rollover(metrics, clock.Now())
+	if snapshot, _ = rl.GetMetricsSnapshot("/a"); snapshot.Rejected != 0 {
+		t.Errorf("%d rejected requests in an interval without traffic, want 0", snapshot.Rejected)
+	}
+}
@@ -0,0 +1,110 @@
+package topdown
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// notifyIntervalLocked wakes the waiters for the next interval of a method. Waiters read the
+// snapshot once the rollover released metrics.mu, so they never see a partial interval. The
+// caller must hold metrics.mu.
+func notifyIntervalLocked(metrics *InterfaceMetrics) {
+	close(metrics.nextInterval)
+	metrics.nextInterval = make(chan struct{})
+}
+
+// WaitForInterval blocks until an interval of a method with a sequence number above after has
+// ended and returns the snapshot taken then, see MetricsSnapshot.Sequence. It returns at once if
+// such an interval already ended, ctx.Err() if ctx is done first, and ErrUnknownMethod if the
+// method isn't registered.
+func (rl *TopDownRL) WaitForInterval(ctx context.Context, method string, after uint64) (MetricsSnapshot, error) {
+	for {
+		metrics := rl.registeredMetrics(method)
+		if metrics == nil {
+			return MetricsSnapshot{}, fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+		}
+		metrics.mu.Lock()
+		sequence, next := metrics.Sequence, metrics.nextInterval
+		metrics.mu.Unlock()
+		if sequence > after {
+			return rl.GetMetricsSnapshot(method)
+		}
+
+		select {
+		case <-next:
+		case <-ctx.Done():
+			return MetricsSnapshot{}, ctx.Err()
+		}
+	}
+}
+
+// HandleNextMetrics handles the GET requests to wait for the next interval of a method and return
+// its metrics in the shape of HandleGetMetrics. The optional 'seq' parameter returns at once if
+// the interval after it already ended, and 'timeout', twice the metrics interval by default,
+// answers 204 if no interval ended in time.
+func (rl *TopDownRL) HandleNextMetrics(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleNextMetrics called")
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	method := r.URL.Query().Get("method")
+	if method == "" {
+		writeError(w, "Missing 'method' parameter", http.StatusBadRequest)
+		return
+	}
+
+	timeout := 2 * rl.MetricsInterval()
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			writeError(w, "Invalid 'timeout' parameter", http.StatusBadRequest)
+			return
+		}
+		timeout = parsed
+	}
+
+	var after uint64
+	if value := r.URL.Query().Get("seq"); value != "" {
+		sequence, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			writeError(w, "Invalid 'seq' parameter", http.StatusBadRequest)
+			return
+		}
+		after = sequence
+	} else {
+		snapshot, err := rl.GetMetricsSnapshot(method)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		after = snapshot.Sequence
+	}
+
+	// The wait ends with the request, so abandoned requests don't keep waiting
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	snapshot, err := rl.WaitForInterval(ctx, method, after)
+	switch {
+	case errors.Is(err, ErrUnknownMethod):
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case err != nil:
+		// The client is gone, so there is no one to answer
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newMetricsResponse(method, snapshot))
+}
@@ -0,0 +1,193 @@
+package topdown
+
+import (
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Option configures optional behavior of a TopDownRL at construction time.
+type Option func(*TopDownRL)
+
+// UnknownMethodPolicy selects how requests for methods without an SLO entry are handled.
+type UnknownMethodPolicy int
+
+const (
+	// UnknownMethodBypass lets requests for unregistered methods through without rate limiting.
+	UnknownMethodBypass UnknownMethodPolicy = iota
+	// UnknownMethodRegister registers unknown methods on first sight using the default SLO and bucket.
+	UnknownMethodRegister
+)
+
+// Default timeouts of the control server, see NewServer.
+const (
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultIdleTimeout       = 2 * time.Minute
+)
+
+// WithServerConfig sets a function that adjusts every control server before it starts,
+// e.g. to change its timeouts or error log.
+func WithServerConfig(configure func(*http.Server)) Option {
+	return func(rl *TopDownRL) {
+		rl.serverConfig = configure
+	}
+}
+
+// WithUnknownMethodPolicy sets the policy applied to methods that are not in the SLO map.
+func WithUnknownMethodPolicy(policy UnknownMethodPolicy) Option {
+	return func(rl *TopDownRL) {
+		rl.unknownMethodPolicy = policy
+	}
+}
+
+// WithDefaultSLO sets the SLO assigned to methods registered on first sight.
+func WithDefaultSLO(slo time.Duration) Option {
+	return func(rl *TopDownRL) {
+		rl.defaultSLO = slo
+	}
+}
+
+// WithDefaultBucket overrides the token bucket parameters assigned to methods without a bucket
+// configuration, including methods registered on first sight. By default NewTopDownRL uses its
+// maxTokens and refillRate, and NewTopDownRLWithBuckets uses the package defaults.
+func WithDefaultBucket(maxTokens int64, refillRate float64) Option {
+	return func(rl *TopDownRL) {
+		rl.defaultBucket.MaxTokens = maxTokens
+		rl.defaultBucket.RefillRate = refillRate
+	}
+}
+
+// WithName sets a name identifying this limiter, exported as the "limiter" label in
+// Prometheus metrics so several limiters can be scraped from the same process.
+func WithName(name string) Option {
+	return func(rl *TopDownRL) {
+		rl.name = name
+	}
+}
+
+// WithPercentiles sets the tail latency percentiles (in (0, 1]) computed every interval.
+// The first one is used for control and reported as the tail latency; the default is 0.95.
+func WithPercentiles(percentiles ...float64) Option {
+	return func(rl *TopDownRL) {
+		rl.percentiles = append([]float64(nil), percentiles...)
+	}
+}
+
+// WithMethodPercentiles overrides the tail latency percentiles computed for a single method.
+func WithMethodPercentiles(methodName string, percentiles ...float64) Option {
+	return func(rl *TopDownRL) {
+		if rl.methodPercentiles == nil {
+			rl.methodPercentiles = make(map[string][]float64)
+		}
+		rl.methodPercentiles[methodName] = append([]float64(nil), percentiles...)
+	}
+}
+
+// WithLatencyPrecision sets the number of significant bits (1 to 14) kept by the latency histograms.
+// Higher precision reduces the quantile error at the cost of memory; the default is DefaultLatencyPrecision.
+func WithLatencyPrecision(bits int) Option {
+	return func(rl *TopDownRL) {
+		rl.latencyPrecision = bits
+	}
+}
+
+// WithMethodLatencyPrecision overrides the latency histogram precision of a single method, e.g. to
+// resolve the tail of a latency-critical method finely or to save memory on a lot of minor ones.
+func WithMethodLatencyPrecision(methodName string, bits int) Option {
+	return func(rl *TopDownRL) {
+		if rl.methodLatencyPrecision == nil {
+			rl.methodLatencyPrecision = make(map[string]int)
+		}
+		rl.methodLatencyPrecision[methodName] = bits
+	}
+}
+
+// WithLatencyWindow enables a rolling view of the tail latencies over the last given number of
+// intervals, reported next to the per-interval tail latencies.
+func WithLatencyWindow(intervals int) Option {
+	return func(rl *TopDownRL) {
+		rl.latencyWindowIntervals = intervals
+	}
+}
+
+// EmptyLatencyMode selects which tail latencies a method reports after an interval without
+// latencies, see WithEmptyLatencyMode.
+type EmptyLatencyMode int
+
+const (
+	// EmptyLatencyHold keeps the tail latencies of the last interval with latencies.
+	EmptyLatencyHold EmptyLatencyMode = iota
+	// EmptyLatencyClear clears the tail latencies, so they are unknown until traffic resumes.
+	EmptyLatencyClear
+)
+
+// WithEmptyLatencyMode sets which tail latencies are reported after an interval without
+// latencies. The default is EmptyLatencyHold. Either way MetricsSnapshot.SampleCount is 0 for
+// such intervals, so they can't be mistaken for instant responses.
+func WithEmptyLatencyMode(mode EmptyLatencyMode) Option {
+	return func(rl *TopDownRL) {
+		rl.emptyLatencyMode = mode
+	}
+}
+
+// WithLatencyWindows adds rolling windows of the tail latencies, e.g. 10s and 60s, reported in
+// MetricsSnapshot.LatencyWindows next to the per-interval tail latencies. Each window is rounded
+// up to whole metrics intervals when the limiter is created and keeps that number of intervals
+// if SetMetricsInterval changes the interval later. The windows share the histograms of the
+// intervals, so the memory of a method grows with the longest window.
+func WithLatencyWindows(windows ...time.Duration) Option {
+	return func(rl *TopDownRL) {
+		rl.latencyWindows = append([]time.Duration(nil), windows...)
+	}
+}
+
+// WithControlWindow points the AIMD and PID controllers at the tail latency over one of the
+// windows set with WithLatencyWindows rather than over the last interval, to match their control
+// period. Windows without latencies don't move the rate, like empty intervals.
+func WithControlWindow(window time.Duration) Option {
+	return func(rl *TopDownRL) {
+		rl.controlWindow = window
+	}
+}
+
+// WithGoodCodes adds status codes that count towards goodput in addition to codes.OK,
+// e.g. codes.NotFound for lookups where a miss is a valid answer.
+func WithGoodCodes(goodCodes ...codes.Code) Option {
+	return func(rl *TopDownRL) {
+		for _, code := range goodCodes {
+			rl.goodCodes[code] = true
+		}
+	}
+}
+
+// LatencyMode selects where the start time of a request is taken from when measuring its latency.
+type LatencyMode int
+
+const (
+	// LatencyClientTimestamp uses the "timestamp" metadata set by the client, falling back to the
+	// time the interceptor was entered if it is missing or invalid.
+	LatencyClientTimestamp LatencyMode = iota
+	// LatencyServerHandlerTime uses the time the interceptor was entered.
+	LatencyServerHandlerTime
+	// LatencyHybrid uses the client timestamp only if it is within the maximum clock skew
+	// of the server time, and the time the interceptor was entered otherwise.
+	LatencyHybrid
+)
+
+// DefaultMaxClockSkew is the default clock skew tolerated by LatencyHybrid.
+const DefaultMaxClockSkew = time.Second
+
+// WithLatencyMode sets how request latencies are measured. The default is LatencyClientTimestamp.
+func WithLatencyMode(mode LatencyMode) Option {
+	return func(rl *TopDownRL) {
+		rl.latencyMode = mode
+	}
+}
+
+// WithMaxClockSkew sets how far a client timestamp may be from the server time for LatencyHybrid to use it.
+func WithMaxClockSkew(skew time.Duration) Option {
+	return func(rl *TopDownRL) {
+		rl.maxClockSkew = skew
+	}
+}
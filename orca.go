@@ -0,0 +1,146 @@
+package topdown
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v3orcapb "github.com/cncf/xds/go/xds/data/orca/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/orca"
+	"google.golang.org/protobuf/proto"
+)
+
+// ORCATrailer is the trailer key of the ORCA load reports, which Envoy and the gRPC weighted
+// round robin balancer read.
+const ORCATrailer = "endpoint-load-metrics-bin"
+
+// Names of the utilizations and metrics reported in addition to the standard ORCA fields.
+const (
+	// LoadTokenUtilization is the share of the refill rate the admitted requests consumed.
+	LoadTokenUtilization = "tokens"
+	// LoadConcurrencyUtilization is the share of the concurrency limit in use, if capped.
+	LoadConcurrencyUtilization = "concurrency"
+	// LoadTailLatencySLORatio is the ratio of the 95th percentile tail latency to the SLO.
+	LoadTailLatencySLORatio = "p95_slo_ratio"
+	// LoadInFlight is the number of requests in flight.
+	LoadInFlight = "in_flight"
+)
+
+// loadReport is the ORCA load report of a method for the last interval, along with its encoding.
+type loadReport struct {
+	report  *v3orcapb.OrcaLoadReport
+	trailer string
+}
+
+// WithLoadReports attaches an ORCA load report to the responses of UnaryInterceptor for the
+// methods matching one of patterns, or all methods without any. The report is computed once per
+// interval: the application utilization is the larger of the token and concurrency utilizations,
+// which are also reported by name, along with the admitted requests and errors per second and
+// the named metrics p95_slo_ratio and in_flight. If the orca package's CallMetricsServerOption
+// runs before the interceptor, the values are set on its per-call recorder instead of the trailer.
+func WithLoadReports(patterns ...string) Option {
+	return func(rl *TopDownRL) {
+		if len(patterns) == 0 {
+			patterns = []string{"*"}
+		}
+		rl.loadReportPatterns = append(rl.loadReportPatterns, patterns...)
+	}
+}
+
+// SetMethodLoadReports enables or disables the load reports of a single method.
+func (rl *TopDownRL) SetMethodLoadReports(method string, enabled bool) error {
+	metrics := rl.registeredMetrics(method)
+	if metrics == nil {
+		return fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+	}
+
+	metrics.loadReports.Store(enabled)
+	if rl.Debug {
+		rl.logger.Debugf("Set load reports for method '%s': %t", method, enabled)
+	}
+	return nil
+}
+
+// loadReportsEnabled reports whether a method matches the patterns of WithLoadReports.
+func (rl *TopDownRL) loadReportsEnabled(methodName string) bool {
+	for _, pattern := range rl.loadReportPatterns {
+		if matchPattern(pattern, methodName) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadReportLocked computes the load report of a method for the interval ending at now. The
+// caller must hold metrics.mu and have saved the interval's metrics.
+func (rl *TopDownRL) loadReportLocked(metrics *InterfaceMetrics, tailLatency time.Duration, now time.Time) {
+	if !metrics.loadReports.Load() {
+		return
+	}
+	elapsed := now.Sub(metrics.intervalStart).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	tokens := 0.0
+	if refilled := metrics.RefillRate * elapsed; refilled > 0 {
+		tokens = float64(metrics.CurrentTokensConsumed) / refilled
+	}
+	inFlight := metrics.concurrency.current()
+	report := &v3orcapb.OrcaLoadReport{
+		ApplicationUtilization: tokens,
+		RpsFractional:          float64(metrics.CurrentAdmitted) / elapsed,
+		Eps:                    float64(metrics.CurrentErrors) / elapsed,
+		Utilization:            map[string]float64{LoadTokenUtilization: tokens},
+		NamedMetrics:           map[string]float64{LoadInFlight: float64(inFlight)},
+	}
+	if metrics.MaxConcurrent > 0 {
+		concurrency := float64(inFlight) / float64(metrics.MaxConcurrent)
+		report.Utilization[LoadConcurrencyUtilization] = concurrency
+		report.ApplicationUtilization = max(report.ApplicationUtilization, concurrency)
+	}
+	if metrics.SLO > 0 {
+		report.NamedMetrics[LoadTailLatencySLORatio] = float64(tailLatency) / float64(metrics.SLO)
+	}
+
+	data, err := proto.Marshal(report)
+	if err != nil {
+		rl.logger.Errorf("Failed to encode load report for method '%s': %v", metrics.method, err)
+		return
+	}
+	metrics.loadReport.Store(&loadReport{report: report, trailer: string(data)})
+}
+
+// attachLoadReport attaches the load report of the last interval to the response of a unary
+// request, if enabled for the method.
+func (rl *TopDownRL) attachLoadReport(ctx context.Context, methodName string) {
+	if len(rl.loadReportPatterns) == 0 {
+		return
+	}
+	metrics := rl.registeredMetrics(methodName)
+	if metrics == nil || !metrics.loadReports.Load() {
+		return
+	}
+	current := metrics.loadReport.Load()
+	if current == nil {
+		return
+	}
+
+	recorder := orca.CallMetricsRecorderFromContext(ctx)
+	if recorder == nil {
+		grpc.SetTrailer(ctx, metadata.Pairs(ORCATrailer, current.trailer))
+		return
+	}
+	report := current.report
+	recorder.SetApplicationUtilization(report.ApplicationUtilization)
+	recorder.SetQPS(report.RpsFractional)
+	recorder.SetEPS(report.Eps)
+	for name, value := range report.Utilization {
+		recorder.SetNamedUtilization(name, value)
+	}
+	for name, value := range report.NamedMetrics {
+		recorder.SetNamedMetric(name, value)
+	}
+}
@@ -0,0 +1,234 @@
+package topdown
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// OverloadConfig holds the conditions under which the limiter reports itself as overloaded, see
+// WithOverloadDetection. An interval is overloaded if any method meets one of the conditions.
+type OverloadConfig struct {
+	// RejectionRatio is the share of the requests of a method rejected by its limits above which
+	// an interval counts as overloaded; zero disables the condition.
+	RejectionRatio float64 `json:"rejection_ratio"`
+	// LatencyFactor is the multiple of its SLO the tail latency of a method must exceed for an
+	// interval to count as overloaded, e.g. 2; zero disables the condition.
+	LatencyFactor float64 `json:"latency_factor"`
+	// Intervals is the number of consecutive overloaded intervals after which the limiter is
+	// overloaded, and RecoveryIntervals the number of consecutive intervals without overload after
+	// which it recovers, so a single good or bad interval doesn't flip the state.
+	Intervals         int `json:"intervals"`
+	RecoveryIntervals int `json:"recovery_intervals"`
+}
+
+// DefaultOverloadConfig returns the default overload conditions.
+func DefaultOverloadConfig() OverloadConfig {
+	return OverloadConfig{
+		RejectionRatio:    0.5,
+		LatencyFactor:     2,
+		Intervals:         3,
+		RecoveryIntervals: 5,
+	}
+}
+
+// validate checks that the overload conditions can be met and cleared.
+func (c OverloadConfig) validate() error {
+	if c.RejectionRatio < 0 || c.RejectionRatio >= 1 {
+		return fmt.Errorf("rejection ratio must be in [0, 1), got %g", c.RejectionRatio)
+	}
+	if c.LatencyFactor < 0 {
+		return fmt.Errorf("latency factor must not be negative, got %g", c.LatencyFactor)
+	}
+	if c.RejectionRatio == 0 && c.LatencyFactor == 0 {
+		return errors.New("either the rejection ratio or the latency factor must be set")
+	}
+	if c.Intervals < 1 || c.RecoveryIntervals < 1 {
+		return fmt.Errorf("intervals must be positive, got %d and %d recovery intervals", c.Intervals, c.RecoveryIntervals)
+	}
+	return nil
+}
+
+// HealthStatusSetter sets the serving status of a gRPC service, as *health.Server of
+// google.golang.org/grpc/health does.
+type HealthStatusSetter interface {
+	SetServingStatus(service string, servingStatus healthpb.HealthCheckResponse_ServingStatus)
+}
+
+// WithOverloadDetection reports the limiter as overloaded through GET /healthz, the metrics and
+// the health server set through WithHealthServer, if any, once the conditions of config held
+// for config.Intervals consecutive intervals.
+func WithOverloadDetection(config OverloadConfig) Option {
+	return func(rl *TopDownRL) {
+		rl.overload = &overloadDetector{config: config}
+	}
+}
+
+// WithHealthServer sets the named services of server, the overall health of the server if none
+// are given, to NOT_SERVING while the limiter is overloaded and to SERVING otherwise, so load
+// balancers take the backend out of rotation. It enables overload detection with
+// DefaultOverloadConfig unless configured with WithOverloadDetection.
+func WithHealthServer(server HealthStatusSetter, services ...string) Option {
+	return func(rl *TopDownRL) {
+		if len(services) == 0 {
+			services = []string{""}
+		}
+		rl.healthServer = server
+		rl.healthServices = services
+	}
+}
+
+// overloadDetector tracks the overload state of the limiter across intervals.
+type overloadDetector struct {
+	config OverloadConfig
+
+	mu          sync.Mutex
+	overloaded  bool
+	since       time.Time
+	badStreak   int
+	goodStreak  int
+	lastMethods []string
+}
+
+// update records whether the last interval was overloaded, by the given methods, and reports
+// whether the overload state flipped.
+func (d *overloadDetector) update(methods []string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lastMethods = methods
+	if len(methods) > 0 {
+		d.badStreak++
+		d.goodStreak = 0
+	} else {
+		d.goodStreak++
+		d.badStreak = 0
+	}
+
+	switch {
+	case !d.overloaded && d.badStreak >= d.config.Intervals:
+		d.overloaded, d.since = true, now
+		return true
+	case d.overloaded && d.goodStreak >= d.config.RecoveryIntervals:
+		d.overloaded, d.since = false, now
+		return true
+	}
+	return false
+}
+
+// detectOverloadLocked evaluates the overload conditions for a method at the end of an interval.
+// The caller must hold metrics.mu.
+func (rl *TopDownRL) detectOverloadLocked(metrics *InterfaceMetrics, tailLatency time.Duration, empty bool) {
+	metrics.overloaded = false
+	if rl.overload == nil || empty {
+		return
+	}
+	config := rl.overload.config
+
+	admitted := metrics.CurrentGoodput + metrics.CurrentSloViolations + metrics.CurrentErrors + metrics.CurrentCancelled
+	if total := admitted + metrics.CurrentRejected; config.RejectionRatio > 0 && total > 0 {
+		metrics.overloaded = float64(metrics.CurrentRejected)/float64(total) > config.RejectionRatio
+	}
+	if config.LatencyFactor > 0 && float64(tailLatency) > float64(metrics.SLO)*config.LatencyFactor {
+		metrics.overloaded = true
+	}
+}
+
+// updateOverload updates the overload state of the limiter after the methods rolled over to a
+// new interval, and the health server if it flipped.
+func (rl *TopDownRL) updateOverload(now time.Time) {
+	if rl.overload == nil {
+		return
+	}
+
+	var methods []string
+	for methodName, metrics := range *rl.published.Load() {
+		metrics.mu.Lock()
+		if metrics.overloaded {
+			methods = append(methods, methodName)
+		}
+		metrics.mu.Unlock()
+	}
+	sort.Strings(methods)
+	if !rl.overload.update(methods, now) {
+		return
+	}
+
+	overloaded := rl.Overloaded()
+	if overloaded {
+		rl.logger.Infof("Limiter overloaded by methods %v", methods)
+	} else {
+		rl.logger.Infof("Limiter recovered from overload")
+	}
+	rl.setHealthStatus(overloaded)
+}
+
+// setHealthStatus sets the serving status of the services of the health server, if any.
+func (rl *TopDownRL) setHealthStatus(overloaded bool) {
+	if rl.healthServer == nil {
+		return
+	}
+	status := healthpb.HealthCheckResponse_SERVING
+	if overloaded {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	for _, service := range rl.healthServices {
+		rl.healthServer.SetServingStatus(service, status)
+	}
+}
+
+// Overloaded reports whether the limiter is overloaded, see WithOverloadDetection.
+func (rl *TopDownRL) Overloaded() bool {
+	if rl.overload == nil {
+		return false
+	}
+	rl.overload.mu.Lock()
+	defer rl.overload.mu.Unlock()
+	return rl.overload.overloaded
+}
+
+// healthResponse is the JSON shape of the health served by HandleHealth.
+type healthResponse struct {
+	Status string `json:"status"`
+	// Methods are the methods that met an overload condition in the last interval.
+	Methods []string `json:"overloaded_methods"`
+	// Since is when the limiter became overloaded or recovered last.
+	Since *time.Time `json:"since,omitempty"`
+}
+
+// HandleHealth handles the GET requests for the health of the limiter, answering 503 while it's
+// overloaded and 200 otherwise.
+func (rl *TopDownRL) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleHealth called")
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := healthResponse{Status: "ok", Methods: []string{}}
+	code := http.StatusOK
+	if rl.overload != nil {
+		rl.overload.mu.Lock()
+		if rl.overload.overloaded {
+			response.Status = "overloaded"
+			code = http.StatusServiceUnavailable
+		}
+		response.Methods = append(response.Methods, rl.overload.lastMethods...)
+		if since := rl.overload.since; !since.IsZero() {
+			response.Since = &since
+		}
+		rl.overload.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(response)
+}
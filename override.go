@@ -0,0 +1,78 @@
+package topdown
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// rateOptions controls how a rate set through SetRateLimit or the control API takes effect.
+type rateOptions struct {
+	// immediate bypasses the ramp configured through WithRateRamp.
+	immediate bool
+	// ttl makes the rate a temporary override reverting once it expires, see SetTemporaryRateLimit.
+	ttl time.Duration
+}
+
+// rateOverride is a temporary rate set with a TTL. baseline is the rate from before the first of
+// the overlapping overrides, which the method reverts to at expires.
+type rateOverride struct {
+	baseline float64
+	expires  time.Time
+}
+
+// ttlFromSeconds converts the "ttl_seconds" field of the control API; zero means no TTL.
+func ttlFromSeconds(seconds float64) (time.Duration, error) {
+	if !(seconds >= 0) || math.IsInf(seconds, 1) {
+		return 0, fmt.Errorf("TTL must be a finite, non-negative number of seconds, got %g", seconds)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// SetTemporaryRateLimit sets the rate limit like SetRateLimit, and reverts it once ttl expires to
+// the rate from before the override. A later override replaces the TTL but keeps reverting to the
+// same rate, while a rate set without a TTL ends the override. The TTL is checked at the end of
+// every metrics interval, and the controller leaves the rate alone until it expires.
+func (rl *TopDownRL) SetTemporaryRateLimit(method string, rateLimit float64, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("TTL must be positive, got %v", ttl)
+	}
+	return rl.setRateLimit(method, rateLimit, rateOptions{ttl: ttl}, apiSource)
+}
+
+// overrideLocked starts, extends or ends the override of a method for a rate being set with ttl.
+// It must run before the new rate is applied. The caller must hold metrics.mu.
+func (rl *TopDownRL) overrideLocked(metrics *InterfaceMetrics, ttl time.Duration) {
+	if ttl <= 0 {
+		metrics.override = nil
+		return
+	}
+	if metrics.override == nil {
+		metrics.override = &rateOverride{baseline: targetRateLocked(metrics)}
+	}
+	metrics.override.expires = rl.clock.Now().Add(ttl)
+}
+
+// expireOverrideLocked reverts the rate of a method to its baseline if its override expired by
+// now. The caller must hold metrics.mu.
+func (rl *TopDownRL) expireOverrideLocked(metrics *InterfaceMetrics, now time.Time) {
+	if metrics.override == nil || now.Before(metrics.override.expires) {
+		return
+	}
+	baseline := metrics.override.baseline
+	metrics.override = nil
+
+	rl.logger.Infof("Rate override for method '%s' expired, reverting to %f", metrics.method, baseline)
+	rl.recordChange(metrics.method, ChangeFieldRefillRate, targetRateLocked(metrics), baseline, changeSource{source: ChangeSourceExpiry})
+	rl.startRampLocked(metrics, baseline, false)
+	metrics.pid = PIDState{}
+}
+
+// overrideRemainingLocked returns the time left until the override of a method expires, zero if
+// there is none. The caller must hold metrics.mu.
+func (rl *TopDownRL) overrideRemainingLocked(metrics *InterfaceMetrics) time.Duration {
+	if metrics.override == nil {
+		return 0
+	}
+	return max(metrics.override.expires.Sub(rl.clock.Now()), 0)
+}
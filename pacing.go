@@ -0,0 +1,155 @@
+package topdown
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Default metadata keys of the rate hints, see WithRateHeaders.
+const (
+	DefaultRateHeader   = "topdown-rate"
+	DefaultTokensHeader = "topdown-tokens"
+)
+
+// WithRateHeaders attaches the current refill rate of a method and the tokens left in its bucket,
+// rounded down, to the trailers of its successful responses under rateKey and tokensKey, so
+// cooperative clients can pace themselves, see WithClientPacing. Empty keys use DefaultRateHeader
+// and DefaultTokensHeader.
+func WithRateHeaders(rateKey, tokensKey string) Option {
+	return func(rl *TopDownRL) {
+		if rateKey == "" {
+			rateKey = DefaultRateHeader
+		}
+		if tokensKey == "" {
+			tokensKey = DefaultTokensHeader
+		}
+		rl.rateKey, rl.tokensKey = rateKey, tokensKey
+	}
+}
+
+// rateHeaders returns the rate hints of a method, or nil if they aren't enabled or the method
+// isn't registered.
+func (rl *TopDownRL) rateHeaders(methodName string) metadata.MD {
+	if rl.rateKey == "" {
+		return nil
+	}
+	metrics := rl.registeredMetrics(methodName)
+	if metrics == nil {
+		return nil
+	}
+	state := metrics.limiter.Snapshot()
+	return metadata.Pairs(
+		rl.rateKey, formatPlainFloat(state.Rate),
+		rl.tokensKey, strconv.FormatInt(int64(math.Max(math.Floor(state.Available), 0)), 10),
+	)
+}
+
+// clientPacer paces the requests of a client to the rates the server advertised per method.
+// Methods without a rate hint yet aren't paced.
+type clientPacer struct {
+	rateKey   string
+	tokensKey string
+	share     float64
+	clock     Clock
+	// buckets maps a method to its *tokenBucket; mu serializes the updates of their parameters.
+	buckets sync.Map
+	mu      sync.Mutex
+}
+
+// WithClientPacing paces the requests of the client interceptors to share of the rate the server
+// advertises for each method with WithRateHeaders, e.g. 0.25 for one of four equal clients.
+// Requests wait for a token of their method's local bucket, which holds a second's worth of the
+// rate, and fail with ResourceExhausted without being sent if their deadline expires first. If the
+// server reports its bucket empty, the local bucket is emptied as well. Methods whose responses
+// don't carry the hints aren't paced.
+func WithClientPacing(share float64) ClientOption {
+	return func(c *clientConfig) {
+		c.pacingShare = share
+	}
+}
+
+// WithClientRateHeaders sets the metadata keys of the rate hints, which must match the keys
+// configured on the server with WithRateHeaders.
+func WithClientRateHeaders(rateKey, tokensKey string) ClientOption {
+	return func(c *clientConfig) {
+		c.rateKey, c.tokensKey = rateKey, tokensKey
+	}
+}
+
+// newClientPacer creates the pacer of a client configuration, or nil if pacing isn't enabled.
+func newClientPacer(c *clientConfig) *clientPacer {
+	if c.pacingShare <= 0 {
+		return nil
+	}
+	return &clientPacer{rateKey: c.rateKey, tokensKey: c.tokensKey, share: c.pacingShare, clock: c.clock}
+}
+
+// wait blocks until the local bucket of a method holds a token and takes it. It returns an error
+// if ctx is done or its deadline expires before.
+func (p *clientPacer) wait(ctx context.Context, method string) error {
+	value, ok := p.buckets.Load(method)
+	if !ok {
+		return nil
+	}
+	bucket := value.(*tokenBucket)
+	for {
+		now := p.clock.Now()
+		if bucket.takeShare(now, 1, 1) {
+			return nil
+		}
+		delay, ok := bucket.retryAfterShare(now, 1, 1)
+		if !ok {
+			// The server advertised a rate of zero, so the request is left to the server, whose next
+			// successful response updates the rate
+			return nil
+		}
+		if deadline, ok := ctx.Deadline(); ok && now.Add(delay).After(deadline) {
+			return status.Error(codes.ResourceExhausted, "Client pacing: deadline shorter than the pacing delay, request not sent")
+		}
+
+		timer := p.clock.NewTimer(max(delay, time.Millisecond))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return status.FromContextError(ctx.Err()).Err()
+		case <-timer.C():
+		}
+	}
+}
+
+// update applies the rate hints of a response to the local bucket of a method. Responses
+// without a valid rate hint leave it unchanged.
+func (p *clientPacer) update(method string, md metadata.MD) {
+	values := md.Get(p.rateKey)
+	if len(values) == 0 {
+		return
+	}
+	rate, err := strconv.ParseFloat(values[0], 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return
+	}
+	rate *= p.share
+	burst := max(int64(math.Ceil(rate)), 1)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.clock.Now()
+	value, loaded := p.buckets.LoadOrStore(method, newTokenBucket(burst, rate, now))
+	bucket := value.(*tokenBucket)
+	if loaded {
+		bucket.setLimits(burst, rate, now)
+	}
+	if tokens := md.Get(p.tokensKey); len(tokens) > 0 && tokens[0] == "0" {
+		if available := bucket.available(now); available > 0 {
+			bucket.drain(now, int64(math.Ceil(available)))
+		}
+	}
+}
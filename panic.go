@@ -0,0 +1,50 @@
+package topdown
+
+import (
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WithPanicRecovery makes the interceptors recover from panicking handlers. The request is
+// recorded as an Internal error with its latency and counted as a panic of its method, and the
+// panic is converted to an Internal status, or raised again after the accounting if repanic is
+// set, for applications whose own recovery middleware runs outside the interceptors.
+func WithPanicRecovery(repanic bool) Option {
+	return func(rl *TopDownRL) {
+		rl.panicRecovery = true
+		rl.repanic = repanic
+	}
+}
+
+// recoverPanic recovers from a panic of the handler of a request started at startTime and
+// replaces err with an Internal status. It must be deferred by the interceptor.
+func (rl *TopDownRL) recoverPanic(methodName string, startTime time.Time, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	rl.recordError(rl.clock.Now().Sub(startTime), methodName, codes.Internal)
+	rl.recordPanic(methodName)
+	rl.logger.Errorf("Handler of method '%s' panicked: %v", methodName, r)
+	if rl.repanic {
+		panic(r)
+	}
+	*err = status.Errorf(codes.Internal, "Handler panicked: %v", r)
+}
+
+// recordPanic counts a panic of the handler of a method.
+func (rl *TopDownRL) recordPanic(methodName string) {
+	metrics := rl.loadMetrics(methodName)
+	if metrics == nil {
+		return
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	metrics.PanicCounter++
+	metrics.PanicsTotal++
+}
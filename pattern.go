@@ -0,0 +1,152 @@
+package topdown
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A pattern is a method name ending in "*", which matches every method starting with the part
+// before it, e.g. "/inventory.Service/*". The SLO map and the bucket configuration accept
+// patterns as keys: a method uses the entry of its own name if there is one, otherwise the
+// matching pattern with the longest prefix. The pattern "*" matches every method and applies
+// last. Each method is resolved once, when it's first seen, and keeps its own metrics.
+
+// sloRule is an SLO configured for the methods matching a pattern.
+type sloRule struct {
+	pattern string
+	slo     time.Duration
+}
+
+// isPattern reports whether a configured method name is a pattern.
+func isPattern(name string) bool {
+	return strings.HasSuffix(name, "*")
+}
+
+// specificity orders the patterns a method may be resolved from: longer prefixes beat shorter
+// ones, and an exact name beats any pattern. The empty pattern, for the defaults, comes last.
+func specificity(pattern string) int {
+	if pattern == "" {
+		return -1
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return len(prefix)
+	}
+	return math.MaxInt
+}
+
+// storeSLORuleLocked adds or replaces the SLO configured for a pattern, keeping the rules sorted
+// from the most specific. The caller must hold rl.mutex, or be constructing rl.
+func (rl *TopDownRL) storeSLORuleLocked(pattern string, slo time.Duration) {
+	var rules []sloRule
+	if current := rl.sloRules.Load(); current != nil {
+		rules = append(rules, *current...)
+	}
+	for i := range rules {
+		if rules[i].pattern == pattern {
+			rules[i].slo = slo
+			rl.sloRules.Store(&rules)
+			return
+		}
+	}
+	rules = append(rules, sloRule{pattern: pattern, slo: slo})
+	sort.SliceStable(rules, func(i, j int) bool { return specificity(rules[i].pattern) > specificity(rules[j].pattern) })
+	rl.sloRules.Store(&rules)
+}
+
+// removeSLORuleLocked removes the SLO configured for a pattern and reports whether there was one.
+// The caller must hold rl.mutex.
+func (rl *TopDownRL) removeSLORuleLocked(pattern string) bool {
+	current := rl.sloRules.Load()
+	if current == nil {
+		return false
+	}
+	for i, rule := range *current {
+		if rule.pattern == pattern {
+			rules := append(append([]sloRule(nil), (*current)[:i]...), (*current)[i+1:]...)
+			rl.sloRules.Store(&rules)
+			return true
+		}
+	}
+	return false
+}
+
+// patternSLO returns the SLO configured for a pattern, if any.
+func (rl *TopDownRL) patternSLO(pattern string) (time.Duration, bool) {
+	if rules := rl.sloRules.Load(); rules != nil {
+		for _, rule := range *rules {
+			if rule.pattern == pattern {
+				return rule.slo, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// matchSLO returns the most specific SLO rule matching a method, without taking rl.mutex.
+func (rl *TopDownRL) matchSLO(methodName string) (sloRule, bool) {
+	rules := rl.sloRules.Load()
+	if rules == nil {
+		return sloRule{}, false
+	}
+	for _, rule := range *rules {
+		if matchPattern(rule.pattern, methodName) {
+			return rule, true
+		}
+	}
+	return sloRule{}, false
+}
+
+// matchBucket returns the bucket parameters configured for a method and the pattern they were
+// resolved from, which is empty for an exact entry or the default bucket. The caller must hold
+// rl.mutex.
+func (rl *TopDownRL) matchBucket(methodName string) (BucketConfig, string) {
+	if bucket, exists := rl.buckets[methodName]; exists {
+		return bucket, ""
+	}
+	bucket, best := rl.defaultBucket, ""
+	for pattern, config := range rl.buckets {
+		if isPattern(pattern) && matchPattern(pattern, methodName) && specificity(pattern) > specificity(best) {
+			bucket, best = config, pattern
+		}
+	}
+	return bucket, best
+}
+
+// resolveLocked applies a rule added for pattern to the registered methods it matches, if it's
+// more specific than the one they were resolved from. SLOs change in place, while methods whose
+// bucket parameters change get new metrics, as if registered again. The caller must hold rl.mutex.
+func (rl *TopDownRL) resolveLocked(pattern string) {
+	replaced := false
+	for methodName, metrics := range rl.interfaces {
+		if !matchPattern(pattern, methodName) {
+			continue
+		}
+
+		metrics.mu.Lock()
+		if rule, ok := rl.matchSLO(methodName); ok && metrics.sloResolved && rule.pattern == pattern {
+			metrics.SLO, metrics.sloPattern = rule.slo, pattern
+			if rl.Debug {
+				rl.logger.Debugf("Resolved SLO of method '%s' from pattern '%s': %v", methodName, pattern, rule.slo)
+			}
+		}
+		slo, sloPattern, sloResolved := metrics.SLO, metrics.sloPattern, metrics.sloResolved
+		bucketPattern := metrics.bucketPattern
+		metrics.mu.Unlock()
+
+		if _, resolved := rl.matchBucket(methodName); resolved != pattern || resolved == bucketPattern {
+			continue
+		}
+		updated := rl.newInterfaceMetrics(methodName, slo)
+		updated.sloPattern, updated.sloResolved = sloPattern, sloResolved
+		rl.interfaces[methodName] = updated
+		replaced = true
+		if rl.Debug {
+			rl.logger.Debugf("Resolved bucket of method '%s' from pattern '%s'", methodName, pattern)
+		}
+	}
+	if replaced {
+		rl.publishInterfacesLocked()
+	}
+}
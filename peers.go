@@ -0,0 +1,433 @@
+package topdown
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultPeerStaleIntervals is the number of metrics intervals after which a peer that didn't
+// report is excluded from the cluster metrics, see WithPeerStaleness.
+const DefaultPeerStaleIntervals = 3
+
+// peerForgetFactor is how many times the staleness threshold a peer is kept before it's forgotten.
+const peerForgetFactor = 10
+
+// peerGossip exchanges the metrics of every interval with the peers. mu guards reports.
+type peerGossip struct {
+	enabled        bool
+	urls           []string
+	token          string
+	staleIntervals int
+	failures       atomic.Int64
+
+	mu      sync.Mutex
+	reports map[string]receivedPeerReport
+}
+
+// receivedPeerReport is the last report of a peer along with the time it arrived.
+type receivedPeerReport struct {
+	report   peerReport
+	received time.Time
+}
+
+// peerReport is the JSON body POSTed to /peer_metrics: the counters and latency histogram of every
+// method for the interval that just ended.
+type peerReport struct {
+	Name       string                       `json:"name"`
+	Timestamp  float64                      `json:"timestamp"`
+	IntervalMs float64                      `json:"interval_ms"`
+	Precision  int                          `json:"precision"`
+	Methods    map[string]peerMethodMetrics `json:"methods"`
+}
+
+// peerMethodMetrics are the metrics of a method in a peer report. Latencies holds the non-empty
+// buckets of the latency histogram as pairs of bucket index and count.
+type peerMethodMetrics struct {
+	Goodput       int64       `json:"goodput"`
+	Rejected      int64       `json:"rejected"`
+	Admitted      int64       `json:"admitted"`
+	Arrivals      int64       `json:"arrivals"`
+	Errors        int64       `json:"errors"`
+	SloViolations int64       `json:"slo_violations"`
+	Latencies     [][2]uint64 `json:"latencies"`
+}
+
+// WithPeers enables peer gossip: after every interval the limiter POSTs the metrics of its
+// methods, including the latency histograms, to /peer_metrics at each of the control URLs, and
+// keeps the reports it receives from its peers, so GET /metrics?scope=cluster on any replica
+// returns the metrics of the whole cluster, see ClusterMetrics. Without urls the limiter only
+// receives reports. Peers are told apart by their names, so every replica needs a unique one,
+// see WithName. The peers must use the same latency precision.
+func WithPeers(urls ...string) Option {
+	return func(rl *TopDownRL) {
+		rl.peers.enabled = true
+		rl.peers.urls = append(rl.peers.urls, urls...)
+	}
+}
+
+// WithPeerStaleness sets after how many metrics intervals without a report a peer is excluded
+// from the cluster metrics.
+func WithPeerStaleness(intervals int) Option {
+	return func(rl *TopDownRL) {
+		rl.peers.staleIntervals = intervals
+	}
+}
+
+// WithPeerAuthToken sets the bearer token sent with the reports to the peers, if their control
+// endpoints require authentication, see WithAuthToken.
+func WithPeerAuthToken(token string) Option {
+	return func(rl *TopDownRL) {
+		rl.peers.token = token
+	}
+}
+
+// validate checks the peer gossip configuration of a limiter named name.
+func (p *peerGossip) validate(name string) error {
+	if name == "" {
+		return errors.New("peers require a limiter name, see WithName")
+	}
+	if p.staleIntervals < 1 {
+		return fmt.Errorf("peer staleness must be at least one interval, got %d", p.staleIntervals)
+	}
+	for _, url := range p.urls {
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return fmt.Errorf("peer URL must be http or https, got '%s'", url)
+		}
+	}
+	return nil
+}
+
+// PeerFailures returns the number of reports to peers that failed.
+func (rl *TopDownRL) PeerFailures() int64 {
+	return rl.peers.failures.Load()
+}
+
+// stalePeers returns the number of known peers that didn't report within the staleness threshold.
+func (rl *TopDownRL) stalePeers() int {
+	now := rl.clock.Now()
+	staleAfter := time.Duration(rl.peers.staleIntervals) * rl.metricsInterval
+
+	rl.peers.mu.Lock()
+	defer rl.peers.mu.Unlock()
+	stale := 0
+	for _, received := range rl.peers.reports {
+		if now.Sub(received.received) > staleAfter {
+			stale++
+		}
+	}
+	return stale
+}
+
+// PeerStatus is the state of a replica in the cluster metrics.
+type PeerStatus struct {
+	Name string
+	// Age is the time since the peer's last report; it's zero for the limiter itself.
+	Age time.Duration
+	// Stale is set if the peer didn't report within the staleness threshold, which excludes it
+	// from the aggregate.
+	Stale bool
+}
+
+// ClusterMethodMetrics are the metrics of a method over the last interval of every replica
+// included in the aggregate.
+type ClusterMethodMetrics struct {
+	Goodput       int64
+	Rejected      int64
+	Admitted      int64
+	Arrivals      int64
+	Errors        int64
+	SloViolations int64
+	// TailLatencies holds the tail latencies of the merged latency distribution for every
+	// configured percentile.
+	TailLatencies map[float64]time.Duration
+	// Replicas is the number of replicas reporting the method.
+	Replicas int
+}
+
+// ClusterMetrics are the metrics aggregated over the limiter and its peers.
+type ClusterMetrics struct {
+	// Peers lists the limiter itself first, followed by its peers by name.
+	Peers   []PeerStatus
+	Methods map[string]ClusterMethodMetrics
+}
+
+// ClusterMetrics aggregates the metrics of the last interval of the limiter and of every peer
+// that reported within the staleness threshold, or returns an error if peer gossip isn't enabled.
+func (rl *TopDownRL) ClusterMetrics() (ClusterMetrics, error) {
+	if !rl.peers.enabled {
+		return ClusterMetrics{}, errors.New("peer gossip not enabled")
+	}
+	own := rl.peerReport()
+	now := rl.clock.Now()
+	staleAfter := time.Duration(rl.peers.staleIntervals) * rl.metricsInterval
+
+	cluster := ClusterMetrics{Peers: []PeerStatus{{Name: rl.name}}}
+	reports := []peerReport{own}
+	rl.peers.mu.Lock()
+	names := make([]string, 0, len(rl.peers.reports))
+	for name, received := range rl.peers.reports {
+		age := now.Sub(received.received)
+		if age > staleAfter*peerForgetFactor {
+			delete(rl.peers.reports, name)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		received := rl.peers.reports[name]
+		status := PeerStatus{Name: name, Age: now.Sub(received.received)}
+		status.Stale = status.Age > staleAfter
+		if !status.Stale {
+			reports = append(reports, received.report)
+		}
+		cluster.Peers = append(cluster.Peers, status)
+	}
+	rl.peers.mu.Unlock()
+
+	histograms := make(map[string]*latencyHistogram)
+	cluster.Methods = make(map[string]ClusterMethodMetrics)
+	for _, report := range reports {
+		for methodName, metrics := range report.Methods {
+			aggregate := cluster.Methods[methodName]
+			aggregate.Goodput += metrics.Goodput
+			aggregate.Rejected += metrics.Rejected
+			aggregate.Admitted += metrics.Admitted
+			aggregate.Arrivals += metrics.Arrivals
+			aggregate.Errors += metrics.Errors
+			aggregate.SloViolations += metrics.SloViolations
+			aggregate.Replicas++
+			cluster.Methods[methodName] = aggregate
+
+			histogram, exists := histograms[methodName]
+			if !exists {
+				histogram = newLatencyHistogram(rl.latencyPrecision)
+				histograms[methodName] = histogram
+			}
+			// The buckets were checked when the report arrived
+			for _, bucket := range metrics.Latencies {
+				histogram.counts[bucket[0]] += bucket[1]
+				histogram.total += bucket[1]
+			}
+		}
+	}
+	for methodName, histogram := range histograms {
+		aggregate := cluster.Methods[methodName]
+		aggregate.TailLatencies = quantiles(histogram, rl.percentiles)
+		cluster.Methods[methodName] = aggregate
+	}
+	return cluster, nil
+}
+
+// peerReport builds the report of the interval that just ended.
+func (rl *TopDownRL) peerReport() peerReport {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	report := peerReport{
+		Name:       rl.name,
+		Timestamp:  float64(rl.clock.Now().UnixNano()) / float64(time.Second),
+		IntervalMs: durationMs(rl.metricsInterval),
+		Precision:  rl.latencyPrecision,
+		Methods:    make(map[string]peerMethodMetrics, len(rl.interfaces)),
+	}
+	for methodName, metrics := range rl.interfaces {
+		metrics.mu.Lock()
+		method := peerMethodMetrics{
+			Goodput:       metrics.CurrentGoodput,
+			Rejected:      metrics.CurrentRejected,
+			Admitted:      metrics.CurrentAdmitted,
+			Arrivals:      metrics.CurrentArrivals,
+			Errors:        metrics.CurrentErrors,
+			SloViolations: metrics.CurrentSloViolations,
+			Latencies:     [][2]uint64{},
+		}
+		if metrics.peerLatencies != nil {
+			for i, count := range metrics.peerLatencies.counts {
+				if count > 0 {
+					method.Latencies = append(method.Latencies, [2]uint64{uint64(i), count})
+				}
+			}
+		}
+		metrics.mu.Unlock()
+		report.Methods[methodName] = method
+	}
+	return report
+}
+
+// peerLoop sends the report of every interval to the peers whenever the metrics goroutine
+// signals the end of an interval, coalescing the signals like pushLoop.
+func (rl *TopDownRL) peerLoop(ctx context.Context, reports <-chan struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reports:
+			body, err := json.Marshal(rl.peerReport())
+			if err != nil {
+				rl.logger.Errorf("Failed to encode peer report: %v", err)
+				continue
+			}
+
+			// A peer that is down must not delay the reports to the others
+			var wg sync.WaitGroup
+			for _, url := range rl.peers.urls {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := rl.sendPeerReport(ctx, url, body); err != nil && ctx.Err() == nil {
+						rl.peers.failures.Add(1)
+						rl.logger.Errorf("Failed to send metrics to peer %s: %v", url, err)
+					}
+				}()
+			}
+			wg.Wait()
+		}
+	}
+}
+
+// sendPeerReport POSTs body to the /peer_metrics endpoint of a peer. Reports aren't retried,
+// since the next interval brings a newer one.
+func (rl *TopDownRL) sendPeerReport(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(url, "/")+"/peer_metrics", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if rl.peers.token != "" {
+		req.Header.Set("Authorization", "Bearer "+rl.peers.token)
+	}
+
+	resp, err := rl.pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// HandlePeerMetrics receives the metrics reports of the peers, see WithPeers.
+func (rl *TopDownRL) HandlePeerMetrics(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandlePeerMetrics called")
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !rl.peers.enabled {
+		writeError(w, "Peer gossip is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var report peerReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		writeError(w, "Failed to decode request body", http.StatusBadRequest)
+		return
+	}
+	if report.Name == "" {
+		writeError(w, "Missing 'name' parameter", http.StatusBadRequest)
+		return
+	}
+	if report.Name == rl.name {
+		writeError(w, fmt.Sprintf("Report from a peer named like this limiter: '%s'", report.Name), http.StatusBadRequest)
+		return
+	}
+	if report.Precision != rl.latencyPrecision {
+		writeError(w, fmt.Sprintf("Latency precision %d doesn't match %d", report.Precision, rl.latencyPrecision), http.StatusBadRequest)
+		return
+	}
+	buckets := uint64(newLatencyHistogram(rl.latencyPrecision).bucketIndex(maxTrackableLatency)) + 1
+	for methodName, metrics := range report.Methods {
+		for _, bucket := range metrics.Latencies {
+			if bucket[0] >= buckets {
+				writeError(w, fmt.Sprintf("Invalid latency bucket %d for method '%s'", bucket[0], methodName), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	rl.peers.mu.Lock()
+	if rl.peers.reports == nil {
+		rl.peers.reports = make(map[string]receivedPeerReport)
+	}
+	rl.peers.reports[report.Name] = receivedPeerReport{report: report, received: rl.clock.Now()}
+	rl.peers.mu.Unlock()
+	if rl.Debug {
+		rl.logger.Debugf("Received metrics of %d methods from peer '%s'", len(report.Methods), report.Name)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// clusterMetricsResponse is the JSON shape of ClusterMetrics served by GET /metrics?scope=cluster.
+type clusterMetricsResponse struct {
+	Scope   string                           `json:"scope"`
+	Peers   []peerStatusResponse             `json:"peers"`
+	Methods map[string]clusterMethodResponse `json:"methods"`
+}
+
+// peerStatusResponse is the JSON shape of a PeerStatus.
+type peerStatusResponse struct {
+	Name  string  `json:"name"`
+	AgeMs float64 `json:"age_ms"`
+	Stale bool    `json:"stale"`
+}
+
+// clusterMethodResponse is the JSON shape of ClusterMethodMetrics.
+type clusterMethodResponse struct {
+	Goodput       int64              `json:"goodput"`
+	Rejected      int64              `json:"rejected"`
+	Admitted      int64              `json:"admitted"`
+	Arrivals      int64              `json:"arrivals"`
+	Errors        int64              `json:"errors"`
+	SloViolations int64              `json:"slo_violations"`
+	LatencyMs     float64            `json:"latency_ms"`
+	PercentilesMs map[string]float64 `json:"percentiles_ms"`
+	Replicas      int                `json:"replicas"`
+}
+
+// handleClusterMetrics serves the cluster metrics for HandleGetMetrics.
+func (rl *TopDownRL) handleClusterMetrics(w http.ResponseWriter) {
+	cluster, err := rl.ClusterMetrics()
+	if err != nil {
+		writeError(w, "Peer gossip is not enabled", http.StatusNotFound)
+		return
+	}
+
+	response := clusterMetricsResponse{
+		Scope:   "cluster",
+		Peers:   make([]peerStatusResponse, 0, len(cluster.Peers)),
+		Methods: make(map[string]clusterMethodResponse, len(cluster.Methods)),
+	}
+	for _, peer := range cluster.Peers {
+		response.Peers = append(response.Peers, peerStatusResponse{Name: peer.Name, AgeMs: durationMs(peer.Age), Stale: peer.Stale})
+	}
+	for methodName, metrics := range cluster.Methods {
+		response.Methods[methodName] = clusterMethodResponse{
+			Goodput:       metrics.Goodput,
+			Rejected:      metrics.Rejected,
+			Admitted:      metrics.Admitted,
+			Arrivals:      metrics.Arrivals,
+			Errors:        metrics.Errors,
+			SloViolations: metrics.SloViolations,
+			LatencyMs:     durationMs(metrics.TailLatencies[rl.percentiles[0]]),
+			PercentilesMs: percentilesMs(metrics.TailLatencies),
+			Replicas:      metrics.Replicas,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
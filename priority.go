@@ -0,0 +1,122 @@
+package topdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// DefaultPriorityKey is the metadata key carrying the priority tier of a request.
+const DefaultPriorityKey = "priority"
+
+// PriorityTier is a priority tier sharing the token buckets with the other tiers. A tier may only
+// take tokens while the bucket holds more than (1 - Share) of its capacity, so with a Share of 0.3
+// batch traffic only uses the top 30% of the bucket. When the rate drops and the bucket drains,
+// the tiers with the smallest shares are shed first.
+type PriorityTier struct {
+	Name  string
+	Share float64
+}
+
+// TierMetrics holds the metrics of a single priority tier of a method for the last interval.
+type TierMetrics struct {
+	Goodput  int64 `json:"goodput"`
+	Rejected int64 `json:"rejected"`
+}
+
+// WithPriorities enables priority tiers, read from the metadata key (DefaultPriorityKey if empty)
+// and ordered from the highest priority to the lowest. Requests without a known tier belong to
+// the first tier unless set otherwise with WithDefaultPriority.
+func WithPriorities(key string, tiers ...PriorityTier) Option {
+	return func(rl *TopDownRL) {
+		if key == "" {
+			key = DefaultPriorityKey
+		}
+		rl.priorityKey = key
+		rl.priorities = tiers
+	}
+}
+
+// WithDefaultPriority sets the tier of requests that carry no tier or an unknown one.
+func WithDefaultPriority(name string) Option {
+	return func(rl *TopDownRL) {
+		rl.defaultPriority = name
+	}
+}
+
+// validatePriorities checks that the tiers have unique names and valid shares, and that the default tier exists.
+func (rl *TopDownRL) validatePriorities() error {
+	if len(rl.priorities) == 0 {
+		if rl.defaultPriority != "" {
+			return errors.New("default priority set without priority tiers")
+		}
+		return nil
+	}
+
+	defaultFound := rl.defaultPriority == ""
+	names := make(map[string]bool, len(rl.priorities))
+	for _, tier := range rl.priorities {
+		if tier.Name == "" || names[tier.Name] {
+			return fmt.Errorf("priority tier names must be unique and not empty, got '%s'", tier.Name)
+		}
+		if !(tier.Share > 0 && tier.Share <= 1) {
+			return fmt.Errorf("share of priority tier '%s' must be in (0, 1], got %g", tier.Name, tier.Share)
+		}
+		names[tier.Name] = true
+		defaultFound = defaultFound || tier.Name == rl.defaultPriority
+	}
+	if !defaultFound {
+		return fmt.Errorf("default priority '%s' is not a priority tier", rl.defaultPriority)
+	}
+	return nil
+}
+
+// priorityTier returns the index of the tier of a request, or -1 if priorities are disabled.
+func (rl *TopDownRL) priorityTier(ctx context.Context) int {
+	if len(rl.priorities) == 0 {
+		return -1
+	}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, name := range md.Get(rl.priorityKey) {
+			for i, tier := range rl.priorities {
+				if tier.Name == name {
+					return i
+				}
+			}
+		}
+	}
+	for i, tier := range rl.priorities {
+		if tier.Name == rl.defaultPriority {
+			return i
+		}
+	}
+	return 0
+}
+
+// tierShare returns the share of the bucket a tier may use.
+func (rl *TopDownRL) tierShare(tier int) float64 {
+	if tier < 0 {
+		return 1
+	}
+	return rl.priorities[tier].Share
+}
+
+// tierMetricsLocked returns the metrics of the last interval per tier name, or nil if priorities
+// are disabled. The caller must hold metrics.mu.
+func (rl *TopDownRL) tierMetricsLocked(metrics *InterfaceMetrics) map[string]TierMetrics {
+	if len(rl.priorities) == 0 {
+		return nil
+	}
+
+	tiers := make(map[string]TierMetrics, len(rl.priorities))
+	for i, tier := range rl.priorities {
+		tiers[tier.Name] = TierMetrics{
+			Goodput:  metrics.CurrentTierGoodput[i],
+			Rejected: metrics.CurrentTierRejected[i],
+		}
+	}
+	return tiers
+}
@@ -0,0 +1,281 @@
+package topdown
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// prometheusMetric describes one metric family in the Prometheus text exposition format.
+type prometheusMetric struct {
+	name  string
+	kind  string
+	help  string
+	value func(MetricsSnapshot) float64
+}
+
+var prometheusMetrics = []prometheusMetric{
+	{"topdown_goodput", "gauge", "Requests completed within the SLO during the last interval.",
+		func(s MetricsSnapshot) float64 { return float64(s.Goodput) }},
+	{"topdown_tail_latency_seconds", "gauge", "95th percentile tail latency of the last interval.",
+		func(s MetricsSnapshot) float64 { return s.TailLatency95th.Seconds() }},
+	{"topdown_tokens", "gauge", "Tokens currently available in the bucket.",
+		func(s MetricsSnapshot) float64 { return s.CurrentTokens }},
+	{"topdown_tokens_consumed", "gauge", "Tokens consumed by admitted requests during the last interval.",
+		func(s MetricsSnapshot) float64 { return float64(s.TokensConsumed) }},
+	{"topdown_refill_rate", "gauge", "Token bucket refill rate in tokens per second.",
+		func(s MetricsSnapshot) float64 { return s.RefillRate }},
+	{"topdown_target_refill_rate", "gauge", "Refill rate the bucket is ramping to in tokens per second.",
+		func(s MetricsSnapshot) float64 { return s.TargetRefillRate }},
+	{"topdown_max_tokens", "gauge", "Token bucket capacity.",
+		func(s MetricsSnapshot) float64 { return float64(s.MaxTokens) }},
+	{"topdown_empty_intervals", "gauge", "Consecutive intervals that ended with an empty bucket.",
+		func(s MetricsSnapshot) float64 { return float64(s.EmptyIntervals) }},
+	{"topdown_overload_condition", "gauge", "Whether the method met an overload condition in the last interval.",
+		func(s MetricsSnapshot) float64 { return boolValue(s.Overloaded) }},
+	{"topdown_arrivals_total", "counter", "Requests that reached the rate limiter.",
+		func(s MetricsSnapshot) float64 { return float64(s.ArrivalsTotal) }},
+	{"topdown_admitted_total", "counter", "Requests admitted by the rate limiter.",
+		func(s MetricsSnapshot) float64 { return float64(s.AdmittedTotal) }},
+	{"topdown_admission_ratio", "gauge", "Share of the requests of the last interval that were admitted.",
+		func(s MetricsSnapshot) float64 { return s.AdmissionRatio }},
+	{"topdown_rejected_total", "counter", "Requests rejected because the rate limit was exceeded.",
+		func(s MetricsSnapshot) float64 { return float64(s.RejectedTotal) }},
+	{"topdown_global_rejected_total", "counter", "Requests rejected by the global bucket.",
+		func(s MetricsSnapshot) float64 { return float64(s.GlobalRejectedTotal) }},
+	{"topdown_borrowed_tokens_total", "counter", "Tokens borrowed from the pool of the method's borrowing group.",
+		func(s MetricsSnapshot) float64 { return float64(s.BorrowedTotal) }},
+	{"topdown_shed_total", "counter", "Requests rejected by the shed probability.",
+		func(s MetricsSnapshot) float64 { return float64(s.ShedTotal) }},
+	{"topdown_shed_probability", "gauge", "Probability with which requests are shed.",
+		func(s MetricsSnapshot) float64 { return s.ShedProbability }},
+	{"topdown_in_flight", "gauge", "Requests currently in flight.",
+		func(s MetricsSnapshot) float64 { return float64(s.InFlight) }},
+	{"topdown_concurrency_rejected_total", "counter", "Requests rejected because the concurrency limit was exceeded.",
+		func(s MetricsSnapshot) float64 { return float64(s.ConcurrencyRejectedTotal) }},
+	{"topdown_doomed_total", "counter", "Requests rejected because their deadline was shorter than the tail latency.",
+		func(s MetricsSnapshot) float64 { return float64(s.DoomedTotal) }},
+	{"topdown_queue_depth", "gauge", "Requests waiting in the admission queue.",
+		func(s MetricsSnapshot) float64 { return float64(s.QueueDepth) }},
+	{"topdown_abandoned_total", "counter", "Requests cancelled while waiting in the admission queue.",
+		func(s MetricsSnapshot) float64 { return float64(s.AbandonedTotal) }},
+	{"topdown_would_reject_total", "counter", "Requests admitted in shadow mode that the rate limit would have rejected.",
+		func(s MetricsSnapshot) float64 { return float64(s.WouldRejectTotal) }},
+	{"topdown_panics_total", "counter", "Handlers that panicked.",
+		func(s MetricsSnapshot) float64 { return float64(s.PanicsTotal) }},
+	{"topdown_degraded_total", "counter", "Requests their handlers marked as degraded.",
+		func(s MetricsSnapshot) float64 { return float64(s.DegradedTotal) }},
+	{"topdown_cancelled_total", "counter", "Requests cancelled by the client.",
+		func(s MetricsSnapshot) float64 { return float64(s.CancelledTotal) }},
+	{"topdown_errors_total", "counter", "Requests that completed with a status code not counting towards goodput.",
+		func(s MetricsSnapshot) float64 { return float64(s.ErrorsTotal) }},
+	{"topdown_slo_violations_total", "counter", "Requests that completed after their SLO.",
+		func(s MetricsSnapshot) float64 { return float64(s.SloViolationsTotal) }},
+	{"topdown_slo_violation_ratio", "gauge", "Share of the requests completed during the last interval that exceeded their SLO.",
+		func(s MetricsSnapshot) float64 { return s.SloViolationRatio }},
+}
+
+// prometheusRetryMetrics are the per-method metrics of retries, written if tracked.
+var prometheusRetryMetrics = []prometheusMetric{
+	{"topdown_retry_arrivals_total", "counter", "Retries that reached the rate limiter.",
+		func(s MetricsSnapshot) float64 { return float64(s.Retries.ArrivalsTotal) }},
+	{"topdown_retry_goodput_total", "counter", "Retries completed within the SLO.",
+		func(s MetricsSnapshot) float64 { return float64(s.Retries.GoodputTotal) }},
+	{"topdown_retry_ratio", "gauge", "Share of the requests of the last interval that were retries.",
+		func(s MetricsSnapshot) float64 { return s.Retries.Ratio }},
+}
+
+// prometheusBudgetMetrics are the per-method metrics of the error budget, written if enabled.
+var prometheusBudgetMetrics = []prometheusMetric{
+	{"topdown_error_budget_remaining", "gauge", "Share of the error budget left over the budget window.",
+		func(s MetricsSnapshot) float64 { return s.Budget.Remaining }},
+	{"topdown_burn_rate_5m", "gauge", "Rate the error budget was used up at over the last 5 minutes.",
+		func(s MetricsSnapshot) float64 { return s.Budget.BurnRateShort }},
+	{"topdown_burn_rate_1h", "gauge", "Rate the error budget was used up at over the last hour.",
+		func(s MetricsSnapshot) float64 { return s.Budget.BurnRateLong }},
+}
+
+// prometheusDistributedMetrics are the per-method metrics of distributed mode, written if enabled.
+var prometheusDistributedMetrics = []prometheusMetric{
+	{"topdown_replica_share", "gauge", "Share of the cluster-wide refill rate enforced by the replica.",
+		func(s MetricsSnapshot) float64 { return s.Distributed.Share }},
+	{"topdown_cluster_demand", "gauge", "Requests per second arriving at all live replicas.",
+		func(s MetricsSnapshot) float64 { return s.Distributed.ClusterDemand }},
+}
+
+// prometheusBreakerMetrics are the per-method metrics of the circuit breakers, written for the
+// methods that have one.
+var prometheusBreakerMetrics = []prometheusMetric{
+	{"topdown_breaker_open", "gauge", "Whether the circuit breaker is open (1), half-open (0.5) or closed (0).",
+		func(s MetricsSnapshot) float64 { return breakerValue(s.Breaker.State) }},
+	{"topdown_breaker_error_rate", "gauge", "Share of the requests in the circuit breaker window that failed.",
+		func(s MetricsSnapshot) float64 { return s.Breaker.ErrorRate }},
+	{"topdown_breaker_transitions_total", "counter", "State changes of the circuit breaker.",
+		func(s MetricsSnapshot) float64 { return float64(s.Breaker.Transitions) }},
+	{"topdown_breaker_rejected_total", "counter", "Requests rejected by the circuit breaker.",
+		func(s MetricsSnapshot) float64 { return float64(s.Breaker.Rejected) }},
+}
+
+// prometheusCPUMetrics are the per-method metrics of CPU throttling, written if enabled.
+var prometheusCPUMetrics = []prometheusMetric{
+	{"topdown_importance", "gauge", "Importance weight of the method under CPU throttling.",
+		func(s MetricsSnapshot) float64 { return s.CPU.Importance }},
+	{"topdown_cpu_admit_probability", "gauge", "Probability a request passes the CPU throttling.",
+		func(s MetricsSnapshot) float64 { return s.CPU.AdmitProbability }},
+	{"topdown_cpu_rejected_total", "counter", "Requests rejected by the CPU throttling.",
+		func(s MetricsSnapshot) float64 { return float64(s.CPU.RejectedTotal) }},
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WritePrometheus writes the metrics of all methods to w in the Prometheus text exposition format.
+// All values are taken from a single snapshot so a scrape never mixes intervals.
+func (rl *TopDownRL) WritePrometheus(w io.Writer) error {
+	snapshots := rl.GetAllMetrics()
+	methods := make([]string, 0, len(snapshots))
+	for methodName := range snapshots {
+		methods = append(methods, methodName)
+	}
+	sort.Strings(methods)
+
+	limiterLabel := ""
+	if rl.name != "" {
+		limiterLabel = fmt.Sprintf(`limiter="%s",`, prometheusLabelEscaper.Replace(rl.name))
+	}
+
+	bw := bufio.NewWriter(w)
+	metrics := prometheusMetrics
+	if rl.retryKey != "" {
+		metrics = append(metrics[:len(metrics):len(metrics)], prometheusRetryMetrics...)
+	}
+	if rl.budget != nil {
+		metrics = append(metrics[:len(metrics):len(metrics)], prometheusBudgetMetrics...)
+	}
+	if rl.distributed != nil {
+		metrics = append(metrics[:len(metrics):len(metrics)], prometheusDistributedMetrics...)
+	}
+	if rl.cpu != nil {
+		metrics = append(metrics[:len(metrics):len(metrics)], prometheusCPUMetrics...)
+	}
+	for _, metric := range metrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, methodName := range methods {
+			fmt.Fprintf(bw, "%s{%smethod=\"%s\"} %g\n", metric.name, limiterLabel,
+				prometheusLabelEscaper.Replace(methodName), metric.value(snapshots[methodName]))
+		}
+	}
+	for _, metric := range prometheusBreakerMetrics {
+		written := false
+		for _, methodName := range methods {
+			if snapshots[methodName].Breaker == nil {
+				continue
+			}
+			if !written {
+				fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+				written = true
+			}
+			fmt.Fprintf(bw, "%s{%smethod=\"%s\"} %g\n", metric.name, limiterLabel,
+				prometheusLabelEscaper.Replace(methodName), metric.value(snapshots[methodName]))
+		}
+	}
+
+	// Limiter-wide counters only carry the limiter label
+	labels := ""
+	if rl.name != "" {
+		labels = fmt.Sprintf(`{limiter="%s"}`, prometheusLabelEscaper.Replace(rl.name))
+	}
+	if rl.auth != nil {
+		writePrometheusCounter(bw, "topdown_auth_failures_total", "Requests to the control endpoints that failed authentication.", labels, rl.AuthFailures())
+	}
+	if rl.pushURL != "" {
+		writePrometheusCounter(bw, "topdown_push_failures_total", "Metrics pushes that failed after all retries.", labels, rl.PushFailures())
+	}
+	if rl.overload != nil {
+		writePrometheusGauge(bw, "topdown_overloaded", "Whether the limiter is overloaded.", labels, boolValue(rl.Overloaded()))
+	}
+	if rl.cpu != nil {
+		cpu := rl.CPU()
+		writePrometheusGauge(bw, "topdown_cpu_utilization", "CPU utilization of the process in the last sample.", labels, cpu.Utilization)
+		writePrometheusGauge(bw, "topdown_scheduler_latency_seconds", "99th percentile scheduler latency in the last sample.", labels, cpu.SchedulerLatency.Seconds())
+		writePrometheusGauge(bw, "topdown_cpu_penalty_factor", "Admission factor applied by the CPU throttling.", labels, cpu.PenaltyFactor)
+	}
+	if rl.memory != nil {
+		memory := rl.MemoryPressure()
+		writePrometheusGauge(bw, "topdown_memory_pressure", "Memory pressure of the process in the last sample.", labels, memory.Pressure)
+		writePrometheusGauge(bw, "topdown_memory_pressured", "Whether the limiter is shedding load under memory pressure.", labels, boolValue(memory.Pressured))
+		writePrometheusGauge(bw, "topdown_memory_shed_tiers", "Lowest priority tiers rejected under memory pressure.", labels, float64(memory.ShedTiers))
+		writePrometheusCounter(bw, "topdown_memory_probe_errors_total", "Memory probes that failed.", labels, rl.MemoryProbeErrors())
+	}
+	if rl.Draining() || rl.DrainRejected() > 0 {
+		writePrometheusGauge(bw, "topdown_drain_rejected", "Requests rejected since the limiter started draining last.", labels, float64(rl.DrainRejected()))
+	}
+	if rl.onAdmit != nil || rl.onReject != nil || rl.onInterval != nil || rl.onStateChange != nil || len(rl.observers) > 0 {
+		writePrometheusCounter(bw, "topdown_hook_panics_total", "Panics recovered from the hooks.", labels, rl.HookPanics())
+	}
+	if rl.EventsDropped() > 0 {
+		writePrometheusCounter(bw, "topdown_stream_events_dropped_total", "Intervals dropped for event stream subscribers that didn't keep up.", labels, rl.EventsDropped())
+	}
+	if rl.statsd != nil {
+		writePrometheusCounter(bw, "topdown_statsd_failures_total", "StatsD packets that couldn't be sent.", labels, rl.StatsDFailures())
+	}
+	if rl.export != nil {
+		writePrometheusCounter(bw, "topdown_export_errors_total", "Failed writes of the metrics export.", labels, rl.ExportErrors())
+	}
+	if rl.alerts.url != "" || rl.alerts.configured() {
+		writePrometheusGauge(bw, "topdown_alerts_firing", "Alerts currently firing.", labels, float64(rl.firingAlerts()))
+		writePrometheusCounter(bw, "topdown_alert_failures_total", "Alert notifications that couldn't be sent.", labels, rl.AlertFailures())
+	}
+	if rl.peers.enabled {
+		writePrometheusGauge(bw, "topdown_peers_stale", "Peers excluded from the cluster metrics for not reporting.", labels, float64(rl.stalePeers()))
+		writePrometheusCounter(bw, "topdown_peer_failures_total", "Metrics reports to peers that failed.", labels, rl.PeerFailures())
+	}
+	if rl.distributed != nil {
+		writePrometheusGauge(bw, "topdown_replicas", "Live replicas sharing the rates as of the last report.", labels, float64(rl.Replicas()))
+		writePrometheusCounter(bw, "topdown_distributed_errors_total", "Demand reports to the distributed backend that failed.", labels, rl.DistributedErrors())
+	}
+	if rl.children != nil {
+		fmt.Fprintf(bw, "# HELP topdown_child_push_failures_total Rate limit pushes to a child that failed after all retries.\n# TYPE topdown_child_push_failures_total counter\n")
+		for _, child := range rl.children.children {
+			fmt.Fprintf(bw, "topdown_child_push_failures_total{%schild=\"%s\"} %d\n", limiterLabel,
+				prometheusLabelEscaper.Replace(child.config.Name), child.failures.Load())
+		}
+	}
+	if rl.configLoaded.Load() {
+		writePrometheusCounter(bw, "topdown_config_errors_total", "Config file loads that failed.", labels, rl.ConfigErrors())
+	}
+	return bw.Flush()
+}
+
+// writePrometheusCounter writes a single counter sample with its metadata.
+func writePrometheusCounter(w io.Writer, name, help, labels string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s%s %d\n", name, help, name, name, labels, value)
+}
+
+// writePrometheusGauge writes a single gauge sample with its metadata.
+func writePrometheusGauge(w io.Writer, name, help, labels string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s%s %g\n", name, help, name, name, labels, value)
+}
+
+// boolValue converts a boolean into a gauge value.
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// HandlePrometheus serves the metrics of all methods in the Prometheus text exposition format.
+func (rl *TopDownRL) HandlePrometheus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := rl.WritePrometheus(w); err != nil {
+		rl.logger.Errorf("Failed to write Prometheus metrics: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package topdown
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Push defaults, see WithPushURL.
+const (
+	DefaultPushTimeout = 2 * time.Second
+	DefaultPushRetries = 3
+	// pushBackoff is the wait before the first retry of a push; it doubles with every retry.
+	pushBackoff = 100 * time.Millisecond
+)
+
+// WithPushURL enables push mode: after every metrics interval the metrics of all methods are
+// POSTed as JSON to url. If the response carries rate limits of the form {"rates": {...}},
+// they are applied atomically like a batch update on /set_rate. Push mode doesn't affect the
+// pull endpoints.
+func WithPushURL(url string) Option {
+	return func(rl *TopDownRL) {
+		rl.pushURL = url
+	}
+}
+
+// WithPushTimeout sets the timeout of a single push attempt.
+func WithPushTimeout(d time.Duration) Option {
+	return func(rl *TopDownRL) {
+		rl.pushClient = &http.Client{Timeout: d}
+	}
+}
+
+// WithPushRetries sets how many times a failed push is retried, with exponential backoff,
+// before it's counted as failed.
+func WithPushRetries(retries int) Option {
+	return func(rl *TopDownRL) {
+		rl.pushRetries = retries
+	}
+}
+
+// PushFailures returns the number of pushes that failed after all retries.
+func (rl *TopDownRL) PushFailures() int64 {
+	return rl.pushFailures.Load()
+}
+
+// pushRequest is the JSON body of a push.
+type pushRequest struct {
+	Name       string                     `json:"name,omitempty"`
+	Timestamp  float64                    `json:"timestamp"`
+	IntervalMs float64                    `json:"interval_ms"`
+	Metrics    map[string]MetricsResponse `json:"metrics"`
+}
+
+// pushLoop pushes the metrics whenever the metrics goroutine signals the end of an interval.
+// A push still in progress when the next interval ends coalesces the signals, so the agent
+// always receives the latest metrics.
+func (rl *TopDownRL) pushLoop(ctx context.Context, pushes <-chan struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pushes:
+			if err := rl.push(ctx); err != nil && ctx.Err() == nil {
+				rl.pushFailures.Add(1)
+				rl.logger.Errorf("Failed to push metrics to %s: %v", rl.pushURL, err)
+			}
+		}
+	}
+}
+
+// push sends the current metrics to the push URL, retrying with exponential backoff.
+func (rl *TopDownRL) push(ctx context.Context) error {
+	snapshots := rl.GetAllMetrics()
+	request := pushRequest{
+		Name:       rl.name,
+		Timestamp:  float64(rl.clock.Now().UnixNano()) / float64(time.Second),
+		IntervalMs: durationMs(rl.MetricsInterval()),
+		Metrics:    make(map[string]MetricsResponse, len(snapshots)),
+	}
+	for methodName, snapshot := range snapshots {
+		request.Metrics[methodName] = newMetricsResponse(methodName, snapshot)
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	backoff := pushBackoff
+	for attempt := 0; ; attempt++ {
+		err = rl.pushOnce(ctx, body)
+		if err == nil || attempt >= rl.pushRetries {
+			return err
+		}
+		if rl.Debug {
+			rl.logger.Debugf("Push attempt %d failed, retrying in %v: %v", attempt+1, backoff, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-rl.clock.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// pushOnce POSTs body to the push URL and applies the rate limits in the response, if any.
+func (rl *TopDownRL) pushOnce(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rl.pushURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := rl.pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var data struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil && err != io.EOF {
+		// The agent isn't required to answer with rates, so the push itself succeeded
+		rl.logger.Errorf("Failed to decode push response: %v", err)
+		return nil
+	}
+	if len(data.Rates) > 0 {
+		for method, err := range rl.setRateLimits(data.Rates, rateOptions{}, changeSource{source: ChangeSourcePush, remote: rl.pushURL}) {
+			rl.logger.Errorf("Failed to apply pushed rate limit for method '%s': %v", method, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package topdown
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// DefaultMaxRetryAfter is the default cap on the backoff suggested to rejected clients.
+const DefaultMaxRetryAfter = 5 * time.Second
+
+// WithRetryPushback enables or disables the retry hints attached to rejections.
+// Hints are enabled by default.
+func WithRetryPushback(enabled bool) Option {
+	return func(rl *TopDownRL) {
+		rl.retryPushback = enabled
+	}
+}
+
+// WithMaxRetryAfter caps the backoff suggested to rejected clients; methods that don't refill
+// are told to wait the full cap. A cap of zero or less disables capping.
+func WithMaxRetryAfter(d time.Duration) Option {
+	return func(rl *TopDownRL) {
+		rl.maxRetryAfter = d
+	}
+}
+
+// retryAfter suggests how long a rejected client should wait before retrying methodName,
+// based on the time until the limiter allows the next request.
+func (rl *TopDownRL) retryAfter(methodName string) (time.Duration, bool) {
+	if !rl.retryPushback {
+		return 0, false
+	}
+	metrics := rl.registeredMetrics(methodName)
+	if metrics == nil || metrics.codel != nil {
+		// Shed requests have no time at which they would be admitted
+		return 0, false
+	}
+
+	limiter, ok := metrics.limiter.(RetryAfterLimiter)
+	if !ok {
+		return 0, false
+	}
+	wait, ok := limiter.RetryAfter(context.Background(), 1)
+	if rl.maxRetryAfter > 0 && (!ok || wait > rl.maxRetryAfter) {
+		return rl.maxRetryAfter, true
+	}
+	return wait, ok
+}
+
+// rejectionError builds the ResourceExhausted error for a rejection of methodName. If a retry hint
+// is available it's attached as RetryInfo, and the returned trailer carries it in milliseconds.
+func (rl *TopDownRL) rejectionError(methodName, msg string) (error, metadata.MD) {
+	st := status.New(codes.ResourceExhausted, msg)
+	wait, ok := rl.retryAfter(methodName)
+	if !ok {
+		return st.Err(), nil
+	}
+
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(wait)}); err == nil {
+		st = detailed
+	}
+	// Round up so clients never retry before the token is there
+	ms := (wait + time.Millisecond - 1) / time.Millisecond
+	return st.Err(), metadata.Pairs(RetryAfterTrailer, strconv.FormatInt(int64(ms), 10))
+}
+
+// retryInfoDelay returns the retry delay of the RetryInfo detail of st, if any.
+func retryInfoDelay(st *status.Status) (time.Duration, bool) {
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok && info.GetRetryDelay() != nil {
+			return info.GetRetryDelay().AsDuration(), true
+		}
+	}
+	return 0, false
+}
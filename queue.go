@@ -0,0 +1,225 @@
+package topdown
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxQueueLength bounds the admission queue of methods that enable queueing without a length.
+const DefaultMaxQueueLength = 1000
+
+// WithAdmissionQueue enables the admission queue for methods without a bucket configuration, see
+// BucketConfig.MaxQueueWait. A maxLength of zero uses DefaultMaxQueueLength.
+func WithAdmissionQueue(maxWait time.Duration, maxLength int) Option {
+	return func(rl *TopDownRL) {
+		rl.defaultBucket.MaxQueueWait = maxWait
+		rl.defaultBucket.MaxQueueLength = maxLength
+	}
+}
+
+// admission is the outcome of the admission of a request.
+type admission int
+
+const (
+	admitted admission = iota
+	rejected
+	// abandoned requests were cancelled by the client while waiting in the admission queue.
+	abandoned
+)
+
+// admissionQueue holds the requests of a method waiting for a token, in arrival order. Only the
+// request at the head takes tokens; it sleeps until the bucket is due to hold the next token.
+type admissionQueue struct {
+	maxWait   time.Duration
+	maxLength int
+
+	mu      sync.Mutex
+	waiters []*queuedRequest
+	// depth mirrors len(waiters) for lock-free reads on the admission path.
+	depth atomic.Int64
+}
+
+// queuedRequest is a request waiting in an admission queue.
+type queuedRequest struct {
+	// head is closed once the request reaches the head of the queue.
+	head chan struct{}
+}
+
+// newAdmissionQueue creates an empty queue, or returns nil if queueing is disabled.
+func newAdmissionQueue(maxWait time.Duration, maxLength int) *admissionQueue {
+	if maxWait <= 0 {
+		return nil
+	}
+	if maxLength <= 0 {
+		maxLength = DefaultMaxQueueLength
+	}
+	return &admissionQueue{maxWait: maxWait, maxLength: maxLength}
+}
+
+// currentDepth returns the number of waiting requests; a disabled queue is always empty.
+func (q *admissionQueue) currentDepth() int64 {
+	if q == nil {
+		return 0
+	}
+	return q.depth.Load()
+}
+
+// enqueue appends a request to the queue, or returns false if the queue is full.
+func (q *admissionQueue) enqueue() (*queuedRequest, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.waiters) >= q.maxLength {
+		return nil, false
+	}
+	r := &queuedRequest{head: make(chan struct{})}
+	q.waiters = append(q.waiters, r)
+	if len(q.waiters) == 1 {
+		close(r.head)
+	}
+	q.depth.Store(int64(len(q.waiters)))
+	return r, true
+}
+
+// remove takes a request out of the queue and promotes the next request if it was the head.
+func (q *admissionQueue) remove(r *queuedRequest) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, waiter := range q.waiters {
+		if waiter != r {
+			continue
+		}
+		q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+		if i == 0 && len(q.waiters) > 0 {
+			close(q.waiters[0].head)
+		}
+		break
+	}
+	q.depth.Store(int64(len(q.waiters)))
+}
+
+// admit admits a request costing n tokens like AllowN, but lets it wait in the method's admission
+// queue, if enabled, when not enough tokens are available. Requests only bypass the queue while
+// nobody waits in it.
+func (rl *TopDownRL) admit(ctx context.Context, methodName string, n int64) admission {
+	metrics := rl.loadMetrics(methodName)
+	if metrics == nil || metrics.queue == nil || metrics.codel != nil || rl.inShadowMode(metrics) || rl.warmupRemaining(rl.clock.Now()) > 0 {
+		if rl.AllowN(ctx, methodName, n) {
+			return admitted
+		}
+		return rejected
+	}
+
+	shed, bypass := rl.shedDecision(metrics)
+	if shed || !rl.cpuAdmits(metrics) || !rl.memoryAdmits(ctx, metrics) || !rl.allowTenant(ctx, metrics, n) {
+		return rejected
+	}
+	if bypass {
+		return rl.admitGlobal(ctx, metrics, n, noTokens)
+	}
+
+	start := rl.clock.Now()
+	if metrics.queue.depth.Load() == 0 {
+		if grant := rl.takeTokens(rl.limiterContext(ctx), metrics, n); grant != noTokens {
+			return rl.admitGlobal(ctx, metrics, n, grant)
+		}
+	}
+	outcome, grant := rl.waitForToken(ctx, metrics, n)
+	rl.recordQueueOutcome(metrics, outcome, rl.clock.Now().Sub(start))
+	if outcome == admitted {
+		return rl.admitGlobal(ctx, metrics, n, grant)
+	}
+	// Requests the queue rejected or that were abandoned give their tenant's tokens back
+	rl.refundTenant(ctx, metrics, n)
+	if outcome == rejected {
+		metrics.limitRejected.Add(1)
+	}
+	return outcome
+}
+
+// admitGlobal admits a request the method's own limit has admitted if the global bucket allows it,
+// and otherwise refunds the tokens it took as grant says, see refundTokens.
+func (rl *TopDownRL) admitGlobal(ctx context.Context, metrics *InterfaceMetrics, n int64, grant tokenGrant) admission {
+	if !rl.allowGlobal(metrics, n) {
+		rl.refundTokens(ctx, metrics, n, grant)
+		return rejected
+	}
+	metrics.tokensConsumed.Add(n)
+	return admitted
+}
+
+// waitForToken queues a request until it takes n tokens, its maximum wait or deadline passes, or
+// it is cancelled, and returns where the tokens of an admitted request came from.
+func (rl *TopDownRL) waitForToken(ctx context.Context, metrics *InterfaceMetrics, n int64) (admission, tokenGrant) {
+	q := metrics.queue
+	r, ok := q.enqueue()
+	if !ok {
+		return rejected, noTokens
+	}
+	defer q.remove(r)
+
+	wait := q.maxWait
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := deadline.Sub(rl.clock.Now()); remaining < wait {
+			wait = remaining
+		}
+	}
+	expired := rl.clock.NewTimer(wait)
+	defer expired.Stop()
+
+	select {
+	case <-r.head:
+	case <-expired.C():
+		return rejected, noTokens
+	case <-ctx.Done():
+		return abandoned, noTokens
+	}
+
+	limiterCtx := rl.limiterContext(ctx)
+	limiter, retries := metrics.limiter.(RetryAfterLimiter)
+	for {
+		if grant := rl.takeTokens(limiterCtx, metrics, n); grant != noTokens {
+			return admitted, grant
+		}
+		// Sleep until the tokens are due; a bucket that doesn't refill leaves the request waiting until it expires
+		refill := QueuePollInterval
+		if retries {
+			var ok bool
+			if refill, ok = limiter.RetryAfter(limiterCtx, n); !ok {
+				refill = wait
+			}
+		}
+		if refill < time.Microsecond {
+			refill = time.Microsecond
+		}
+
+		timer := rl.clock.NewTimer(refill)
+		select {
+		case <-timer.C():
+		case <-expired.C():
+			timer.Stop()
+			return rejected, noTokens
+		case <-ctx.Done():
+			timer.Stop()
+			return abandoned, noTokens
+		}
+	}
+}
+
+// recordQueueOutcome records the time a request spent in the admission queue if it was admitted,
+// or counts it if it was abandoned. Rejections are counted by the interceptor.
+func (rl *TopDownRL) recordQueueOutcome(metrics *InterfaceMetrics, outcome admission, waited time.Duration) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	switch outcome {
+	case admitted:
+		metrics.queueWaits.Record(waited)
+	case abandoned:
+		metrics.AbandonedCounter++
+		metrics.AbandonedTotal++
+	}
+}
@@ -0,0 +1,46 @@
+package topdown
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAdmissionQueueWaitsOnClock(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 1, RefillRate: 1, MaxQueueWait: 5 * time.Second}},
+		map[string]time.Duration{"/a": time.Second}, WithClock(clock))
+	ctx := context.Background()
+
+	if got := rl.admit(ctx, "/a", 1); got != admitted {
+		t.Fatalf("first request: admit() = %v, want admitted", got)
+	}
+	outcome := make(chan admission)
+	go func() { outcome <- rl.admit(ctx, "/a", 1) }()
+
+	// The queued request waits on its expiry and on the refill of the next token
+	waitUntil(t, func() bool { return clock.Timers() == 2 })
+	clock.Advance(time.Second)
+	if got := <-outcome; got != admitted {
+		t.Errorf("queued request: admit() = %v, want admitted once the token refilled", got)
+	}
+}
+
+func TestAdmissionQueueExpiresOnClock(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 1, RefillRate: 0.1, MaxQueueWait: 2 * time.Second}},
+		map[string]time.Duration{"/a": time.Second}, WithClock(clock))
+	ctx := context.Background()
+
+	if got := rl.admit(ctx, "/a", 1); got != admitted {
+		t.Fatalf("first request: admit() = %v, want admitted", got)
+	}
+	outcome := make(chan admission)
+	go func() { outcome <- rl.admit(ctx, "/a", 1) }()
+
+	waitUntil(t, func() bool { return clock.Timers() == 2 })
+	clock.Advance(2 * time.Second)
+	if got := <-outcome; got != rejected {
+		t.Errorf("queued request: admit() = %v, want rejected once its wait expired", got)
+	}
+}
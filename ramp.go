@@ -0,0 +1,96 @@
+package topdown
+
+import (
+	"math"
+	"time"
+)
+
+// RampMode selects how the refill rate moves toward a new rate, see WithRateRamp.
+type RampMode int
+
+const (
+	// RampLinear changes the rate by the same amount at every interval.
+	RampLinear RampMode = iota
+	// RampExponential changes the rate by the same factor at every interval, so large increases
+	// start slowly. Ramps from or to a rate of zero are linear.
+	RampExponential
+)
+
+// String returns the name of the mode as used by the control API.
+func (m RampMode) String() string {
+	if m == RampExponential {
+		return "exponential"
+	}
+	return "linear"
+}
+
+// WithRateRamp moves the refill rates set through SetRateLimit toward the new rate over duration
+// instead of switching at once. The rate is updated at the end of every metrics interval, so the
+// duration should span a few of them. Controller adjustments always apply at once.
+func WithRateRamp(duration time.Duration, mode RampMode) Option {
+	return func(rl *TopDownRL) {
+		rl.rampDuration = duration
+		rl.rampMode = mode
+	}
+}
+
+// rateRamp is a rate change in progress from start to target, started at startTime.
+type rateRamp struct {
+	start     float64
+	target    float64
+	startTime time.Time
+}
+
+// rateAt returns the rate of the ramp at now.
+func (r *rateRamp) rateAt(now time.Time, duration time.Duration, mode RampMode) float64 {
+	progress := float64(now.Sub(r.startTime)) / float64(duration)
+	if progress >= 1 {
+		return r.target
+	}
+	if progress <= 0 {
+		return r.start
+	}
+	if mode == RampExponential && r.start > 0 && r.target > 0 {
+		return r.start * math.Pow(r.target/r.start, progress)
+	}
+	return r.start + (r.target-r.start)*progress
+}
+
+// startRampLocked starts moving the rate of a method toward target, or sets it at once if ramps
+// are disabled or immediate is set. The caller must hold metrics.mu.
+func (rl *TopDownRL) startRampLocked(metrics *InterfaceMetrics, target float64, immediate bool) {
+	if immediate || rl.rampDuration <= 0 || target == metrics.RefillRate {
+		metrics.ramp = nil
+		// The bucket keeps the tokens earned at the old rate before switching to the new one
+		setLimiterRateLocked(metrics, target)
+		metrics.RefillRate = target
+		return
+	}
+	metrics.ramp = &rateRamp{start: metrics.RefillRate, target: target, startTime: rl.clock.Now()}
+}
+
+// rampLocked advances the ramp of a method, if any, at the end of an interval. The caller must
+// hold metrics.mu.
+func (rl *TopDownRL) rampLocked(metrics *InterfaceMetrics, now time.Time) {
+	if metrics.ramp == nil {
+		return
+	}
+	rate := metrics.ramp.rateAt(now, rl.rampDuration, rl.rampMode)
+	if rate == metrics.ramp.target {
+		metrics.ramp = nil
+	}
+	setLimiterRateLocked(metrics, rate)
+	metrics.RefillRate = rate
+	if rl.Debug {
+		rl.logger.Debugf("Ramped rate limit for method '%s' to %f", metrics.method, rate)
+	}
+}
+
+// targetRateLocked returns the rate a method is ramping to, or its rate if it isn't ramping.
+// The caller must hold metrics.mu.
+func targetRateLocked(metrics *InterfaceMetrics) float64 {
+	if metrics.ramp != nil {
+		return metrics.ramp.target
+	}
+	return metrics.RefillRate
+}
@@ -0,0 +1,202 @@
+package topdown
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ChargingLimiter is implemented by limiters that can adjust the capacity a request consumed
+// after it was admitted, see SetCost.
+type ChargingLimiter interface {
+	Limiter
+	// Charge consumes delta more units of capacity without refusing them, going into debt by up
+	// to the burst, or returns -delta units if delta is negative, up to the burst.
+	Charge(delta int64)
+}
+
+// Charge takes delta more tokens from the bucket, or returns -delta tokens to it.
+func (l *tokenBucketLimiter) Charge(delta int64) {
+	now := l.clock.Now()
+	if delta > 0 {
+		l.bucket.drain(now, delta)
+		return
+	}
+	l.bucket.refill(now)
+	l.bucket.add(-delta*tokenScale, l.bucket.params.Load().maxTokens)
+}
+
+// Charge advances the TAT by delta emission intervals, or moves it back by -delta, within the
+// same bounds as the token bucket.
+func (g *gcraLimiter) Charge(delta int64) {
+	now := g.clock.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.rate <= 0 {
+		return
+	}
+	if g.tat.Before(now) {
+		g.tat = now
+	}
+	g.tat = g.tat.Add(time.Duration(delta) * g.emissionInterval())
+	if g.tat.Before(now) {
+		g.tat = now
+	}
+	if limit := now.Add(2 * time.Duration(g.burst) * g.emissionInterval()); g.tat.After(limit) {
+		g.tat = limit
+	}
+}
+
+// requestReport is what the handler of an admitted request reported about it, see MarkDegraded,
+// SetCost, OverrideLatency and StartExternalCall. rl, method and charged never change after the
+// report is installed.
+type requestReport struct {
+	rl      *TopDownRL
+	method  string
+	charged int64
+
+	mu         sync.Mutex
+	degraded   bool
+	cost       int64
+	costSet    bool
+	latency    time.Duration
+	latencySet bool
+	// external is the time spent in external calls that ended, and calls the number of calls in
+	// progress, which began at callStart.
+	external  time.Duration
+	calls     int
+	callStart time.Time
+}
+
+// reportKey is the context key of the request report.
+type reportKey struct{}
+
+// reportFrom returns the report of the request of ctx, or nil outside an admitted request.
+func reportFrom(ctx context.Context) *requestReport {
+	report, _ := ctx.Value(reportKey{}).(*requestReport)
+	return report
+}
+
+// MarkDegraded marks the request of ctx as degraded, e.g. because it returned a partial result:
+// if it completes with a good status code, it counts as an SLO violation instead of towards
+// goodput. It's a no-op outside a request admitted by the limiter.
+func MarkDegraded(ctx context.Context) {
+	if report := reportFrom(ctx); report != nil {
+		report.mu.Lock()
+		report.degraded = true
+		report.mu.Unlock()
+	}
+}
+
+// SetCost sets the number of tokens the request of ctx costs. Once it completes, the difference
+// to the tokens it took when admitted is charged to the bucket of its method, which may go into
+// debt, or returned to it, so it shows in the admissions of the next requests. Limiters that
+// don't implement ChargingLimiter aren't charged. It's a no-op outside a request admitted by the
+// limiter.
+func SetCost(ctx context.Context, n int64) {
+	if report := reportFrom(ctx); report != nil && n >= 0 {
+		report.mu.Lock()
+		report.cost, report.costSet = n, true
+		report.mu.Unlock()
+	}
+}
+
+// OverrideLatency sets the latency recorded for the request of ctx instead of the time it took,
+// e.g. to exclude the time spent receiving a client-streamed upload. It's a no-op outside a
+// request admitted by the limiter.
+func OverrideLatency(ctx context.Context, d time.Duration) {
+	if report := reportFrom(ctx); report != nil {
+		report.mu.Lock()
+		report.latency, report.latencySet = d, true
+		report.mu.Unlock()
+	}
+}
+
+// StartExternalCall starts timing a call of the request of ctx to an external dependency, such as
+// a downstream service with its own limiter, and returns the function ending it. The time spent
+// in external calls is subtracted from the latency the request is held to its SLO with, so both
+// tiers don't throttle for the same slowness. Overlapping calls count once, for the time any of
+// them was in progress, and calls still in progress when the request completes end then.
+// ClientUnaryInterceptor and UnaryClientInterceptor time the calls they make. It's a no-op outside
+// a request admitted by the limiter.
+func StartExternalCall(ctx context.Context) (done func()) {
+	report := reportFrom(ctx)
+	if report == nil {
+		return func() {}
+	}
+	report.mu.Lock()
+	if report.calls == 0 {
+		report.callStart = report.rl.clock.Now()
+	}
+	report.calls++
+	report.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			report.mu.Lock()
+			defer report.mu.Unlock()
+			report.calls--
+			if report.calls == 0 {
+				report.external += report.rl.clock.Now().Sub(report.callStart)
+			}
+		})
+	}
+}
+
+// AddExternalTime adds d to the time the request of ctx spent in external calls, see
+// StartExternalCall, e.g. for a call timed by the handler itself. Unlike the calls timed with
+// StartExternalCall, d is added as is, even if it overlaps other calls. It's a no-op outside a
+// request admitted by the limiter.
+func AddExternalTime(ctx context.Context, d time.Duration) {
+	if report := reportFrom(ctx); report != nil && d > 0 {
+		report.mu.Lock()
+		report.external += d
+		report.mu.Unlock()
+	}
+}
+
+// settlement is how the report of a completed request affects its accounting.
+type settlement struct {
+	// external is the time the request spent in external calls.
+	external time.Duration
+	degraded bool
+}
+
+// settleReport applies the report of a completed request of rl, if any: it charges the difference
+// of the cost set by the handler and returns the latency to record and the settlement. The reports
+// of other limiters and methods are ignored, e.g. the report of the incoming request seen by the
+// limiter of its outgoing calls.
+func (rl *TopDownRL) settleReport(ctx context.Context, methodName string, latency time.Duration) (time.Duration, settlement) {
+	report := reportFrom(ctx)
+	if report == nil || report.rl != rl || report.method != methodName {
+		return latency, settlement{}
+	}
+	report.mu.Lock()
+	settled, delta := settlement{external: report.external, degraded: report.degraded}, report.cost-report.charged
+	if !report.costSet {
+		delta = 0
+	}
+	if report.latencySet {
+		latency = report.latency
+	}
+	if report.calls > 0 {
+		settled.external += rl.clock.Now().Sub(report.callStart)
+	}
+	report.mu.Unlock()
+
+	if delta != 0 {
+		if metrics := rl.registeredMetrics(methodName); metrics != nil {
+			if limiter, ok := metrics.limiter.(ChargingLimiter); ok {
+				limiter.Charge(delta)
+				metrics.tokensConsumed.Add(delta)
+				if rl.Debug {
+					rl.logger.Debugf("Charged %d tokens to method '%s' after completion", delta, methodName)
+				}
+			}
+		}
+	}
+	return latency, settled
+}
@@ -0,0 +1,116 @@
+package topdown
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// DefaultRetryAttemptKey is the default metadata key carrying the attempt number of a request,
+// 0 for the first attempt.
+const DefaultRetryAttemptKey = "x-retry-attempt"
+
+// RetryMetrics holds the retries of a method, see WithRetryAttempts. Arrivals and Goodput count
+// the retries that arrived and completed within the SLO during the last interval, and Ratio is
+// the share of all arrivals that were retries, i.e. the retry amplification.
+type RetryMetrics struct {
+	Arrivals      int64   `json:"arrivals"`
+	Goodput       int64   `json:"goodput"`
+	Ratio         float64 `json:"ratio"`
+	ArrivalsTotal int64   `json:"arrivals_total"`
+	GoodputTotal  int64   `json:"goodput_total"`
+}
+
+// WithRetryAttempts reads the attempt number of incoming requests from the metadata key
+// (DefaultRetryAttemptKey if empty), e.g. "grpc-previous-rpc-attempts" for gRPC's own retries.
+// Retries, requests with an attempt above 0, are counted apart in RetryMetrics and, by default,
+// not towards goodput, since the operation they retry already failed once. Requests without a
+// valid attempt number are first attempts.
+func WithRetryAttempts(key string) Option {
+	return func(rl *TopDownRL) {
+		if key == "" {
+			key = DefaultRetryAttemptKey
+		}
+		rl.retryKey = strings.ToLower(key)
+	}
+}
+
+// WithGoodputAttempts sets the highest attempt number counting towards goodput; the default is 0,
+// so only first attempts do.
+func WithGoodputAttempts(attempt int) Option {
+	return func(rl *TopDownRL) {
+		rl.goodputAttempts = attempt
+	}
+}
+
+// WithRetryShare deprioritizes retries: like a priority tier, they may only take tokens while
+// the bucket holds more than (1 - share) of its capacity, so they are rejected before first
+// attempts when the bucket drains. It applies on top of the share of the request's tier.
+func WithRetryShare(share float64) Option {
+	return func(rl *TopDownRL) {
+		rl.retryShare = share
+	}
+}
+
+// validateRetries checks the retry options, which need an attempt key.
+func (rl *TopDownRL) validateRetries() error {
+	if rl.retryKey == "" {
+		if rl.goodputAttempts != 0 || rl.retryShare != 0 {
+			return fmt.Errorf("goodput attempts or retry share set without a retry attempt key")
+		}
+		return nil
+	}
+	if rl.goodputAttempts < 0 {
+		return fmt.Errorf("goodput attempts must not be negative, got %d", rl.goodputAttempts)
+	}
+	if rl.retryShare != 0 && !(rl.retryShare > 0 && rl.retryShare <= 1) {
+		return fmt.Errorf("retry share must be in (0, 1], got %g", rl.retryShare)
+	}
+	return nil
+}
+
+// retryAttempt returns the attempt number of a request, 0 if retries aren't tracked.
+func (rl *TopDownRL) retryAttempt(ctx context.Context) int {
+	if rl.retryKey == "" {
+		return 0
+	}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return 0
+	}
+	value, ok := firstValue(md, []string{rl.retryKey})
+	if !ok {
+		return 0
+	}
+	attempt, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || attempt < 0 {
+		return 0
+	}
+	return attempt
+}
+
+// retryShareOf returns the share of the bucket a request may use because of its attempt number.
+func (rl *TopDownRL) retryShareOf(ctx context.Context) float64 {
+	if rl.retryShare == 0 || rl.retryAttempt(ctx) == 0 {
+		return 1
+	}
+	return rl.retryShare
+}
+
+// retryMetricsLocked returns the retries of a method, or nil if retries aren't tracked.
+// The caller must hold metrics.mu.
+func (rl *TopDownRL) retryMetricsLocked(metrics *InterfaceMetrics) *RetryMetrics {
+	if rl.retryKey == "" {
+		return nil
+	}
+	return &RetryMetrics{
+		Arrivals:      metrics.CurrentRetryArrivals,
+		Goodput:       metrics.CurrentRetryGoodput,
+		Ratio:         ratio(metrics.CurrentRetryArrivals, metrics.CurrentArrivals),
+		ArrivalsTotal: metrics.RetryArrivalsTotal,
+		GoodputTotal:  metrics.RetryGoodputTotal,
+	}
+}
@@ -0,0 +1,283 @@
+package topdown
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ScheduleEntry is an entry of the rate schedule of a method, see WithRateSchedule.
+type ScheduleEntry struct {
+	// Name identifies the entry in the configuration; it may be empty.
+	Name string
+	// Start and End are the times of day the entry is active between, as offsets from midnight
+	// in the location of the schedules, see WithScheduleLocation. An entry ending before it
+	// starts runs past midnight, and one ending when it starts lasts for a whole day.
+	Start time.Duration
+	End   time.Duration
+	// Days are the days of the week the entry starts on, every day if empty.
+	Days []time.Weekday
+	// RefillRate is the rate of the method while the entry is active, and MaxTokens its burst,
+	// if positive.
+	RefillRate float64
+	MaxTokens  int64
+}
+
+// validate checks that the entry has valid times of day, days and rate.
+func (e ScheduleEntry) validate() error {
+	if e.Start < 0 || e.Start >= 24*time.Hour || e.End < 0 || e.End >= 24*time.Hour {
+		return fmt.Errorf("start %v and end %v must be times of day in [0, 24h)", e.Start, e.End)
+	}
+	for _, day := range e.Days {
+		if day < time.Sunday || day > time.Saturday {
+			return fmt.Errorf("invalid day of the week %d", day)
+		}
+	}
+	if err := validateRate(e.RefillRate); err != nil {
+		return err
+	}
+	if e.MaxTokens < 0 {
+		return fmt.Errorf("max tokens must not be negative, got %d", e.MaxTokens)
+	}
+	return nil
+}
+
+// startsOn reports whether the entry starts on day.
+func (e ScheduleEntry) startsOn(day time.Weekday) bool {
+	if len(e.Days) == 0 {
+		return true
+	}
+	for _, d := range e.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// activeAt reports whether the entry is active at t, by the wall clock of t's location.
+func (e ScheduleEntry) activeAt(t time.Time) bool {
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+	today, yesterday := t.Weekday(), (t.Weekday()+6)%7
+	if e.Start < e.End {
+		return e.startsOn(today) && clock >= e.Start && clock < e.End
+	}
+	// The entry runs past midnight, so it may have started the day before
+	return e.startsOn(today) && clock >= e.Start || e.startsOn(yesterday) && clock < e.End
+}
+
+// WithRateSchedule sets the rate schedule of a method, e.g. higher rates for reporting methods
+// during a nightly batch window. At the end of every metrics interval, the first of the entries
+// active then sets the rate and burst of the method, ramping if enabled with WithRateRamp. Once
+// no entry is active, the method returns to its baseline, the rate it had before, or the last one
+// set without a TTL while an entry was active. Scheduled rates take precedence over that baseline
+// and the controller, while a temporary rate set through SetTemporaryRateLimit holds until it
+// expires, reverting to the scheduled rate.
+func WithRateSchedule(method string, entries ...ScheduleEntry) Option {
+	return func(rl *TopDownRL) {
+		if rl.schedules == nil {
+			rl.schedules = make(map[string][]ScheduleEntry)
+		}
+		rl.schedules[method] = entries
+	}
+}
+
+// WithScheduleLocation sets the time zone the rate schedules are evaluated in, UTC by default.
+func WithScheduleLocation(location *time.Location) Option {
+	return func(rl *TopDownRL) {
+		rl.scheduleLocation = location
+	}
+}
+
+// validateSchedules checks the schedules and their location.
+func (rl *TopDownRL) validateSchedules() error {
+	if rl.scheduleLocation == nil {
+		return errors.New("schedule location must be set")
+	}
+	for methodName, entries := range rl.schedules {
+		if methodName == "" || isPattern(methodName) {
+			return fmt.Errorf("rate schedules must be set for methods, got '%s'", methodName)
+		}
+		for i, entry := range entries {
+			if err := entry.validate(); err != nil {
+				return fmt.Errorf("invalid entry %d of the rate schedule of method '%s': %w", i, methodName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// rateSchedule is the rate schedule of a method. active is the index of the active entry, -1 if
+// none is, and baseline and baselineTokens the rate and burst the method returns to afterwards.
+type rateSchedule struct {
+	entries        []ScheduleEntry
+	active         int
+	baseline       float64
+	baselineTokens int64
+}
+
+// newRateSchedule returns the schedule of a method, or nil if it has none.
+func (rl *TopDownRL) newRateSchedule(methodName string) *rateSchedule {
+	entries, exists := rl.schedules[methodName]
+	if !exists {
+		return nil
+	}
+	return &rateSchedule{entries: entries, active: -1}
+}
+
+// activeLocked reports whether an entry of the schedule is active. The caller must hold
+// metrics.mu.
+func (s *rateSchedule) activeLocked() bool {
+	return s != nil && s.active >= 0
+}
+
+// scheduleLocked applies the entry of the schedule of a method active at now, if it changed. The
+// caller must hold metrics.mu.
+func (rl *TopDownRL) scheduleLocked(metrics *InterfaceMetrics, now time.Time) {
+	schedule := metrics.schedule
+	if schedule == nil {
+		return
+	}
+	local := now.In(rl.scheduleLocation)
+	active := -1
+	for i, entry := range schedule.entries {
+		if entry.activeAt(local) {
+			active = i
+			break
+		}
+	}
+	if active == schedule.active {
+		return
+	}
+
+	if schedule.active < 0 {
+		// The method returns to the rate it would have without the schedule
+		schedule.baseline, schedule.baselineTokens = targetRateLocked(metrics), metrics.MaxTokens
+		if metrics.override != nil {
+			schedule.baseline = metrics.override.baseline
+		}
+	}
+	schedule.active = active
+	rate, maxTokens := schedule.baseline, schedule.baselineTokens
+	if active >= 0 {
+		entry := schedule.entries[active]
+		bounded, err := rl.boundRateLocked(metrics.method, metrics, entry.RefillRate)
+		if err != nil {
+			rl.logger.Errorf("Failed to apply entry %d of the rate schedule of method '%s': %v", active, metrics.method, err)
+			bounded = targetRateLocked(metrics)
+		}
+		rate = bounded
+		if entry.MaxTokens > 0 {
+			maxTokens = entry.MaxTokens
+		}
+		rl.logger.Infof("Rate schedule entry %d '%s' of method '%s' started, setting the rate to %f", active, entry.Name, metrics.method, rate)
+	} else {
+		rl.logger.Infof("Rate schedule of method '%s' ended, reverting to %f", metrics.method, rate)
+	}
+
+	source := changeSource{source: ChangeSourceSchedule}
+	if metrics.override != nil {
+		// The override holds until it expires, then reverts to the scheduled rate
+		metrics.override.baseline = rate
+	} else {
+		rl.recordChange(metrics.method, ChangeFieldRefillRate, targetRateLocked(metrics), rate, source)
+		rl.startRampLocked(metrics, rate, false)
+		metrics.pid = PIDState{}
+	}
+	if limiter, ok := metrics.limiter.(BurstLimiter); ok && maxTokens > 0 && maxTokens != metrics.MaxTokens {
+		limiter.SetBurst(maxTokens)
+		rl.recordChange(metrics.method, ChangeFieldMaxTokens, float64(metrics.MaxTokens), float64(maxTokens), source)
+		metrics.MaxTokens = maxTokens
+	}
+}
+
+// scheduledRateLocked returns the rate of the active entry of the schedule of a method; it must
+// only be called while one is active. The caller must hold metrics.mu.
+func (rl *TopDownRL) scheduledRateLocked(metrics *InterfaceMetrics) float64 {
+	rate, err := rl.boundRateLocked(metrics.method, metrics, metrics.schedule.entries[metrics.schedule.active].RefillRate)
+	if err != nil {
+		return metrics.RefillRate
+	}
+	return rate
+}
+
+// ScheduleState is the rate schedule of a method and its active entry, see WithRateSchedule.
+type ScheduleState struct {
+	Entries []ScheduleEntry
+	// Active is the index of the active entry in Entries, -1 if none is, and Baseline the rate
+	// the method returns to once none is; it's zero while none is active.
+	Active   int
+	Baseline float64
+}
+
+// stateLocked returns the state of the schedule, nil if the method has none. The caller must
+// hold metrics.mu.
+func (s *rateSchedule) stateLocked() *ScheduleState {
+	if s == nil {
+		return nil
+	}
+	state := &ScheduleState{Entries: append([]ScheduleEntry(nil), s.entries...), Active: s.active}
+	if s.active >= 0 {
+		state.Baseline = s.baseline
+	}
+	return state
+}
+
+// scheduleEntryResponse is the JSON shape of a ScheduleEntry, with the times of day like "02:00".
+type scheduleEntryResponse struct {
+	Name       string   `json:"name,omitempty"`
+	Start      string   `json:"start"`
+	End        string   `json:"end"`
+	Days       []string `json:"days,omitempty"`
+	RefillRate float64  `json:"refill_rate"`
+	MaxTokens  int64    `json:"max_tokens,omitempty"`
+}
+
+// scheduleResponse is the JSON shape of a ScheduleState served by HandleConfig. ActiveEntry is
+// null while no entry is active.
+type scheduleResponse struct {
+	Entries      []scheduleEntryResponse `json:"entries"`
+	Active       int                     `json:"active"`
+	ActiveEntry  *scheduleEntryResponse  `json:"active_entry"`
+	BaselineRate float64                 `json:"baseline_rate,omitempty"`
+}
+
+// newScheduleResponse converts the state of a schedule into its JSON shape, nil without one.
+func newScheduleResponse(state *ScheduleState) *scheduleResponse {
+	if state == nil {
+		return nil
+	}
+	response := &scheduleResponse{
+		Entries:      make([]scheduleEntryResponse, 0, len(state.Entries)),
+		Active:       state.Active,
+		BaselineRate: state.Baseline,
+	}
+	for _, entry := range state.Entries {
+		days := make([]string, 0, len(entry.Days))
+		for _, day := range entry.Days {
+			days = append(days, day.String())
+		}
+		response.Entries = append(response.Entries, scheduleEntryResponse{
+			Name:       entry.Name,
+			Start:      timeOfDay(entry.Start),
+			End:        timeOfDay(entry.End),
+			Days:       days,
+			RefillRate: entry.RefillRate,
+			MaxTokens:  entry.MaxTokens,
+		})
+	}
+	if state.Active >= 0 {
+		response.ActiveEntry = &response.Entries[state.Active]
+	}
+	return response
+}
+
+// timeOfDay formats an offset from midnight like "02:00", or "02:00:30" with seconds.
+func timeOfDay(d time.Duration) string {
+	hours, minutes, seconds := int(d/time.Hour), int(d%time.Hour/time.Minute), int(d%time.Minute/time.Second)
+	if seconds != 0 {
+		return fmt.Sprintf("%02d:%02d:%02d", hours, minutes, seconds)
+	}
+	return fmt.Sprintf("%02d:%02d", hours, minutes)
+}
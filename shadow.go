@@ -0,0 +1,95 @@
+package topdown
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// WithShadowMode starts the limiter in shadow mode for all methods, see SetShadowMode.
+func WithShadowMode(enabled bool) Option {
+	return func(rl *TopDownRL) {
+		rl.shadowMode.Store(enabled)
+	}
+}
+
+// SetShadowMode enables or disables shadow mode for all methods. In shadow mode Allow keeps
+// consuming tokens but admits every request, counting the ones it would have rejected.
+func (rl *TopDownRL) SetShadowMode(enabled bool) {
+	rl.shadowMode.Store(enabled)
+	if rl.Debug {
+		rl.logger.Debugf("Set shadow mode for all methods: %t", enabled)
+	}
+}
+
+// SetMethodShadowMode enables or disables shadow mode for a single method. A method is in
+// shadow mode if either its own flag or the global one is set.
+func (rl *TopDownRL) SetMethodShadowMode(method string, enabled bool) error {
+	metrics := rl.registeredMetrics(method)
+	if metrics == nil {
+		return fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+	}
+
+	metrics.shadowMode.Store(enabled)
+	if rl.Debug {
+		rl.logger.Debugf("Set shadow mode for method '%s': %t", method, enabled)
+	}
+	return nil
+}
+
+// inShadowMode reports whether requests to the method must be admitted regardless of its bucket.
+func (rl *TopDownRL) inShadowMode(metrics *InterfaceMetrics) bool {
+	return rl.shadowMode.Load() || metrics.shadowMode.Load()
+}
+
+// recordShadowDecision counts the admission decision the bucket made for a request in shadow mode.
+func (rl *TopDownRL) recordShadowDecision(metrics *InterfaceMetrics, admitted bool) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	if admitted {
+		metrics.ShadowAdmittedCounter++
+		return
+	}
+	metrics.WouldRejectCounter++
+	metrics.WouldRejectTotal++
+}
+
+// HandleSetShadowMode handles the POST requests to toggle shadow mode with a body of {"enabled": <bool>}.
+// Without a 'method' parameter it applies to all methods.
+func (rl *TopDownRL) HandleSetShadowMode(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleSetShadowMode called")
+	}
+
+	if r.Method != http.MethodPost {
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var data struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Enabled == nil {
+		writeError(w, "Failed to decode request body", http.StatusBadRequest)
+		return
+	}
+
+	method := r.URL.Query().Get("method")
+	if method == "" {
+		rl.SetShadowMode(*data.Enabled)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if err := rl.SetMethodShadowMode(method, *data.Enabled); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrUnknownMethod) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,142 @@
+package topdown
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// ShedMode selects how the shed probability of a method combines with its limiter.
+type ShedMode int
+
+const (
+	// ShedWithLimiter sheds requests before the limiter, and the remaining requests still need
+	// capacity from it. This is the default.
+	ShedWithLimiter ShedMode = iota
+	// ShedOnly admits every request that isn't shed while the method has a shed probability,
+	// bypassing its limiter.
+	ShedOnly
+)
+
+// WithShedMode sets how the shed probability combines with the limiter, see SetShedProbability.
+func WithShedMode(mode ShedMode) Option {
+	return func(rl *TopDownRL) {
+		rl.shedMode = mode
+	}
+}
+
+// WithShedSeed seeds the generators deciding which requests are shed. Each method's generator is
+// seeded from seed and the method name, so runs with the same seed shed the same requests.
+func WithShedSeed(seed int64) Option {
+	return func(rl *TopDownRL) {
+		rl.shedSeed = seed
+	}
+}
+
+// shedder rejects the requests of a method with a given probability. evaluated and shed count the
+// requests checked and shed during the current interval.
+type shedder struct {
+	probability atomic.Uint64 // math.Float64bits
+
+	mu  sync.Mutex
+	rng *rand.Rand
+
+	evaluated atomic.Int64
+	shed      atomic.Int64
+}
+
+// newShedder creates a shedder with a probability of zero and a generator seeded from seed and the method name.
+func newShedder(seed int64, methodName string) *shedder {
+	h := fnv.New64a()
+	h.Write([]byte(methodName))
+	return &shedder{rng: rand.New(rand.NewSource(seed ^ int64(h.Sum64())))}
+}
+
+// load returns the shed probability.
+func (s *shedder) load() float64 {
+	return math.Float64frombits(s.probability.Load())
+}
+
+// float64 draws a number in [0, 1) from the generator of the method.
+func (s *shedder) float64() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.Float64()
+}
+
+// shedDecision reports whether a request must be shed, and whether it bypasses the limiter
+// because the method is shedding in ShedOnly mode.
+func (rl *TopDownRL) shedDecision(metrics *InterfaceMetrics) (shed, bypass bool) {
+	s := metrics.shed
+	s.evaluated.Add(1)
+	p := s.load()
+	if p <= 0 {
+		return false, false
+	}
+
+	if s.float64() < p {
+		s.shed.Add(1)
+		return true, false
+	}
+	return false, rl.shedMode == ShedOnly
+}
+
+// SetShedProbability sets the fraction of the requests of a method that are rejected before
+// reaching its limiter, between 0 (the default, shedding nothing) and 1.
+func (rl *TopDownRL) SetShedProbability(method string, probability float64) error {
+	if !(probability >= 0 && probability <= 1) {
+		return fmt.Errorf("shed probability must be in [0, 1], got %g", probability)
+	}
+	metrics := rl.registeredMetrics(method)
+	if metrics == nil {
+		return fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+	}
+
+	metrics.shed.probability.Store(math.Float64bits(probability))
+	if rl.Debug {
+		rl.logger.Debugf("Set shed probability for method '%s': %g", method, probability)
+	}
+	return nil
+}
+
+// HandleSetShed handles the POST requests to update the shed probability of the method given by
+// the 'method' parameter with a body of {"probability": <float>}.
+func (rl *TopDownRL) HandleSetShed(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleSetShed called")
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	method := r.URL.Query().Get("method")
+	if method == "" {
+		writeError(w, "Missing 'method' parameter", http.StatusBadRequest)
+		return
+	}
+
+	var data struct {
+		Probability *float64 `json:"probability"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Probability == nil {
+		writeError(w, "Failed to decode request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := rl.SetShedProbability(method, *data.Probability); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrUnknownMethod) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,138 @@
+package topdown
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SetSLO sets the SLO of a method from an external source. Setting the SLO of a method that
+// isn't registered yet registers it, so it starts being rate limited with its bucket configuration.
+// A pattern like "/inventory.Service/*" sets the SLO of the matching methods that have none of
+// their own, including those already registered from a less specific pattern.
+func (rl *TopDownRL) SetSLO(method string, slo time.Duration) {
+	if err := rl.setSLO(method, slo, apiSource); err != nil {
+		rl.logger.Errorf("Failed to set SLO for method '%s': %v", method, err)
+	}
+}
+
+// setSLO sets the SLO of a method on behalf of source, registering it if needed.
+func (rl *TopDownRL) setSLO(method string, slo time.Duration, source changeSource) error {
+	if slo <= 0 {
+		return fmt.Errorf("SLO must be positive, got %v", slo)
+	}
+
+	defer rl.changes.flush()
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	return rl.setSLOLocked(method, slo, source)
+}
+
+// setSLOLocked sets a validated SLO on behalf of source. The caller must hold rl.mutex.
+func (rl *TopDownRL) setSLOLocked(method string, slo time.Duration, source changeSource) error {
+	if isPattern(method) {
+		old, _ := rl.patternSLO(method)
+		rl.recordChange(method, ChangeFieldSLO, durationMs(old), durationMs(slo), source)
+		rl.storeSLORuleLocked(method, slo)
+		if rl.Debug {
+			rl.logger.Debugf("Set new SLO for pattern '%s': %v", method, slo)
+		}
+		rl.resolveLocked(method)
+		return nil
+	}
+
+	metrics, exists := rl.interfaces[method]
+	if !exists {
+		rl.interfaces[method] = rl.newInterfaceMetrics(method, slo)
+		rl.publishInterfacesLocked()
+		rl.recordChange(method, ChangeFieldSLO, 0, durationMs(slo), source)
+		if rl.Debug {
+			rl.logger.Debugf("Registered method '%s' with SLO %v", method, slo)
+		}
+		return nil
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	rl.recordChange(method, ChangeFieldSLO, durationMs(metrics.SLO), durationMs(slo), source)
+	metrics.SLO, metrics.sloPattern, metrics.sloResolved = slo, "", false
+	if rl.Debug {
+		rl.logger.Debugf("Set new SLO for method '%s': %v", method, slo)
+	}
+	return nil
+}
+
+// GetSLO returns the SLO of a method, or the one configured for a pattern.
+func (rl *TopDownRL) GetSLO(method string) (time.Duration, error) {
+	if isPattern(method) {
+		if slo, exists := rl.patternSLO(method); exists {
+			return slo, nil
+		}
+		return 0, fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+	}
+	metrics := rl.registeredMetrics(method)
+	if metrics == nil {
+		return 0, fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	return metrics.SLO, nil
+}
+
+// parseDuration parses a duration given either as a string, e.g. "150ms", or as a number of milliseconds.
+func parseDuration(raw json.RawMessage) (time.Duration, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return time.ParseDuration(text)
+	}
+
+	var ms float64
+	if err := json.Unmarshal(raw, &ms); err != nil {
+		return 0, errors.New("duration must be a string like \"150ms\" or a number of milliseconds")
+	}
+	return time.Duration(ms * float64(time.Millisecond)), nil
+}
+
+// HandleSetSLO handles the POST requests to update the SLO of a method with a body of
+// {"slo": "150ms"} or {"slo": 150}, in milliseconds.
+func (rl *TopDownRL) HandleSetSLO(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleSetSLO called")
+	}
+
+	if r.Method != http.MethodPost {
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	method := r.URL.Query().Get("method")
+	if method == "" {
+		writeError(w, "Missing 'method' parameter", http.StatusBadRequest)
+		return
+	}
+
+	var data struct {
+		SLO json.RawMessage `json:"slo"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.SLO == nil {
+		writeError(w, "Failed to decode request body", http.StatusBadRequest)
+		return
+	}
+	slo, err := parseDuration(data.SLO)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := rl.setSLO(method, slo, httpSource(r)); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,47 @@
+package topdown
+
+import (
+	"fmt"
+	"time"
+)
+
+// WithSmoothing smooths the goodput and tail latency returned by GetMetrics and the legacy
+// /metrics shape with an exponentially weighted moving average: every interval, the smoothed
+// value moves alpha of the way to the interval's value. Intervals without traffic count as zero
+// goodput and latency, so the smoothed values decay rather than hold stale values. An alpha of 1,
+// the default, disables smoothing. The full snapshot reports both the raw and smoothed values.
+func WithSmoothing(alpha float64) Option {
+	return func(rl *TopDownRL) {
+		rl.smoothingAlpha = alpha
+	}
+}
+
+// validateSmoothing checks that alpha is in (0, 1].
+func validateSmoothing(alpha float64) error {
+	if !(alpha > 0 && alpha <= 1) {
+		return fmt.Errorf("alpha must be in (0, 1], got %g", alpha)
+	}
+	return nil
+}
+
+// smoothLocked updates the smoothed goodput and tail latency at the end of an interval. Without
+// smoothing they're the raw values, so GetMetrics returns exactly what it always did.
+// The caller must hold metrics.mu.
+func (rl *TopDownRL) smoothLocked(metrics *InterfaceMetrics, empty bool) {
+	goodput, latency := float64(metrics.CurrentGoodput), metrics.LastTailLatency95th
+	alpha := rl.smoothingAlpha
+	if alpha == 1 {
+		metrics.smoothedGoodput, metrics.smoothedLatency = goodput, latency
+		return
+	}
+	if empty {
+		// The raw tail latency is kept across empty intervals, but there is no latency to smooth in
+		latency = 0
+	}
+	if !metrics.smoothed {
+		metrics.smoothedGoodput, metrics.smoothedLatency, metrics.smoothed = goodput, latency, true
+		return
+	}
+	metrics.smoothedGoodput += alpha * (goodput - metrics.smoothedGoodput)
+	metrics.smoothedLatency += time.Duration(alpha * float64(latency-metrics.smoothedLatency))
+}
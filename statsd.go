@@ -0,0 +1,131 @@
+package topdown
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// StatsD defaults, see WithStatsD.
+const (
+	// DefaultStatsDWriteTimeout bounds a single write to the StatsD socket.
+	DefaultStatsDWriteTimeout = 10 * time.Millisecond
+	// statsdMaxPacket is the largest packet sent, so that packets fit a typical network MTU.
+	statsdMaxPacket = 1432
+)
+
+// statsdEmitter sends the metrics of every interval to a StatsD agent.
+type statsdEmitter struct {
+	addr     string
+	prefix   string
+	tags     []string
+	failures atomic.Int64
+}
+
+// statsdTagEscaper replaces the characters delimiting DogStatsD tags in method names.
+var statsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", " ", "_")
+
+// WithStatsD sends the metrics of every method to the StatsD agent at addr over UDP at the end
+// of every metrics interval, in the DogStatsD format: the counters goodput and rejected of the
+// interval, and the gauges p95_ms, tokens and rate, each prefixed with prefix and tagged with
+// the method and tags such as "env:prod". Metrics are sent from their own goroutine with a short
+// write timeout, so a slow socket never delays the ticks, and stop along with Stop.
+func WithStatsD(addr, prefix string, tags ...string) Option {
+	return func(rl *TopDownRL) {
+		if prefix != "" && !strings.HasSuffix(prefix, ".") {
+			prefix += "."
+		}
+		rl.statsd = &statsdEmitter{addr: addr, prefix: prefix, tags: tags}
+	}
+}
+
+// StatsDFailures returns the number of StatsD packets that couldn't be sent.
+func (rl *TopDownRL) StatsDFailures() int64 {
+	if rl.statsd == nil {
+		return 0
+	}
+	return rl.statsd.failures.Load()
+}
+
+// statsdLoop sends the metrics whenever the metrics goroutine signals the end of an interval,
+// coalescing the signals like pushLoop.
+func (rl *TopDownRL) statsdLoop(ctx context.Context, emits <-chan struct{}) {
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-emits:
+			if conn == nil {
+				var err error
+				if conn, err = net.Dial("udp", rl.statsd.addr); err != nil {
+					rl.statsd.failures.Add(1)
+					rl.logger.Errorf("Failed to connect to StatsD at %s: %v", rl.statsd.addr, err)
+					continue
+				}
+			}
+			for _, packet := range rl.statsd.packets(rl.GetAllMetrics()) {
+				conn.SetWriteDeadline(time.Now().Add(DefaultStatsDWriteTimeout))
+				if _, err := conn.Write(packet); err != nil {
+					rl.statsd.failures.Add(1)
+					if rl.Debug {
+						rl.logger.Debugf("Failed to send metrics to StatsD at %s: %v", rl.statsd.addr, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+// packets formats the metrics of the methods as StatsD lines, in the order of the method names,
+// and splits them into packets of at most statsdMaxPacket bytes.
+func (e *statsdEmitter) packets(snapshots map[string]MetricsSnapshot) [][]byte {
+	methods := make([]string, 0, len(snapshots))
+	for methodName := range snapshots {
+		methods = append(methods, methodName)
+	}
+	sort.Strings(methods)
+
+	var packets [][]byte
+	var packet bytes.Buffer
+	add := func(line string) {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+			packets = append(packets, append([]byte(nil), packet.Bytes()...))
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	for _, methodName := range methods {
+		snapshot := snapshots[methodName]
+		tags := "|#" + strings.Join(append([]string{"method:" + statsdTagEscaper.Replace(methodName)}, e.tags...), ",")
+		add(fmt.Sprintf("%sgoodput:%d|c%s", e.prefix, snapshot.Goodput, tags))
+		add(fmt.Sprintf("%srejected:%d|c%s", e.prefix, snapshot.Rejected, tags))
+		add(fmt.Sprintf("%sp95_ms:%s|g%s", e.prefix, formatPlainFloat(durationMs(snapshot.TailLatency95th)), tags))
+		add(fmt.Sprintf("%stokens:%s|g%s", e.prefix, formatPlainFloat(snapshot.CurrentTokens), tags))
+		add(fmt.Sprintf("%srate:%s|g%s", e.prefix, formatPlainFloat(snapshot.RefillRate), tags))
+	}
+	if packet.Len() > 0 {
+		packets = append(packets, packet.Bytes())
+	}
+	return packets
+}
+
+// formatPlainFloat formats a value without an exponent, which StatsD doesn't parse.
+func formatPlainFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
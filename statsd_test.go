@@ -0,0 +1,103 @@
+package topdown
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsDWireFormat(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	clock := NewFakeClock(time.Unix(1000, 0))
+	rl := newTestRL(t, map[string]BucketConfig{"/a b": {MaxTokens: 1, RefillRate: 2}},
+		map[string]time.Duration{"/a b": time.Second}, WithClock(clock), WithStatsD(listener.LocalAddr().String(), "svc", "env:prod"))
+	intervals, unsubscribe := rl.subscribeIntervals()
+	defer unsubscribe()
+	rl.AllowN(context.Background(), "/a b", 1)
+	rl.recordRejection("/a b", 0)
+	clock.Advance(time.Second)
+	<-intervals
+
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, statsdMaxPacket)
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := "|#method:/a_b,env:prod"
+	want := []string{
+		"svc.goodput:0|c" + tags,
+		"svc.rejected:1|c" + tags,
+		"svc.p95_ms:0|g" + tags,
+		"svc.tokens:1|g" + tags,
+		"svc.rate:2|g" + tags,
+	}
+	if got := string(buf[:n]); got != strings.Join(want, "\n") {
+		t.Errorf("packet = %q, want %q", got, strings.Join(want, "\n"))
+	}
+	if got := rl.StatsDFailures(); got != 0 {
+		t.Errorf("failures = %d, want 0", got)
+	}
+}
+
+func TestStatsDPacketsFitMTU(t *testing.T) {
+	emitter := &statsdEmitter{prefix: "svc."}
+	snapshots := make(map[string]MetricsSnapshot)
+	for i := 0; i < 50; i++ {
+		snapshots[fmt.Sprintf("/service/method%02d", i)] = MetricsSnapshot{RefillRate: 1}
+	}
+	packets := emitter.packets(snapshots)
+	if len(packets) < 2 {
+		t.Fatalf("got %d packets, want the lines split across several", len(packets))
+	}
+	lines := 0
+	for _, packet := range packets {
+		if len(packet) > statsdMaxPacket {
+			t.Errorf("packet of %d bytes, want at most %d", len(packet), statsdMaxPacket)
+		}
+		lines += strings.Count(string(packet), "\n") + 1
+	}
+	if lines != 5*len(snapshots) {
+		t.Errorf("sent %d lines, want %d", lines, 5*len(snapshots))
+	}
+}
+
+func TestStatsDCountsFailures(t *testing.T) {
+	// Nothing listens on the port once the listener is closed, so the writes are refused
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.LocalAddr().String()
+	listener.Close()
+
+	clock := NewFakeClock(time.Unix(1000, 0))
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 1, RefillRate: 1}},
+		map[string]time.Duration{"/a": time.Second}, WithClock(clock), WithStatsD(addr, "svc"))
+	intervals, unsubscribe := rl.subscribeIntervals()
+	defer unsubscribe()
+	for i := 0; i < 10 && rl.StatsDFailures() == 0; i++ {
+		clock.Advance(time.Second)
+		<-intervals
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rl.StatsDFailures() == 0 {
+		t.Error("no failures counted for a refused port")
+	}
+}
+
+func TestStatsDRejectsInvalidAddress(t *testing.T) {
+	_, err := NewTopDownRLWithBuckets(map[string]BucketConfig{"/a": {MaxTokens: 1, RefillRate: 1}},
+		map[string]time.Duration{"/a": time.Second}, false, WithStatsD("no port", "svc"))
+	if err == nil {
+		t.Error("created a limiter with an invalid StatsD address")
+	}
+}
@@ -0,0 +1,183 @@
+package topdown
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+// StatsHandler plugs a TopDownRL into a server as a stats.Handler, measuring the latency of the
+// requests from the time gRPC began handling them to the time it wrote their status, rather
+// than from the start time metadata. It works in one of two modes:
+//
+//   - Measurement: the limiter's UnaryInterceptor and StreamInterceptor still decide on the
+//     requests, while the handler records the goodput, latency and violations of the unary
+//     requests they admitted; streams are measured by the interceptor as before.
+//   - Admission: the handler decides on requests and streams alike in TagRPC, like the
+//     interceptors for a cost of one token, or the method's BucketConfig.Cost, and records
+//     their outcomes. Its own UnaryInterceptor and StreamInterceptor, which must be installed
+//     instead of the limiter's, only fail the rejected requests. The cost function, message
+//     limiting, per-message stream latency and panic recovery don't apply in this mode.
+type StatsHandler struct {
+	rl        *TopDownRL
+	admission bool
+}
+
+// NewStatsHandler creates a stats handler for rl, deciding on the requests in TagRPC if admission
+// is set. Install it with grpc.StatsHandler.
+func NewStatsHandler(rl *TopDownRL, admission bool) *StatsHandler {
+	return &StatsHandler{rl: rl, admission: admission}
+}
+
+// statsKey is the context key of the *statsRPC of a request.
+type statsKey struct{}
+
+// statsRPC is the state of a request seen by a StatsHandler. It's only accessed from the
+// request's goroutine.
+type statsRPC struct {
+	method string
+	tier   int
+	begin  time.Time
+	// measured is set once the request was admitted, so its outcome is recorded at its end.
+	measured bool
+	// report is the report of a request the interceptor admitted, see MarkDegraded.
+	report *requestReport
+
+	// release, drained, rejection and trailer are set by the admission in TagRPC.
+	release   func()
+	drained   bool
+	rejection error
+	trailer   metadata.MD
+}
+
+// TagConn implements stats.Handler.
+func (h *StatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+// HandleConn implements stats.Handler.
+func (h *StatsHandler) HandleConn(context.Context, stats.ConnStats) {}
+
+// TagRPC implements stats.Handler, deciding on the request in admission mode.
+func (h *StatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	rpc := &statsRPC{}
+	ctx = context.WithValue(ctx, statsKey{}, rpc)
+	if !h.admission || h.rl.exempt(info.FullMethodName) {
+		return ctx
+	}
+	rl := h.rl
+	methodName := rl.methodName(ctx, info.FullMethodName)
+	if methodName == "" {
+		return ctx
+	}
+
+	rl.recordArrival(ctx, methodName)
+	if !rl.enterDrain() {
+		rl.rejectHook(ctx, methodName, RejectDraining)
+		rpc.rejection = status.Error(codes.Unavailable, "Server is draining, request denied")
+		return ctx
+	}
+	rpc.drained = true
+	tier := rl.priorityTier(ctx)
+	if !rl.breakerAllows(methodName) {
+		rl.rejectHook(ctx, methodName, RejectCircuitOpen)
+		rpc.rejection = status.Error(codes.Unavailable, "Circuit open, request denied")
+		return ctx
+	}
+	if rl.doomed(ctx, methodName) {
+		rl.rejectHook(ctx, methodName, RejectDeadline)
+		rpc.rejection = status.Error(codes.ResourceExhausted, "Deadline shorter than the expected latency, request denied")
+		return ctx
+	}
+	release, ok := rl.acquireSlot(ctx, methodName)
+	if !ok {
+		rl.recordConcurrencyRejection(methodName)
+		rl.rejectHook(ctx, methodName, RejectConcurrency)
+		rpc.rejection = status.Error(codes.ResourceExhausted, "Concurrency limit exceeded, request denied")
+		return ctx
+	}
+	rpc.release = release
+	cost := rl.requestCost(ctx, methodName, nil)
+	switch rl.admit(ctx, methodName, cost) {
+	case abandoned:
+		rpc.rejection = status.FromContextError(ctx.Err()).Err()
+		return ctx
+	case rejected:
+		rl.recordRejection(methodName, tier)
+		rl.recordTenantOutcome(ctx, methodName, 0, nil, true)
+		rl.rejectHook(ctx, methodName, RejectRateLimit)
+		rpc.rejection, rpc.trailer = rl.rejectionError(methodName, "Rate limit exceeded, request denied")
+		return ctx
+	}
+	rl.recordAdmission(methodName)
+	rl.admitHook(ctx, methodName)
+	rpc.method, rpc.tier, rpc.measured = methodName, tier, true
+	return rl.withAdmission(ctx, methodName, tier, cost)
+}
+
+// HandleRPC implements stats.Handler, recording the outcome of admitted requests at their end.
+func (h *StatsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	rpc, ok := ctx.Value(statsKey{}).(*statsRPC)
+	if !ok || s.IsClient() {
+		return
+	}
+	switch s := s.(type) {
+	case *stats.Begin:
+		rpc.begin = s.BeginTime
+	case *stats.End:
+		if rpc.measured {
+			if rpc.report != nil {
+				ctx = context.WithValue(ctx, reportKey{}, rpc.report)
+			}
+			latency := s.EndTime.Sub(rpc.begin)
+			outcome := h.rl.recordOutcome(ctx, latency, rpc.method, rpc.tier, s.Error)
+			h.rl.recordTenantOutcome(ctx, rpc.method, latency, s.Error, false)
+			h.rl.completionHook(ctx, rpc.method, latency, outcome)
+		}
+		if rpc.release != nil {
+			rpc.release()
+		}
+		if rpc.drained {
+			h.rl.exitDrain()
+		}
+	}
+}
+
+// UnaryInterceptor fails the unary requests rejected in TagRPC in admission mode.
+func (h *StatsHandler) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if rpc, ok := ctx.Value(statsKey{}).(*statsRPC); ok && rpc.rejection != nil {
+		if rpc.trailer != nil {
+			grpc.SetTrailer(ctx, rpc.trailer)
+		}
+		return nil, rpc.rejection
+	}
+	return handler(ctx, req)
+}
+
+// StreamInterceptor fails the streams rejected in TagRPC in admission mode.
+func (h *StatsHandler) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if rpc, ok := ss.Context().Value(statsKey{}).(*statsRPC); ok && rpc.rejection != nil {
+		if rpc.trailer != nil {
+			ss.SetTrailer(rpc.trailer)
+		}
+		return rpc.rejection
+	}
+	return handler(srv, ss)
+}
+
+// measuredByStats hands the outcome of a unary request the interceptor admitted and handled over
+// to a StatsHandler, if one is installed. It reports whether the handler records the outcome.
+func measuredByStats(ctx context.Context, methodName string, tier int) bool {
+	rpc, ok := ctx.Value(statsKey{}).(*statsRPC)
+	if !ok {
+		return false
+	}
+	rpc.method, rpc.tier, rpc.measured = methodName, tier, true
+	rpc.report = reportFrom(ctx)
+	return true
+}
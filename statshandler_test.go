@@ -0,0 +1,78 @@
+package topdown
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestStatsHandlerMatchesInterceptor(t *testing.T) {
+	modes := []struct {
+		name    string
+		options func(rl *TopDownRL) []grpc.ServerOption
+	}{
+		{"interceptor", func(rl *TopDownRL) []grpc.ServerOption {
+			return []grpc.ServerOption{grpc.UnaryInterceptor(rl.UnaryInterceptor)}
+		}},
+		{"measurement", func(rl *TopDownRL) []grpc.ServerOption {
+			return []grpc.ServerOption{grpc.StatsHandler(NewStatsHandler(rl, false)), grpc.UnaryInterceptor(rl.UnaryInterceptor)}
+		}},
+		{"admission", func(rl *TopDownRL) []grpc.ServerOption {
+			h := NewStatsHandler(rl, true)
+			return []grpc.ServerOption{grpc.StatsHandler(h), grpc.UnaryInterceptor(h.UnaryInterceptor)}
+		}},
+	}
+	snapshots := make(map[string]MetricsSnapshot)
+	for _, mode := range modes {
+		clock := NewFakeClock(time.Unix(1000, 0))
+		rl := newTestRL(t, map[string]BucketConfig{echoMethod: {MaxTokens: 3, RefillRate: 0.1}},
+			map[string]time.Duration{echoMethod: time.Second}, WithClock(clock), WithMetricsInterval(time.Hour))
+		// The second request fails, the others succeed
+		var calls atomic.Int64
+		handler := func(context.Context) error {
+			if calls.Add(1) == 2 {
+				return status.Error(codes.Internal, "failed")
+			}
+			return nil
+		}
+		conn := newTestServer(t, handler, mode.options(rl))
+		for i := 0; i < 5; i++ {
+			echo(context.Background(), conn, &structpb.Struct{})
+		}
+
+		// The stats handler may record the outcome after the client got the response
+		metrics := rl.loadMetrics(echoMethod)
+		waitUntil(t, func() bool {
+			metrics.mu.Lock()
+			defer metrics.mu.Unlock()
+			return metrics.GoodputCounter+metrics.ErrorCounter == 3
+		})
+		rl.rollover(metrics, clock.Now())
+		snapshot, err := rl.GetMetricsSnapshot(echoMethod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshots[mode.name] = snapshot
+	}
+
+	want := snapshots["interceptor"]
+	if want.Arrivals != 5 || want.Admitted != 3 || want.Goodput != 2 || want.Errors != 1 || want.Rejected != 2 {
+		t.Fatalf("interceptor arrivals = %d, admitted = %d, goodput = %d, errors = %d, rejected = %d, want 5, 3, 2, 1 and 2",
+			want.Arrivals, want.Admitted, want.Goodput, want.Errors, want.Rejected)
+	}
+	for _, mode := range modes[1:] {
+		got := snapshots[mode.name]
+		if got.Arrivals != want.Arrivals || got.Admitted != want.Admitted || got.Goodput != want.Goodput ||
+			got.Errors != want.Errors || got.Rejected != want.Rejected {
+			t.Errorf("%s arrivals = %d, admitted = %d, goodput = %d, errors = %d, rejected = %d, want %d, %d, %d, %d and %d like the interceptor",
+				mode.name, got.Arrivals, got.Admitted, got.Goodput, got.Errors, got.Rejected,
+				want.Arrivals, want.Admitted, want.Goodput, want.Errors, want.Rejected)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package topdown
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StateVersion is the version of the State format; states of other versions are ignored.
+const StateVersion = 1
+
+// State is the configuration of the registered methods saved to a Store, see WithStore.
+type State struct {
+	Version int                    `json:"version"`
+	Time    time.Time              `json:"time"`
+	Methods map[string]MethodState `json:"methods"`
+}
+
+// MethodState is the saved configuration of a single method.
+type MethodState struct {
+	// RefillRate is the rate the method was set or ramping to, or the rate it reverts to if it
+	// had a temporary override, see SetTemporaryRateLimit.
+	RefillRate float64 `json:"refill_rate"`
+	MaxTokens  int64   `json:"max_tokens"`
+	SloMs      float64 `json:"slo_ms"`
+}
+
+// Store saves the state of the limiter so that restarts keep the rates learned so far.
+type Store interface {
+	// Save replaces the saved state.
+	Save(state State) error
+	// Load returns the saved state, or an error wrapping fs.ErrNotExist if there is none.
+	Load() (State, error)
+}
+
+// WithStore restores the rates, bucket capacities and SLOs of the methods from store on creation,
+// and saves them to it at the end of the metrics interval at most every period; a period of zero
+// saves at every interval. Only the methods of the SLO map are restored, while the others in the
+// saved state are ignored. A state that can't be loaded is logged and the limiter starts from its
+// configuration.
+func WithStore(store Store, period time.Duration) Option {
+	return func(rl *TopDownRL) {
+		rl.store = store
+		rl.storePeriod = period
+	}
+}
+
+// FileStore is a Store keeping the state in a JSON file.
+type FileStore struct {
+	path string
+}
+
+// NewFileStore creates a FileStore keeping the state in the file at path.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Save writes the state to a temporary file and moves it over the file, so a crash while saving
+// never leaves a truncated state behind.
+func (s *FileStore) Save(state State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), s.path)
+}
+
+// Load reads the state from the file.
+func (s *FileStore) Load() (State, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return State{}, err
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return State{}, fmt.Errorf("corrupted state in '%s': %w", s.path, err)
+	}
+	return state, nil
+}
+
+// State returns the current state of the registered methods as saved by WithStore.
+func (rl *TopDownRL) State() State {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	state := State{Version: StateVersion, Time: rl.clock.Now(), Methods: make(map[string]MethodState, len(rl.interfaces))}
+	for methodName, metrics := range rl.interfaces {
+		metrics.mu.Lock()
+		rate := targetRateLocked(metrics)
+		if metrics.override != nil {
+			rate = metrics.override.baseline
+		}
+		if metrics.schedule.activeLocked() {
+			rate = metrics.schedule.baseline
+		}
+		state.Methods[methodName] = MethodState{RefillRate: rate, MaxTokens: metrics.MaxTokens, SloMs: durationMs(metrics.SLO)}
+		metrics.mu.Unlock()
+	}
+	return state
+}
+
+// SaveState saves the current state to the store set through WithStore, e.g. before shutting down.
+func (rl *TopDownRL) SaveState() error {
+	if rl.store == nil {
+		return errors.New("no store configured")
+	}
+	return rl.store.Save(rl.State())
+}
+
+// saveStateIfDue saves the state at the end of an interval if the store period has passed since
+// the last save. It runs on the metrics goroutine only.
+func (rl *TopDownRL) saveStateIfDue() {
+	if rl.store == nil {
+		return
+	}
+	now := rl.clock.Now()
+	if !rl.lastSave.IsZero() && now.Sub(rl.lastSave) < rl.storePeriod {
+		return
+	}
+	rl.lastSave = now
+	if err := rl.SaveState(); err != nil {
+		rl.logger.Errorf("Failed to save state: %v", err)
+	}
+}
+
+// restoreState applies the state saved in the store, if any, to the methods of the SLO map.
+func (rl *TopDownRL) restoreState() {
+	state, err := rl.store.Load()
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		rl.logger.Errorf("Failed to load state, starting from the configuration: %v", err)
+		return
+	}
+	if state.Version != StateVersion {
+		rl.logger.Errorf("Ignoring saved state of version %d, expected %d", state.Version, StateVersion)
+		return
+	}
+
+	source := changeSource{source: ChangeSourceStore}
+	restoreRates := rl.ControllerMode() != ControllerNone
+	for methodName, saved := range state.Methods {
+		metrics := rl.registeredMetrics(methodName)
+		if metrics == nil {
+			rl.logger.Infof("Ignoring saved state of method '%s', which isn't configured", methodName)
+			continue
+		}
+		if saved.MaxTokens != 0 {
+			if err := rl.setMaxTokens(methodName, saved.MaxTokens, source); err != nil {
+				rl.logger.Errorf("Failed to restore max tokens for method '%s': %v", methodName, err)
+			}
+		}
+		if restoreRates {
+			rl.setRateLimit(methodName, saved.RefillRate, rateOptions{immediate: true}, source)
+		}
+		metrics.mu.Lock()
+		unchanged := durationMs(metrics.SLO) == saved.SloMs
+		metrics.mu.Unlock()
+		if !unchanged {
+			slo := time.Duration(saved.SloMs * float64(time.Millisecond))
+			if err := rl.setSLO(methodName, slo, source); err != nil {
+				rl.logger.Errorf("Failed to restore SLO for method '%s': %v", methodName, err)
+			}
+		}
+	}
+	if rl.Debug {
+		rl.logger.Debugf("Restored state saved at %v", state.Time)
+	}
+}
@@ -0,0 +1,173 @@
+package topdown
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// StreamLatencyMode selects how latency is measured for streaming RPCs.
+type StreamLatencyMode int
+
+const (
+	// StreamLatencyPerStream measures latency from stream open to handler return.
+	StreamLatencyPerStream StreamLatencyMode = iota
+	// StreamLatencyPerMessage measures the processing time of each received message,
+	// from its arrival until the handler asks for the next message or returns.
+	StreamLatencyPerMessage
+)
+
+// WithStreamMessageLimiting makes the stream interceptor consume a token for every received
+// message in addition to the token consumed when the stream is established.
+func WithStreamMessageLimiting(enabled bool) Option {
+	return func(rl *TopDownRL) {
+		rl.streamMessageLimiting = enabled
+	}
+}
+
+// WithStreamLatencyMode sets how latency is measured for streaming RPCs.
+func WithStreamLatencyMode(mode StreamLatencyMode) Option {
+	return func(rl *TopDownRL) {
+		rl.streamLatencyMode = mode
+	}
+}
+
+// StreamInterceptor is the stream gRPC interceptor function that enforces rate limiting.
+func (rl *TopDownRL) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	if rl.exempt(info.FullMethod) {
+		return rl.serveExemptStream(srv, ss, info.FullMethod, handler)
+	}
+
+	// Extract the method name and start time
+	methodName := rl.methodName(ss.Context(), info.FullMethod)
+	if methodName == "" {
+		// The method can't be identified, so let the stream through without rate limiting
+		return handler(srv, ss)
+	}
+	rl.recordArrival(ss.Context(), methodName)
+	if !rl.enterDrain() {
+		rl.refundTap(ss.Context(), methodName)
+		rl.rejectHook(ss.Context(), methodName, RejectDraining)
+		return status.Error(codes.Unavailable, "Server is draining, stream denied")
+	}
+	defer rl.exitDrain()
+	startTime := rl.extractStartTime(ss.Context(), methodName)
+	tier := rl.priorityTier(ss.Context())
+
+	// Check if the stream is allowed before handling it; it holds a concurrency slot until it ends
+	if !rl.breakerAllows(methodName) {
+		rl.refundTap(ss.Context(), methodName)
+		rl.rejectHook(ss.Context(), methodName, RejectCircuitOpen)
+		return status.Error(codes.Unavailable, "Circuit open, stream denied")
+	}
+	release, ok := rl.acquireSlot(ss.Context(), methodName)
+	if !ok {
+		rl.refundTap(ss.Context(), methodName)
+		rl.recordConcurrencyRejection(methodName)
+		rl.rejectHook(ss.Context(), methodName, RejectConcurrency)
+		return status.Error(codes.ResourceExhausted, "Concurrency limit exceeded, stream denied")
+	}
+	defer release()
+	cost := rl.requestCost(ss.Context(), methodName, nil)
+	switch rl.admitUnlessTapped(ss.Context(), methodName, cost) {
+	case abandoned:
+		return status.FromContextError(ss.Context().Err()).Err()
+	case rejected:
+		rl.recordRejection(methodName, tier)
+		rl.recordTenantOutcome(ss.Context(), methodName, 0, nil, true)
+		rl.rejectHook(ss.Context(), methodName, RejectRateLimit)
+		err, trailer := rl.rejectionError(methodName, "Rate limit exceeded, stream denied")
+		if trailer != nil {
+			ss.SetTrailer(trailer)
+		}
+		return err
+	}
+	rl.recordAdmission(methodName)
+	rl.admitHook(ss.Context(), methodName)
+
+	stream := &rateLimitedStream{ServerStream: ss, ctx: rl.withAdmission(ss.Context(), methodName, tier, cost), rl: rl, methodName: methodName, tier: tier}
+	if rl.panicRecovery {
+		defer rl.recoverPanic(methodName, startTime, &err)
+	}
+	err = handler(srv, stream)
+	if hints := rl.rateHeaders(methodName); err == nil && hints != nil {
+		ss.SetTrailer(hints)
+	}
+
+	// In per-message mode the messages count towards goodput and the SLO, and the final status
+	// only counts errors and cancellations
+	perMessage := rl.streamLatencyMode == StreamLatencyPerMessage
+	if perMessage {
+		stream.finishMessage()
+	}
+
+	// A stream cut short by message throttling is not counted towards goodput
+	if !stream.throttled {
+		latency := rl.clock.Now().Sub(startTime)
+		outcome := rl.recordStatus(stream.Context(), latency, methodName, tier, err, !perMessage)
+		tenantLatency := latency
+		if perMessage {
+			tenantLatency = 0
+		}
+		rl.recordTenantOutcome(ss.Context(), methodName, tenantLatency, err, false)
+		rl.completionHook(ss.Context(), methodName, latency, outcome)
+	}
+	return err
+}
+
+// rateLimitedStream wraps a grpc.ServerStream to throttle and time received messages.
+type rateLimitedStream struct {
+	grpc.ServerStream
+	ctx        context.Context
+	rl         *TopDownRL
+	methodName string
+	tier       int
+
+	throttled    bool
+	messageStart time.Time
+	pending      bool
+}
+
+// Context returns the context of the stream with the admission, see AdmissionFromContext.
+func (s *rateLimitedStream) Context() context.Context {
+	return s.ctx
+}
+
+// RecvMsg receives the next message, consuming a token for it if message limiting is enabled.
+func (s *rateLimitedStream) RecvMsg(m interface{}) error {
+	// The previous message has been processed once the handler asks for the next one
+	s.finishMessage()
+
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	if s.rl.streamMessageLimiting && !s.rl.AllowN(s.Context(), s.methodName, s.rl.requestCost(s.Context(), s.methodName, m)) {
+		s.throttled = true
+		s.rl.recordRejection(s.methodName, s.tier)
+		s.rl.rejectHook(s.Context(), s.methodName, RejectRateLimit)
+		err, trailer := s.rl.rejectionError(s.methodName, "Rate limit exceeded, message denied")
+		if trailer != nil {
+			s.SetTrailer(trailer)
+		}
+		return err
+	}
+
+	if s.rl.streamLatencyMode == StreamLatencyPerMessage {
+		s.messageStart = s.rl.clock.Now()
+		s.pending = true
+	}
+	return nil
+}
+
+// finishMessage records the latency of the message currently being processed, if any.
+func (s *rateLimitedStream) finishMessage() {
+	if !s.pending {
+		return
+	}
+	s.pending = false
+	s.rl.postProcess(s.rl.clock.Now().Sub(s.messageStart), s.methodName, s.tier, s.rl.retryAttempt(s.Context()), settlement{})
+}
@@ -0,0 +1,152 @@
+package topdown
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// fakeServerStream is a grpc.ServerStream receiving a number of messages, each after the clock
+// advanced by the processing time of the previous one.
+type fakeServerStream struct {
+	grpc.ServerStream
+	clock    *FakeClock
+	messages int
+	process  time.Duration
+	received int
+}
+
+func (s *fakeServerStream) Context() context.Context     { return context.Background() }
+func (s *fakeServerStream) SetTrailer(metadata.MD)       {}
+func (s *fakeServerStream) SetHeader(metadata.MD) error  { return nil }
+func (s *fakeServerStream) SendHeader(metadata.MD) error { return nil }
+func (s *fakeServerStream) SendMsg(interface{}) error    { return nil }
+
+func (s *fakeServerStream) RecvMsg(interface{}) error {
+	if s.received > 0 {
+		s.clock.Advance(s.process)
+	}
+	if s.received == s.messages {
+		return io.EOF
+	}
+	s.received++
+	return nil
+}
+
+// drainStream is a stream handler receiving every message, then returning err.
+func drainStream(err error) grpc.StreamHandler {
+	return func(srv interface{}, ss grpc.ServerStream) error {
+		for {
+			if recvErr := ss.RecvMsg(nil); recvErr == io.EOF {
+				return err
+			} else if recvErr != nil {
+				return recvErr
+			}
+		}
+	}
+}
+
+func TestStreamAdmission(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 1, RefillRate: 1e-9}},
+		map[string]time.Duration{"/a": time.Second}, WithClock(clock), WithMetricsInterval(time.Hour))
+	info := &grpc.StreamServerInfo{FullMethod: "/a"}
+
+	if err := rl.StreamInterceptor(nil, &fakeServerStream{clock: clock, messages: 2, process: time.Millisecond}, info, drainStream(nil)); err != nil {
+		t.Fatalf("first stream = %v, want it admitted", err)
+	}
+	called := false
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		called = true
+		return nil
+	}
+	if err := rl.StreamInterceptor(nil, &fakeServerStream{clock: clock}, info, handler); status.Code(err) != codes.ResourceExhausted || called {
+		t.Errorf("second stream = %v with the handler called %v, want %v before the handler", err, called, codes.ResourceExhausted)
+	}
+
+	rl.rollover(rl.loadMetrics("/a"), clock.Now())
+	snapshot, err := rl.GetMetricsSnapshot("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Admitted != 1 || snapshot.Rejected != 1 || snapshot.Goodput != 1 {
+		t.Errorf("admitted = %d, rejected = %d, goodput = %d, want 1, 1 and 1", snapshot.Admitted, snapshot.Rejected, snapshot.Goodput)
+	}
+}
+
+func TestStreamMessageLimiting(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 3, RefillRate: 1e-9}},
+		map[string]time.Duration{"/a": time.Second}, WithClock(clock), WithMetricsInterval(time.Hour), WithStreamMessageLimiting(true))
+	info := &grpc.StreamServerInfo{FullMethod: "/a"}
+
+	// The stream takes the first token and its first two messages the others
+	stream := &fakeServerStream{clock: clock, messages: 5, process: time.Millisecond}
+	if err := rl.StreamInterceptor(nil, stream, info, drainStream(nil)); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("stream = %v, want %v once the messages used up the tokens", err, codes.ResourceExhausted)
+	}
+	if stream.received != 3 {
+		t.Errorf("received %d messages, want the stream cut short at the third", stream.received)
+	}
+
+	rl.rollover(rl.loadMetrics("/a"), clock.Now())
+	snapshot, err := rl.GetMetricsSnapshot("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Admitted != 1 || snapshot.Rejected != 1 || snapshot.Goodput != 0 || snapshot.Errors != 0 {
+		t.Errorf("admitted = %d, rejected = %d, goodput = %d, errors = %d, want 1, 1, 0 and 0 for a throttled stream",
+			snapshot.Admitted, snapshot.Rejected, snapshot.Goodput, snapshot.Errors)
+	}
+}
+
+func TestStreamOutcomeCountedOnce(t *testing.T) {
+	tests := []struct {
+		name            string
+		mode            StreamLatencyMode
+		err             error
+		goodput, errors int64
+		samples         uint64
+		outcome         Outcome
+	}{
+		{"per stream", StreamLatencyPerStream, nil, 1, 0, 1, OutcomeGood},
+		{"per stream with an error", StreamLatencyPerStream, status.Error(codes.Internal, "failed"), 0, 1, 0, OutcomeError},
+		{"per message", StreamLatencyPerMessage, nil, 3, 0, 3, OutcomeGood},
+		{"per message with an error", StreamLatencyPerMessage, status.Error(codes.Internal, "failed"), 3, 1, 3, OutcomeError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := NewFakeClock(time.Unix(1000, 0))
+			events := &eventLog{}
+			rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 10, RefillRate: 1}},
+				map[string]time.Duration{"/a": time.Second}, WithClock(clock), WithMetricsInterval(time.Hour),
+				WithStreamLatencyMode(tt.mode), WithRequestObserver(loggingObserver{events}))
+			info := &grpc.StreamServerInfo{FullMethod: "/a"}
+
+			stream := &fakeServerStream{clock: clock, messages: 3, process: 10 * time.Millisecond}
+			if err := rl.StreamInterceptor(nil, stream, info, drainStream(tt.err)); err != tt.err {
+				t.Fatalf("stream = %v, want %v", err, tt.err)
+			}
+
+			rl.rollover(rl.loadMetrics("/a"), clock.Now())
+			snapshot, err := rl.GetMetricsSnapshot("/a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if snapshot.Goodput != tt.goodput || snapshot.Errors != tt.errors || snapshot.SampleCount != tt.samples {
+				t.Errorf("goodput = %d, errors = %d, samples = %d, want %d, %d and %d",
+					snapshot.Goodput, snapshot.Errors, snapshot.SampleCount, tt.goodput, tt.errors, tt.samples)
+			}
+			want := []string{"observer admitted", "observer " + string(tt.outcome)}
+			if got := events.get(); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+				t.Errorf("observer calls = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package topdown
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/tap"
+)
+
+// tapKey is the context key of the tapGrant of a request TapHandle admitted.
+type tapKey struct{}
+
+// tapGrant records the tokens TapHandle took for a request of a method: whether it took any, how
+// many, and where those of the method came from.
+type tapGrant struct {
+	methodName string
+	charged    bool
+	n          int64
+	grant      tokenGrant
+}
+
+// TapHandle is a tap.ServerInHandle checking the rate limit of a request before its stream is
+// created and its message decoded, which makes rejections under overload much cheaper than in
+// the interceptors. Install it with grpc.InTapHandle(rl.TapHandle) along with the interceptors:
+// rejected requests fail with ResourceExhausted, but without a retry hint, since gRPC only sends
+// the code and message of early rejections, while the interceptors don't check the limit a
+// second time for the requests it admitted. Since it runs on the connection's I/O goroutine, it
+// leaves requests to the interceptors whenever a check could block or needs the request message:
+// methods with an admission queue or a circuit breaker that isn't closed, unregistered methods, a
+// cost function set with WithCostFunc, and draining.
+// Admitted requests take their tokens before the deadline and concurrency checks of the
+// interceptors, which refund them if they reject the request.
+func (rl *TopDownRL) TapHandle(ctx context.Context, info *tap.Info) (context.Context, error) {
+	if rl.costFunc != nil || rl.exempt(info.FullMethodName) || rl.Draining() {
+		return ctx, nil
+	}
+	// The incoming metadata is already in ctx
+	methodName := rl.methodName(ctx, info.FullMethodName)
+	if methodName == "" {
+		return ctx, nil
+	}
+	metrics := rl.registeredMetrics(methodName)
+	if metrics == nil || metrics.queue != nil || !breakerClosed(metrics) {
+		return ctx, nil
+	}
+
+	n := rl.requestCost(ctx, methodName, nil)
+	if allowed, charged, grant := rl.allowN(ctx, methodName, n); allowed {
+		return context.WithValue(ctx, tapKey{}, &tapGrant{methodName: methodName, charged: charged, n: n, grant: grant}), nil
+	}
+	rl.recordArrival(ctx, methodName)
+	rl.recordRejection(methodName, rl.priorityTier(ctx))
+	rl.recordTenantOutcome(ctx, methodName, 0, nil, true)
+	rl.rejectHook(ctx, methodName, RejectRateLimit)
+	return ctx, status.Error(codes.ResourceExhausted, "Rate limit exceeded, request denied")
+}
+
+// admitUnlessTapped admits a request whose tokens TapHandle already took, or decides on it like
+// admit otherwise.
+func (rl *TopDownRL) admitUnlessTapped(ctx context.Context, methodName string, cost int64) admission {
+	if tapped, ok := ctx.Value(tapKey{}).(*tapGrant); ok && tapped.methodName == methodName {
+		return admitted
+	}
+	return rl.admit(ctx, methodName, cost)
+}
+
+// refundTap gives the tokens TapHandle took for a request back to the limits it passed, for the
+// interceptors rejecting it before admitUnlessTapped, e.g. because of its deadline or the
+// concurrency limit.
+func (rl *TopDownRL) refundTap(ctx context.Context, methodName string) {
+	tapped, ok := ctx.Value(tapKey{}).(*tapGrant)
+	if !ok || tapped.methodName != methodName || !tapped.charged {
+		return
+	}
+	metrics := rl.registeredMetrics(methodName)
+	if metrics == nil {
+		return
+	}
+	rl.refundTokens(ctx, metrics, tapped.n, tapped.grant)
+	rl.global.bucket.refund(tapped.n)
+	metrics.tokensConsumed.Add(-tapped.n)
+}
@@ -0,0 +1,87 @@
+package topdown
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/tap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestInterceptorRejectionsRefundTappedTokens(t *testing.T) {
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 5, RefillRate: 1e-9, MaxConcurrent: 1}},
+		map[string]time.Duration{"/a": time.Second}, WithDeadlineCheck(1), WithGlobalLimit(5, 1e-9))
+	metrics := rl.loadMetrics("/a")
+	metrics.mu.Lock()
+	metrics.LastTailLatency95th = 100 * time.Millisecond
+	metrics.mu.Unlock()
+	info := &grpc.UnaryServerInfo{FullMethod: "/a"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+
+	// A deadline shorter than the tail latency, and a request while the only slot is taken
+	doomed := func() (context.Context, func()) {
+		return context.WithTimeout(context.Background(), 10*time.Millisecond)
+	}
+	busy := func() (context.Context, func()) {
+		release, _ := rl.acquireSlot(context.Background(), "/a")
+		return context.Background(), release
+	}
+	for _, rejection := range []func() (context.Context, func()){doomed, busy} {
+		ctx, done := rejection()
+		tapped, err := rl.TapHandle(ctx, &tap.Info{FullMethodName: "/a"})
+		if err != nil {
+			t.Fatalf("TapHandle() = %v, want the request admitted", err)
+		}
+		if _, err := rl.UnaryInterceptor(tapped, nil, info, handler); status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("UnaryInterceptor() = %v, want %v", err, codes.ResourceExhausted)
+		}
+		done()
+		if got := metrics.limiter.Snapshot().Available; got != 5 {
+			t.Errorf("method tokens = %v, want 5 after the refund", got)
+		}
+		if got := rl.GlobalLimit().Tokens; got != 5 {
+			t.Errorf("global tokens = %v, want 5 after the refund", got)
+		}
+		if got := metrics.tokensConsumed.Load(); got != 0 {
+			t.Errorf("tokens consumed = %d, want 0 for rejected requests", got)
+		}
+	}
+}
+
+// BenchmarkRejection compares the cost of rejecting requests of an exhausted method in the
+// interceptor with rejecting them in TapHandle, before their message is decoded.
+func BenchmarkRejection(b *testing.B) {
+	payload, err := structpb.NewStruct(map[string]interface{}{"payload": strings.Repeat("x", 16<<10)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, tapped := range []bool{false, true} {
+		name := "interceptor"
+		if tapped {
+			name = "tap"
+		}
+		b.Run(name, func(b *testing.B) {
+			rl := newTestRL(b, map[string]BucketConfig{echoMethod: {MaxTokens: 1, RefillRate: 1e-9}}, map[string]time.Duration{echoMethod: time.Second})
+			opts := []grpc.ServerOption{grpc.UnaryInterceptor(rl.UnaryInterceptor)}
+			if tapped {
+				opts = append(opts, grpc.InTapHandle(rl.TapHandle))
+			}
+			conn := newTestServer(b, nil, opts)
+			ctx := context.Background()
+			echo(ctx, conn, payload)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := echo(ctx, conn, payload); status.Code(err) != codes.ResourceExhausted {
+					b.Fatalf("Echo() = %v, want %v", err, codes.ResourceExhausted)
+				}
+			}
+		})
+	}
+}
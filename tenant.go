@@ -0,0 +1,419 @@
+package topdown
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Defaults of per-tenant limiting, see TenantConfig.
+const (
+	DefaultTenantHeader = "x-tenant-id"
+	DefaultMaxTenants   = 10000
+	DefaultTopTenants   = 10
+)
+
+// TenantKeyFunc returns the tenant of a request, or an empty string if it has none.
+type TenantKeyFunc func(ctx context.Context) string
+
+// TenantConfig holds the parameters of per-tenant limiting. Every tenant of a method gets a token
+// bucket of its own, checked before the method's limit, so one tenant can't use up the budget of
+// the others.
+type TenantConfig struct {
+	// Key extracts the tenant of a request. If nil, the tenant is read from the Header metadata
+	// key (DefaultTenantHeader if empty), falling back to the host of the peer address.
+	Key    TenantKeyFunc
+	Header string
+	// MaxTokens and RefillRate are the parameters of the bucket of each tenant.
+	MaxTokens  int64
+	RefillRate float64
+	// FairShare replaces the fixed RefillRate with a max-min fair share of the method's rate,
+	// recomputed every interval from the demand of the tenants in the last one: tenants wanting
+	// less than an equal share get what they want, and the rest is split equally among the others.
+	FairShare bool
+	// MaxTenants bounds the tenants tracked per method, DefaultMaxTenants if zero; the least
+	// recently seen tenant is evicted to make room for a new one. Tenants not seen for TTL, or
+	// without requests for IdleIntervals intervals, are evicted as well unless they are zero.
+	MaxTenants    int
+	TTL           time.Duration
+	IdleIntervals int
+}
+
+// WithTenantLimit enables per-tenant limiting for all methods.
+func WithTenantLimit(config TenantConfig) Option {
+	return func(rl *TopDownRL) {
+		rl.tenantConfig = &config
+	}
+}
+
+// validate checks that the tenant buckets can admit requests.
+func (c *TenantConfig) validate() error {
+	if c.MaxTokens <= 0 || !(c.RefillRate > 0 || c.FairShare) {
+		return fmt.Errorf("tenant max tokens and refill rate must be positive, got %d and %g", c.MaxTokens, c.RefillRate)
+	}
+	if c.MaxTenants < 0 || c.TTL < 0 || c.IdleIntervals < 0 {
+		return fmt.Errorf("max tenants, tenant TTL and idle intervals must not be negative, got %d, %v and %d",
+			c.MaxTenants, c.TTL, c.IdleIntervals)
+	}
+	return nil
+}
+
+// TenantMetrics holds the metrics of a single tenant of a method for the last interval. Share is
+// the refill rate of the tenant's bucket and Usage the rate of the tokens it took, both in tokens
+// per second.
+type TenantMetrics struct {
+	Tenant   string  `json:"tenant"`
+	Requests int64   `json:"requests"`
+	Goodput  int64   `json:"goodput"`
+	Rejected int64   `json:"rejected"`
+	Share    float64 `json:"share"`
+	Usage    float64 `json:"usage"`
+}
+
+// tenantLimiter holds the buckets of the tenants of a method in least recently used order.
+// budget is the rate of the method split among the tenants in FairShare mode, as of the last
+// interval, which ended at lastRollover.
+type tenantLimiter struct {
+	config TenantConfig
+
+	mu           sync.Mutex
+	entries      map[string]*list.Element
+	lru          *list.List // of *tenantEntry, most recently seen first
+	budget       float64
+	lastRollover time.Time
+}
+
+// tenantEntry is the bucket and the counters of a single tenant. demand and used count the tokens
+// the tenant asked for and took during the current interval, and idle the intervals in a row
+// without requests.
+type tenantEntry struct {
+	bucket   *tokenBucket
+	lastSeen time.Time
+	counters TenantMetrics
+	current  TenantMetrics
+	demand   int64
+	used     int64
+	idle     int
+}
+
+// newTenantLimiter creates the tenant buckets of a method with a rate of budget at now, or returns
+// nil if per-tenant limiting is disabled.
+func newTenantLimiter(config *TenantConfig, budget float64, now time.Time) *tenantLimiter {
+	if config == nil {
+		return nil
+	}
+	c := *config
+	if c.Header == "" {
+		c.Header = DefaultTenantHeader
+	}
+	if c.MaxTenants == 0 {
+		c.MaxTenants = DefaultMaxTenants
+	}
+	return &tenantLimiter{
+		config:       c,
+		entries:      make(map[string]*list.Element),
+		lru:          list.New(),
+		budget:       budget,
+		lastRollover: now,
+	}
+}
+
+// key returns the tenant of a request.
+func (t *tenantLimiter) key(ctx context.Context) string {
+	if t.config.Key != nil {
+		return t.config.Key(ctx)
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, tenant := range md.Get(t.config.Header) {
+			if tenant != "" {
+				return tenant
+			}
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		// The port changes with every connection, so only the host identifies the client
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// entryLocked returns the entry of a tenant seen at now, creating it with a full bucket and
+// evicting the least recently seen tenant if the limiter is full. The caller must hold t.mu.
+func (t *tenantLimiter) entryLocked(tenant string, now time.Time) *tenantEntry {
+	if elem, exists := t.entries[tenant]; exists {
+		t.lru.MoveToFront(elem)
+		entry := elem.Value.(*tenantEntry)
+		entry.lastSeen = now
+		return entry
+	}
+
+	if t.lru.Len() >= t.config.MaxTenants {
+		t.removeLocked(t.lru.Back())
+	}
+	// New tenants start with an equal share until their demand is known
+	rate := t.config.RefillRate
+	if t.config.FairShare {
+		rate = t.budget / float64(t.lru.Len()+1)
+	}
+	entry := &tenantEntry{
+		bucket:   newTokenBucket(t.config.MaxTokens, rate, now),
+		lastSeen: now,
+		counters: TenantMetrics{Tenant: tenant},
+	}
+	t.entries[tenant] = t.lru.PushFront(entry)
+	return entry
+}
+
+// allow takes n tokens from the bucket of a tenant at now.
+func (t *tenantLimiter) allow(tenant string, now time.Time, n int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry := t.entryLocked(tenant, now)
+	entry.counters.Requests++
+	entry.demand += n
+	if !entry.bucket.takeShare(now, n, 1) {
+		return false
+	}
+	entry.used += n
+	return true
+}
+
+// refund puts back n tokens a tenant took, unless the tenant was evicted since.
+func (t *tenantLimiter) refund(tenant string, n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	elem, exists := t.entries[tenant]
+	if !exists {
+		return
+	}
+	entry := elem.Value.(*tenantEntry)
+	entry.bucket.refund(n)
+	entry.used -= n
+}
+
+// removeLocked evicts the tenant of elem. The caller must hold t.mu.
+func (t *tenantLimiter) removeLocked(elem *list.Element) {
+	t.lru.Remove(elem)
+	delete(t.entries, elem.Value.(*tenantEntry).counters.Tenant)
+}
+
+// record counts the outcome of a request of a tenant, unless the tenant was evicted since.
+func (t *tenantLimiter) record(tenant string, goodput, rejected bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	elem, exists := t.entries[tenant]
+	if !exists {
+		return
+	}
+	entry := elem.Value.(*tenantEntry)
+	if goodput {
+		entry.counters.Goodput++
+	}
+	if rejected {
+		entry.counters.Rejected++
+	}
+}
+
+// rollover saves the counters of the interval ending at now, evicts the idle tenants and, in
+// FairShare mode, splits budget among the remaining ones.
+func (t *tenantLimiter) rollover(now time.Time, budget float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	elapsed := now.Sub(t.lastRollover).Seconds()
+	t.lastRollover = now
+	t.budget = budget
+
+	demands := make(map[*tenantEntry]float64, t.lru.Len())
+	for elem := t.lru.Front(); elem != nil; {
+		next := elem.Next()
+		entry := elem.Value.(*tenantEntry)
+		if entry.counters.Requests == 0 {
+			entry.idle++
+		} else {
+			entry.idle = 0
+		}
+
+		if t.config.TTL > 0 && now.Sub(entry.lastSeen) > t.config.TTL ||
+			t.config.IdleIntervals > 0 && entry.idle >= t.config.IdleIntervals {
+			t.removeLocked(elem)
+		} else {
+			entry.current = entry.counters
+			entry.current.Share = entry.bucket.params.Load().rate
+			if elapsed > 0 {
+				entry.current.Usage = float64(entry.used) / elapsed
+				demands[entry] = float64(entry.demand) / elapsed
+			}
+			entry.counters = TenantMetrics{Tenant: entry.counters.Tenant}
+			entry.demand, entry.used = 0, 0
+		}
+		elem = next
+	}
+
+	if t.config.FairShare {
+		for entry, share := range maxMinShares(demands, budget) {
+			entry.bucket.setRate(share, now)
+		}
+	}
+}
+
+// maxMinShares splits budget among the tenants by max-min fairness: in order of increasing
+// demand, every tenant gets the smaller of its demand and an equal share of what's left.
+func maxMinShares(demands map[*tenantEntry]float64, budget float64) map[*tenantEntry]float64 {
+	entries := make([]*tenantEntry, 0, len(demands))
+	for entry := range demands {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return demands[entries[i]] < demands[entries[j]] })
+
+	shares := make(map[*tenantEntry]float64, len(entries))
+	remaining := budget
+	for i, entry := range entries {
+		share := remaining / float64(len(entries)-i)
+		if demands[entry] < share {
+			share = demands[entry]
+		}
+		shares[entry] = share
+		remaining -= share
+	}
+	return shares
+}
+
+// top returns the metrics of the last interval of the n tenants with the most requests.
+func (t *tenantLimiter) top(n int) []TenantMetrics {
+	t.mu.Lock()
+	tenants := make([]TenantMetrics, 0, t.lru.Len())
+	for elem := t.lru.Front(); elem != nil; elem = elem.Next() {
+		if current := elem.Value.(*tenantEntry).current; current.Requests > 0 {
+			tenants = append(tenants, current)
+		}
+	}
+	t.mu.Unlock()
+
+	sort.Slice(tenants, func(i, j int) bool {
+		if tenants[i].Requests != tenants[j].Requests {
+			return tenants[i].Requests > tenants[j].Requests
+		}
+		return tenants[i].Tenant < tenants[j].Tenant
+	})
+	if len(tenants) > n {
+		tenants = tenants[:n]
+	}
+	return tenants
+}
+
+// allowTenant takes n tokens from the bucket of the request's tenant, if per-tenant limiting is
+// enabled and the request has a tenant.
+func (rl *TopDownRL) allowTenant(ctx context.Context, metrics *InterfaceMetrics, n int64) bool {
+	if metrics.tenants == nil {
+		return true
+	}
+	tenant := metrics.tenants.key(ctx)
+	if tenant == "" || metrics.tenants.allow(tenant, rl.clock.Now(), n) {
+		return true
+	}
+	metrics.tenantRejected.Add(1)
+	return false
+}
+
+// refundTenant gives n tokens taken by allowTenant back to the bucket of the request's tenant.
+func (rl *TopDownRL) refundTenant(ctx context.Context, metrics *InterfaceMetrics, n int64) {
+	if metrics.tenants == nil {
+		return
+	}
+	if tenant := metrics.tenants.key(ctx); tenant != "" {
+		metrics.tenants.refund(tenant, n)
+	}
+}
+
+// recordTenantOutcome counts a rejected or completed request towards the metrics of its tenant.
+func (rl *TopDownRL) recordTenantOutcome(ctx context.Context, methodName string, latency time.Duration, err error, rejected bool) {
+	metrics := rl.registeredMetrics(methodName)
+	if metrics == nil || metrics.tenants == nil {
+		return
+	}
+	tenant := metrics.tenants.key(ctx)
+	if tenant == "" {
+		return
+	}
+
+	metrics.mu.Lock()
+	slo := metrics.SLO
+	metrics.mu.Unlock()
+	goodput := !rejected && rl.goodCodes[status.Code(err)] && latency <= slo
+	metrics.tenants.record(tenant, goodput, rejected)
+}
+
+// TopTenants returns the metrics of the last interval of the n tenants of a method with the most requests.
+func (rl *TopDownRL) TopTenants(method string, n int) ([]TenantMetrics, error) {
+	metrics := rl.registeredMetrics(method)
+	if metrics == nil {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownMethod, method)
+	}
+	if metrics.tenants == nil {
+		return []TenantMetrics{}, nil
+	}
+	return metrics.tenants.top(n), nil
+}
+
+// HandleTenantMetrics handles the GET requests for the metrics of the busiest tenants of the
+// method given by the 'method' parameter. The optional 'top' parameter sets how many tenants are
+// returned, DefaultTopTenants by default.
+func (rl *TopDownRL) HandleTenantMetrics(w http.ResponseWriter, r *http.Request) {
+	if rl.Debug {
+		rl.logger.Debugf("HandleTenantMetrics called")
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	method := r.URL.Query().Get("method")
+	if method == "" {
+		writeError(w, "Missing 'method' parameter", http.StatusBadRequest)
+		return
+	}
+	top := DefaultTopTenants
+	if value := r.URL.Query().Get("top"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			writeError(w, "Invalid 'top' parameter", http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+
+	tenants, err := rl.TopTenants(method, top)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrUnknownMethod) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Method  string          `json:"method"`
+		Tenants []TenantMetrics `json:"tenants"`
+	}{Method: method, Tenants: tenants})
+}
@@ -0,0 +1,116 @@
+package topdown
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+// tenantKey is the context key of the synthetic tenants of the tests.
+type tenantKey struct{}
+
+func TestTenantFairShare(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	key := func(ctx context.Context) string { return ctx.Value(tenantKey{}).(string) }
+	// The ticker never fires, so the test rolls the intervals over itself
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 1000, RefillRate: 90}}, map[string]time.Duration{"/a": time.Second},
+		WithClock(clock), WithMetricsInterval(time.Hour), WithTenantLimit(TenantConfig{Key: key, MaxTokens: 5, FairShare: true}))
+	metrics := rl.loadMetrics("/a")
+	demands := map[string]int{"small": 10, "medium": 50, "large": 200}
+
+	// Every interval, each tenant sends its demand evenly over a second in steps of 10ms
+	interval := func() {
+		for step := 0; step < 100; step++ {
+			clock.Advance(10 * time.Millisecond)
+			for tenant, demand := range demands {
+				ctx := context.WithValue(context.Background(), tenantKey{}, tenant)
+				for i := demand * step / 100; i < demand*(step+1)/100; i++ {
+					rl.AllowN(ctx, "/a", 1)
+				}
+			}
+		}
+		rl.rollover(metrics, clock.Now())
+	}
+	// The first interval measures the demands, and the second one runs at the fair shares
+	interval()
+	interval()
+
+	tenants, err := rl.TopTenants("/a", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"small": 10, "medium": 40, "large": 40}
+	for _, tenant := range tenants {
+		if tenant.Share != want[tenant.Tenant] {
+			t.Errorf("tenant %s: share = %v, want %v", tenant.Tenant, tenant.Share, want[tenant.Tenant])
+		}
+		// A tenant may take up to its burst on top of its share
+		if math.Abs(tenant.Usage-want[tenant.Tenant]) > 5 {
+			t.Errorf("tenant %s: usage = %v, want %v", tenant.Tenant, tenant.Usage, want[tenant.Tenant])
+		}
+	}
+	if len(tenants) != 3 {
+		t.Errorf("got %d tenants, want 3", len(tenants))
+	}
+}
+
+func TestTenantIdleEviction(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tenants := newTenantLimiter(&TenantConfig{MaxTokens: 5, FairShare: true, IdleIntervals: 2}, 90, now)
+	tenants.allow("idle", now, 1)
+	tenants.allow("busy", now, 1)
+	now = now.Add(time.Second)
+	tenants.rollover(now, 90)
+
+	for i := 1; i <= 2; i++ {
+		now = now.Add(time.Second)
+		if _, exists := tenants.entries["idle"]; !exists {
+			t.Fatalf("tenant evicted after %d intervals, want 2 idle intervals", i-1)
+		}
+		tenants.allow("busy", now, 1)
+		tenants.rollover(now, 90)
+	}
+	if _, exists := tenants.entries["idle"]; exists {
+		t.Error("tenant kept after 2 idle intervals")
+	}
+	if _, exists := tenants.entries["busy"]; !exists {
+		t.Error("busy tenant evicted")
+	}
+}
+
+func TestTenantRefundedOnMethodRejections(t *testing.T) {
+	tenant := func(context.Context) string { return "t1" }
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 1, RefillRate: 1e-9}, "/q": {MaxTokens: 1, RefillRate: 1e-9, MaxQueueWait: 5 * time.Millisecond}},
+		map[string]time.Duration{"/a": time.Second, "/q": time.Second},
+		WithTenantLimit(TenantConfig{Key: tenant, MaxTokens: 5, RefillRate: 1e-9}))
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		method string
+		allow  func() bool
+	}{
+		{"method limiter", "/a", func() bool { return rl.AllowN(ctx, "/a", 1) }},
+		{"queue expiry", "/q", func() bool { return rl.admit(ctx, "/q", 1) == admitted }},
+	}
+	for _, tt := range tests {
+		if !tt.allow() {
+			t.Fatalf("%s: first request rejected, want it to take the method's only token", tt.name)
+		}
+		for i := 0; i < 3; i++ {
+			if tt.allow() {
+				t.Fatalf("%s: request admitted, want the method's limit to reject it", tt.name)
+			}
+		}
+
+		metrics := rl.loadMetrics(tt.method)
+		metrics.tenants.mu.Lock()
+		entry := metrics.tenants.entries["t1"].Value.(*tenantEntry)
+		available, used := entry.bucket.available(rl.clock.Now()), entry.used
+		metrics.tenants.mu.Unlock()
+		if math.Abs(available-4) > 1e-6 || used != 1 {
+			t.Errorf("%s: tenant tokens = %v, used = %d, want 4 and 1 after the refunds", tt.name, available, used)
+		}
+	}
+}
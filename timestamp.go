@@ -0,0 +1,99 @@
+package topdown
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimestampFormat is the encoding of the request start time set by clients in the metadata.
+type TimestampFormat int
+
+const (
+	// TimestampRFC3339 parses RFC3339 timestamps, with or without fractional seconds.
+	TimestampRFC3339 TimestampFormat = iota
+	// TimestampRFC3339Nano parses RFC3339 timestamps with nanosecond precision.
+	TimestampRFC3339Nano
+	// TimestampUnixSeconds parses (possibly fractional) seconds since the Unix epoch.
+	TimestampUnixSeconds
+	// TimestampUnixMillis parses milliseconds since the Unix epoch.
+	TimestampUnixMillis
+	// TimestampUnixNanos parses nanoseconds since the Unix epoch.
+	TimestampUnixNanos
+	// TimestampAuto detects RFC3339 timestamps and Unix timestamps in seconds, milliseconds,
+	// microseconds or nanoseconds from their shape and magnitude.
+	TimestampAuto
+)
+
+// DefaultTimestampKey is the default metadata key carrying the request start time.
+const DefaultTimestampKey = "timestamp"
+
+// WithTimestampKey sets the metadata key carrying the request start time, e.g. "x-request-start".
+// See WithTimestampKeys for several candidate keys.
+func WithTimestampKey(key string) Option {
+	return WithTimestampKeys(key)
+}
+
+// WithTimestampFormat sets how the request start time in the metadata is parsed.
+// The default is TimestampRFC3339.
+func WithTimestampFormat(format TimestampFormat) Option {
+	return func(rl *TopDownRL) {
+		rl.timestampFormat = format
+	}
+}
+
+// parseTimestamp parses a request start time in the given format.
+func parseTimestamp(value string, format TimestampFormat) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	switch format {
+	case TimestampRFC3339:
+		t, err := time.Parse(time.RFC3339, value)
+		return t, err == nil
+	case TimestampRFC3339Nano:
+		t, err := time.Parse(time.RFC3339Nano, value)
+		return t, err == nil
+	case TimestampUnixSeconds:
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+			return time.Time{}, false
+		}
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(fraction*float64(time.Second))), true
+	case TimestampUnixMillis:
+		millis, err := strconv.ParseInt(value, 10, 64)
+		return time.UnixMilli(millis), err == nil
+	case TimestampUnixNanos:
+		nanos, err := strconv.ParseInt(value, 10, 64)
+		return time.Unix(0, nanos), err == nil
+	case TimestampAuto:
+		return parseTimestampAuto(value)
+	}
+	return time.Time{}, false
+}
+
+// parseTimestampAuto detects the format of a timestamp. Integer Unix timestamps are told apart
+// by magnitude, which is unambiguous for any date between 1973 and 5138.
+func parseTimestampAuto(value string) (time.Time, bool) {
+	if strings.ContainsAny(value, "T-:") {
+		return parseTimestamp(value, TimestampRFC3339Nano)
+	}
+	if strings.Contains(value, ".") {
+		return parseTimestamp(value, TimestampUnixSeconds)
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	switch {
+	case n < 1e11:
+		return time.Unix(n, 0), true
+	case n < 1e14:
+		return time.UnixMilli(n), true
+	case n < 1e17:
+		return time.UnixMicro(n), true
+	default:
+		return time.Unix(0, n), true
+	}
+}
@@ -2,6 +2,11 @@ package topdown
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,135 +16,1478 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// InterfaceMetrics holds the token bucket, configuration and metrics of a single API (method).
+// All fields are guarded by mu, except for the limiter, which is safe for concurrent use, the
+// concurrency limiter and the admission queue, which have their own locks, and the atomic fields.
 type InterfaceMetrics struct {
-	MaxTokens           int64
-	Tokens              int64
-	RefillRate          int64
-	LastRefill          time.Time
+	mu sync.Mutex
+	// method is the name the method is registered under.
+	method string
+
+	SLO time.Duration
+	// sloPattern and bucketPattern are the patterns the SLO and bucket parameters were resolved
+	// from, if any. sloResolved is false if the SLO was configured for the method itself.
+	sloPattern    string
+	sloResolved   bool
+	bucketPattern string
+	// MaxTokens and RefillRate mirror the parameters of limiter; change them through SetRateLimit.
+	MaxTokens     int64
+	RefillRate    float64
+	MinRefillRate float64
+	MaxRefillRate float64
+	limiter       Limiter
+	// ramp is the change of RefillRate in progress, if any, see WithRateRamp, and override the
+	// temporary rate set through SetTemporaryRateLimit, if any.
+	ramp     *rateRamp
+	override *rateOverride
+	// schedule is the rate schedule of the method, if any, see WithRateSchedule.
+	schedule *rateSchedule
+	// codel sheds requests by tail latency instead of the limiter, if enabled.
+	codel *codel
+	// breaker fails requests fast while the handler keeps failing, if enabled.
+	breaker *breaker
+	// shed rejects requests with the probability set through SetShedProbability.
+	shed                 *shedder
+	CurrentShed          int64
+	CurrentShedEvaluated int64
+	ShedTotal            int64
+	// limitRejected and globalRejected count the requests rejected during the current interval by
+	// the method's own limit and by the global bucket, see WithGlobalLimit.
+	limitRejected         atomic.Int64
+	globalRejected        atomic.Int64
+	CurrentLimitRejected  int64
+	CurrentGlobalRejected int64
+	GlobalRejectedTotal   int64
+	// group is the borrowing group of the method, if any, and borrowed the number of tokens
+	// borrowed from its pool during the current interval.
+	group           *borrowingGroup
+	borrowed        atomic.Int64
+	CurrentBorrowed int64
+	BorrowedTotal   int64
+	// tenants holds the buckets of the tenants of the method, if enabled, and tenantRejected
+	// counts the requests rejected by them during the current interval.
+	tenants               *tenantLimiter
+	tenantRejected        atomic.Int64
+	CurrentTenantRejected int64
+	// cost is the static cost of a request; it never changes after registration. tokensConsumed
+	// counts the tokens taken during the current interval.
+	cost                  int64
+	tokensConsumed        atomic.Int64
+	CurrentTokensConsumed int64
+	// arrivals counts the requests reaching the interceptors during the current interval, before
+	// any admission decision, and admitted those admitted.
+	arrivals        atomic.Int64
+	admitted        atomic.Int64
+	CurrentArrivals int64
+	CurrentAdmitted int64
+	ArrivalsTotal   int64
+	AdmittedTotal   int64
+	// CurrentMemberArrivals breaks the arrivals of the last interval down by member method if the
+	// method is a method group, see WithMethodGroup.
+	CurrentMemberArrivals map[string]int64
+	// retryArrivals and RetryGoodputCounter count the retries arriving and completing within the
+	// SLO during the current interval, see WithRetryAttempts.
+	retryArrivals        atomic.Int64
+	RetryGoodputCounter  int64
+	CurrentRetryArrivals int64
+	CurrentRetryGoodput  int64
+	RetryArrivalsTotal   int64
+	RetryGoodputTotal    int64
+	// EmptyIntervals is the number of consecutive intervals that ended with an empty bucket.
+	EmptyIntervals int64
+	// importance weighs the penalty of CPU throttling (math.Float64bits), and cpuRejected counts
+	// the requests it rejected during the current interval.
+	importance         atomic.Uint64
+	cpuRejected        atomic.Int64
+	CurrentCPURejected int64
+	CPURejectedTotal   int64
+	// rateFactor is the factor applied to the rate of the limiter under memory pressure, and
+	// memoryRejected counts the requests rejected by the tier shedding during the current interval.
+	rateFactor            float64
+	memoryRejected        atomic.Int64
+	CurrentMemoryRejected int64
+	// MaxConcurrent mirrors the limit of concurrency; change it through SetMaxConcurrent.
+	MaxConcurrent int64
+	concurrency   *concurrencyLimiter
+	// queue is the admission queue, nil unless enabled. queueWaits holds the time the requests
+	// admitted from the queue during the current interval waited in it.
+	queue          *admissionQueue
+	queueWaits     *latencyHistogram
+	LastQueueWaits map[float64]time.Duration
+
 	GoodputCounter      int64
 	CurrentGoodput      int64
 	SloViolationCounter int64
-	LatencyHistory      []time.Duration
+	// CurrentSloViolations is the number of SLO violations during the last interval.
+	CurrentSloViolations int64
+	SloViolationsTotal   int64
+	RejectedCounter      int64
+	CurrentRejected      int64
+	RejectedTotal        int64
+	// The goodput and rejections of each priority tier, indexed like the tiers, if enabled.
+	TierGoodputCounter  []int64
+	CurrentTierGoodput  []int64
+	TierRejectedCounter []int64
+	CurrentTierRejected []int64
+	// Requests rejected because the method was at its concurrency limit are counted apart from
+	// the requests rejected by the token bucket.
+	ConcurrencyRejectedCounter int64
+	CurrentConcurrencyRejected int64
+	ConcurrencyRejectedTotal   int64
+	// Requests rejected because their deadline was shorter than the tail latency are doomed.
+	DoomedCounter int64
+	CurrentDoomed int64
+	DoomedTotal   int64
+	// Requests cancelled by the client while waiting in the admission queue are abandoned.
+	AbandonedCounter int64
+	CurrentAbandoned int64
+	AbandonedTotal   int64
+	// In shadow mode every request is admitted; the bucket's decisions are only counted.
+	shadowMode            atomic.Bool
+	WouldRejectCounter    int64
+	CurrentWouldReject    int64
+	WouldRejectTotal      int64
+	ShadowAdmittedCounter int64
+	CurrentShadowAdmitted int64
+	// Panics counts the handlers that panicked, if recovered with WithPanicRecovery.
+	PanicCounter  int64
+	CurrentPanics int64
+	PanicsTotal   int64
+	// Degraded counts the requests its handler marked with MarkDegraded, which count as SLO
+	// violations.
+	DegradedCounter int64
+	CurrentDegraded int64
+	DegradedTotal   int64
+	// Requests cancelled by the client are excluded from goodput, SLO violations and the control
+	// percentiles unless WithIncludeCancelled is set.
+	CancelledCounter int64
+	CurrentCancelled int64
+	CancelledTotal   int64
+	// Requests completed with a status code that doesn't count towards goodput are errors.
+	// They are excluded from goodput, SLO violations and the control percentiles.
+	ErrorCounter        int64
+	CurrentErrors       int64
+	ErrorsTotal         int64
+	ErrorsByCode        map[codes.Code]int64
+	CurrentErrorsByCode map[codes.Code]int64
+	// NegativeLatencies counts requests whose computed latency was negative and clamped to zero,
+	// which happens when the client clock is ahead of ours.
+	NegativeLatencies int64
+	// UnparseableTimestamps counts requests whose start time metadata couldn't be parsed.
+	UnparseableTimestamps int64
+	// latencies holds the latencies of the current interval and latencyWindows, if enabled,
+	// the latencies of the last few intervals.
+	latencies      *latencyHistogram
+	latencyWindows *latencyWindows
+	// Percentiles lists the tail latency percentiles computed each interval. The first one is the
+	// percentile used for control and stored in LastTailLatency95th, which is the 95th by default.
+	Percentiles         []float64
+	LastTailLatencies   map[float64]time.Duration
 	LastTailLatency95th time.Duration
+	// LastSampleCount is the number of latencies recorded during the last interval.
+	LastSampleCount uint64
+	// WindowTailLatencies holds the tail latencies over the rolling latency window, if enabled,
+	// and LatencyWindows those over the windows set with WithLatencyWindows.
+	WindowTailLatencies map[float64]time.Duration
+	LatencyWindows      []WindowLatencies
+	// latencyBuckets counts the latencies of the current interval in fixed buckets, and
+	// LastLatencyBuckets holds the counts of the last interval.
+	latencyBuckets     *latencyBuckets
+	LastLatencyBuckets LatencyBuckets
+	// errorLatencies holds the latencies of the errors of the current interval.
+	errorLatencies         *latencyHistogram
+	LastErrorTailLatencies map[float64]time.Duration
+	// totalLatencies holds the latencies of the current interval including the external time,
+	// which latencies excludes; ExternalCounter counts the requests that had any, see
+	// StartExternalCall. LastTotalTailLatencies is nil unless the last interval had some.
+	totalLatencies         *latencyHistogram
+	LastTotalTailLatencies map[float64]time.Duration
+	ExternalCounter        int64
+	CurrentExternal        int64
+	// history holds the records of the last intervals, if enabled. intervalStart is the start of
+	// the current interval.
+	history       *historyRing
+	intervalStart time.Time
+	// Sequence is the number of the last interval and IntervalEnd its end, set with the metrics
+	// of the interval. nextInterval is closed once the next interval ends, see WaitForInterval.
+	Sequence     uint64
+	IntervalEnd  time.Time
+	nextInterval chan struct{}
+	// budget holds the intervals of the error budget, if enabled, see WithErrorBudget.
+	budget *errorBudget
+	// exportLatencies holds the latencies of the last interval exported by WithMetricsExport.
+	exportLatencies map[float64]time.Duration
+	// loadReports enables the load reports of the method and loadReport holds the report of the
+	// last interval, see WithLoadReports.
+	loadReports atomic.Bool
+	loadReport  atomic.Pointer[loadReport]
+	// pid is the state of the PID controller, see pidControlLocked.
+	pid PIDState
+	// overloaded is set if the method met an overload condition in the last interval, see
+	// WithOverloadDetection.
+	overloaded bool
+	// share is the share of RefillRate the limiter enforces, 1 unless distributed mode divided the
+	// rate among the replicas along the cluster demand, see WithDistributed.
+	share         float64
+	clusterDemand float64
+	replicas      int
+	// peerLatencies holds the latencies of the last interval for the peer reports, if enabled,
+	// see WithPeers. It keeps the precision of WithLatencyPrecision, shared by all replicas.
+	peerLatencies *latencyHistogram
+	// smoothedGoodput and smoothedLatency are the smoothed goodput and tail latency, set once
+	// smoothed is, see WithSmoothing.
+	smoothedGoodput float64
+	smoothedLatency time.Duration
+	smoothed        bool
+}
+
+// BucketConfig holds the token bucket parameters of a single API (method).
+type BucketConfig struct {
+	MaxTokens  int64
+	RefillRate float64
+	// MinRefillRate and MaxRefillRate bound the refill rates SetRateLimit and the controllers may
+	// set; a MaxRefillRate of zero means no cap. If both are zero, WithRateBounds applies.
+	MinRefillRate float64
+	MaxRefillRate float64
+	// MaxConcurrent caps the number of in-flight requests; zero means no cap.
+	MaxConcurrent int64
+	// MaxQueueWait enables the admission queue: requests arriving while the bucket is empty wait
+	// up to MaxQueueWait, bounded by their deadline, for a token instead of being rejected right
+	// away. At most MaxQueueLength requests wait at a time, DefaultMaxQueueLength if zero.
+	MaxQueueWait   time.Duration
+	MaxQueueLength int
+	// NewLimiter creates the limiter of the method; nil means NewTokenBucketLimiter.
+	NewLimiter LimiterFactory
+	// CoDel, if set, sheds requests based on the tail latency instead of admitting them through the limiter.
+	CoDel *CoDelConfig
+	// Breaker, if set, enables the circuit breaker of the method, which rejects its requests with
+	// Unavailable before they reach the limiter while its handler keeps failing.
+	Breaker *BreakerConfig
+	// Importance weighs how much CPU throttling penalizes the method, see WithCPUThrottling; zero
+	// means one, and more important methods are penalized less.
+	Importance float64
+	// Cost is the number of tokens a request consumes unless WithCostFunc says otherwise; zero
+	// means one. Requests costing more than MaxTokens are admitted when the bucket is full and
+	// leave it in debt, so the bucket refills their full cost before admitting further requests.
+	Cost int64
+}
+
+// Package defaults for methods that have an SLO but no bucket configuration.
+const (
+	DefaultMaxTokens  int64   = 1000
+	DefaultRefillRate float64 = 1000
+)
+
+// validate checks that the bucket parameters can admit requests.
+func (c BucketConfig) validate() error {
+	if c.MaxTokens <= 0 {
+		return fmt.Errorf("max tokens must be positive, got %d", c.MaxTokens)
+	}
+	if c.RefillRate <= 0 {
+		return fmt.Errorf("refill rate must be positive, got %g", c.RefillRate)
+	}
+	if c.MaxRefillRate < 0 || (c.MaxRefillRate > 0 && c.MaxRefillRate < c.RefillRate) {
+		return fmt.Errorf("max refill rate %g must be zero or at least the refill rate %g", c.MaxRefillRate, c.RefillRate)
+	}
+	if !(c.MinRefillRate >= 0 && c.MinRefillRate <= c.RefillRate) {
+		return fmt.Errorf("min refill rate %g must be between zero and the refill rate %g", c.MinRefillRate, c.RefillRate)
+	}
+	if c.MaxConcurrent < 0 {
+		return fmt.Errorf("max concurrent must not be negative, got %d", c.MaxConcurrent)
+	}
+	if c.CoDel != nil {
+		if err := c.CoDel.validate(); err != nil {
+			return fmt.Errorf("invalid CoDel parameters: %w", err)
+		}
+	}
+	if c.Breaker != nil {
+		if err := c.Breaker.validate(); err != nil {
+			return fmt.Errorf("invalid circuit breaker parameters: %w", err)
+		}
+	}
+	if c.Cost < 0 {
+		return fmt.Errorf("cost must not be negative, got %d", c.Cost)
+	}
+	if c.Importance != 0 {
+		if err := validateImportance(c.Importance); err != nil {
+			return err
+		}
+	}
+	if c.MaxQueueWait < 0 || c.MaxQueueLength < 0 {
+		return fmt.Errorf("max queue wait %v and length %d must not be negative", c.MaxQueueWait, c.MaxQueueLength)
+	}
+	return nil
+}
+
+// validatePercentiles checks that a list of percentiles is non-empty and within (0, 1].
+func validatePercentiles(percentiles []float64) error {
+	if len(percentiles) == 0 {
+		return errors.New("at least one percentile is required")
+	}
+	for _, percentile := range percentiles {
+		if !(percentile > 0 && percentile <= 1) {
+			return fmt.Errorf("percentile must be in (0, 1], got %g", percentile)
+		}
+	}
+	return nil
 }
 
 // TopDownRL is the RL-based rate limiter for the gRPC server.
+// mutex guards the set of registered methods and the configuration used to register them,
+// and serializes updates spanning several methods; per-method state is guarded by InterfaceMetrics.mu.
+// Lock order is mutex before any InterfaceMetrics.mu.
 type TopDownRL struct {
-	slo        map[string]time.Duration
 	interfaces map[string]*InterfaceMetrics
 	mutex      sync.Mutex
 	Debug      bool
+
+	// logger receives the log messages, see WithLogger.
+	logger Logger
+
+	// published is a read-only copy of interfaces, replaced whenever a method is registered,
+	// so that Allow can look up methods without taking rl.mutex.
+	published atomic.Pointer[map[string]*InterfaceMetrics]
+
+	// buckets holds per-method bucket parameters; methods without an entry use the matching
+	// pattern, if any, or defaultBucket. sloRules holds the SLOs configured for patterns.
+	buckets       map[string]BucketConfig
+	defaultBucket BucketConfig
+	sloRules      atomic.Pointer[[]sloRule]
+
+	unknownMethodPolicy UnknownMethodPolicy
+	defaultSLO          time.Duration
+
+	name  string
+	clock Clock
+
+	// goodCodes are the status codes that count towards goodput.
+	goodCodes map[codes.Code]bool
+
+	latencyMode     LatencyMode
+	maxClockSkew    time.Duration
+	methodKeys      []string
+	timestampKeys   []string
+	timestampFormat TimestampFormat
+	retryPushback   bool
+	maxRetryAfter   time.Duration
+	concurrencyWait time.Duration
+	costFunc        CostFunc
+	shedMode        ShedMode
+	shedSeed        int64
+	deadlineFactor  float64
+
+	includeCancelled          bool
+	deadlineExceededCancelled bool
+	panicRecovery             bool
+	repanic                   bool
+
+	// exemptions holds the patterns of the methods exempt from rate limiting, replaced as a whole
+	// under rl.mutex so the interceptors can read it without locking.
+	exemptions        atomic.Pointer[[]string]
+	defaultExemptions bool
+	exemptLatency     bool
+
+	// global is the token bucket shared by all methods, created from globalConfig; it's disabled
+	// while its capacity is zero.
+	globalConfig BucketConfig
+	global       globalLimit
+
+	// borrowingGroups are the declared borrowing groups; groups holds their pools and groupOf
+	// indexes them by member method. Both are fixed after construction.
+	borrowingGroups []borrowingGroupConfig
+	groups          []*borrowingGroup
+	groupOf         map[string]*borrowingGroup
+
+	// methodGroupConfigs are the declared method groups; methodGroups maps their members to them,
+	// published like published and replaced under rl.mutex, see SetMethodGroup.
+	methodGroupConfigs []methodGroupConfig
+	methodGroups       atomic.Pointer[map[string]*groupMember]
+
+	// tenantConfig enables per-tenant limiting, see WithTenantLimit.
+	tenantConfig *TenantConfig
+
+	// priorities are the priority tiers from highest to lowest, if enabled, see WithPriorities.
+	priorityKey     string
+	priorities      []PriorityTier
+	defaultPriority string
+
+	// shadowMode puts all methods in shadow mode, see SetShadowMode.
+	shadowMode atomic.Bool
+
+	// controller selects and configures the built-in rate controller.
+	controller atomic.Pointer[controllerConfig]
+
+	// auth authenticates requests to the control endpoints, if set.
+	auth         AuthFunc
+	authFailures atomic.Int64
+
+	// pushURL enables push mode, see WithPushURL.
+	pushURL      string
+	pushClient   *http.Client
+	pushRetries  int
+	pushFailures atomic.Int64
+
+	// statsd sends the metrics to a StatsD agent, see WithStatsD.
+	statsd *statsdEmitter
+
+	// export writes the metrics of every interval to a file or writer, see WithMetricsExport.
+	export *metricsExport
+
+	// budget is the SLO objective of the error budgets, see WithErrorBudget.
+	budget *errorBudgetConfig
+
+	// alerts evaluates the alert rules and sends their notifications, see WithAlertRules.
+	alerts alertManager
+
+	// loadReportPatterns are the methods attaching load reports, see WithLoadReports.
+	loadReportPatterns []string
+
+	// rateKey and tokensKey are the trailer keys of the rate hints, empty if disabled, see WithRateHeaders.
+	rateKey   string
+	tokensKey string
+
+	// children propagates the rate limits to downstream services, see WithChildManager.
+	children *ChildManager
+
+	// distributed divides the rates among the replicas of the service, see WithDistributed.
+	distributed *distributedMode
+
+	// cpu throttles admission while the process is overloaded, see WithCPUThrottling.
+	cpu *cpuThrottle
+	// memory sheds load while the process is short of memory, see WithMemoryPressure.
+	memory *memoryPressure
+
+	// peers exchanges the metrics with the other replicas, see WithPeers.
+	peers peerGossip
+
+	// retryKey, goodputAttempts and retryShare configure how retries are counted and admitted,
+	// see WithRetryAttempts.
+	retryKey        string
+	goodputAttempts int
+	retryShare      float64
+
+	// httpMethodFunc and httpStartHeader configure HTTPMiddleware.
+	httpMethodFunc  HTTPMethodFunc
+	httpStartHeader string
+
+	// defaultMinRate and defaultMaxRate bound the rates of methods without bounds of their own.
+	defaultMinRate float64
+	defaultMaxRate float64
+	rateBoundsMode RateBoundsMode
+
+	// rampDuration and rampMode control how rates set through SetRateLimit take effect, see WithRateRamp.
+	rampDuration time.Duration
+	rampMode     RampMode
+
+	// schedules are the rate schedules keyed by method, evaluated in scheduleLocation, see
+	// WithRateSchedule.
+	schedules        map[string][]ScheduleEntry
+	scheduleLocation *time.Location
+
+	// configFile is the configuration file loaded through LoadConfig, if any, and configErrors
+	// counts the loads that failed.
+	configFile   configFile
+	configErrors atomic.Int64
+	configLoaded atomic.Bool
+
+	// overload detects overload, if enabled, and healthServer reports it for healthServices.
+	overload       *overloadDetector
+	healthServer   HealthStatusSetter
+	healthServices []string
+
+	// drain tracks the requests in flight and rejects new ones while draining, see Drain.
+	drain drainState
+
+	// onAdmit, onReject and onInterval are the hooks, see WithOnAdmit, and observers the request
+	// observers; hookPanics counts the panics recovered from them.
+	onAdmit    func(method string, tokensRemaining float64)
+	onReject   func(method string, reason RejectReason)
+	onInterval func(method string, snapshot MetricsSnapshot)
+	observers  []RequestObserver
+	hookPanics atomic.Int64
+	// onStateChange is the hook called when a circuit breaker changes state, see WithOnStateChange.
+	onStateChange func(method string, from, to BreakerState)
+
+	// changes records the changes to the rates, bucket capacities and SLOs, see Changes.
+	changes       *changeLog
+	changeLogSize int
+	changeWriter  io.Writer
+
+	// store saves and restores the state of the methods, see WithStore. lastSave is only used by
+	// the metrics goroutine.
+	store       Store
+	storePeriod time.Duration
+	lastSave    time.Time
+
+	// percentiles is the default list of tail latency percentiles; methodPercentiles overrides it per method.
+	percentiles       []float64
+	methodPercentiles map[string][]float64
+
+	// latencyPrecision is the number of significant bits of the latency histograms, which
+	// methodLatencyPrecision overrides per method, and latencyWindowIntervals the number of
+	// intervals in the rolling latency window (0 disables it).
+	latencyPrecision       int
+	methodLatencyPrecision map[string]int
+	latencyWindowIntervals int
+	historySize            int
+	// latencyWindows are the rolling windows of the tail latencies, windowSizes their lengths in
+	// intervals after the window of latencyWindowIntervals, if any, and controlWindow the window
+	// of the controllers, zero for the last interval.
+	latencyWindows []time.Duration
+	windowSizes    []int
+	controlWindow  time.Duration
+	// smoothingAlpha is the EWMA weight of the values returned by GetMetrics, 1 for none.
+	smoothingAlpha   float64
+	emptyLatencyMode EmptyLatencyMode
+
+	// warmup is the grace period from warmupStart, the creation of the limiter, during which
+	// requests are admitted regardless of the limits, see WithWarmup.
+	warmup      time.Duration
+	warmupRamp  bool
+	warmupStart time.Time
+	// latencyBounds are the bounds of the latency buckets, derived from the SLO if empty.
+	latencyBounds []time.Duration
+
+	streamMessageLimiting bool
+	streamLatencyMode     StreamLatencyMode
+
+	// watchers are notified after every metrics interval, see subscribeIntervals.
+	watchMutex sync.Mutex
+	watchers   map[chan struct{}]struct{}
+	// eventSubscribers receive the snapshots after every metrics interval, see subscribeEvents,
+	// while eventsOpen reports whether the metrics goroutine runs, and eventsDropped counts the
+	// intervals they missed.
+	eventMutex       sync.Mutex
+	eventsOpen       bool
+	eventSubscribers map[*eventSubscriber]struct{}
+	eventsDropped    atomic.Int64
+
+	// maxRequestBytes caps the request bodies of the control API, see WithMaxRequestBytes.
+	maxRequestBytes int64
+
+	// lifecycleMutex guards the background metrics goroutine, its interval and the control server.
+	lifecycleMutex  sync.Mutex
+	metricsInterval time.Duration
+	alignedTicks    bool
+	stopMetrics     context.CancelFunc
+	metricsDone     chan struct{}
+	server          *http.Server
+	serverConfig    func(*http.Server)
 }
 
-// NewTopDownRL creates a new TopDownRL with the specified parameters.
-func NewTopDownRL(maxTokens, refillRate int64, slo map[string]time.Duration, debug bool) *TopDownRL {
-	rl := &TopDownRL{
-		slo:        slo,
-		interfaces: make(map[string]*InterfaceMetrics),
-		Debug:      debug,
+// NewTopDownRL creates a new TopDownRL with the specified parameters. It panics if an option is
+// invalid, before starting any background work, while NewTopDownRLWithBuckets returns the error.
+func NewTopDownRL(maxTokens, refillRate int64, slo map[string]time.Duration, debug bool, opts ...Option) *TopDownRL {
+	rl := newTopDownRL(BucketConfig{MaxTokens: maxTokens, RefillRate: float64(refillRate)}, nil, slo, debug, opts)
+	if err := rl.validateOptions(); err != nil {
+		panic(fmt.Sprintf("topdown: invalid option: %v", err))
 	}
+	rl.StartMetricsCollection()
+	return rl
+}
 
-	// Initialize metrics for each API (method)
-	for methodName := range slo {
-		rl.interfaces[methodName] = &InterfaceMetrics{
-			MaxTokens:           maxTokens,
-			Tokens:              maxTokens,
-			RefillRate:          refillRate,
-			LastRefill:          time.Now(),
-			LatencyHistory:      make([]time.Duration, 0),
-			LastTailLatency95th: 0 * time.Millisecond,
-			GoodputCounter:      0,
-			SloViolationCounter: 0,
-			CurrentGoodput:      0,
+// NewTopDownRLWithBuckets creates a new TopDownRL with per-method token bucket parameters.
+// Methods in slo without an entry in buckets use DefaultMaxTokens and DefaultRefillRate,
+// unless overridden with WithDefaultBucket. Zero or negative rates are rejected.
+func NewTopDownRLWithBuckets(buckets map[string]BucketConfig, slo map[string]time.Duration, debug bool, opts ...Option) (*TopDownRL, error) {
+	defaults := BucketConfig{MaxTokens: DefaultMaxTokens, RefillRate: DefaultRefillRate}
+	rl := newTopDownRL(defaults, buckets, slo, debug, opts)
+
+	if err := rl.validateOptions(); err != nil {
+		return nil, err
+	}
+	if err := rl.defaultBucket.validate(); err != nil {
+		return nil, fmt.Errorf("invalid default bucket: %w", err)
+	}
+	for methodName, bucket := range rl.buckets {
+		if err := bucket.validate(); err != nil {
+			return nil, fmt.Errorf("invalid bucket for method '%s': %w", methodName, err)
 		}
 	}
 
 	rl.StartMetricsCollection()
+	return rl, nil
+}
+
+// validateOptions checks the parameters set through the options.
+func (rl *TopDownRL) validateOptions() error {
+	if err := validatePercentiles(rl.percentiles); err != nil {
+		return err
+	}
+	for methodName, percentiles := range rl.methodPercentiles {
+		if err := validatePercentiles(percentiles); err != nil {
+			return fmt.Errorf("invalid percentiles for method '%s': %w", methodName, err)
+		}
+	}
+	if err := validateWarmup(rl.warmup); err != nil {
+		return fmt.Errorf("invalid warm-up: %w", err)
+	}
+	if err := validateSmoothing(rl.smoothingAlpha); err != nil {
+		return fmt.Errorf("invalid smoothing: %w", err)
+	}
+	if rl.cpu != nil {
+		if err := rl.cpu.config.validate(); err != nil {
+			return fmt.Errorf("invalid CPU throttling: %w", err)
+		}
+	}
+	if rl.memory != nil {
+		if err := rl.memory.config.validate(); err != nil {
+			return fmt.Errorf("invalid memory pressure: %w", err)
+		}
+	}
+	if err := validateLatencyBounds(rl.latencyBounds); err != nil {
+		return fmt.Errorf("invalid latency buckets: %w", err)
+	}
+	if err := validateLatencyPrecision(rl.latencyPrecision); err != nil {
+		return err
+	}
+	for methodName, precision := range rl.methodLatencyPrecision {
+		if err := validateLatencyPrecision(precision); err != nil {
+			return fmt.Errorf("invalid latency precision for method '%s': %w", methodName, err)
+		}
+	}
+	if err := validateMetricsInterval(rl.metricsInterval); err != nil {
+		return err
+	}
+	if _, err := parseControllerMode(rl.ControllerMode().String()); err != nil {
+		return err
+	}
+	if err := rl.AIMDConfig().validate(); err != nil {
+		return fmt.Errorf("invalid AIMD parameters: %w", err)
+	}
+	if err := rl.PIDConfig().validate(); err != nil {
+		return fmt.Errorf("invalid PID parameters: %w", err)
+	}
+	if err := validateDeadlineFactor(rl.deadlineFactor); err != nil {
+		return err
+	}
+	if err := rl.validateBorrowingGroups(); err != nil {
+		return err
+	}
+	if err := rl.validateMethodGroups(); err != nil {
+		return err
+	}
+	if err := rl.validateSchedules(); err != nil {
+		return err
+	}
+	if rl.tenantConfig != nil {
+		if err := rl.tenantConfig.validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateGlobalLimit(rl.globalConfig.MaxTokens, rl.globalConfig.RefillRate); err != nil {
+		return err
+	}
+	if err := rl.validatePriorities(); err != nil {
+		return err
+	}
+	if err := validateRateBounds(rl.defaultMinRate, rl.defaultMaxRate); err != nil {
+		return fmt.Errorf("invalid default rate bounds: %w", err)
+	}
+	if err := rl.validateRetries(); err != nil {
+		return fmt.Errorf("invalid retries: %w", err)
+	}
+	if err := validateKeys(rl.methodKeys); err != nil {
+		return fmt.Errorf("invalid method keys: %w", err)
+	}
+	if err := validateKeys(rl.timestampKeys); err != nil {
+		return fmt.Errorf("invalid timestamp keys: %w", err)
+	}
+	if rl.rampDuration < 0 {
+		return fmt.Errorf("rate ramp duration must not be negative, got %v", rl.rampDuration)
+	}
+	if rl.overload != nil {
+		if err := rl.overload.config.validate(); err != nil {
+			return fmt.Errorf("invalid overload config: %w", err)
+		}
+	}
+	if rl.budget != nil {
+		if err := rl.budget.validate(); err != nil {
+			return fmt.Errorf("invalid error budget: %w", err)
+		}
+	}
+	if rl.peers.enabled {
+		if err := rl.peers.validate(rl.name); err != nil {
+			return fmt.Errorf("invalid peers: %w", err)
+		}
+	}
+	if rl.distributed != nil {
+		if err := rl.distributed.validate(); err != nil {
+			return fmt.Errorf("invalid distributed mode: %w", err)
+		}
+	}
+	if rl.children != nil {
+		if err := rl.children.validate(); err != nil {
+			return fmt.Errorf("invalid children: %w", err)
+		}
+	}
+	if err := validateAlertRules(rl.alerts.rules); err != nil {
+		return fmt.Errorf("invalid alert rules: %w", err)
+	}
+	if rl.statsd != nil {
+		if _, err := net.ResolveUDPAddr("udp", rl.statsd.addr); err != nil {
+			return fmt.Errorf("invalid StatsD address: %w", err)
+		}
+	}
+	if rl.storePeriod < 0 {
+		return fmt.Errorf("store period must not be negative, got %v", rl.storePeriod)
+	}
+	if rl.changeLogSize < 0 {
+		return fmt.Errorf("change log size must not be negative, got %d", rl.changeLogSize)
+	}
+	if rl.historySize < 0 {
+		return fmt.Errorf("history size must not be negative, got %d", rl.historySize)
+	}
+	if rl.latencyWindowIntervals < 0 {
+		return fmt.Errorf("latency window must not be negative, got %d", rl.latencyWindowIntervals)
+	}
+	if err := rl.validateLatencyWindows(); err != nil {
+		return fmt.Errorf("invalid latency windows: %w", err)
+	}
+	return nil
+}
+
+// newTopDownRL builds a TopDownRL without starting any background work.
+func newTopDownRL(defaults BucketConfig, buckets map[string]BucketConfig, slo map[string]time.Duration, debug bool, opts []Option) *TopDownRL {
+	rl := &TopDownRL{
+		interfaces:    make(map[string]*InterfaceMetrics),
+		Debug:         debug,
+		buckets:       make(map[string]BucketConfig, len(buckets)),
+		defaultBucket: defaults,
+		percentiles:   []float64{0.95},
+
+		latencyPrecision: DefaultLatencyPrecision,
+		smoothingAlpha:   1,
+		clock:            realClock{},
+		goodCodes:        map[codes.Code]bool{codes.OK: true},
+		maxClockSkew:     DefaultMaxClockSkew,
+		methodKeys:       []string{DefaultMethodKey},
+		timestampKeys:    []string{DefaultTimestampKey},
+		retryPushback:    true,
+		maxRetryAfter:    DefaultMaxRetryAfter,
+		metricsInterval:  DefaultMetricsInterval,
+		historySize:      DefaultHistorySize,
+		pushClient:       &http.Client{Timeout: DefaultPushTimeout},
+		pushRetries:      DefaultPushRetries,
+		shedSeed:         time.Now().UnixNano(),
+		changeLogSize:    DefaultChangeLogSize,
+		maxRequestBytes:  DefaultMaxRequestBytes,
+		scheduleLocation: time.UTC,
+
+		alerts: alertManager{
+			client:  &http.Client{Timeout: DefaultAlertTimeout},
+			retries: DefaultAlertRetries,
+			queue:   make(chan alertNotification, alertQueueSize),
+		},
+		peers: peerGossip{staleIntervals: DefaultPeerStaleIntervals},
+	}
+	for methodName, bucket := range buckets {
+		rl.buckets[methodName] = bucket
+	}
+	rl.defaultExemptions = true
+	rl.drain.idle = make(chan struct{}, 1)
+	rl.controller.Store(&controllerConfig{mode: ControllerExternal, aimd: DefaultAIMDConfig(), pid: DefaultPIDConfig()})
+	for _, opt := range opts {
+		opt(rl)
+	}
+	rl.windowSizes = rl.latencyWindowSizes()
+	rl.warmupStart = rl.clock.Now()
+	if rl.logger == nil {
+		rl.logger = stdLogger{}
+	}
+	if rl.defaultExemptions {
+		exemptions := append(append([]string(nil), DefaultExemptions...), rl.loadExemptions()...)
+		rl.exemptions.Store(&exemptions)
+	}
+	rl.changes = newChangeLog(rl.changeLogSize, rl.changeWriter, rl.logger)
+	if rl.healthServer != nil && rl.overload == nil {
+		rl.overload = &overloadDetector{config: DefaultOverloadConfig()}
+	}
+	rl.setHealthStatus(false)
+	rl.global.bucket = newTokenBucket(rl.globalConfig.MaxTokens, rl.globalConfig.RefillRate, rl.clock.Now())
+	rl.newBorrowingGroups()
+	rl.newMethodGroups()
+
+	// Initialize metrics for each API (method)
+	for methodName, methodSLO := range slo {
+		if isPattern(methodName) {
+			rl.storeSLORuleLocked(methodName, methodSLO)
+			continue
+		}
+		if rl.methodGroupOf(methodName) != methodName {
+			// The members of method groups share the metrics of their group
+			continue
+		}
+		rl.interfaces[methodName] = rl.newInterfaceMetrics(methodName, methodSLO)
+	}
+	rl.publishInterfacesLocked()
+	if rl.store != nil {
+		rl.restoreState()
+	}
 	return rl
 }
 
-// Allow checks if a request is allowed to proceed based on the token bucket algorithm.
-func (rl *TopDownRL) Allow(ctx context.Context, methodName string) bool {
-	rl.mutex.Lock()
-	defer rl.mutex.Unlock()
+// publishInterfacesLocked publishes a copy of rl.interfaces for lock-free lookups.
+// It must be called whenever rl.interfaces changes. The caller must hold rl.mutex.
+func (rl *TopDownRL) publishInterfacesLocked() {
+	published := make(map[string]*InterfaceMetrics, len(rl.interfaces))
+	for methodName, metrics := range rl.interfaces {
+		published[methodName] = metrics
+	}
+	rl.published.Store(&published)
+}
 
-	metrics := rl.interfaces[methodName] // Get metrics for the API
+// newLimiter creates the limiter configured for a method.
+func newLimiter(config BucketConfig, clock Clock) Limiter {
+	if config.NewLimiter == nil {
+		return NewTokenBucketLimiter(config, clock)
+	}
+	return config.NewLimiter(config, clock)
+}
 
-	now := time.Now()
-	elapsed := now.Sub(metrics.LastRefill).Seconds()
+// newInterfaceMetrics creates the metrics for a single API with a full token bucket.
+func (rl *TopDownRL) newInterfaceMetrics(methodName string, slo time.Duration) *InterfaceMetrics {
+	bucket, bucketPattern := rl.matchBucket(methodName)
+	if bucket.MinRefillRate == 0 && bucket.MaxRefillRate == 0 {
+		bucket.MinRefillRate, bucket.MaxRefillRate = rl.defaultMinRate, rl.defaultMaxRate
+	}
+	percentiles, exists := rl.methodPercentiles[methodName]
+	if !exists {
+		percentiles = rl.percentiles
+	}
+	precision, exists := rl.methodLatencyPrecision[methodName]
+	if !exists {
+		precision = rl.latencyPrecision
+	}
 
-	// Calculate the number of tokens to refill (using integer arithmetic)
-	refillTokens := int64(elapsed * float64(metrics.RefillRate))
-	if refillTokens > 0 {
-		metrics.Tokens = intMin(metrics.Tokens+refillTokens, metrics.MaxTokens)
-		metrics.LastRefill = now
+	metrics := &InterfaceMetrics{
+		method:              methodName,
+		SLO:                 slo,
+		bucketPattern:       bucketPattern,
+		Percentiles:         percentiles,
+		LastTailLatencies:   make(map[float64]time.Duration),
+		MaxTokens:           bucket.MaxTokens,
+		RefillRate:          bucket.RefillRate,
+		MinRefillRate:       bucket.MinRefillRate,
+		MaxRefillRate:       bucket.MaxRefillRate,
+		limiter:             newLimiter(bucket, rl.clock),
+		codel:               newCoDel(bucket.CoDel),
+		breaker:             newBreaker(bucket.Breaker, rl.clock.Now()),
+		shed:                newShedder(rl.shedSeed, methodName),
+		group:               rl.groupOf[methodName],
+		tenants:             newTenantLimiter(rl.tenantConfig, bucket.RefillRate, rl.clock.Now()),
+		cost:                bucket.Cost,
+		MaxConcurrent:       bucket.MaxConcurrent,
+		concurrency:         newConcurrencyLimiter(bucket.MaxConcurrent, rl.clock),
+		queue:               newAdmissionQueue(bucket.MaxQueueWait, bucket.MaxQueueLength),
+		queueWaits:          newLatencyHistogram(precision),
+		LastQueueWaits:      make(map[float64]time.Duration),
+		TierGoodputCounter:  make([]int64, len(rl.priorities)),
+		CurrentTierGoodput:  make([]int64, len(rl.priorities)),
+		TierRejectedCounter: make([]int64, len(rl.priorities)),
+		CurrentTierRejected: make([]int64, len(rl.priorities)),
+		latencies:           newLatencyHistogram(precision),
+		errorLatencies:      newLatencyHistogram(precision),
+		totalLatencies:      newLatencyHistogram(precision),
+		nextInterval:        make(chan struct{}),
+		ErrorsByCode:        make(map[codes.Code]int64),
+		CurrentErrorsByCode: make(map[codes.Code]int64),
+		LastTailLatency95th: 0 * time.Millisecond,
+		GoodputCounter:      0,
+		SloViolationCounter: 0,
+		CurrentGoodput:      0,
+	}
+	metrics.intervalStart = rl.clock.Now()
+	metrics.share = 1
+	metrics.schedule = rl.newRateSchedule(methodName)
+	if bucket.Importance == 0 {
+		bucket.Importance = 1
+	}
+	metrics.storeImportance(bucket.Importance)
+	if metrics.rateFactor = rl.memory.rateFactor(); metrics.rateFactor != 1 {
+		setLimiterRateLocked(metrics, metrics.RefillRate)
 	}
+	metrics.latencyBuckets = rl.newLatencyBuckets(slo)
+	metrics.LastLatencyBuckets = LatencyBuckets{Bounds: metrics.latencyBuckets.bounds, Counts: make([]uint64, len(metrics.latencyBuckets.counts))}
+	if rl.peers.enabled {
+		metrics.peerLatencies = newLatencyHistogram(rl.latencyPrecision)
+	}
+	metrics.loadReports.Store(rl.loadReportsEnabled(methodName))
+	if rl.historySize > 0 {
+		metrics.history = newHistoryRing(rl.historySize)
+	}
+	if len(rl.windowSizes) > 0 {
+		metrics.latencyWindows = newLatencyWindows(rl.windowSizes, precision)
+	}
+	return metrics
+}
 
-	if metrics.Tokens > 0 {
-		metrics.Tokens--
-		return true
+// lookupMetrics returns the metrics for methodName, registering the method first if the
+// unknown method policy asks for it. It returns nil if the method should bypass rate limiting.
+// The members of method groups get the metrics of their group. The caller must hold rl.mutex.
+func (rl *TopDownRL) lookupMetrics(methodName string) *InterfaceMetrics {
+	methodName = rl.methodGroupOf(methodName)
+	if metrics, exists := rl.interfaces[methodName]; exists {
+		return metrics
 	}
-	return false
+	rule, matched := rl.matchSLO(methodName)
+	if !matched && rl.unknownMethodPolicy != UnknownMethodRegister {
+		return nil
+	}
+
+	slo := rl.defaultSLO
+	if matched {
+		slo = rule.slo
+	}
+	metrics := rl.newInterfaceMetrics(methodName, slo)
+	metrics.sloPattern, metrics.sloResolved = rule.pattern, true
+	rl.interfaces[methodName] = metrics
+	rl.publishInterfacesLocked()
+	if rl.Debug {
+		if matched {
+			rl.logger.Debugf("Registered method '%s' with SLO %v from pattern '%s'", methodName, slo, rule.pattern)
+		} else {
+			rl.logger.Debugf("Registered unknown method '%s' with SLO %v", methodName, slo)
+		}
+	}
+	return metrics
 }
 
-// postProcess handles the logic after a request has been processed to update goodput, SLO violations, and latency.
-func (rl *TopDownRL) postProcess(latency time.Duration, methodName string) {
+// Allow checks if a request is allowed to proceed based on the token bucket algorithm.
+// Registered methods are admitted or rejected without taking any lock.
+func (rl *TopDownRL) Allow(ctx context.Context, methodName string) bool {
+	return rl.AllowN(ctx, methodName, 1)
+}
+
+// AllowN is like Allow for a request costing n tokens, which are consumed atomically or not at all.
+// Requests costing no tokens or a negative number of tokens are rejected.
+func (rl *TopDownRL) AllowN(ctx context.Context, methodName string, n int64) bool {
+	allowed, _, _ := rl.allowN(ctx, methodName, n)
+	return allowed
+}
+
+// allowN is AllowN also returning whether the request took its tokens and where those of its
+// method came from, so that they can be refunded, see refundTap.
+func (rl *TopDownRL) allowN(ctx context.Context, methodName string, n int64) (allowed, charged bool, grant tokenGrant) {
+	if n <= 0 {
+		return false, false, noTokens
+	}
+	metrics := rl.loadMetrics(methodName) // Get metrics for the API
+	if metrics == nil {
+		// Unregistered methods bypass rate limiting
+		return true, false, noTokens
+	}
+	// Requests are checked against the limits from the narrowest to the widest, so a rejection
+	// doesn't take tokens from the wider ones
+	shed, bypass := rl.shedDecision(metrics)
+	var admitted, limited bool
+	grant = noTokens
+	switch {
+	case shed:
+	case !rl.cpuAdmits(metrics):
+	case !rl.memoryAdmits(ctx, metrics):
+	case !rl.allowTenant(ctx, metrics, n):
+	case bypass:
+		admitted = true
+	case metrics.codel != nil:
+		admitted = metrics.codel.admit()
+		limited = !admitted
+	default:
+		grant = rl.takeTokens(rl.limiterContext(ctx), metrics, n)
+		admitted = grant != noTokens
+		limited = !admitted
+	}
+	if limited {
+		// The request passed the tenant's limit, so it gets its tenant's tokens back
+		rl.refundTenant(ctx, metrics, n)
+		metrics.limitRejected.Add(1)
+	}
+	if admitted && !rl.allowGlobal(metrics, n) {
+		rl.refundTokens(ctx, metrics, n, grant)
+		admitted = false
+	}
+	if admitted {
+		metrics.tokensConsumed.Add(n)
+	}
+	if rl.inShadowMode(metrics) {
+		rl.recordShadowDecision(metrics, admitted)
+		return true, admitted, grant
+	}
+	if !admitted && rl.warmupAdmits(metrics) {
+		rl.recordShadowDecision(metrics, false)
+		return true, false, noTokens
+	}
+	return admitted, admitted, grant
+}
+
+// loadMetrics returns the metrics for methodName like lookupMetrics, but without taking
+// rl.mutex unless the method has to be registered first.
+func (rl *TopDownRL) loadMetrics(methodName string) *InterfaceMetrics {
+	if metrics := rl.registeredMetrics(methodName); metrics != nil {
+		return metrics
+	}
+	if _, matched := rl.matchSLO(rl.methodGroupOf(methodName)); !matched && rl.unknownMethodPolicy != UnknownMethodRegister {
+		return nil
+	}
+
 	rl.mutex.Lock()
 	defer rl.mutex.Unlock()
+	return rl.lookupMetrics(methodName)
+}
+
+// registeredMetrics returns the metrics for methodName, or those of its method group, or nil if
+// it isn't registered, without taking rl.mutex.
+func (rl *TopDownRL) registeredMetrics(methodName string) *InterfaceMetrics {
+	return (*rl.published.Load())[rl.methodGroupOf(methodName)]
+}
 
-	metrics := rl.interfaces[methodName]
+// postProcess handles the logic after a request has been processed to update goodput, SLO violations, and latency.
+// tier is the index of the request's priority tier, or -1 if priorities are disabled, and attempt
+// its attempt number; only attempts up to WithGoodputAttempts count towards goodput. The request
+// is held to its SLO with its own latency, without the external time of the settlement.
+func (rl *TopDownRL) postProcess(latency time.Duration, methodName string, tier int, attempt int, settled settlement) Outcome {
+	metrics := rl.loadMetrics(methodName)
+	if metrics == nil {
+		return OutcomeGood
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	metrics.totalLatencies.Record(latency)
+	if settled.external > 0 {
+		metrics.ExternalCounter++
+		latency -= settled.external
+		if latency < 0 {
+			latency = 0
+		}
+	}
 
 	// Update goodput and SLO violation counter
-	if latency <= rl.slo[methodName] {
-		atomic.AddInt64(&metrics.GoodputCounter, 1)
+	outcome := OutcomeGood
+	if latency <= metrics.SLO && !settled.degraded {
+		if attempt <= rl.goodputAttempts {
+			metrics.GoodputCounter++
+			if tier >= 0 && tier < len(metrics.TierGoodputCounter) {
+				metrics.TierGoodputCounter[tier]++
+			}
+		}
+		if attempt > 0 {
+			metrics.RetryGoodputCounter++
+		}
 	} else {
 		metrics.SloViolationCounter++
+		outcome = OutcomeViolating
+	}
+	if settled.degraded {
+		metrics.DegradedCounter++
+		metrics.DegradedTotal++
+	}
+
+	metrics.latencies.Record(latency)
+	metrics.latencyBuckets.record(latency)
+	return outcome
+}
+
+// recordOutcome records a completed request: requests with a good status code count towards
+// goodput and the SLO, requests cancelled by the client are counted apart, and all others are
+// recorded as errors. It returns how the request was counted.
+func (rl *TopDownRL) recordOutcome(ctx context.Context, latency time.Duration, methodName string, tier int, err error) Outcome {
+	return rl.recordStatus(ctx, latency, methodName, tier, err, true)
+}
+
+// recordStatus is recordOutcome for requests whose latency counts towards goodput and the SLO
+// only if measured is set, e.g. not for streams whose messages were measured on their own.
+func (rl *TopDownRL) recordStatus(ctx context.Context, latency time.Duration, methodName string, tier int, err error, measured bool) Outcome {
+	latency, settled := rl.settleReport(ctx, methodName, latency)
+	if latency < 0 {
+		rl.recordNegativeLatency(methodName)
+		latency = 0
+	}
+
+	code := status.Code(err)
+	cancelled := rl.cancelled(err)
+	if !cancelled {
+		rl.recordBreakerOutcome(methodName, code)
+	}
+	switch {
+	case cancelled && !rl.includeCancelled:
+		rl.recordCancelled(methodName)
+		return OutcomeCancelled
+	case cancelled || rl.goodCodes[code]:
+		if !measured {
+			return OutcomeGood
+		}
+		return rl.postProcess(latency, methodName, tier, rl.retryAttempt(ctx), settled)
+	default:
+		rl.recordError(latency, methodName, code)
+		return OutcomeError
 	}
+}
 
-	metrics.LatencyHistory = append(metrics.LatencyHistory, latency)
+// recordError counts a request that completed with a status code not counting towards goodput
+// and records its latency separately from the latencies used for control.
+func (rl *TopDownRL) recordError(latency time.Duration, methodName string, code codes.Code) {
+	metrics := rl.loadMetrics(methodName)
+	if metrics == nil {
+		return
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	metrics.ErrorCounter++
+	metrics.ErrorsTotal++
+	metrics.ErrorsByCode[code]++
+	metrics.errorLatencies.Record(latency)
 }
 
-// StartMetricsCollection starts a separate goroutine that saves metrics and calculates the 95th percentile tail latency every second.
+// recordNegativeLatency counts a request whose computed latency was negative.
+func (rl *TopDownRL) recordNegativeLatency(methodName string) {
+	metrics := rl.loadMetrics(methodName)
+	if metrics == nil {
+		return
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	metrics.NegativeLatencies++
+}
+
+// recordUnparseableTimestamp counts a request whose start time metadata couldn't be parsed.
+func (rl *TopDownRL) recordUnparseableTimestamp(methodName string) {
+	metrics := rl.loadMetrics(methodName)
+	if metrics == nil {
+		return
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	metrics.UnparseableTimestamps++
+}
+
+// recordArrival counts a request reaching the interceptors, before any admission decision.
+func (rl *TopDownRL) recordArrival(ctx context.Context, methodName string) {
+	if metrics := rl.loadMetrics(methodName); metrics != nil {
+		metrics.arrivals.Add(1)
+		rl.recordMemberArrival(methodName)
+		if rl.retryAttempt(ctx) > 0 {
+			metrics.retryArrivals.Add(1)
+		}
+	}
+}
+
+// recordAdmission counts a request admitted by the interceptors.
+func (rl *TopDownRL) recordAdmission(methodName string) {
+	if metrics := rl.registeredMetrics(methodName); metrics != nil {
+		metrics.admitted.Add(1)
+	}
+}
+
+// recordRejection counts a request from the given priority tier rejected because the rate limit was exceeded.
+func (rl *TopDownRL) recordRejection(methodName string, tier int) {
+	metrics := rl.loadMetrics(methodName)
+	if metrics == nil {
+		return
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	metrics.RejectedCounter++
+	metrics.RejectedTotal++
+	if tier >= 0 && tier < len(metrics.TierRejectedCounter) {
+		metrics.TierRejectedCounter[tier]++
+	}
+}
+
+// StartMetricsCollection starts a separate goroutine that saves metrics and calculates the tail latency percentiles
+// every metrics interval, one second by default. It is a no-op if the goroutine is already running, and restarts it after Stop.
 func (rl *TopDownRL) StartMetricsCollection() {
+	rl.lifecycleMutex.Lock()
+	defer rl.lifecycleMutex.Unlock()
+
+	rl.startMetricsLocked()
+}
+
+// startMetricsLocked starts the metrics goroutine if it isn't running. The caller must hold rl.lifecycleMutex.
+func (rl *TopDownRL) startMetricsLocked() {
+	if rl.stopMetrics != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	rl.stopMetrics = cancel
+	rl.metricsDone = done
+	rl.openEvents()
+
+	// The ticker is created before returning so that ticks follow the clock from this point on.
+	// Aligned ticks first wait for the next multiple of the interval and start ticking from there.
+	interval := rl.metricsInterval
+	var ticker Ticker
+	aligning := false
+	if rl.alignedTicks {
+		now := rl.clock.Now()
+		if delay := now.Truncate(interval).Add(interval).Sub(now); delay < interval {
+			ticker = rl.clock.NewTicker(delay)
+			aligning = true
+		}
+	}
+	if ticker == nil {
+		ticker = rl.clock.NewTicker(interval)
+	}
+
 	go func() {
-		ticker := time.NewTicker(1 * time.Second)
-		defer ticker.Stop()
+		defer close(done)
+		defer rl.closeEvents()
+		defer func() { ticker.Stop() }()
+		defer rl.flushExport()
+
+		// Pushes run on their own goroutine so a slow agent never delays the ticks
+		var pushes chan struct{}
+		if rl.pushURL != "" {
+			pushes = make(chan struct{}, 1)
+			pushDone := make(chan struct{})
+			go func() {
+				defer close(pushDone)
+				rl.pushLoop(ctx, pushes)
+			}()
+			defer func() { <-pushDone }()
+		}
+		var emits chan struct{}
+		if rl.statsd != nil {
+			emits = make(chan struct{}, 1)
+			emitDone := make(chan struct{})
+			go func() {
+				defer close(emitDone)
+				rl.statsdLoop(ctx, emits)
+			}()
+			defer func() { <-emitDone }()
+		}
+		if rl.cpu != nil {
+			cpuDone := make(chan struct{})
+			go func() {
+				defer close(cpuDone)
+				rl.cpuLoop(ctx)
+			}()
+			defer func() { <-cpuDone }()
+		}
+		if rl.alerts.url != "" {
+			alertDone := make(chan struct{})
+			go func() {
+				defer close(alertDone)
+				rl.alertLoop(ctx)
+			}()
+			defer func() { <-alertDone }()
+		}
+		var peerReports chan struct{}
+		if len(rl.peers.urls) > 0 {
+			peerReports = make(chan struct{}, 1)
+			peerDone := make(chan struct{})
+			go func() {
+				defer close(peerDone)
+				rl.peerLoop(ctx, peerReports)
+			}()
+			defer func() { <-peerDone }()
+		}
+		if rl.distributed != nil {
+			reportDone := make(chan struct{})
+			go func() {
+				defer close(reportDone)
+				rl.distributedLoop(ctx)
+			}()
+			defer func() { <-reportDone }()
+		}
+		if rl.children != nil {
+			for _, child := range rl.children.children {
+				childDone := make(chan struct{})
+				go func() {
+					defer close(childDone)
+					rl.children.pushLoop(ctx, child)
+				}()
+				defer func() { <-childDone }()
+			}
+		}
 
 		for {
 			select {
-			case <-ticker.C:
-
-				// Calculate the 95th percentile tail latency and save it
-				// loop through all the methods in interface map and calculate the 95th percentile tail latency
-				for methodName := range rl.interfaces {
-					rl.calculateTailLatency95th(methodName)
-
-					// Save the metrics (goodput and latency) to history
-					rl.saveMetrics(methodName)
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+				if aligning {
+					ticker.Stop()
+					ticker = rl.clock.NewTicker(interval)
+					aligning = false
+				}
+				rl.tick()
+				rl.exportIntervals()
+				rl.intervalHooks()
+				rl.evaluateAlerts()
+				if rl.children != nil {
+					rl.children.propagate()
+				}
+				rl.notifyIntervals()
+				rl.publishEvents()
+				rl.saveStateIfDue()
+				if pushes != nil {
+					select {
+					case pushes <- struct{}{}:
+					default:
+					}
+				}
+				if emits != nil {
+					select {
+					case emits <- struct{}{}:
+					default:
+					}
+				}
+				if peerReports != nil {
+					select {
+					case peerReports <- struct{}{}:
+					default:
+					}
+				}
+				if rl.distributed != nil {
+					select {
+					case rl.distributed.reports <- struct{}{}:
+					default:
+					}
 				}
 			}
 		}
 	}()
 }
 
+// tick rolls every registered method over to the next interval. It works on the published copy
+// of the registered methods, so methods can be registered and unregistered while it runs.
+func (rl *TopDownRL) tick() {
+	now := rl.clock.Now()
+	rl.sampleMemory(now)
+	for _, metrics := range *rl.published.Load() {
+		rl.rollover(metrics, now)
+	}
+	rl.updateOverload(now)
+	rl.changes.flush()
+}
+
+// Stop shuts down the metrics goroutine and gracefully shuts down the control server, waiting
+// until ctx is done at the latest. StartMetricsCollection and StartServer may be called again afterwards.
+func (rl *TopDownRL) Stop(ctx context.Context) error {
+	rl.lifecycleMutex.Lock()
+	defer rl.lifecycleMutex.Unlock()
+
+	if err := rl.stopMetricsLocked(ctx); err != nil {
+		return err
+	}
+
+	if rl.server != nil {
+		server := rl.server
+		rl.server = nil
+		return server.Shutdown(ctx)
+	}
+	return nil
+}
+
+// stopMetricsLocked stops the metrics goroutine, if running, waiting until ctx is done at the latest.
+// The caller must hold rl.lifecycleMutex.
+func (rl *TopDownRL) stopMetricsLocked(ctx context.Context) error {
+	if rl.stopMetrics == nil {
+		return nil
+	}
+
+	rl.stopMetrics()
+	select {
+	case <-rl.metricsDone:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	rl.stopMetrics = nil
+	rl.metricsDone = nil
+	return nil
+}
+
 // UnaryInterceptor is the unary gRPC interceptor function that enforces rate limiting.
-func (rl *TopDownRL) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+func (rl *TopDownRL) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	if rl.exempt(info.FullMethod) {
+		return rl.serveExempt(ctx, req, info.FullMethod, handler)
+	}
+
 	// Extract the method name and start time
-	methodName := getMethodName(ctx)
-	startTime := extractStartTime(ctx)
+	methodName := rl.methodName(ctx, info.FullMethod)
+	if methodName == "" {
+		// The method can't be identified, so let the request through without rate limiting
+		return handler(ctx, req)
+	}
+	rl.recordArrival(ctx, methodName)
+	defer rl.attachLoadReport(ctx, methodName)
+	if !rl.enterDrain() {
+		rl.refundTap(ctx, methodName)
+		rl.rejectHook(ctx, methodName, RejectDraining)
+		return nil, status.Error(codes.Unavailable, "Server is draining, request denied")
+	}
+	defer rl.exitDrain()
+	startTime := rl.extractStartTime(ctx, methodName)
+	tier := rl.priorityTier(ctx)
 
 	// Check if the request is allowed before handling it
-	if !rl.Allow(ctx, methodName) {
+	if !rl.breakerAllows(methodName) {
+		rl.refundTap(ctx, methodName)
+		rl.rejectHook(ctx, methodName, RejectCircuitOpen)
+		return nil, status.Error(codes.Unavailable, "Circuit open, request denied")
+	}
+	if rl.doomed(ctx, methodName) {
+		rl.refundTap(ctx, methodName)
+		rl.rejectHook(ctx, methodName, RejectDeadline)
+		return nil, status.Error(codes.ResourceExhausted, "Deadline shorter than the expected latency, request denied")
+	}
+	release, ok := rl.acquireSlot(ctx, methodName)
+	if !ok {
+		rl.refundTap(ctx, methodName)
+		rl.recordConcurrencyRejection(methodName)
+		rl.rejectHook(ctx, methodName, RejectConcurrency)
+		return nil, status.Error(codes.ResourceExhausted, "Concurrency limit exceeded, request denied")
+	}
+	// The slot is released even if the handler panics
+	defer release()
+	cost := rl.requestCost(ctx, methodName, req)
+	switch rl.admitUnlessTapped(ctx, methodName, cost) {
+	case abandoned:
+		return nil, status.FromContextError(ctx.Err()).Err()
+	case rejected:
+		rl.recordRejection(methodName, tier)
+		rl.recordTenantOutcome(ctx, methodName, 0, nil, true)
+		rl.rejectHook(ctx, methodName, RejectRateLimit)
 		// ResourceExhausted: use this status code if the rate limit is exceeded
-		return nil, status.Error(codes.ResourceExhausted, "Rate limit exceeded, request denied")
+		err, trailer := rl.rejectionError(methodName, "Rate limit exceeded, request denied")
+		if trailer != nil {
+			grpc.SetTrailer(ctx, trailer)
+		}
+		return nil, err
 	}
+	rl.recordAdmission(methodName)
+	rl.admitHook(ctx, methodName)
+	ctx = rl.withAdmission(ctx, methodName, tier, cost)
 
 	// Proceed with the handler to get the response
-	resp, err := handler(ctx, req)
+	if rl.panicRecovery {
+		defer rl.recoverPanic(methodName, startTime, &err)
+	}
+	resp, err = handler(ctx, req)
 
-	// Calculate the response latency and update metrics after handling the request
-	latency := time.Since(startTime)
-	rl.postProcess(latency, methodName)
+	// Calculate the response latency and update metrics after handling the request, unless a
+	// StatsHandler measures it when the response is written
+	if !measuredByStats(ctx, methodName, tier) {
+		latency := rl.clock.Now().Sub(startTime)
+		outcome := rl.recordOutcome(ctx, latency, methodName, tier, err)
+		rl.recordTenantOutcome(ctx, methodName, latency, err, false)
+		rl.completionHook(ctx, methodName, latency, outcome)
+	}
+	if hints := rl.rateHeaders(methodName); err == nil && hints != nil {
+		grpc.SetTrailer(ctx, hints)
+	}
 
 	return resp, err
 }
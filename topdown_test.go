@@ -0,0 +1,316 @@
+package topdown
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// newTestRL creates a limiter with NewTopDownRLWithBuckets and stops it at the end of the test.
+func newTestRL(t testing.TB, buckets map[string]BucketConfig, slo map[string]time.Duration, opts ...Option) *TopDownRL {
+	t.Helper()
+	rl, err := NewTopDownRLWithBuckets(buckets, slo, false, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rl.Stop(context.Background()) })
+	return rl
+}
+
+// echoMethod is the full name of the method of the echo service served by newTestServer.
+const echoMethod = "/topdown.test.Echo/Echo"
+
+// echoServiceDesc describes a service whose Echo method returns its request, calling handler
+// first if the server was created with one.
+var echoServiceDesc = grpc.ServiceDesc{
+	ServiceName: "topdown.test.Echo",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Echo",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := &structpb.Struct{}
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				if h, ok := srv.(func(context.Context) error); ok && h != nil {
+					if err := h(ctx); err != nil {
+						return nil, err
+					}
+				}
+				return req, nil
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: echoMethod}, handler)
+		},
+	}},
+}
+
+// newTestServer serves the echo service over an in-memory connection with the server options, e.g.
+// the interceptors of a limiter, and returns a client connection to it created with the dial
+// options. handler, if not nil, runs in every Echo call before the request is echoed.
+func newTestServer(t testing.TB, handler func(context.Context) error, serverOpts []grpc.ServerOption, dialOpts ...grpc.DialOption) *grpc.ClientConn {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(serverOpts...)
+	server.RegisterService(&echoServiceDesc, handler)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	dialOpts = append([]grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}, dialOpts...)
+	conn, err := grpc.NewClient("passthrough:///bufconn", dialOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// echo calls the Echo method of the test server on conn.
+func echo(ctx context.Context, conn *grpc.ClientConn, req *structpb.Struct) error {
+	return conn.Invoke(ctx, echoMethod, req, &structpb.Struct{})
+}
+
+func TestIntervalBoundaries(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 10, RefillRate: 1}},
+		map[string]time.Duration{"/a": time.Second}, WithClock(clock))
+	info := &grpc.UnaryServerInfo{FullMethod: "/a"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	ctx := context.Background()
+	goodput := func() int64 {
+		snapshot, err := rl.GetMetricsSnapshot("/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return snapshot.Goodput
+	}
+
+	for i := 0; i < 3; i++ {
+		rl.UnaryInterceptor(ctx, nil, info, handler)
+	}
+	clock.Advance(999 * time.Millisecond)
+	if got := goodput(); got != 0 {
+		t.Fatalf("goodput = %d before the first tick, want 0", got)
+	}
+
+	clock.Advance(time.Millisecond)
+	waitUntil(t, func() bool { return goodput() == 3 })
+
+	rl.UnaryInterceptor(ctx, nil, info, handler)
+	clock.Advance(time.Second)
+	waitUntil(t, func() bool { return goodput() == 1 })
+}
+
+func TestUnknownMethodBypass(t *testing.T) {
+	rl := NewTopDownRL(1, 0, map[string]time.Duration{"/a": time.Second}, false)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if !rl.Allow(ctx, "/unknown") {
+			t.Fatal("request for an unknown method rejected, want it to bypass rate limiting")
+		}
+	}
+	rl.postProcess(time.Millisecond, "/unknown", -1, 0, settlement{})
+	if _, err := rl.GetMetricsSnapshot("/unknown"); err == nil {
+		t.Error("unknown method registered under UnknownMethodBypass")
+	}
+}
+
+func TestUnknownMethodRegisterConcurrently(t *testing.T) {
+	rl := NewTopDownRL(1, 0, map[string]time.Duration{"/a": time.Second}, false,
+		WithUnknownMethodPolicy(UnknownMethodRegister), WithDefaultSLO(50*time.Millisecond), WithDefaultBucket(7, 3))
+
+	const goroutines = 64
+	seen := make(chan *InterfaceMetrics, goroutines)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			rl.Allow(context.Background(), "/new")
+			seen <- rl.loadMetrics("/new")
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(seen)
+
+	first := <-seen
+	for metrics := range seen {
+		if metrics != first {
+			t.Fatal("concurrent first requests registered the method more than once")
+		}
+	}
+	if first.SLO != 50*time.Millisecond || first.MaxTokens != 7 || first.RefillRate != 3 {
+		t.Errorf("registered with SLO %v and bucket %d/%v, want the defaults 50ms and 7/3", first.SLO, first.MaxTokens, first.RefillRate)
+	}
+}
+
+func TestConcurrentInterceptorTicksAndReads(t *testing.T) {
+	const (
+		workers  = 8
+		requests = 500
+	)
+	clock := NewFakeClock(time.Unix(1000, 0))
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 100, RefillRate: 1000}},
+		map[string]time.Duration{"/a": time.Second}, WithClock(clock))
+	info := &grpc.UnaryServerInfo{FullMethod: "/a"}
+	var admitted atomic.Int64
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		admitted.Add(1)
+		return nil, nil
+	}
+	ctx := context.Background()
+
+	// Rollovers run back to back next to the ticker, and reads next to both
+	metrics := rl.loadMetrics("/a")
+	var done atomic.Bool
+	var background sync.WaitGroup
+	background.Add(2)
+	go func() {
+		defer background.Done()
+		for !done.Load() {
+			rl.rollover(metrics, clock.Now())
+		}
+	}()
+	go func() {
+		defer background.Done()
+		for !done.Load() {
+			rl.GetMetrics("/a")
+			rl.GetAllMetrics()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				rl.UnaryInterceptor(ctx, nil, info, handler)
+			}
+		}()
+	}
+	wg.Wait()
+	done.Store(true)
+	background.Wait()
+
+	snapshot, err := rl.GetMetricsSnapshot("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := admitted.Load() + snapshot.RejectedTotal; got != workers*requests {
+		t.Errorf("admitted %d and rejected %d requests, want %d in total", admitted.Load(), snapshot.RejectedTotal, workers*requests)
+	}
+}
+
+func TestTickerRacesTrafficAndHTTPReads(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the ticker for a few seconds")
+	}
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 100, RefillRate: 1000}, "/b": {MaxTokens: 100, RefillRate: 1000}},
+		map[string]time.Duration{"/a": time.Second, "/b": time.Second}, WithMetricsInterval(time.Millisecond))
+	server := httptest.NewServer(rl.Handler())
+	defer server.Close()
+	var admitted atomic.Int64
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		admitted.Add(1)
+		return nil, nil
+	}
+	ctx := context.Background()
+
+	var done atomic.Bool
+	var wg sync.WaitGroup
+	run := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !done.Load() {
+				f()
+			}
+		}()
+	}
+	for _, method := range []string{"/a", "/b"} {
+		info := &grpc.UnaryServerInfo{FullMethod: method}
+		run(func() { rl.UnaryInterceptor(ctx, nil, info, handler) })
+	}
+	for _, path := range []string{"/metrics", "/metrics?method=/a", "/prometheus"} {
+		url := server.URL + path
+		run(func() {
+			resp, err := http.Get(url)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("GET %s = %d, want 200", path, resp.StatusCode)
+			}
+		})
+	}
+	// Methods come and go while the ticker ranges over them
+	run(func() {
+		if err := rl.RegisterMethod("/c", time.Second, 10, 10); err != nil {
+			t.Error(err)
+		}
+		if err := rl.UnregisterMethod("/c"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	time.Sleep(2 * time.Second)
+	done.Store(true)
+	wg.Wait()
+
+	if admitted.Load() == 0 {
+		t.Error("no request admitted, want the traffic to have run")
+	}
+}
+
+// BenchmarkPostProcess measures recording the latency of a completed request, which must not
+// allocate once the method is registered.
+func BenchmarkPostProcess(b *testing.B) {
+	rl := newTestRL(b, map[string]BucketConfig{"/a": {MaxTokens: 10, RefillRate: 10}}, map[string]time.Duration{"/a": time.Second})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rl.postProcess(time.Duration(i%1000)*time.Microsecond, "/a", -1, 0, settlement{})
+	}
+}
+
+func TestPostProcessDoesNotAllocate(t *testing.T) {
+	rl, err := NewTopDownRLWithBuckets(map[string]BucketConfig{"/a": {MaxTokens: 10, RefillRate: 10}}, map[string]time.Duration{"/a": time.Second}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.Stop(context.Background())
+	rl.postProcess(time.Millisecond, "/a", -1, 0, settlement{})
+
+	latency := time.Duration(0)
+	allocs := testing.AllocsPerRun(1000, func() {
+		latency += 7 * time.Microsecond
+		rl.postProcess(latency, "/a", -1, 0, settlement{})
+	})
+	if allocs != 0 {
+		t.Errorf("postProcess allocated %v times per call, want 0", allocs)
+	}
+}
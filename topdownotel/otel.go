@@ -0,0 +1,125 @@
+// Package topdownotel records the metrics of a TopDownRL with OpenTelemetry and annotates the
+// spans of the requests it admits and rejects. It lives in its own package so that the limiter
+// doesn't depend on OpenTelemetry.
+package topdownotel
+
+import (
+	"context"
+	"time"
+
+	topdown "github.com/Jiali-Xing/topdown-grpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ScopeName is the instrumentation scope of the meter.
+const ScopeName = "github.com/Jiali-Xing/topdown-grpc"
+
+// Attribute keys of the instruments and span annotations.
+const (
+	MethodKey          = attribute.Key("rpc.method")
+	ReasonKey          = attribute.Key("topdown.rejection_reason")
+	OutcomeKey         = attribute.Key("topdown.latency_class")
+	TokensRemainingKey = attribute.Key("topdown.tokens_remaining")
+)
+
+// latencyBuckets are the bucket boundaries of the latency histogram in seconds.
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Observer records the decisions and outcomes of a TopDownRL as OpenTelemetry instruments and
+// span events. It's installed with Option.
+type Observer struct {
+	admitted metric.Int64Counter
+	rejected metric.Int64Counter
+	goodput  metric.Int64Counter
+	latency  metric.Float64Histogram
+	tokens   metric.Float64ObservableGauge
+
+	meter metric.Meter
+	rl    *topdown.TopDownRL
+}
+
+// New creates the instruments of an Observer with a meter of provider:
+//
+//   - topdown.requests.admitted, topdown.requests.rejected (with the reason) and
+//     topdown.requests.goodput, counting requests per method,
+//   - topdown.request.duration, a histogram of the latency of completed requests in seconds with
+//     their outcome, and
+//   - topdown.tokens, a gauge of the tokens in the bucket of every method read at collection.
+func New(provider metric.MeterProvider) (*Observer, error) {
+	o := &Observer{meter: provider.Meter(ScopeName)}
+	var err error
+	if o.admitted, err = o.meter.Int64Counter("topdown.requests.admitted",
+		metric.WithDescription("Requests admitted by the rate limiter."), metric.WithUnit("{request}")); err != nil {
+		return nil, err
+	}
+	if o.rejected, err = o.meter.Int64Counter("topdown.requests.rejected",
+		metric.WithDescription("Requests rejected by the rate limiter."), metric.WithUnit("{request}")); err != nil {
+		return nil, err
+	}
+	if o.goodput, err = o.meter.Int64Counter("topdown.requests.goodput",
+		metric.WithDescription("Requests completed within their SLO."), metric.WithUnit("{request}")); err != nil {
+		return nil, err
+	}
+	if o.latency, err = o.meter.Float64Histogram("topdown.request.duration",
+		metric.WithDescription("Latency of the requests admitted by the rate limiter."), metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(latencyBuckets...)); err != nil {
+		return nil, err
+	}
+	if o.tokens, err = o.meter.Float64ObservableGauge("topdown.tokens",
+		metric.WithDescription("Tokens available in the bucket of the method."), metric.WithUnit("{token}")); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Option installs the observer on the limiter being created; an Observer serves a single limiter.
+func (o *Observer) Option() topdown.Option {
+	return func(rl *topdown.TopDownRL) {
+		o.rl = rl
+		topdown.WithRequestObserver(o)(rl)
+	}
+}
+
+// Register registers the callback reading the tokens of the methods of the limiter the observer
+// was installed on, and returns it for unregistering once the limiter is stopped.
+func (o *Observer) Register() (metric.Registration, error) {
+	return o.meter.RegisterCallback(func(ctx context.Context, observer metric.Observer) error {
+		if o.rl == nil {
+			return nil
+		}
+		for methodName, snapshot := range o.rl.GetAllMetrics() {
+			observer.ObserveFloat64(o.tokens, snapshot.CurrentTokens, metric.WithAttributes(MethodKey.String(methodName)))
+		}
+		return nil
+	}, o.tokens)
+}
+
+// Admitted counts an admitted request and adds an event with the tokens left to its span.
+func (o *Observer) Admitted(ctx context.Context, method string, tokensRemaining float64) {
+	o.admitted.Add(ctx, 1, metric.WithAttributes(MethodKey.String(method)))
+	if span := trace.SpanFromContext(ctx); span.IsRecording() {
+		span.AddEvent("topdown.admitted", trace.WithAttributes(TokensRemainingKey.Float64(tokensRemaining)))
+	}
+}
+
+// Rejected counts a rejected request and records the reason on its span.
+func (o *Observer) Rejected(ctx context.Context, method string, reason topdown.RejectReason) {
+	o.rejected.Add(ctx, 1, metric.WithAttributes(MethodKey.String(method), ReasonKey.String(string(reason))))
+	if span := trace.SpanFromContext(ctx); span.IsRecording() {
+		span.AddEvent("topdown.rejected", trace.WithAttributes(ReasonKey.String(string(reason))))
+		span.SetAttributes(ReasonKey.String(string(reason)))
+	}
+}
+
+// Completed records the latency of a completed request and its classification on its span.
+func (o *Observer) Completed(ctx context.Context, method string, latency time.Duration, outcome topdown.Outcome) {
+	if outcome == topdown.OutcomeGood {
+		o.goodput.Add(ctx, 1, metric.WithAttributes(MethodKey.String(method)))
+	}
+	o.latency.Record(ctx, latency.Seconds(), metric.WithAttributes(MethodKey.String(method), OutcomeKey.String(string(outcome))))
+	if span := trace.SpanFromContext(ctx); span.IsRecording() {
+		span.SetAttributes(OutcomeKey.String(string(outcome)))
+	}
+}
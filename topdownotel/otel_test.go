@@ -0,0 +1,104 @@
+package topdownotel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	topdown "github.com/Jiali-Xing/topdown-grpc"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+)
+
+func TestObserverRecordsInstruments(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	observer, err := New(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := topdown.NewTopDownRLWithBuckets(map[string]topdown.BucketConfig{"/a": {MaxTokens: 2, RefillRate: 0.1}},
+		map[string]time.Duration{"/a": time.Second}, false,
+		topdown.WithClock(topdown.NewFakeClock(time.Unix(1000, 0))), topdown.WithMetricsInterval(time.Hour), observer.Option())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Stop(context.Background())
+	registration, err := observer.Register()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registration.Unregister()
+
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("test")
+	info := &grpc.UnaryServerInfo{FullMethod: "/a"}
+	handler := func(context.Context, interface{}) (interface{}, error) { return nil, nil }
+	for i := 0; i < 3; i++ {
+		ctx, span := tracer.Start(context.Background(), "call")
+		rl.UnaryInterceptor(ctx, nil, info, handler)
+		span.End()
+	}
+
+	var metrics metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &metrics); err != nil {
+		t.Fatal(err)
+	}
+	instruments := make(map[string]metricdata.Aggregation)
+	for _, scope := range metrics.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			instruments[m.Name] = m.Data
+		}
+	}
+	counters := map[string]int64{"topdown.requests.admitted": 2, "topdown.requests.rejected": 1, "topdown.requests.goodput": 2}
+	for name, want := range counters {
+		sum, ok := instruments[name].(metricdata.Sum[int64])
+		if !ok || len(sum.DataPoints) != 1 {
+			t.Errorf("%s = %+v, want one data point", name, instruments[name])
+			continue
+		}
+		point := sum.DataPoints[0]
+		if method, _ := point.Attributes.Value(MethodKey); point.Value != want || method.AsString() != "/a" {
+			t.Errorf("%s = %d for %v, want %d for /a", name, point.Value, point.Attributes, want)
+		}
+	}
+	if sum, ok := instruments["topdown.requests.rejected"].(metricdata.Sum[int64]); ok && len(sum.DataPoints) == 1 {
+		if reason, _ := sum.DataPoints[0].Attributes.Value(ReasonKey); reason.AsString() != string(topdown.RejectRateLimit) {
+			t.Errorf("rejection reason = %q, want %q", reason.AsString(), topdown.RejectRateLimit)
+		}
+	}
+	if histogram, ok := instruments["topdown.request.duration"].(metricdata.Histogram[float64]); !ok || len(histogram.DataPoints) != 1 || histogram.DataPoints[0].Count != 2 {
+		t.Errorf("topdown.request.duration = %+v, want 2 latencies", instruments["topdown.request.duration"])
+	}
+	if gauge, ok := instruments["topdown.tokens"].(metricdata.Gauge[float64]); !ok || len(gauge.DataPoints) != 1 || gauge.DataPoints[0].Value != 0 {
+		t.Errorf("topdown.tokens = %+v, want 0 tokens", instruments["topdown.tokens"])
+	}
+
+	ended := spans.Ended()
+	if len(ended) != 3 {
+		t.Fatalf("recorded %d spans, want 3", len(ended))
+	}
+	want := []struct {
+		event string
+		attr  attribute.KeyValue
+	}{
+		{"topdown.admitted", OutcomeKey.String(string(topdown.OutcomeGood))},
+		{"topdown.admitted", OutcomeKey.String(string(topdown.OutcomeGood))},
+		{"topdown.rejected", ReasonKey.String(string(topdown.RejectRateLimit))},
+	}
+	for i, span := range ended {
+		if events := span.Events(); len(events) != 1 || events[0].Name != want[i].event {
+			t.Errorf("span %d events = %+v, want %s", i, events, want[i].event)
+		}
+		found := false
+		for _, attr := range span.Attributes() {
+			found = found || attr == want[i].attr
+		}
+		if !found {
+			t.Errorf("span %d attributes = %v, want %v", i, span.Attributes(), want[i].attr)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Package topdownredis implements the distributed mode backend of a TopDownRL with Redis, see
+// topdown.WithDistributed. It lives in its own package so that the limiter doesn't depend on a
+// Redis client.
+package topdownredis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultPrefix is the prefix of the keys if none is given.
+const DefaultPrefix = "topdown"
+
+// reportScript stores the demand of a replica and returns the demands of the live replicas in a
+// single atomic step. The expiries are kept in a sorted set by the time of the Redis server, so
+// the clocks of the replicas don't matter, and both keys expire once every replica stopped.
+var reportScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local ttl = tonumber(ARGV[3])
+redis.call('ZADD', KEYS[1], now + ttl, ARGV[1])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+local expired = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', now)
+if #expired > 0 then
+	redis.call('ZREM', KEYS[1], unpack(expired))
+	redis.call('HDEL', KEYS[2], unpack(expired))
+end
+redis.call('PEXPIRE', KEYS[1], ttl)
+redis.call('PEXPIRE', KEYS[2], ttl)
+return redis.call('HGETALL', KEYS[2])
+`)
+
+// Backend is a topdown.Backend keeping the demands of the replicas in Redis, under two keys
+// sharing a hash tag so that it works with Redis Cluster too.
+type Backend struct {
+	client   redis.Scripter
+	replicas string
+	demands  string
+}
+
+// New creates a Backend using client, which may be a *redis.Client, *redis.ClusterClient or
+// *redis.Ring. The replicas of a service must use the same prefix, and each service its own; an
+// empty prefix uses DefaultPrefix.
+func New(client redis.Scripter, prefix string) *Backend {
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	return &Backend{
+		client:   client,
+		replicas: fmt.Sprintf("{%s}:replicas", prefix),
+		demands:  fmt.Sprintf("{%s}:demands", prefix),
+	}
+}
+
+// Report implements topdown.Backend.
+func (b *Backend) Report(ctx context.Context, replica string, demand map[string]float64, ttl time.Duration) (map[string]map[string]float64, error) {
+	encoded, err := json.Marshal(demand)
+	if err != nil {
+		return nil, err
+	}
+	ttlMs := max(ttl.Milliseconds(), 1)
+
+	values, err := reportScript.Run(ctx, b.client, []string{b.replicas, b.demands}, replica, encoded, ttlMs).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	demands := make(map[string]map[string]float64, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		var replicaDemand map[string]float64
+		if err := json.Unmarshal([]byte(values[i+1]), &replicaDemand); err != nil {
+			return nil, fmt.Errorf("invalid demand of replica '%s': %w", values[i], err)
+		}
+		demands[values[i]] = replicaDemand
+	}
+	return demands, nil
+}
@@ -2,83 +2,208 @@ package topdown
 
 import (
 	"context"
-	"fmt"
-	"log"
-	"sort"
-	"sync/atomic"
 	"time"
 
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 )
 
-// calculateTailLatency95th calculates the 95th percentile tail latency from the current latency history.
-func (rl *TopDownRL) calculateTailLatency95th(methodName string) time.Duration {
-	rl.mutex.Lock()
-	defer rl.mutex.Unlock()
+// rollover closes the current interval of a method at now: it calculates the tail latencies, saves
+// the counters and records the interval in one critical section, so readers never see a mix of two intervals.
+func (rl *TopDownRL) rollover(metrics *InterfaceMetrics, now time.Time) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	empty := metrics.latencies.Count() == 0
+	rl.calculateTailLatenciesLocked(metrics)
+	rl.rolloverLatencyBucketsLocked(metrics)
+	rl.saveMetricsLocked(metrics)
+	rl.smoothLocked(metrics, empty)
+	if metrics.tenants != nil {
+		metrics.tenants.rollover(now, metrics.RefillRate)
+	}
+	countEmptyIntervalLocked(metrics)
 
-	metrics := rl.interfaces[methodName]
+	// The last tail latency is kept across empty intervals, but the history records them as empty
+	tailLatency := metrics.LastTailLatency95th
+	if empty {
+		tailLatency = 0
+	}
+	rl.recordBudgetLocked(metrics, now)
+	rl.loadReportLocked(metrics, tailLatency, now)
+	rl.detectOverloadLocked(metrics, tailLatency, empty)
+	rl.recordIntervalLocked(metrics, tailLatency, now)
+	rl.exportLocked(metrics, now)
+	rl.scheduleLocked(metrics, now)
+	rl.expireOverrideLocked(metrics, now)
+	rl.rampLocked(metrics, now)
+	controlLatency, controlEmpty := rl.controlLatencyLocked(metrics, tailLatency, empty)
+	rl.controlLocked(metrics, controlLatency, controlEmpty)
+	if metrics.codel != nil {
+		metrics.codel.update(tailLatency, metrics.SLO, empty, now)
+	}
+}
 
-	// do the same thing as in the original code but with the metrics
-	if len(metrics.LatencyHistory) == 0 {
-		return 0 // No data, return 0 or a default value
+// calculateTailLatenciesLocked calculates the configured tail latency percentiles from the current latency histogram.
+// The first configured percentile (the 95th by default) is also saved as LastTailLatency95th.
+// The caller must hold metrics.mu.
+func (rl *TopDownRL) calculateTailLatenciesLocked(metrics *InterfaceMetrics) {
+	// The rolling windows include empty intervals so they always span the same time
+	if metrics.latencyWindows != nil {
+		metrics.latencyWindows.push(metrics.latencies)
+		rl.windowTailLatenciesLocked(metrics)
+	}
+	if metrics.peerLatencies != nil {
+		metrics.peerLatencies.copyFrom(metrics.latencies)
 	}
 
-	// Sort the latencies to find the 95th percentile
-	sort.Slice(metrics.LatencyHistory, func(i, j int) bool {
-		return metrics.LatencyHistory[i] < metrics.LatencyHistory[j]
-	})
+	if metrics.queueWaits.Count() > 0 {
+		metrics.LastQueueWaits = quantiles(metrics.queueWaits, metrics.Percentiles)
+		metrics.queueWaits.Reset()
+	}
 
-	index := int(float64(len(metrics.LatencyHistory)) * 0.95)
-	if index >= len(metrics.LatencyHistory) {
-		index = len(metrics.LatencyHistory) - 1
+	if metrics.errorLatencies.Count() > 0 {
+		metrics.LastErrorTailLatencies = quantiles(metrics.errorLatencies, metrics.Percentiles)
+		metrics.errorLatencies.Reset()
 	}
 
-	// Update the last 95th percentile latency and clear the history for the next second
-	metrics.LastTailLatency95th = metrics.LatencyHistory[index]
-	metrics.LatencyHistory = metrics.LatencyHistory[:0] // Clear the latency history
+	metrics.LastTotalTailLatencies = nil
+	if metrics.ExternalCounter > 0 {
+		metrics.LastTotalTailLatencies = quantiles(metrics.totalLatencies, metrics.Percentiles)
+	}
+	metrics.totalLatencies.Reset()
+	metrics.CurrentExternal, metrics.ExternalCounter = metrics.ExternalCounter, 0
+
+	// Compute the tail latencies of the requests that completed successfully in this interval
+	metrics.LastSampleCount = metrics.latencies.Count()
+	if metrics.LastSampleCount == 0 {
+		metrics.exportLatencies = nil
+		if rl.emptyLatencyMode == EmptyLatencyClear {
+			metrics.LastTailLatencies = make(map[float64]time.Duration)
+			metrics.LastTailLatency95th = 0
+		}
+		return // No data, keep the last tail latencies unless they are cleared
+	}
+	if rl.export != nil {
+		metrics.exportLatencies = quantiles(metrics.latencies, exportPercentiles)
+	}
 
-	return metrics.LastTailLatency95th
+	// Update the last tail latencies and clear the histogram for the next second
+	metrics.LastTailLatencies = quantiles(metrics.latencies, metrics.Percentiles)
+	metrics.LastTailLatency95th = metrics.LastTailLatencies[metrics.Percentiles[0]]
+	metrics.latencies.Reset()
 }
 
-// getMethodName extracts the method name from the gRPC metadata.
-func getMethodName(ctx context.Context) string {
-	md, _ := metadata.FromIncomingContext(ctx)
-	if methodNames, exists := md["method"]; exists && len(methodNames) > 0 {
-		return methodNames[0]
+// quantiles reads every percentile in percentiles from h.
+func quantiles(h *latencyHistogram, percentiles []float64) map[float64]time.Duration {
+	latencies := make(map[float64]time.Duration, len(percentiles))
+	for _, percentile := range percentiles {
+		latencies[percentile] = h.Quantile(percentile)
 	}
-	log.Panicf("Method name not found in metadata: %v", md)
-	return ""
+	return latencies
 }
 
-// saveMetrics saves the current goodput and latency before resetting the counters.
-func (rl *TopDownRL) saveMetrics(methodName string) {
-	metrics := rl.interfaces[methodName]
+// methodName resolves the method name for a request. The method metadata keys take
+// precedence; otherwise it falls back to fullMethod, the name reported by gRPC in the
+// server info. An empty string is returned if neither is available.
+func (rl *TopDownRL) methodName(ctx context.Context, fullMethod string) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if name, ok := firstValue(md, rl.methodKeys); ok {
+			return name
+		}
+	}
+	return fullMethod
+}
 
-	metrics.CurrentGoodput = atomic.SwapInt64(&metrics.GoodputCounter, 0)
+// saveMetricsLocked saves the current goodput, rejections and errors before resetting the counters.
+// The caller must hold metrics.mu.
+func (rl *TopDownRL) saveMetricsLocked(metrics *InterfaceMetrics) {
+	metrics.CurrentGoodput, metrics.GoodputCounter = metrics.GoodputCounter, 0
+	metrics.CurrentRejected, metrics.RejectedCounter = metrics.RejectedCounter, 0
+	metrics.CurrentSloViolations, metrics.SloViolationCounter = metrics.SloViolationCounter, 0
+	metrics.SloViolationsTotal += metrics.CurrentSloViolations
+	metrics.CurrentTokensConsumed = metrics.tokensConsumed.Swap(0)
+	metrics.CurrentArrivals, metrics.CurrentAdmitted = metrics.arrivals.Swap(0), metrics.admitted.Swap(0)
+	metrics.ArrivalsTotal += metrics.CurrentArrivals
+	metrics.AdmittedTotal += metrics.CurrentAdmitted
+	metrics.CurrentMemberArrivals = rl.swapMemberArrivals(metrics.method)
+	metrics.CurrentRetryArrivals = metrics.retryArrivals.Swap(0)
+	metrics.CurrentRetryGoodput, metrics.RetryGoodputCounter = metrics.RetryGoodputCounter, 0
+	metrics.RetryArrivalsTotal += metrics.CurrentRetryArrivals
+	metrics.RetryGoodputTotal += metrics.CurrentRetryGoodput
+	metrics.CurrentShed, metrics.CurrentShedEvaluated = metrics.shed.shed.Swap(0), metrics.shed.evaluated.Swap(0)
+	metrics.ShedTotal += metrics.CurrentShed
+	metrics.CurrentLimitRejected, metrics.CurrentGlobalRejected = metrics.limitRejected.Swap(0), metrics.globalRejected.Swap(0)
+	metrics.GlobalRejectedTotal += metrics.CurrentGlobalRejected
+	metrics.CurrentBorrowed = metrics.borrowed.Swap(0)
+	metrics.CurrentTenantRejected = metrics.tenantRejected.Swap(0)
+	metrics.CurrentCPURejected = metrics.cpuRejected.Swap(0)
+	metrics.CPURejectedTotal += metrics.CurrentCPURejected
+	metrics.CurrentMemoryRejected = metrics.memoryRejected.Swap(0)
+	metrics.BorrowedTotal += metrics.CurrentBorrowed
+	metrics.CurrentTierGoodput, metrics.TierGoodputCounter = metrics.TierGoodputCounter, make([]int64, len(metrics.TierGoodputCounter))
+	metrics.CurrentTierRejected, metrics.TierRejectedCounter = metrics.TierRejectedCounter, make([]int64, len(metrics.TierRejectedCounter))
+	metrics.CurrentConcurrencyRejected, metrics.ConcurrencyRejectedCounter = metrics.ConcurrencyRejectedCounter, 0
+	metrics.CurrentAbandoned, metrics.AbandonedCounter = metrics.AbandonedCounter, 0
+	metrics.CurrentDoomed, metrics.DoomedCounter = metrics.DoomedCounter, 0
+	metrics.CurrentWouldReject, metrics.WouldRejectCounter = metrics.WouldRejectCounter, 0
+	metrics.CurrentShadowAdmitted, metrics.ShadowAdmittedCounter = metrics.ShadowAdmittedCounter, 0
+	metrics.CurrentCancelled, metrics.CancelledCounter = metrics.CancelledCounter, 0
+	metrics.CurrentPanics, metrics.PanicCounter = metrics.PanicCounter, 0
+	metrics.CurrentDegraded, metrics.DegradedCounter = metrics.DegradedCounter, 0
+	metrics.CurrentErrors, metrics.ErrorCounter = metrics.ErrorCounter, 0
+	metrics.CurrentErrorsByCode, metrics.ErrorsByCode = metrics.ErrorsByCode, make(map[codes.Code]int64)
 	if rl.Debug {
-		fmt.Printf("[DEBUG] Goodput for this interval: %d\n", metrics.CurrentGoodput)
+		rl.logger.Debugf("Goodput for this interval: %d, rejected: %d", metrics.CurrentGoodput, metrics.CurrentRejected)
+	}
+}
+
+// extractStartTime returns the start time of a request according to the latency mode.
+func (rl *TopDownRL) extractStartTime(ctx context.Context, methodName string) time.Time {
+	serverStart := rl.clock.Now()
+	switch rl.latencyMode {
+	case LatencyServerHandlerTime:
+		return serverStart
+	case LatencyHybrid:
+		// Only trust the client timestamp if the client clock agrees with ours
+		clientStart, ok := rl.clientStartTime(ctx, methodName)
+		if !ok {
+			return serverStart
+		}
+		skew := serverStart.Sub(clientStart)
+		if skew < -rl.maxClockSkew || skew > rl.maxClockSkew {
+			return serverStart
+		}
+		return clientStart
+	default:
+		if clientStart, ok := rl.clientStartTime(ctx, methodName); ok {
+			return clientStart
+		}
+		return serverStart
 	}
 }
 
-// extractStartTime extracts the start time from the gRPC metadata.
-func extractStartTime(ctx context.Context) time.Time {
+// clientStartTime extracts the start time set by the client in the gRPC metadata.
+// Timestamps that are present but can't be parsed are counted per method.
+func (rl *TopDownRL) clientStartTime(ctx context.Context, methodName string) (time.Time, bool) {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
-		return time.Now()
+		return time.Time{}, false
 	}
 
-	timestamp, exists := md["timestamp"]
-	if !exists || len(timestamp) == 0 {
-		return time.Now()
+	timestamp, exists := firstValue(md, rl.timestampKeys)
+	if !exists {
+		return time.Time{}, false
 	}
 
 	// Parse the timestamp string to time.Time
-	startTime, err := time.Parse(time.RFC3339, timestamp[0])
-	if err != nil {
-		return time.Now()
+	startTime, ok := parseTimestamp(timestamp, rl.timestampFormat)
+	if !ok {
+		rl.recordUnparseableTimestamp(methodName)
+		return time.Time{}, false
 	}
 
-	return startTime
+	return startTime, true
 }
 
 // CalculateResponseLatency calculates the response latency using the start time.
@@ -86,15 +211,29 @@ func CalculateResponseLatency(startTime time.Time) time.Duration {
 	return time.Since(startTime)
 }
 
-// min is a helper function to get the minimum of two floats.
-func min(a, b float64) float64 {
-	if a < b {
-		return a
+// durationMs converts a duration to fractional milliseconds.
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// ratio returns n/total, or zero if total is zero.
+func ratio(n, total int64) float64 {
+	if total == 0 {
+		return 0
 	}
-	return b
+	return float64(n) / float64(total)
+}
+
+// admissionRatio returns the share of the arrivals that were admitted, 1 without arrivals.
+func admissionRatio(admitted, arrivals int64) float64 {
+	if arrivals == 0 {
+		return 1
+	}
+	return float64(admitted) / float64(arrivals)
 }
 
-func intMin(a, b int64) int64 {
+// min is a helper function to get the minimum of two floats.
+func min(a, b float64) float64 {
 	if a < b {
 		return a
 	}
@@ -0,0 +1,113 @@
+package topdown
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestTailLatencyPercentiles(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	rl, err := NewTopDownRLWithBuckets(map[string]BucketConfig{"/a": {MaxTokens: 10, RefillRate: 10}, "/b": {MaxTokens: 10, RefillRate: 10}},
+		map[string]time.Duration{"/a": 10 * time.Second, "/b": 10 * time.Second},
+		false, WithClock(clock), WithPercentiles(0.5, 0.95, 0.99), WithMethodPercentiles("/b", 0.99))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Compute the percentiles by hand instead of on the ticker
+	rl.Stop(context.Background())
+
+	// 1ms to 1000ms in steps of 1ms, recorded out of order
+	for i := 0; i < 1000; i++ {
+		latency := time.Duration((i*389)%1000+1) * time.Millisecond
+		rl.postProcess(latency, "/a", -1, 0, settlement{})
+		rl.postProcess(latency, "/b", -1, 0, settlement{})
+	}
+	rl.rollover(rl.loadMetrics("/a"), clock.Now())
+	rl.rollover(rl.loadMetrics("/b"), clock.Now())
+
+	// The nearest rank of p in 1..1000 is 1000p, within the relative error of the histogram
+	check := func(method string, want map[float64]time.Duration) {
+		t.Helper()
+		snapshot, err := rl.GetMetricsSnapshot(method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(snapshot.TailLatencies) != len(want) {
+			t.Errorf("%s: tail latencies = %v, want the percentiles of %v", method, snapshot.TailLatencies, want)
+		}
+		for percentile, latency := range want {
+			got := snapshot.TailLatencies[percentile]
+			if diff := got - latency; diff < -latency/64 || diff > latency/64 {
+				t.Errorf("%s: p%g = %v, want %v", method, percentile*100, got, latency)
+			}
+		}
+	}
+	check("/a", map[float64]time.Duration{0.5: 500 * time.Millisecond, 0.95: 950 * time.Millisecond, 0.99: 990 * time.Millisecond})
+	check("/b", map[float64]time.Duration{0.99: 990 * time.Millisecond})
+
+	snapshot, _ := rl.GetMetricsSnapshot("/a")
+	if snapshot.TailLatency95th != snapshot.TailLatencies[0.5] {
+		t.Errorf("primary tail latency = %v, want the first percentile %v", snapshot.TailLatency95th, snapshot.TailLatencies[0.5])
+	}
+}
+
+func TestMethodName(t *testing.T) {
+	rl := newTestRL(t, nil, map[string]time.Duration{"/a": time.Second})
+	tests := []struct {
+		name       string
+		md         metadata.MD
+		fullMethod string
+		want       string
+	}{
+		{"no metadata", nil, "/svc/Full", "/svc/Full"},
+		{"metadata without the key", metadata.Pairs("other", "/b"), "/svc/Full", "/svc/Full"},
+		{"metadata with the key", metadata.Pairs(DefaultMethodKey, "/a"), "/svc/Full", "/a"},
+		{"multiple values", metadata.MD{DefaultMethodKey: {"", "/a", "/b"}}, "/svc/Full", "/a"},
+		{"empty value", metadata.MD{DefaultMethodKey: {""}}, "/svc/Full", "/svc/Full"},
+		{"unresolvable", nil, "", ""},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		if tt.md != nil {
+			ctx = metadata.NewIncomingContext(ctx, tt.md)
+		}
+		if got := rl.methodName(ctx, tt.fullMethod); got != tt.want {
+			t.Errorf("%s: methodName() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUnaryInterceptorPassesUnresolvableMethods(t *testing.T) {
+	rl := NewTopDownRL(1, 0, map[string]time.Duration{"/a": time.Second}, false)
+	called := false
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return "ok", nil
+	}
+
+	resp, err := rl.UnaryInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{}, handler)
+	if err != nil || resp != "ok" || !called {
+		t.Errorf("UnaryInterceptor() = %v, %v with the handler called %v, want the handler's response", resp, err, called)
+	}
+}
+
+func TestInterceptorFallsBackToFullMethod(t *testing.T) {
+	rl := NewTopDownRL(1, 0, map[string]time.Duration{echoMethod: time.Second}, false)
+	conn := newTestServer(t, nil, []grpc.ServerOption{grpc.UnaryInterceptor(rl.UnaryInterceptor)})
+	ctx := context.Background()
+
+	// A client that sets no method metadata is limited by the full method name
+	if err := echo(ctx, conn, &structpb.Struct{}); err != nil {
+		t.Fatalf("first Echo() = %v, want it admitted", err)
+	}
+	if err := echo(ctx, conn, &structpb.Struct{}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("second Echo() = %v, want %v", err, codes.ResourceExhausted)
+	}
+}
@@ -0,0 +1,48 @@
+package topdown
+
+import (
+	"fmt"
+	"time"
+)
+
+// WithWarmup sets a grace period after the limiter is created during which Allow admits every
+// request, while still taking tokens and counting the requests it would have rejected like in
+// shadow mode, so the controller can set realistic rates before enforcement begins. With ramp,
+// enforcement phases in linearly instead: a request the limits reject is admitted with the
+// probability of the share of the warm-up left.
+func WithWarmup(duration time.Duration, ramp bool) Option {
+	return func(rl *TopDownRL) {
+		rl.warmup, rl.warmupRamp = duration, ramp
+	}
+}
+
+// validateWarmup checks that the warm-up isn't negative.
+func validateWarmup(duration time.Duration) error {
+	if duration < 0 {
+		return fmt.Errorf("warm-up must not be negative, got %v", duration)
+	}
+	return nil
+}
+
+// warmupRemaining returns the time left of the warm-up at now, zero once it's over.
+func (rl *TopDownRL) warmupRemaining(now time.Time) time.Duration {
+	if rl.warmup == 0 {
+		return 0
+	}
+	if remaining := rl.warmupStart.Add(rl.warmup).Sub(now); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// warmupAdmits reports whether the warm-up admits a request the limits of the method rejected.
+func (rl *TopDownRL) warmupAdmits(metrics *InterfaceMetrics) bool {
+	remaining := rl.warmupRemaining(rl.clock.Now())
+	if remaining == 0 {
+		return false
+	}
+	if !rl.warmupRamp {
+		return true
+	}
+	return metrics.shed.float64() < float64(remaining)/float64(rl.warmup)
+}
@@ -0,0 +1,85 @@
+package topdown
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWarmupEndsAtBoundary(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 1, RefillRate: 0.001}},
+		map[string]time.Duration{"/a": time.Second}, WithClock(clock), WithMetricsInterval(time.Hour), WithWarmup(10*time.Second, false))
+	ctx := context.Background()
+
+	// configWarmup returns the warm-up left as served by HandleConfig
+	configWarmup := func() float64 {
+		rr := httptest.NewRecorder()
+		rl.HandleConfig(rr, httptest.NewRequest(http.MethodGet, "/config", nil))
+		var config struct {
+			WarmupMs          float64 `json:"warmup_ms"`
+			WarmupRemainingMs float64 `json:"warmup_remaining_ms"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&config); err != nil {
+			t.Fatal(err)
+		}
+		if config.WarmupMs != 10000 {
+			t.Errorf("warmup_ms = %v, want 10000", config.WarmupMs)
+		}
+		return config.WarmupRemainingMs
+	}
+
+	for i := 0; i < 3; i++ {
+		if !rl.AllowN(ctx, "/a", 1) {
+			t.Fatalf("request %d rejected during the warm-up", i)
+		}
+	}
+	clock.Advance(10*time.Second - time.Millisecond)
+	if !rl.AllowN(ctx, "/a", 1) {
+		t.Fatal("request rejected 1ms before the end of the warm-up")
+	}
+	if got := configWarmup(); got != 1 {
+		t.Errorf("warmup_remaining_ms = %v, want 1", got)
+	}
+
+	clock.Advance(time.Millisecond)
+	if rl.AllowN(ctx, "/a", 1) {
+		t.Error("request admitted at the end of the warm-up, want enforcement")
+	}
+	if got := configWarmup(); got != 0 {
+		t.Errorf("warmup_remaining_ms = %v, want 0 once enforcement began", got)
+	}
+
+	// Requests admitted by the warm-up were counted as the limits would have decided
+	metrics := rl.loadMetrics("/a")
+	metrics.mu.Lock()
+	wouldReject := metrics.WouldRejectCounter
+	metrics.mu.Unlock()
+	if wouldReject != 3 {
+		t.Errorf("would reject = %d, want the 3 requests beyond the burst the warm-up admitted", wouldReject)
+	}
+}
+
+func TestWarmupRampPhasesInEnforcement(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	rl := newTestRL(t, map[string]BucketConfig{"/a": {MaxTokens: 1, RefillRate: 0.001}},
+		map[string]time.Duration{"/a": time.Second}, WithClock(clock), WithMetricsInterval(time.Hour), WithWarmup(10*time.Second, true))
+	ctx := context.Background()
+	rl.AllowN(ctx, "/a", 1)
+
+	// Halfway through, about half of the requests the limits reject are admitted
+	clock.Advance(5 * time.Second)
+	const n = 2000
+	admitted := 0
+	for i := 0; i < n; i++ {
+		if rl.AllowN(ctx, "/a", 1) {
+			admitted++
+		}
+	}
+	if admitted < n*4/10 || admitted > n*6/10 {
+		t.Errorf("admitted %d of %d requests halfway through the ramp, want about half", admitted, n)
+	}
+}
@@ -0,0 +1,124 @@
+package topdown
+
+import (
+	"fmt"
+	"time"
+)
+
+// WindowLatencies holds the tail latencies of a method over a rolling window, see
+// WithLatencyWindows.
+type WindowLatencies struct {
+	Window        time.Duration
+	TailLatencies map[float64]time.Duration
+	// Samples is the number of latencies in the window, which tells how far its tail latencies
+	// can be trusted.
+	Samples uint64
+}
+
+// latencyWindowSizes returns the lengths in intervals of the rolling windows: the one set with
+// WithLatencyWindow first, if any, then those set with WithLatencyWindows.
+func (rl *TopDownRL) latencyWindowSizes() []int {
+	var sizes []int
+	if rl.latencyWindowIntervals > 0 {
+		sizes = append(sizes, rl.latencyWindowIntervals)
+	}
+	for _, window := range rl.latencyWindows {
+		size := 1
+		if rl.metricsInterval > 0 && window > rl.metricsInterval {
+			size = int((window + rl.metricsInterval - 1) / rl.metricsInterval)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes
+}
+
+// validateLatencyWindows checks that the windows are positive and unique, and that the control
+// window is one of them.
+func (rl *TopDownRL) validateLatencyWindows() error {
+	seen := make(map[time.Duration]bool, len(rl.latencyWindows))
+	for _, window := range rl.latencyWindows {
+		if window <= 0 {
+			return fmt.Errorf("windows must be positive, got %v", window)
+		}
+		if seen[window] {
+			return fmt.Errorf("duplicate window %v", window)
+		}
+		seen[window] = true
+	}
+	if rl.controlWindow != 0 && !seen[rl.controlWindow] {
+		return fmt.Errorf("control window %v is not a latency window", rl.controlWindow)
+	}
+	return nil
+}
+
+// windowTailLatenciesLocked calculates the tail latencies over the rolling windows. The caller
+// must hold metrics.mu.
+func (rl *TopDownRL) windowTailLatenciesLocked(metrics *InterfaceMetrics) {
+	merged := metrics.latencyWindows.merged
+	if rl.latencyWindowIntervals > 0 {
+		metrics.WindowTailLatencies = quantiles(merged[0], metrics.Percentiles)
+		merged = merged[1:]
+	}
+	if len(merged) == 0 {
+		return
+	}
+	windows := make([]WindowLatencies, len(merged))
+	for i, histogram := range merged {
+		windows[i] = WindowLatencies{
+			Window:        rl.latencyWindows[i],
+			TailLatencies: quantiles(histogram, metrics.Percentiles),
+			Samples:       histogram.Count(),
+		}
+	}
+	metrics.LatencyWindows = windows
+}
+
+// controlLatencyLocked returns the tail latency the controllers act on and whether it's empty:
+// the one of the last interval unless a control window is set. The caller must hold metrics.mu.
+func (rl *TopDownRL) controlLatencyLocked(metrics *InterfaceMetrics, tailLatency time.Duration, empty bool) (time.Duration, bool) {
+	if rl.controlWindow == 0 {
+		return tailLatency, empty
+	}
+	for _, window := range metrics.LatencyWindows {
+		if window.Window == rl.controlWindow {
+			return window.TailLatencies[metrics.Percentiles[0]], window.Samples == 0
+		}
+	}
+	return tailLatency, empty
+}
+
+// copyWindowLatencies returns a copy of windows safe to hand out.
+func copyWindowLatencies(windows []WindowLatencies) []WindowLatencies {
+	if windows == nil {
+		return nil
+	}
+	copied := make([]WindowLatencies, len(windows))
+	for i, window := range windows {
+		copied[i] = window
+		copied[i].TailLatencies = copyLatencies(window.TailLatencies)
+	}
+	return copied
+}
+
+// WindowLatenciesResponse is the JSON shape of WindowLatencies.
+type WindowLatenciesResponse struct {
+	WindowMs      float64            `json:"window_ms"`
+	PercentilesMs map[string]float64 `json:"percentiles_ms"`
+	Samples       uint64             `json:"samples"`
+}
+
+// newWindowLatenciesResponse converts windows into their JSON shape.
+func newWindowLatenciesResponse(windows []WindowLatencies) []WindowLatenciesResponse {
+	if windows == nil {
+		return nil
+	}
+	converted := make([]WindowLatenciesResponse, len(windows))
+	for i, window := range windows {
+		converted[i] = WindowLatenciesResponse{
+			WindowMs:      durationMs(window.Window),
+			PercentilesMs: percentilesMs(window.TailLatencies),
+			Samples:       window.Samples,
+		}
+	}
+	return converted
+}